@@ -0,0 +1,79 @@
+// Package main implements reloading tables when their files change
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// autoReloadDelay is how long the table directories must be quiet before
+// the tables are reloaded, so a series of edits causes a single reload
+const autoReloadDelay = time.Second
+
+// tableDirMask selects the events that add, change or remove a table file
+const tableDirMask = eventcron.InCloseWrite | eventcron.InMovedTo | eventcron.InMovedFrom | eventcron.InDelete
+
+// autoReloadOwner describes the table directory watches in log lines
+const autoReloadOwner = "auto_reload"
+
+// autoReload watches the table directories and reloads the tables after
+// their files changed. Its watches are entries of their own that never run
+// a command, kept next to the entries of the tables.
+type autoReload struct {
+	entries []*eventcron.IncronEntry // Watches on the table directories
+	reload  func()
+	mu      sync.Mutex
+	timer   *time.Timer // Pending reload, nil before the first change
+	stopped bool
+}
+
+// newAutoReload creates the watches on the table directories dirs; reload is
+// called once changes have settled
+func newAutoReload(reload func(), dirs []string) *autoReload {
+	a := &autoReload{reload: reload}
+	for i, dir := range dirs {
+		if slices.Contains(dirs[:i], dir) {
+			continue
+		}
+		a.entries = append(a.entries, &eventcron.IncronEntry{Path: dir, Mask: tableDirMask, Command: autoReloadOwner,
+			Owner: autoReloadOwner})
+	}
+	return a
+}
+
+// matches reports whether event changed a file in a table directory
+func (a *autoReload) matches(event *eventcron.InotifyEvent) bool {
+	for _, entry := range a.entries {
+		if event.WatchDir == entry.Path && entry.MatchesEvent(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// trigger schedules a reload, pushing back one that is still pending
+func (a *autoReload) trigger() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return
+	}
+	if a.timer == nil {
+		a.timer = time.AfterFunc(autoReloadDelay, a.reload)
+		return
+	}
+	a.timer.Reset(autoReloadDelay)
+}
+
+// stop cancels a pending reload and ignores further changes
+func (a *autoReload) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+}
@@ -0,0 +1,80 @@
+// Package main implements the eventcrond command result log
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// commandLog appends one line per executed command to a file
+type commandLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// openCommandLog opens (or creates) the command log for appending
+func openCommandLog(path string) (*commandLog, error) {
+	l := &commandLog{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen closes and reopens the log file, so a rotated log is picked up
+func (l *commandLog) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open command log %s: %v", l.path, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// close closes the log file
+func (l *commandLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// record writes a key=value line describing a finished command
+func (l *commandLog) record(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent,
+	username string, result *eventcron.ExecutionResult) error {
+	sum := sha256.Sum256([]byte(entry.Command))
+
+	line := fmt.Sprintf("time=%s user=%s path=%s event=%s success=%t exit=%d duration=%s command=%s\n",
+		time.Now().Format(time.RFC3339),
+		strconv.Quote(username),
+		strconv.Quote(event.Path),
+		event.MaskString(),
+		result.Success,
+		result.ExitCode,
+		result.Duration,
+		hex.EncodeToString(sum[:8]))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	_, err := l.file.WriteString(line)
+	return err
+}
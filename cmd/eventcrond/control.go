@@ -0,0 +1,173 @@
+// Package main implements the eventcrond control socket
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+const (
+	defaultControlSocket = eventcron.DefaultControlSocket
+	controlTimeout       = 30 * time.Second
+)
+
+// startControlSocket listens on the configured Unix socket for status
+// queries. An empty socket path disables it.
+func (d *Daemon) startControlSocket() error {
+	path := d.config.ControlSocket
+	if path == "" {
+		return nil
+	}
+
+	// Remove a socket left behind by a daemon that didn't shut down cleanly
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket %s: %v", path, err)
+	}
+
+	// Watched paths of every user are visible through the socket, so it
+	// is created accessible to root only rather than chmodded afterwards,
+	// which would leave a window to connect in
+	oldMask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %v", path, err)
+	}
+
+	d.control = listener
+	go d.acceptControl(listener)
+	return nil
+}
+
+// stopControlSocket closes the control socket and removes its file
+func (d *Daemon) stopControlSocket() {
+	if d.control == nil {
+		return
+	}
+	d.control.Close()
+	os.Remove(d.config.ControlSocket)
+}
+
+// acceptControl serves control connections until the listener is closed
+func (d *Daemon) acceptControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				d.logger.Error("Control socket error", "error", err)
+			}
+			return
+		}
+		go d.handleControl(conn)
+	}
+}
+
+// handleControl answers the commands sent on one connection. Each response
+// is terminated by an empty line.
+func (d *Daemon) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(controlTimeout))
+		if !scanner.Scan() {
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if command == "" {
+			continue
+		}
+
+		var response []string
+		switch command {
+		case "STATUS":
+			response = d.statusLines()
+		case "WATCHES":
+			response = d.watchLines()
+		case "WATCHES --BY-USER":
+			response = d.watchesByOwner()
+		default:
+			response = []string{fmt.Sprintf("ERROR unknown command: %s (expected STATUS, WATCHES or WATCHES --by-user)", command)}
+		}
+
+		if _, err := fmt.Fprint(conn, strings.Join(append(response, "", ""), "\n")); err != nil {
+			return
+		}
+	}
+}
+
+// watchLines returns the lines of the WATCHES command: the watched paths,
+// sorted, with the file type after those that are neither a directory nor a
+// regular file, such as "/run/jobs.fifo (fifo)"
+func (d *Daemon) watchLines() []string {
+	types := d.watcher.GetWatchTypes()
+	lines := make([]string, 0, len(types))
+	for path, fileType := range types {
+		if fileType != eventcron.FileTypeDirectory && fileType != eventcron.FileTypeFile {
+			path += " (" + fileType + ")"
+		}
+		lines = append(lines, path)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// watchesByOwner returns the lines of the WATCHES --by-user command: a line
+// per table, such as "user alice:", followed by its watched paths indented.
+// A path watched for several tables is listed under each of them.
+func (d *Daemon) watchesByOwner() []string {
+	byOwner := make(map[string][]string)
+	for path, owners := range d.watcher.GetWatchOwners() {
+		if len(owners) == 0 {
+			owners = []string{"unknown"}
+		}
+		for _, owner := range owners {
+			byOwner[owner] = append(byOwner[owner], path)
+		}
+	}
+
+	names := make([]string, 0, len(byOwner))
+	for owner := range byOwner {
+		names = append(names, owner)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, owner := range names {
+		paths := byOwner[owner]
+		sort.Strings(paths)
+		lines = append(lines, owner+":")
+		for _, path := range paths {
+			lines = append(lines, "  "+path)
+		}
+	}
+	return lines
+}
+
+// statusLines returns the daemon state reported by the STATUS command
+func (d *Daemon) statusLines() []string {
+	d.mu.RLock()
+	userTables := len(d.userTables)
+	systemTables := len(d.systemTables)
+	d.mu.RUnlock()
+
+	return []string{
+		fmt.Sprintf("watches: %d", d.watcher.GetWatchCount()),
+		fmt.Sprintf("pending_watches: %d", len(d.watcher.GetPendingPaths())),
+		fmt.Sprintf("running_commands: %d", d.executor.GetRunningCount()),
+		fmt.Sprintf("queued_commands: %d", d.executor.GetQueuedCount()),
+		fmt.Sprintf("user_tables: %d", userTables),
+		fmt.Sprintf("system_tables: %d", systemTables),
+		fmt.Sprintf("uptime: %v", time.Since(d.startTime).Truncate(time.Second)),
+	}
+}
@@ -0,0 +1,77 @@
+// Package main implements the cooldown= option of entries
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// cooldownKey identifies the runs of an entry for one file. Entries are told
+// apart by table, line and path rather than by pointer, as every command runs
+// with its own copy of its entry.
+type cooldownKey struct {
+	owner string
+	line  int
+	entry string // Path of the entry, which differs between expanded braces
+	path  string
+}
+
+// newCooldownKey returns the key of entry's runs for event's file
+func newCooldownKey(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent) cooldownKey {
+	return cooldownKey{entry.Owner, entry.LineNumber, entry.Path, event.Path}
+}
+
+// cooldowns keeps entries with cooldown= from firing again for a file while
+// their command for it runs and for the cooldown after it finished, so a
+// command writing to the file it was started for doesn't trigger itself
+type cooldowns struct {
+	mu    sync.Mutex
+	until map[cooldownKey]time.Time // End of the cooldown, zero while the command runs
+}
+
+// newCooldowns creates an empty cooldown tracker
+func newCooldowns() *cooldowns {
+	return &cooldowns{until: make(map[cooldownKey]time.Time)}
+}
+
+// start reports whether entry may run for event, and if so holds back
+// further events for the file until the command has finished
+func (c *cooldowns) start(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent) bool {
+	if entry.Options.Cooldown <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCooldownKey(entry, event)
+	if until, exists := c.until[key]; exists && (until.IsZero() || time.Now().Before(until)) {
+		return false
+	}
+	c.until[key] = time.Time{}
+	return true
+}
+
+// end starts the cooldown after entry's command for event finished, and
+// forgets the file once it is over
+func (c *cooldowns) end(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent) {
+	if entry.Options.Cooldown <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCooldownKey(entry, event)
+	until := time.Now().Add(entry.Options.Cooldown)
+	c.until[key] = until
+	time.AfterFunc(entry.Options.Cooldown, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.until[key].Equal(until) {
+			delete(c.until, key)
+		}
+	})
+}
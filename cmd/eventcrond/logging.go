@@ -0,0 +1,142 @@
+// Package main implements the eventcrond log output
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log formats accepted by log_format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevels maps the log_level names to levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logger writes the daemon's log lines, either as text with key=value pairs
+// appended to the message or as one JSON object per line. Every method takes
+// the message followed by alternating keys and values.
+type logger struct {
+	level slog.Level
+	text  *log.Logger  // Set for the text format
+	json  *slog.Logger // Set for the JSON format
+}
+
+// newLogger creates a logger writing to out. Text lines get prefix and the
+// standard log flags; JSON lines carry their own time and give durations in
+// seconds.
+func newLogger(out io.Writer, format string, level slog.Level, prefix string, flags int) *logger {
+	l := &logger{level: level}
+	if format == logFormatJSON {
+		l.json = slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && len(groups) == 0 {
+					a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+				}
+				// Durations are written in seconds rather than nanoseconds
+				if a.Value.Kind() == slog.KindDuration {
+					a.Value = slog.Float64Value(a.Value.Duration().Seconds())
+				}
+				return a
+			},
+		}))
+	} else {
+		l.text = log.New(out, prefix, flags)
+	}
+	return l
+}
+
+// setupLogging creates the daemon's logger for syslog or stderr
+func setupLogging(useSyslog bool, format, level string) (*logger, error) {
+	lvl, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %s", level)
+	}
+
+	if useSyslog {
+		syslogWriter, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "eventcrond")
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		return newLogger(syslogWriter, format, lvl, "", 0), nil
+	}
+	return newLogger(os.Stderr, format, lvl, "eventcrond: ", log.LstdFlags), nil
+}
+
+// Debug logs details only wanted with log_level = debug
+func (l *logger) Debug(msg string, args ...any) {
+	l.log(slog.LevelDebug, msg, args)
+}
+
+// Info logs normal operation
+func (l *logger) Info(msg string, args ...any) {
+	l.log(slog.LevelInfo, msg, args)
+}
+
+// Warn logs problems the daemon works around
+func (l *logger) Warn(msg string, args ...any) {
+	l.log(slog.LevelWarn, msg, args)
+}
+
+// Error logs failures
+func (l *logger) Error(msg string, args ...any) {
+	l.log(slog.LevelError, msg, args)
+}
+
+// log writes a single line at level
+func (l *logger) log(level slog.Level, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+	if l.json != nil {
+		l.json.Log(context.Background(), level, msg, args...)
+		return
+	}
+
+	var b strings.Builder
+	if level == slog.LevelWarn {
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %s", textValue(args[i]))
+			break
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], textValue(args[i+1]))
+	}
+	l.text.Print(b.String())
+}
+
+// textValue formats a value for the text format, quoting it if needed
+func textValue(value any) string {
+	var s string
+	switch v := value.(type) {
+	case time.Duration:
+		s = v.String()
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
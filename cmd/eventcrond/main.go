@@ -2,12 +2,19 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"log/syslog"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,10 +23,15 @@ import (
 )
 
 const (
-	defaultConfigFile    = "/etc/eventcron.conf"
-	defaultPidFile       = "/tmp/eventcrond.pid"
+	defaultConfigFile    = eventcron.DefaultConfigFile
+	defaultPidFile       = eventcron.DefaultPidFile
 	defaultMaxConcurrent = 32
 	defaultTimeout       = 300 // 5 minutes
+	defaultCommandQueue  = 1000
+	defaultQueueMaxAge   = 10 * time.Minute
+	dropReportInterval   = time.Minute
+	daemonizedEnv        = "EVENTCROND_DAEMONIZED" // Set in the re-executed daemon process
+	maxLoggedOutput      = 512                     // Bytes of command output logged with log=all
 )
 
 // Config holds daemon configuration
@@ -28,22 +40,60 @@ type Config struct {
 	CommandTimeout        time.Duration
 	LogToSyslog          bool
 	LogLevel             string
+	LogFormat            string // text or json
 	PidFile              string
 	UserTableDir         string
 	SystemTableDir       string
+	CombinedTable        string // File of user tables in [user:<name>] sections, empty disables it
+	EventBufferSize      int
+	OverflowPolicy       eventcron.OverflowPolicy
+	CommandRate          float64 // Commands started per second, 0 means unlimited
+	CommandRatePolicy    eventcron.RateLimitPolicy
+	PruneOrphanTables    bool // Remove tables of deleted users while loading
+	ControlSocket        string // Unix socket for status queries, empty disables it
+	MetricsAddr          string // Listen address for Prometheus metrics, empty disables it
+	CommandLog           string // File receiving one line per executed command, empty disables it
+	SpoolDir             string // Journal of unfinished commands replayed on startup, empty disables it
+	MaxOutputBytes       int    // Output kept per command before it is killed, 0 means unlimited
+	OutputRetention      int    // Output files kept per entry with output_dir=, 0 keeps all
+	MaxCommandsPerUser   int    // Concurrent commands of a single user, 0 means unlimited
+	CommandQueueSize     int           // Commands waiting for a free slot, 0 skips them instead
+	CommandQueueMaxAge   time.Duration // Longest wait in the command queue, 0 means unlimited
+	ProtectedRoots       []string // Paths only watched recursively with force=true
+	SkipDotfiles         bool     // Ignore events for hidden files unless the entry sets dotdirs=true
+	MaxEntriesPerTable   int      // Entries a table may have before it is refused, 0 means unlimited
+	MaxLineLength        int      // Longest table line in bytes that can be read
+	EventMasks           map[string]uint32 // Extra mask names, e.g. for flags of newer kernels
+	WebhookURL           string   // URL receiving a JSON POST per finished command, empty disables it
+	AutoReload           bool     // Reload tables when files in the table directories change
+	UserCheckInterval    time.Duration // How often tables of deleted or denied users are unloaded, 0 never
 }
 
 // Daemon represents the eventcron daemon
 type Daemon struct {
 	config       *Config
 	watcher      *eventcron.Watcher
+	events       eventcron.EventSource // Events the main loop handles, normally the watcher
 	executor     *eventcron.CommandExecutor
 	userTables   map[string]*eventcron.IncronTable
 	systemTables map[string]*eventcron.IncronTable
-	logger       *log.Logger
+	logger       *logger
 	mu           sync.RWMutex
 	shutdown     chan struct{}
 	done         chan struct{}
+	control      net.Listener // Control socket listener
+	startTime    time.Time
+	metrics      *metrics
+	metricsSrv   *http.Server
+	commandLog   *commandLog // nil unless command_log is set
+	webhook      *webhook    // nil unless webhook_url is set
+	autoReload   *autoReload // nil unless auto_reload is set
+	cooldowns    *cooldowns
+	tableConfig  *eventcron.TableConfig // Settings for reading tables
+	commands     sync.WaitGroup         // Commands started for events
+	commandsMu   sync.Mutex             // Orders commands.Add before the Wait in Stop
+	stopping     bool                   // Set by Stop, no more commands start
+	batch        chan struct{}          // Slots limiting the commands of --run-once, nil otherwise
 }
 
 func main() {
@@ -51,9 +101,15 @@ func main() {
 		configFile = flag.String("f", defaultConfigFile, "Configuration file path")
 		foreground = flag.Bool("n", false, "Run in foreground (don't daemonize)")
 		pidFile    = flag.String("p", defaultPidFile, "PID file path")
+		prune      = flag.Bool("prune", false, "Remove user tables of accounts that no longer exist")
+		runOnce    = flag.Bool("run-once", false, "Run the tables once for the files in --path as if each caused --mask, then exit")
+		runPath    = flag.String("path", "", "Directory whose files --run-once handles")
+		runMask    = flag.String("mask", "", "Event flags --run-once pretends each file caused, e.g. IN_CREATE")
+		verbose    = flag.Bool("v", false, "Log every event and command at debug level, to stderr with -n")
 		version    = flag.Bool("V", false, "Show version and exit")
 		help       = flag.Bool("h", false, "Show help and exit")
 	)
+	flag.BoolVar(verbose, "verbose", false, "Same as -v")
 	flag.Parse()
 
 	if *help {
@@ -69,6 +125,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *runOnce && (*runPath == "" || *runMask == "") {
+		fmt.Fprintln(os.Stderr, "Error: --run-once needs --path and --mask, e.g. --run-once --path /data --mask IN_CREATE")
+		os.Exit(1)
+	}
+
 	// Check root privileges
 	if err := eventcron.CheckRootPrivileges(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -76,19 +137,39 @@ func main() {
 	}
 
 	// Load configuration
-	config := loadConfig(*configFile)
-	config.PidFile = *pidFile
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Command line flags take precedence over the config file
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			config.PidFile = *pidFile
+		}
+	})
+	config.PruneOrphanTables = *prune
+
+	// -v is for watching the daemon at work, so it overrides log_level and
+	// keeps a foreground daemon's log on the terminal
+	if *verbose {
+		config.LogLevel = "debug"
+		if *foreground || *runOnce {
+			config.LogToSyslog = false
+		}
+	}
 
 	// Setup logging
-	logger, err := setupLogging(config.LogToSyslog)
+	logger, err := setupLogging(config.LogToSyslog, config.LogFormat, config.LogLevel)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to setup logging: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Setup directories and permissions
-	if err := eventcron.SetupPermissions(); err != nil {
-		logger.Printf("Failed to setup permissions: %v", err)
+	if err := config.tableConfig().SetupPermissions(); err != nil {
+		logger.Error("Failed to setup permissions", "error", err)
 		os.Exit(1)
 	}
 
@@ -100,26 +181,38 @@ func main() {
 		logger:       logger,
 		shutdown:     make(chan struct{}),
 		done:         make(chan struct{}),
+		metrics:      newMetrics(),
+		cooldowns:    newCooldowns(),
+	}
+
+	// A single pass over existing files needs neither the PID file nor the
+	// event loop
+	if *runOnce {
+		if err := daemon.RunOnce(*runPath, *runMask); err != nil {
+			logger.Error("Failed to run tables once", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// Daemonize if not running in foreground
 	if !*foreground {
 		if err := daemonize(); err != nil {
-			logger.Printf("Failed to daemonize: %v", err)
+			logger.Error("Failed to daemonize", "error", err)
 			os.Exit(1)
 		}
 	}
 
 	// Write PID file
 	if err := writePidFile(config.PidFile); err != nil {
-		logger.Printf("Failed to write PID file: %v", err)
+		logger.Error("Failed to write PID file", "path", config.PidFile, "error", err)
 		os.Exit(1)
 	}
 	defer removePidFile(config.PidFile)
 
 	// Initialize daemon
 	if err := daemon.Initialize(); err != nil {
-		logger.Printf("Failed to initialize daemon: %v", err)
+		logger.Error("Failed to initialize daemon", "error", err)
 		os.Exit(1)
 	}
 
@@ -127,63 +220,271 @@ func main() {
 	go daemon.handleSignals()
 
 	// Start daemon
-	logger.Printf("eventcrond %s starting up", eventcron.Version)
+	logger.Info("eventcrond starting up", "version", eventcron.Version)
 	if err := daemon.Run(); err != nil {
-		logger.Printf("Daemon error: %v", err)
+		logger.Error("Daemon error", "error", err)
 		os.Exit(1)
 	}
 
-	logger.Printf("eventcrond %s shutting down", eventcron.Version)
+	logger.Info("eventcrond shutting down", "version", eventcron.Version)
 }
 
 // loadConfig loads configuration from file or returns defaults
-func loadConfig(configFile string) *Config {
+func loadConfig(configFile string) (*Config, error) {
 	config := &Config{
 		MaxConcurrentCommands: defaultMaxConcurrent,
 		CommandTimeout:        time.Duration(defaultTimeout) * time.Second,
 		LogToSyslog:          true,
 		LogLevel:             "info",
+		LogFormat:            logFormatText,
 		UserTableDir:         eventcron.DefaultUserTableDir,
 		SystemTableDir:       eventcron.DefaultSystemTableDir,
+		PidFile:              defaultPidFile,
+		EventBufferSize:      eventcron.DefaultEventBufferSize,
+		OverflowPolicy:       eventcron.OverflowDropNewest,
+		CommandRatePolicy:    eventcron.RateLimitQueue,
+		ControlSocket:        defaultControlSocket,
+		ProtectedRoots:       eventcron.DefaultProtectedRoots,
+		CommandQueueSize:     defaultCommandQueue,
+		CommandQueueMaxAge:   defaultQueueMaxAge,
+		MaxEntriesPerTable:   eventcron.DefaultMaxEntriesPerTable,
+		MaxLineLength:        eventcron.DefaultMaxLineLength,
+		OutputRetention:      eventcron.DefaultOutputRetention,
 	}
 
-	// TODO: Implement actual config file parsing
-	// For now, return defaults
-	return config
-}
+	file, err := os.Open(configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil // No config file, use defaults
+		}
+		return nil, fmt.Errorf("failed to open config file %s: %v", configFile, err)
+	}
+	defer file.Close()
 
-// setupLogging sets up logging to syslog or stderr
-func setupLogging(useSyslog bool) (*log.Logger, error) {
-	if useSyslog {
-		syslogWriter, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "eventcrond")
-		if err != nil {
-			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <key> = <value>", configFile, lineNumber)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if err := config.set(key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", configFile, lineNumber, err)
 		}
-		return log.New(syslogWriter, "", 0), nil
 	}
-	return log.New(os.Stderr, "eventcrond: ", log.LstdFlags), nil
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", configFile, err)
+	}
+
+	return config, nil
 }
 
-// daemonize turns the process into a daemon
-func daemonize() error {
-	// Fork the process
-	pid, err := syscall.ForkExec(os.Args[0], os.Args, &syscall.ProcAttr{
-		Env:   os.Environ(),
-		Files: []uintptr{0, 1, 2}, // stdin, stdout, stderr
-		Sys: &syscall.SysProcAttr{
-			Setsid: true,
-		},
-	})
+// tableConfig returns the settings for reading tables
+func (c *Config) tableConfig() *eventcron.TableConfig {
+	return &eventcron.TableConfig{
+		UserTableDir:   c.UserTableDir,
+		SystemTableDir: c.SystemTableDir,
+		MaxEntries:     c.MaxEntriesPerTable,
+		MaxLineLength:  c.MaxLineLength,
+	}
+}
+
+// plannedKeys are the keys documented in the example configuration that
+// aren't implemented yet; set ignores them
+var plannedKeys = map[string]bool{
+	"allow_file":               true,
+	"deny_file":                true,
+	"max_user_watches":         true,
+	"max_user_instances":       true,
+	"default_recursion_depth":  true,
+	"follow_symlinks":          true,
+	"event_buffer_size":        true,
+	"auto_reload_tables":       true,
+	"reload_interval":          true,
+	"create_user_dir":          true,
+	"create_system_dir":        true,
+	"user_table_permissions":   true,
+	"system_table_permissions": true,
+	"environment":              true,
+	"always_allow_commands":    true,
+	"never_allow_commands":     true,
+}
+
+// set applies a single configuration key. Keys that are documented but not
+// implemented yet are ignored, other unknown keys are an error so that a
+// misspelt setting doesn't silently keep its default.
+func (c *Config) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "max_concurrent_commands":
+		c.MaxConcurrentCommands, err = strconv.Atoi(value)
+	case "max_commands_per_user":
+		c.MaxCommandsPerUser, err = strconv.Atoi(value)
+		if err == nil && c.MaxCommandsPerUser < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "command_queue_size":
+		c.CommandQueueSize, err = strconv.Atoi(value)
+		if err == nil && c.CommandQueueSize < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "command_queue_max_age":
+		var seconds int
+		seconds, err = strconv.Atoi(value)
+		if err == nil && seconds < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		c.CommandQueueMaxAge = time.Duration(seconds) * time.Second
+	case "command_timeout":
+		var seconds int
+		seconds, err = strconv.Atoi(value)
+		c.CommandTimeout = time.Duration(seconds) * time.Second
+	case "log_to_syslog":
+		c.LogToSyslog, err = strconv.ParseBool(value)
+	case "log_level":
+		c.LogLevel = value
+		if _, ok := logLevels[value]; !ok {
+			err = fmt.Errorf("expected debug, info, warn or error")
+		}
+	case "log_format":
+		c.LogFormat = value
+		if value != logFormatText && value != logFormatJSON {
+			err = fmt.Errorf("expected text or json")
+		}
+	case "pid_file":
+		c.PidFile = value
+	case "user_table_dir":
+		c.UserTableDir = value
+		if !filepath.IsAbs(value) {
+			err = fmt.Errorf("must be an absolute path")
+		}
+	case "system_table_dir":
+		c.SystemTableDir = value
+		if !filepath.IsAbs(value) {
+			err = fmt.Errorf("must be an absolute path")
+		}
+	case "combined_table":
+		c.CombinedTable = value
+		if value != "" && !filepath.IsAbs(value) {
+			err = fmt.Errorf("must be an absolute path")
+		}
+	case "event_queue_size":
+		c.EventBufferSize, err = strconv.Atoi(value)
+	case "event_overflow_policy":
+		c.OverflowPolicy, err = eventcron.ParseOverflowPolicy(value)
+	case "command_rate":
+		c.CommandRate, err = strconv.ParseFloat(value, 64)
+		if err == nil && c.CommandRate < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "command_rate_policy":
+		c.CommandRatePolicy, err = eventcron.ParseRateLimitPolicy(value)
+	case "control_socket":
+		c.ControlSocket = value
+	case "metrics_addr":
+		c.MetricsAddr = value
+	case "command_log":
+		c.CommandLog = value
+	case "webhook_url":
+		c.WebhookURL = value
+		if value != "" {
+			err = parseWebhookURL(value)
+		}
+	case "spool_dir":
+		c.SpoolDir = value
+	case "skip_dotfiles":
+		c.SkipDotfiles, err = strconv.ParseBool(value)
+	case "auto_reload":
+		c.AutoReload, err = strconv.ParseBool(value)
+	case "user_check_interval":
+		var seconds int
+		seconds, err = strconv.Atoi(value)
+		if err == nil && seconds < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		c.UserCheckInterval = time.Duration(seconds) * time.Second
+	case "protected_roots":
+		c.ProtectedRoots = strings.Fields(value)
+		for _, root := range c.ProtectedRoots {
+			if !filepath.IsAbs(root) {
+				err = fmt.Errorf("path must be absolute: %s", root)
+			}
+		}
+	case "event_masks":
+		c.EventMasks, err = eventcron.ParseEventMasks(value)
+	case "max_entries_per_table":
+		c.MaxEntriesPerTable, err = strconv.Atoi(value)
+		if err == nil && c.MaxEntriesPerTable < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "max_line_length":
+		c.MaxLineLength, err = strconv.Atoi(value)
+		if err == nil && c.MaxLineLength <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "output_retention":
+		c.OutputRetention, err = strconv.Atoi(value)
+		if err == nil && c.OutputRetention < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "max_output_bytes":
+		c.MaxOutputBytes, err = strconv.Atoi(value)
+		if err == nil && c.MaxOutputBytes < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	default:
+		if !plannedKeys[key] {
+			return fmt.Errorf("unknown key %s", key)
+		}
+	}
+
 	if err != nil {
-		return fmt.Errorf("failed to fork: %v", err)
+		return fmt.Errorf("invalid value for %s: %v", key, err)
 	}
+	return nil
+}
+
+// daemonize turns the process into a daemon. Go can't fork without exec, so
+// the process re-executes itself in a new session and exits; the re-executed
+// child is recognised by daemonizedEnv and detaches from the terminal.
+func daemonize() error {
+	if os.Getenv(daemonizedEnv) == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find executable: %v", err)
+		}
+
+		_, err = syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{
+			Env:   append(os.Environ(), daemonizedEnv+"=1"),
+			Files: []uintptr{0, 1, 2}, // stdin, stdout, stderr
+			Sys: &syscall.SysProcAttr{
+				Setsid: true,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fork: %v", err)
+		}
 
-	if pid > 0 {
 		// Parent process exits
 		os.Exit(0)
 	}
 
-	// Child process continues
+	// Child process continues; commands shouldn't inherit the sentinel
+	os.Unsetenv(daemonizedEnv)
+
 	// Change working directory to root
 	if err := os.Chdir("/"); err != nil {
 		return fmt.Errorf("failed to change directory: %v", err)
@@ -221,18 +522,42 @@ func removePidFile(pidFile string) {
 
 // Initialize initializes the daemon
 func (d *Daemon) Initialize() error {
+	if err := d.setupTables(); err != nil {
+		return err
+	}
+
 	// Create inotify watcher
-	watcher, err := eventcron.NewWatcher()
+	watcher, err := eventcron.NewWatcherWithBuffer(d.config.EventBufferSize)
 	if err != nil {
 		return fmt.Errorf("failed to create watcher: %v", err)
 	}
+	watcher.SetOverflowPolicy(d.config.OverflowPolicy)
+	watcher.SetProtectedRoots(d.config.ProtectedRoots)
 	d.watcher = watcher
+	d.events = watcher
 
-	// Create command executor
-	d.executor = eventcron.NewCommandExecutor(
-		d.config.MaxConcurrentCommands,
-		d.config.CommandTimeout,
-	)
+	if err := d.setupCommands(); err != nil {
+		return err
+	}
+
+	// Journal commands so they survive a restart
+	var spool *eventcron.Spool
+	if d.config.SpoolDir != "" {
+		spool, err = eventcron.OpenSpool(d.config.SpoolDir)
+		if err != nil {
+			return err
+		}
+		d.executor.SetSpool(spool)
+	}
+
+	// Watch the table directories along with the tables
+	if d.config.AutoReload {
+		dirs := []string{d.tableConfig.UserTableDir, d.tableConfig.SystemTableDir}
+		if d.config.CombinedTable != "" {
+			dirs = append(dirs, filepath.Dir(d.config.CombinedTable))
+		}
+		d.autoReload = newAutoReload(d.reloadChangedTables, dirs)
+	}
 
 	// Load tables
 	if err := d.LoadTables(); err != nil {
@@ -244,78 +569,260 @@ func (d *Daemon) Initialize() error {
 		return fmt.Errorf("failed to start watcher: %v", err)
 	}
 
+	// Start answering status queries. The control socket is created
+	// before any command runs, as the umask it is created with would be
+	// passed on to them.
+	d.startTime = time.Now()
+	if err := d.startControlSocket(); err != nil {
+		return err
+	}
+
+	// Run commands that didn't finish before the last shutdown
+	if spool != nil {
+		d.replaySpool(spool)
+	}
+
+	if err := d.startMetricsServer(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setupTables applies the settings for reading tables: the extra mask names
+// of event_masks and the limits on table size
+func (d *Daemon) setupTables() error {
+	if err := eventcron.RegisterEventMasks(d.config.EventMasks); err != nil {
+		return fmt.Errorf("invalid event_masks: %v", err)
+	}
+	d.tableConfig = d.config.tableConfig()
+	return nil
+}
+
+// setupCommands creates the command executor and opens the command log and
+// webhook that record the commands it runs
+func (d *Daemon) setupCommands() error {
+	// Create command executor
+	d.executor = eventcron.NewCommandExecutor(
+		d.config.MaxConcurrentCommands,
+		d.config.CommandTimeout,
+	)
+	d.executor.SetCommandRate(d.config.CommandRate, d.config.CommandRatePolicy)
+	d.executor.SetMaxOutput(d.config.MaxOutputBytes)
+	d.executor.SetOutputRetention(d.config.OutputRetention)
+	d.executor.SetMaxPerUser(d.config.MaxCommandsPerUser)
+	d.executor.SetQueue(d.config.CommandQueueSize, d.config.CommandQueueMaxAge)
+	d.executor.SetStartHook(func(cmd *eventcron.RunningCommand) {
+		d.metrics.observeStart()
+		d.logger.Debug("Command started", "user", cmd.Username, "path", cmd.Event.Path, "pid", cmd.Cmd.Process.Pid,
+			"command", strings.Join(cmd.Cmd.Args, " "))
+	})
+
+	// Open the command audit log
+	if d.config.CommandLog != "" {
+		commandLog, err := openCommandLog(d.config.CommandLog)
+		if err != nil {
+			return err
+		}
+		d.commandLog = commandLog
+	}
+
+	// Report finished commands to the webhook
+	if d.config.WebhookURL != "" {
+		d.webhook = newWebhook(d.config.WebhookURL, d.logger)
+	}
+
 	return nil
 }
 
+// loadCombinedTable adds the user tables of combined_table to d.userTables.
+// A user's own table file takes precedence over their sections, unless the
+// user table directory couldn't be read (internal, assumes lock held).
+func (d *Daemon) loadCombinedTable(userTablesRead bool) {
+	if d.config.CombinedTable == "" {
+		return
+	}
+
+	tables, skipped, err := d.tableConfig.LoadCombinedTable(d.config.CombinedTable)
+	if err != nil {
+		d.logger.Warn("Failed to load combined table", "path", d.config.CombinedTable, "error", err)
+		return
+	}
+	for _, err := range skipped {
+		d.logger.Warn("Skipping combined table section", "path", d.config.CombinedTable, "error", err)
+	}
+	for username, table := range tables {
+		if userTablesRead {
+			if _, err := os.Lstat(d.tableConfig.GetUserTablePath(username)); err == nil {
+				d.logger.Warn("Skipping combined table section, user has a table file", "user", username,
+					"path", d.config.CombinedTable)
+				continue
+			}
+		}
+		d.userTables[username] = table
+	}
+}
+
 // LoadTables loads all user and system tables
 func (d *Daemon) LoadTables() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	desired := d.readTables()
+	tableEntries := len(desired)
+	if d.autoReload != nil {
+		desired = append(desired, d.autoReload.entries...)
+	}
+
+	// Only touch watches that actually changed, so a reload doesn't miss events
+	failed := d.watcher.Reconcile(desired)
+	var limitErr *eventcron.WatchLimitError
+	for entry, err := range failed {
+		errors.As(err, &limitErr)
+		if entry.Owner == autoReloadOwner {
+			d.logger.Warn("Failed to add watch", "table", entry.Owner, "path", entry.Path, "error", err)
+			continue
+		}
+		d.logger.Warn("Failed to add watch", "table", entry.Owner, "line", entry.LineNumber,
+			"path", entry.Path, "command", entry.Command, "error", err)
+		tableEntries--
+	}
+	if limitErr != nil {
+		d.logWatchLimit(limitErr)
+	}
+	d.logger.Info("Loaded tables", "user_tables", len(d.userTables), "system_tables", len(d.systemTables),
+		"entries", tableEntries)
+	if pending := d.watcher.GetPendingPaths(); len(pending) > 0 {
+		d.logger.Info("Entries are waiting for their paths to be created", "entries", len(pending))
+	}
+
+	return nil
+}
+
+// logWatchLimit tells how to raise the inotify watch limit that err ran into
+func (d *Daemon) logWatchLimit(err *eventcron.WatchLimitError) {
+	d.logger.Error(fmt.Sprintf("Out of inotify watches: raise the limit with e.g. 'sysctl fs.inotify.max_user_watches=%d' "+
+		"and add it to /etc/sysctl.conf, then reload", max(2*err.Limit, 524288)), "limit", err.Limit)
+}
+
+// readTables reads all user and system tables and returns their entries,
+// each naming its table in Owner (internal, assumes lock held)
+func (d *Daemon) readTables() []*eventcron.IncronEntry {
 	// Clear existing tables
 	d.userTables = make(map[string]*eventcron.IncronTable)
 	d.systemTables = make(map[string]*eventcron.IncronTable)
 
 	// Load user tables
-	userTables, err := eventcron.LoadAllUserTables()
+	userTables, err := d.tableConfig.LoadAllUserTables(d.config.PruneOrphanTables)
 	if err != nil {
-		d.logger.Printf("Warning: failed to load user tables: %v", err)
+		d.logger.Warn("Failed to load user tables", "error", err)
 	} else {
 		d.userTables = userTables
 	}
+	d.loadCombinedTable(err == nil)
 
 	// Load system tables
-	systemTables, err := eventcron.LoadAllSystemTables()
+	systemTables, err := d.tableConfig.LoadAllSystemTables()
 	if err != nil {
-		d.logger.Printf("Warning: failed to load system tables: %v", err)
+		d.logger.Warn("Failed to load system tables", "error", err)
 	} else {
 		d.systemTables = systemTables
 	}
 
-	// Setup watches for all tables
-	totalEntries := 0
+	// Warn about entries that would run twice, then watch and match entries
+	// for several paths as one entry per path
 	for username, table := range d.userTables {
-		for _, entry := range table.Entries {
-			if err := d.watcher.AddWatch(&entry); err != nil {
-				d.logger.Printf("Warning: failed to add watch for user %s, path %s: %v",
-					username, entry.Path, err)
-			} else {
-				totalEntries++
-			}
+		for _, warning := range eventcron.DuplicateWarnings(table) {
+			d.logger.Warn("Duplicate entry", "table", "user "+username, "warning", warning)
 		}
+		table.ExpandBraces()
 	}
-
 	for tableName, table := range d.systemTables {
-		for _, entry := range table.Entries {
-			if err := d.watcher.AddWatch(&entry); err != nil {
-				d.logger.Printf("Warning: failed to add watch for system table %s, path %s: %v",
-					tableName, entry.Path, err)
-			} else {
-				totalEntries++
-			}
+		for _, warning := range eventcron.DuplicateWarnings(table) {
+			d.logger.Warn("Duplicate entry", "table", "system table "+tableName, "warning", warning)
 		}
+		table.ExpandBraces()
 	}
 
-	d.logger.Printf("Loaded %d user tables, %d system tables, %d total entries",
-		len(d.userTables), len(d.systemTables), totalEntries)
+	// Collect the watches wanted by all tables, each entry naming its table
+	var desired []*eventcron.IncronEntry
+	for username, table := range d.userTables {
+		for i := range table.Entries {
+			entry := &table.Entries[i]
+			entry.Owner = "user " + username
+			desired = append(desired, entry)
+		}
+	}
 
-	return nil
+	for tableName, table := range d.systemTables {
+		for i := range table.Entries {
+			entry := &table.Entries[i]
+			entry.Owner = "system table " + tableName
+			desired = append(desired, entry)
+		}
+	}
+	return desired
 }
 
 // Run starts the main daemon loop
 func (d *Daemon) Run() error {
-	d.logger.Printf("Starting main event loop")
+	d.logger.Info("Starting main event loop")
+
+	dropTicker := time.NewTicker(dropReportInterval)
+	defer dropTicker.Stop()
+	var lastDropped uint64
+
+	if d.config.UserCheckInterval > 0 {
+		go d.checkUsersEvery(d.config.UserCheckInterval)
+	}
 
 	for {
 		select {
-		case event := <-d.watcher.Events():
+		case event, ok := <-d.events.Events():
+			if !ok {
+				d.logger.Error("Watcher stopped unexpectedly")
+				return d.Stop()
+			}
+			d.metrics.eventsReceived.Add(1)
+			d.logger.Debug("Event received", "path", event.Path, "event", event.MaskString(), "seq", event.Seq)
+			if event.Spent {
+				d.logger.Info("Oneshot watch fired and was removed", "path", event.WatchDir)
+			}
 			go d.handleEvent(event)
 
-		case err := <-d.watcher.Errors():
-			d.logger.Printf("Watcher error: %v", err)
+		case err, ok := <-d.events.Errors():
+			if !ok {
+				d.logger.Error("Watcher stopped unexpectedly")
+				return d.Stop()
+			}
+			if errors.Is(err, eventcron.ErrQueueOverflow) {
+				d.logger.Warn("Rescanning recursive watches", "error", err)
+				added, err := d.watcher.Rescan()
+				if err != nil {
+					d.logger.Error("Rescan after queue overflow failed", "error", err)
+					var limitErr *eventcron.WatchLimitError
+					if errors.As(err, &limitErr) {
+						d.logWatchLimit(limitErr)
+					}
+				}
+				d.logger.Info("Rescan added missed watches", "watches", added)
+				continue
+			}
+			d.logger.Error("Watcher error", "error", err)
+			var limitErr *eventcron.WatchLimitError
+			if errors.As(err, &limitErr) {
+				d.logWatchLimit(limitErr)
+			}
+
+		case <-dropTicker.C:
+			if dropped := d.watcher.DroppedEvents(); dropped > lastDropped {
+				d.logger.Warn("Events dropped", "dropped", dropped-lastDropped, "interval", dropReportInterval,
+					"total", dropped, "policy", d.config.OverflowPolicy)
+				lastDropped = dropped
+			}
 
 		case <-d.shutdown:
-			d.logger.Printf("Shutdown signal received")
+			d.logger.Info("Shutdown signal received")
 			return d.Stop()
 
 		}
@@ -324,110 +831,356 @@ func (d *Daemon) Run() error {
 
 // handleEvent processes an inotify event
 func (d *Daemon) handleEvent(event *eventcron.InotifyEvent) {
+	if d.autoReload != nil && d.autoReload.matches(event) {
+		d.logger.Debug("Table file changed", "path", event.Path, "event", event.MaskString())
+		d.autoReload.trigger()
+	}
+
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
 	// Find matching entries in user tables
 	for username, table := range d.userTables {
-		for _, entry := range table.Entries {
-			if d.eventMatches(&entry, event) {
-				// Check user permissions
-				allowed, err := eventcron.CheckUserPermission(username)
-				if err != nil {
-					d.logger.Printf("Error checking permissions for user %s: %v", username, err)
-					continue
-				}
-				if !allowed {
-					d.logger.Printf("User %s not allowed to use eventcron", username)
-					continue
-				}
+		for _, entry := range table.Match(event) {
+			if d.skipsHidden(entry, event) {
+				continue
+			}
+			if entry.WaitsForClose(event) {
+				d.logger.Debug("Waiting for close: skipping modify event", "path", event.Path, "entry", entry.Path)
+				continue
+			}
 
-				// Execute command
-				go d.executeCommand(&entry, event, username)
+			// Check user permissions
+			allowed, err := eventcron.CheckUserPermission(username)
+			if err != nil {
+				d.logger.Error("Error checking permissions", "user", username, "error", err)
+				continue
+			}
+			if !allowed {
+				d.logger.Info("User not allowed to use eventcron", "user", username)
+				continue
 			}
+
+			// Only a command that starts may hold the cooldown, which
+			// executeCommand ends
+			if !d.cooldowns.start(entry, event) {
+				d.logger.Debug("Cooling down: skipping event", "path", event.Path, "entry", entry.Path)
+				continue
+			}
+
+			// Execute command
+			d.startCommand(entry, event, username, "")
 		}
 	}
 
 	// Find matching entries in system tables
 	for _, table := range d.systemTables {
-		for _, entry := range table.Entries {
-			if d.eventMatches(&entry, event) {
-				// System commands run as root
-				go d.executeCommand(&entry, event, "root")
+		for _, entry := range table.Match(event) {
+			if d.skipsHidden(entry, event) {
+				continue
 			}
+			if entry.WaitsForClose(event) {
+				d.logger.Debug("Waiting for close: skipping modify event", "path", event.Path, "entry", entry.Path)
+				continue
+			}
+			if !d.cooldowns.start(entry, event) {
+				d.logger.Debug("Cooling down: skipping event", "path", event.Path, "entry", entry.Path)
+				continue
+			}
+
+			// System commands run as root unless the entry names a user
+			runAs := "root"
+			if entry.Options.RunAs != "" {
+				runAs = entry.Options.RunAs
+			}
+			d.startCommand(entry, event, runAs, "")
 		}
 	}
 }
 
-// eventMatches checks if an event matches an eventcron entry
-func (d *Daemon) eventMatches(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent) bool {
-	// Check if the path matches
-	if !entry.MatchesPath(event.WatchDir) && !entry.MatchesPath(event.Path) {
-		return false
+// replaySpool runs the journaled commands left over from a previous run
+func (d *Daemon) replaySpool(spool *eventcron.Spool) {
+	commands, err := spool.Pending()
+	if err != nil {
+		d.logger.Warn("Failed to read spool", "error", err)
+		return
+	}
+	if len(commands) == 0 {
+		return
 	}
 
-	// Check if the event mask matches
-	if entry.Mask&event.Mask == 0 {
-		return false
+	d.logger.Info("Replaying unfinished commands", "commands", len(commands), "spool_dir", d.config.SpoolDir)
+	for _, command := range commands {
+		if command.Username != "root" {
+			allowed, err := eventcron.CheckUserPermission(command.Username)
+			if err != nil || !allowed {
+				d.logger.Info("Not replaying command: user not allowed to use eventcron",
+					"user", command.Username, "path", command.Entry.Path)
+				if err := spool.Remove(command.ID); err != nil {
+					d.logger.Warn("Failed to remove spool record", "error", err)
+				}
+				continue
+			}
+		}
+
+		// The command keeps its record until it finished
+		d.startCommand(command.Entry, command.Event, command.Username, command.ID)
 	}
+}
 
-	return true
+// skipsHidden reports whether an entry ignores an event it matches, which
+// with skip_dotfiles are events for hidden files unless it has dotdirs=true
+func (d *Daemon) skipsHidden(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent) bool {
+	return d.config.SkipDotfiles && !entry.Options.DotDirs && event.IsHidden()
 }
 
-// executeCommand executes a command for an eventcron entry
-func (d *Daemon) executeCommand(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent, username string) {
-	result, err := d.executor.Execute(entry, event, username)
+// startCommand runs entry's command for event in the background. The
+// command gets a copy of the entry taken while d.mu is held, so it never
+// reads the tables a reload replaces. With --run-once it first waits for
+// one of the slots of d.batch. spoolID is the journal record of a replayed
+// command, empty for new events.
+func (d *Daemon) startCommand(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent, username, spoolID string) {
+	run := *entry
+	if d.batch != nil {
+		d.batch <- struct{}{}
+	}
+	d.commandsMu.Lock()
+	if d.stopping {
+		d.commandsMu.Unlock()
+		if d.batch != nil {
+			<-d.batch
+		}
+		d.logger.Debug("Daemon stopping: skipping command", "user", username, "path", entry.Path)
+		return
+	}
+	d.commands.Add(1)
+	d.commandsMu.Unlock()
+	go func() {
+		defer d.commands.Done()
+		d.executeCommand(&run, event, username, spoolID)
+		if d.batch != nil {
+			<-d.batch
+		}
+	}()
+}
+
+// executeCommand executes a command for an eventcron entry, replaying the
+// journal record spoolID if it isn't empty
+func (d *Daemon) executeCommand(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent, username, spoolID string) {
+	defer d.cooldowns.end(entry, event)
+
+	result, err := d.executor.ExecuteSpooled(entry, event, username, spoolID)
+	if errors.Is(err, eventcron.ErrRateLimited) {
+		d.logger.Warn("Rate limited: skipping command", "user", username, "path", entry.Path, "error", err)
+		return
+	}
+	if errors.Is(err, eventcron.ErrQueueFull) {
+		d.logger.Warn("Command queue full: skipping command", "user", username, "path", entry.Path, "error", err)
+		return
+	}
+	if errors.Is(err, eventcron.ErrMaxConcurrent) {
+		d.logger.Warn("Too many commands running: skipping command", "user", username, "path", entry.Path, "error", err)
+		return
+	}
 	if err != nil {
-		d.logger.Printf("Failed to execute command for user %s: %v", username, err)
+		d.logger.Error("Failed to execute command", "user", username, "path", event.Path, "error", err)
 		return
 	}
+	d.metrics.observeCommand(result)
+	if d.commandLog != nil {
+		if err := d.commandLog.record(entry, event, username, result); err != nil {
+			d.logger.Error("Failed to write command log", "error", err)
+		}
+	}
+	if d.webhook != nil {
+		d.webhook.notify(entry, event, username, result)
+	}
 
+	if result.Restarted {
+		d.logRun(entry, slog.LevelInfo, "Command killed to restart it for a new event", "user", username,
+			"path", event.Path, "duration", result.Duration)
+		return
+	}
+	if result.Truncated {
+		d.logRun(entry, slog.LevelWarn, "Command killed after writing too much output", "user", username,
+			"path", event.Path, "max_output_bytes", d.config.MaxOutputBytes)
+	}
+	if result.OutputFile != "" {
+		d.logger.Debug("Command output written", "user", username, "path", event.Path, "file", result.OutputFile)
+	}
 	if !result.Success {
-		d.logger.Printf("Command failed for user %s (exit code %d): %v",
-			username, result.ExitCode, result.Error)
+		d.logRun(entry, slog.LevelError, "Command failed", withOutput(entry, result, "user", username,
+			"path", event.Path, "event", event.MaskString(), "seq", event.Seq, "exit_code", result.ExitCode,
+			"attempts", result.Attempts, "duration", result.Duration, "error", result.Error)...)
 	} else {
-		d.logger.Printf("Command executed successfully for user %s (duration: %v)",
-			username, result.Duration)
+		d.logRun(entry, slog.LevelInfo, "Command executed successfully", withOutput(entry, result, "user", username,
+			"path", event.Path, "event", event.MaskString(), "seq", event.Seq, "exit_code", result.ExitCode,
+			"duration", result.Duration)...)
+	}
+
+	if followUp := result.FollowUp; followUp != nil {
+		command := entry.FollowUp(result.Success)
+		if !followUp.Success {
+			d.logRun(entry, slog.LevelError, "Follow-up command failed", withOutput(entry, followUp, "user", username,
+				"path", event.Path, "command", command, "exit_code", followUp.ExitCode, "duration", followUp.Duration,
+				"error", followUp.Error)...)
+		} else {
+			d.logRun(entry, slog.LevelInfo, "Follow-up command executed successfully", withOutput(entry, followUp,
+				"user", username, "path", event.Path, "command", command, "duration", followUp.Duration)...)
+		}
+	}
+}
+
+// logRun logs a message about a run of entry's command as its log= option
+// asks: warnings and errors unless it is none, and other messages at level
+// with log=all, at debug level with the default of errors or not at all
+// with none
+func (d *Daemon) logRun(entry *eventcron.IncronEntry, level slog.Level, msg string, args ...any) {
+	switch entry.Options.Log {
+	case eventcron.EntryLogNone:
+		return
+	case eventcron.EntryLogErrors:
+		if level < slog.LevelWarn {
+			level = slog.LevelDebug
+		}
+	}
+	d.logger.log(level, msg, args)
+}
+
+// withOutput adds the output of result to the log arguments args if entry
+// has log=all, cut to maxLoggedOutput bytes. Output written to an
+// output_dir= file isn't repeated.
+func withOutput(entry *eventcron.IncronEntry, result *eventcron.ExecutionResult, args ...any) []any {
+	if entry.Options.Log == eventcron.EntryLogAll && len(result.Output) > 0 {
+		output := strings.TrimRight(string(result.Output), "\n")
+		if len(output) > maxLoggedOutput {
+			output = strings.ToValidUTF8(output[:maxLoggedOutput], "") + "... (truncated)"
+		}
+		args = append(args, "output", output)
 	}
+	return args
 }
 
 // handleSignals sets up signal handling
 func (d *Daemon) handleSignals() {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
 
 	for sig := range sigChan {
 		switch sig {
 		case syscall.SIGTERM, syscall.SIGINT:
-			d.logger.Printf("Received %v signal, shutting down", sig)
+			d.logger.Info("Signal received, shutting down", "signal", sig)
 			close(d.shutdown)
 			return
 
 		case syscall.SIGHUP:
-			d.logger.Printf("Received SIGHUP signal, reloading tables")
+			d.logger.Info("Signal received, reloading tables", "signal", "SIGHUP")
+			if d.commandLog != nil {
+				if err := d.commandLog.reopen(); err != nil {
+					d.logger.Error("Failed to reopen command log", "error", err)
+				}
+			}
 			if err := d.LoadTables(); err != nil {
-				d.logger.Printf("Failed to reload tables: %v", err)
+				d.logger.Error("Failed to reload tables", "error", err)
 			} else {
-				d.logger.Printf("Tables reloaded successfully")
+				d.logger.Info("Tables reloaded successfully")
+			}
+
+		case syscall.SIGUSR1:
+			d.dumpState()
+		}
+	}
+}
+
+// reloadChangedTables reloads the tables after auto_reload saw their files change
+func (d *Daemon) reloadChangedTables() {
+	d.logger.Info("Table files changed, reloading tables")
+	if err := d.LoadTables(); err != nil {
+		d.logger.Error("Failed to reload tables", "error", err)
+	} else {
+		d.logger.Info("Tables reloaded successfully")
+	}
+}
+
+// dumpState logs the watched paths and running commands
+func (d *Daemon) dumpState() {
+	types := d.watcher.GetWatchTypes()
+	paths := make([]string, 0, len(types))
+	for path := range types {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	d.logger.Info("State dump", "watches", len(paths))
+	for _, path := range paths {
+		d.logger.Info("  watch", "path", path, "type", types[path])
+	}
+
+	commands := d.executor.GetRunningCommands()
+	running := make([]*eventcron.RunningCommand, 0, len(commands))
+	for _, command := range commands {
+		running = append(running, command)
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].StartTime.Before(running[j].StartTime)
+	})
+
+	d.logger.Info("State dump", "running_commands", len(running))
+	for _, command := range running {
+		d.logger.Info("  command", "user", command.Username, "path", command.Event.Path,
+			"started", command.StartTime.Format(time.RFC3339),
+			"running", time.Since(command.StartTime).Truncate(time.Second), "command", command.Entry.Command)
+	}
+}
+
+// drainEvents empties the event channel after the watcher has stopped and
+// returns the number of events discarded
+func (d *Daemon) drainEvents() int {
+	discarded := 0
+	for {
+		select {
+		case _, ok := <-d.events.Events():
+			if !ok {
+				return discarded
 			}
+			discarded++
+		default:
+			return discarded
 		}
 	}
 }
 
 // Stop stops the daemon gracefully
 func (d *Daemon) Stop() error {
-	d.logger.Printf("Stopping daemon...")
+	d.logger.Info("Stopping daemon...")
 
-	// Stop accepting new events
+	if d.autoReload != nil {
+		d.autoReload.stop()
+	}
+	// Stop accepting new events and drop those nobody handled yet
 	if err := d.watcher.Stop(); err != nil {
-		d.logger.Printf("Error stopping watcher: %v", err)
+		d.logger.Error("Error stopping watcher", "error", err)
 	}
-
-	// Wait for running commands to complete (with timeout)
+	if discarded := d.drainEvents(); discarded > 0 {
+		d.logger.Info("Discarded events received during shutdown", "events", discarded)
+	}
+	d.stopControlSocket()
+	d.stopMetricsServer()
+
+	// Start no more commands, then wait for running commands to complete
+	// (with timeout)
+	d.commandsMu.Lock()
+	d.stopping = true
+	d.commandsMu.Unlock()
 	if err := d.executor.WaitForAllCommands(30 * time.Second); err != nil {
-		d.logger.Printf("Timeout waiting for commands, killing remaining: %v", err)
+		d.logger.Warn("Timeout waiting for commands, killing remaining", "error", err)
 		d.executor.KillAllCommands()
 	}
+	// Let the commands' results be logged before the command log closes
+	d.commands.Wait()
+
+	if d.commandLog != nil {
+		d.commandLog.close()
+	}
 
 	close(d.done)
 	return nil
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+func TestHandleEventConcurrentReload(t *testing.T) {
+	dir := t.TempDir()
+	userDir, systemDir, data := filepath.Join(dir, "spool"), filepath.Join(dir, "eventcron.d"), filepath.Join(dir, "data")
+	for _, path := range []string{userDir, systemDir, filepath.Join(data, "in"), filepath.Join(data, "out")} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := data + "/{in,out} IN_CREATE,loopable=true true $#\n" + data + " IN_DELETE,exclude=*.tmp true $#\n"
+	if err := os.WriteFile(filepath.Join(systemDir, "data"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Daemon{
+		config:       &Config{MaxConcurrentCommands: 200, CommandTimeout: 10 * time.Second},
+		userTables:   make(map[string]*eventcron.IncronTable),
+		systemTables: make(map[string]*eventcron.IncronTable),
+		logger:       newLogger(io.Discard, "text", slog.LevelError, "", 0),
+		shutdown:     make(chan struct{}),
+		done:         make(chan struct{}),
+		metrics:      newMetrics(),
+		cooldowns:    newCooldowns(),
+		tableConfig:  &eventcron.TableConfig{UserTableDir: userDir, SystemTableDir: systemDir},
+	}
+	watcher, err := eventcron.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { watcher.Stop() })
+	d.watcher = watcher
+	if err := d.setupCommands(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.LoadTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands keep their entries while reloads replace the tables they
+	// were matched in; run with -race to catch shared entries
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := d.LoadTables(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		in := filepath.Join(data, "in")
+		for i := 0; i < 100; i++ {
+			d.handleEvent(&eventcron.InotifyEvent{Path: filepath.Join(in, "a"), Name: "a", Mask: eventcron.InCreate,
+				WatchDir: in})
+		}
+	}()
+	wg.Wait()
+	d.commands.Wait()
+
+	if started := d.metrics.commandsStarted.Load(); started != 100 {
+		t.Errorf("commands started = %d, want 100", started)
+	}
+}
+
+func TestLogRun(t *testing.T) {
+	failed := &eventcron.ExecutionResult{ExitCode: 1, Output: []byte("no space left\n")}
+	succeeded := &eventcron.ExecutionResult{Success: true, Output: []byte("copied\n")}
+
+	tests := []struct {
+		name   string
+		log    eventcron.EntryLog
+		level  slog.Level // Level the daemon logs at
+		result *eventcron.ExecutionResult
+		want   string // Expected line, empty if nothing is logged
+	}{
+		{"none drops failures", eventcron.EntryLogNone, slog.LevelDebug, failed, ""},
+		{"errors logs failures", eventcron.EntryLogErrors, slog.LevelInfo, failed, "Command failed exit_code=1"},
+		{"errors hides successes at info", eventcron.EntryLogErrors, slog.LevelInfo, succeeded, ""},
+		{"errors logs successes at debug", eventcron.EntryLogErrors, slog.LevelDebug, succeeded, "Command executed successfully exit_code=0"},
+		{"all logs successes with output", eventcron.EntryLogAll, slog.LevelInfo, succeeded, "Command executed successfully exit_code=0 output=copied"},
+		{"all logs failures with output", eventcron.EntryLogAll, slog.LevelInfo, failed, `Command failed exit_code=1 output="no space left"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := &Daemon{logger: newLogger(&out, "text", tt.level, "", 0)}
+			entry := &eventcron.IncronEntry{Options: eventcron.EntryOptions{Log: tt.log}}
+
+			level, msg := slog.LevelInfo, "Command executed successfully"
+			if !tt.result.Success {
+				level, msg = slog.LevelError, "Command failed"
+			}
+			d.logRun(entry, level, msg, withOutput(entry, tt.result, "exit_code", tt.result.ExitCode)...)
+
+			if got := strings.TrimSpace(out.String()); got != tt.want {
+				t.Errorf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithOutputTruncates(t *testing.T) {
+	entry := &eventcron.IncronEntry{Options: eventcron.EntryOptions{Log: eventcron.EntryLogAll}}
+	result := &eventcron.ExecutionResult{Output: bytes.Repeat([]byte("x"), 4*maxLoggedOutput)}
+
+	args := withOutput(entry, result)
+	if len(args) != 2 {
+		t.Fatalf("withOutput() = %v, want the output", args)
+	}
+	if output := args[1].(string); len(output) > maxLoggedOutput+len("... (truncated)") || !strings.HasSuffix(output, "(truncated)") {
+		t.Errorf("withOutput() logged %d bytes, want at most %d marked as truncated", len(output), maxLoggedOutput)
+	}
+}
+
+func TestCheckUsers(t *testing.T) {
+	for _, path := range []string{eventcron.DefaultAllowFile, eventcron.DefaultDenyFile} {
+		if _, err := os.Stat(path); err == nil {
+			t.Skipf("%s exists", path)
+		}
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables of both users watch the shared directory, and the gone
+	// user's table also watches a directory of its own
+	dir := t.TempDir()
+	shared, own := filepath.Join(dir, "shared"), filepath.Join(dir, "own")
+	for _, path := range []string{shared, own} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gone := "eventcron-no-such-user"
+	tables := map[string]*eventcron.IncronTable{
+		current.Username: {Username: current.Username, Entries: []eventcron.IncronEntry{
+			{Path: shared, Mask: eventcron.InCreate, Command: "true", Owner: current.Username, LineNumber: 1},
+		}},
+		gone: {Username: gone, Entries: []eventcron.IncronEntry{
+			{Path: shared, Mask: eventcron.InDelete, Command: "true", Owner: gone, LineNumber: 1},
+			{Path: own, Mask: eventcron.InCreate, Command: "true", Owner: gone, LineNumber: 2},
+		}},
+	}
+
+	watcher, err := eventcron.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+	var desired []*eventcron.IncronEntry
+	for _, table := range tables {
+		for i := range table.Entries {
+			desired = append(desired, &table.Entries[i])
+		}
+	}
+	if failed := watcher.Reconcile(desired); len(failed) != 0 {
+		t.Fatalf("Reconcile() failed: %v", failed)
+	}
+
+	d := &Daemon{
+		userTables: tables,
+		logger:     newLogger(io.Discard, "text", slog.LevelError, "", 0),
+		watcher:    watcher,
+	}
+	d.checkUsers()
+
+	if _, ok := d.userTables[gone]; ok {
+		t.Errorf("table of %s is still loaded", gone)
+	}
+	if _, ok := d.userTables[current.Username]; !ok {
+		t.Errorf("table of %s was unloaded", current.Username)
+	}
+	if paths := watcher.GetWatchedPaths(); len(paths) != 1 || paths[0] != shared {
+		t.Errorf("watched paths = %v, want only %s", paths, shared)
+	}
+}
+
+func TestCommandsStartedCountsRunningCommands(t *testing.T) {
+	d := &Daemon{
+		config:  &Config{MaxConcurrentCommands: 1, CommandTimeout: 10 * time.Second},
+		logger:  newLogger(io.Discard, "text", slog.LevelError, "", 0),
+		metrics: newMetrics(),
+	}
+	if err := d.setupCommands(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.executor.KillAllCommands()
+
+	entry := &eventcron.IncronEntry{Path: "/tmp", Mask: eventcron.InCreate, Command: "sleep 10"}
+	event := &eventcron.InotifyEvent{Path: "/tmp/a", Name: "a", Mask: eventcron.InCreate, WatchDir: "/tmp"}
+	go d.executor.Execute(entry, event, "")
+
+	// The command counts as started while it is still running
+	deadline := time.Now().Add(2 * time.Second)
+	for d.metrics.commandsStarted.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("running command not counted as started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestControlSocketPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eventcrond.sock")
+	d := &Daemon{
+		config: &Config{ControlSocket: path},
+		logger: newLogger(io.Discard, "text", slog.LevelError, "", 0),
+	}
+	if err := d.startControlSocket(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.stopControlSocket()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("control socket mode = %o, want 600", perm)
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		wantErr    string
+	}{
+		{"max_concurrent_commands", "8", ""},
+		{"max_concurent_commands", "8", "unknown key max_concurent_commands"},
+		{"max_user_watches", "8192", ""}, // Documented, not implemented yet
+		{"max_concurrent_commands", "many", "invalid value for max_concurrent_commands"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			err := (&Config{}).set(tt.key, tt.value)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("set(%q, %q) = %v", tt.key, tt.value, err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("set(%q, %q) = %v, want %q", tt.key, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseWebhookURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://hooks.example.com/eventcron", false},
+		{"http://127.0.0.1:8080/hook", false},
+		{"ftp://hooks.example.com/eventcron", true},
+		{"/eventcron", true},
+		{"https://", true},
+	}
+
+	for _, tt := range tests {
+		if err := parseWebhookURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("parseWebhookURL(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	payloads := make(chan webhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("bad payload: %v", err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		payloads <- payload
+	}))
+	defer server.Close()
+
+	hook := newWebhook(server.URL, newLogger(io.Discard, "text", slog.LevelError, "", 0))
+	entry := &eventcron.IncronEntry{Path: "/data", Mask: eventcron.InCloseWrite, Command: "true"}
+	event := &eventcron.InotifyEvent{Path: "/data/a", Name: "a", Mask: eventcron.InCloseWrite, WatchDir: "/data"}
+	result := &eventcron.ExecutionResult{ExitCode: 2, Duration: 1500 * time.Millisecond, Attempts: 3}
+	hook.notify(entry, event, "alice", result)
+
+	select {
+	case got := <-payloads:
+		if got.User != "alice" || got.Entry != "/data" || got.Path != "/data/a" || got.Event != "IN_CLOSE_WRITE" ||
+			got.Success || got.ExitCode != 2 || got.Duration != 1.5 || got.Attempts != 3 {
+			t.Errorf("payload = %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestWebhookPostStatus(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	hook := newWebhook(server.URL, newLogger(io.Discard, "text", slog.LevelError, "", 0))
+
+	if err := hook.post([]byte("{}")); err != nil {
+		t.Errorf("post() with status 200 = %v", err)
+	}
+	status = http.StatusInternalServerError
+	if err := hook.post([]byte("{}")); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("post() with status 500 = %v", err)
+	}
+}
+
+func TestAutoReloadMatches(t *testing.T) {
+	a := newAutoReload(func() {}, []string{"/etc/eventcron.d", "/var/spool/eventcron", "/etc/eventcron.d"})
+	if len(a.entries) != 2 {
+		t.Fatalf("entries = %d, want 2 for two distinct directories", len(a.entries))
+	}
+
+	tests := []struct {
+		name  string
+		event eventcron.InotifyEvent
+		want  bool
+	}{
+		{"table written", eventcron.InotifyEvent{Path: "/etc/eventcron.d/app", Name: "app", Mask: eventcron.InCloseWrite,
+			WatchDir: "/etc/eventcron.d"}, true},
+		{"table moved in", eventcron.InotifyEvent{Path: "/var/spool/eventcron/alice", Name: "alice",
+			Mask: eventcron.InMovedTo, WatchDir: "/var/spool/eventcron"}, true},
+		{"table deleted", eventcron.InotifyEvent{Path: "/etc/eventcron.d/app", Name: "app", Mask: eventcron.InDelete,
+			WatchDir: "/etc/eventcron.d"}, true},
+		{"table only opened", eventcron.InotifyEvent{Path: "/etc/eventcron.d/app", Name: "app", Mask: eventcron.InOpen,
+			WatchDir: "/etc/eventcron.d"}, false},
+		{"other directory", eventcron.InotifyEvent{Path: "/data/app", Name: "app", Mask: eventcron.InCloseWrite,
+			WatchDir: "/data"}, false},
+	}
+	for _, tt := range tests {
+		if got := a.matches(&tt.event); got != tt.want {
+			t.Errorf("%s: matches() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAutoReloadTrigger(t *testing.T) {
+	var mu sync.Mutex
+	reloads := map[string]int{}
+	counter := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			reloads[name]++
+		}
+	}
+
+	// A series of changes causes a single reload
+	burst := newAutoReload(counter("burst"), nil)
+	for i := 0; i < 3; i++ {
+		burst.trigger()
+	}
+	defer burst.stop()
+
+	// Stopping cancels the pending reload and ignores later changes
+	stopped := newAutoReload(counter("stopped"), nil)
+	stopped.trigger()
+	stopped.stop()
+	stopped.trigger()
+
+	time.Sleep(autoReloadDelay + 500*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if reloads["burst"] != 1 || reloads["stopped"] != 0 {
+		t.Errorf("reloads = %v, want 1 for burst and none for stopped", reloads)
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, logFormatText, slog.LevelInfo, "", 0)
+
+	l.Debug("Hidden below info")
+	l.Info("Command finished", "user", "alice", "path", "/data/a b", "took", 1500*time.Millisecond)
+	l.Warn("Skipping", "error", errors.New(`bad "quote"`), "empty", "")
+	l.Error("Odd argument", "dangling")
+
+	want := `Command finished user=alice path="/data/a b" took=1.5s
+Warning: Skipping error="bad \"quote\"" empty=""
+Odd argument dangling
+`
+	if got := out.String(); got != want {
+		t.Errorf("text log =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, logFormatJSON, slog.LevelWarn, "", 0)
+
+	l.Info("Hidden below warn")
+	l.Warn("Slow command", "user", "alice", "took", 1500*time.Millisecond)
+
+	var line map[string]any
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("not a single JSON line: %q: %v", out.String(), err)
+	}
+	if line["level"] != "warn" || line["msg"] != "Slow command" || line["user"] != "alice" || line["took"] != 1.5 {
+		t.Errorf("JSON log = %v", line)
+	}
+	if _, ok := line["time"]; !ok {
+		t.Errorf("JSON log has no time: %v", line)
+	}
+}
+
+func TestSetupLoggingLevel(t *testing.T) {
+	if _, err := setupLogging(false, logFormatText, "verbose"); err == nil {
+		t.Error("setupLogging() accepted an unknown log level")
+	}
+	l, err := setupLogging(false, logFormatJSON, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.level != slog.LevelDebug || l.json == nil {
+		t.Errorf("setupLogging() = level %v, JSON %v", l.level, l.json != nil)
+	}
+}
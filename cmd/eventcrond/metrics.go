@@ -0,0 +1,177 @@
+// Package main implements Prometheus metrics export for eventcrond
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// durationBuckets are the upper bounds of the command duration histogram
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// metrics collects daemon counters for the Prometheus endpoint
+type metrics struct {
+	eventsReceived  atomic.Uint64
+	commandsStarted atomic.Uint64
+
+	mu             sync.Mutex
+	commandsFailed map[int]uint64 // Exit code to failure count
+	bucketCounts   []uint64       // Non-cumulative counts per duration bucket
+	durationSum    float64
+	durationCount  uint64
+}
+
+// newMetrics creates an empty metrics collection
+func newMetrics() *metrics {
+	return &metrics{
+		commandsFailed: make(map[int]uint64),
+		bucketCounts:   make([]uint64, len(durationBuckets)),
+	}
+}
+
+// observeStart counts a command, or a retry of one, that was started
+func (m *metrics) observeStart() {
+	m.commandsStarted.Add(1)
+}
+
+// observeCommand records the outcome of a command that finished
+func (m *metrics) observeCommand(result *eventcron.ExecutionResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !result.Success {
+		m.commandsFailed[result.ExitCode]++
+	}
+
+	seconds := result.Duration.Seconds()
+	m.durationSum += seconds
+	m.durationCount++
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.bucketCounts[i]++
+			break
+		}
+	}
+}
+
+// finishedCommands returns the number of commands that finished
+func (m *metrics) finishedCommands() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.durationCount
+}
+
+// failedCommands returns the number of commands that failed
+func (m *metrics) failedCommands() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failed uint64
+	for _, count := range m.commandsFailed {
+		failed += count
+	}
+	return failed
+}
+
+// write renders the metrics in the Prometheus text exposition format
+func (m *metrics) write(out io.Writer, watcher *eventcron.Watcher, executor *eventcron.CommandExecutor) {
+	fmt.Fprintln(out, "# HELP eventcron_events_received_total Inotify events received by the daemon.")
+	fmt.Fprintln(out, "# TYPE eventcron_events_received_total counter")
+	fmt.Fprintf(out, "eventcron_events_received_total %d\n", m.eventsReceived.Load())
+
+	fmt.Fprintln(out, "# HELP eventcron_events_dropped_total Events dropped because the event queue was full.")
+	fmt.Fprintln(out, "# TYPE eventcron_events_dropped_total counter")
+	fmt.Fprintf(out, "eventcron_events_dropped_total %d\n", watcher.DroppedEvents())
+
+	fmt.Fprintln(out, "# HELP eventcron_watches Active inotify watches.")
+	fmt.Fprintln(out, "# TYPE eventcron_watches gauge")
+	fmt.Fprintf(out, "eventcron_watches %d\n", watcher.GetWatchCount())
+
+	fmt.Fprintln(out, "# HELP eventcron_commands_started_total Commands started, counting each retry.")
+	fmt.Fprintln(out, "# TYPE eventcron_commands_started_total counter")
+	fmt.Fprintf(out, "eventcron_commands_started_total %d\n", m.commandsStarted.Load())
+
+	fmt.Fprintln(out, "# HELP eventcron_command_queue_depth Commands waiting for a free command slot.")
+	fmt.Fprintln(out, "# TYPE eventcron_command_queue_depth gauge")
+	fmt.Fprintf(out, "eventcron_command_queue_depth %d\n", executor.GetQueuedCount())
+
+	full, expired := executor.QueueDrops()
+	fmt.Fprintln(out, "# HELP eventcron_command_queue_dropped_total Commands skipped because the command queue was full or they waited too long.")
+	fmt.Fprintln(out, "# TYPE eventcron_command_queue_dropped_total counter")
+	fmt.Fprintf(out, "eventcron_command_queue_dropped_total{reason=\"full\"} %d\n", full)
+	fmt.Fprintf(out, "eventcron_command_queue_dropped_total{reason=\"expired\"} %d\n", expired)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP eventcron_commands_failed_total Commands that failed, by exit code.")
+	fmt.Fprintln(out, "# TYPE eventcron_commands_failed_total counter")
+	codes := make([]int, 0, len(m.commandsFailed))
+	for code := range m.commandsFailed {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(out, "eventcron_commands_failed_total{exit_code=\"%d\"} %d\n", code, m.commandsFailed[code])
+	}
+
+	fmt.Fprintln(out, "# HELP eventcron_command_duration_seconds Command run time.")
+	fmt.Fprintln(out, "# TYPE eventcron_command_duration_seconds histogram")
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		cumulative += m.bucketCounts[i]
+		fmt.Fprintf(out, "eventcron_command_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(out, "eventcron_command_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(out, "eventcron_command_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(out, "eventcron_command_duration_seconds_count %d\n", m.durationCount)
+}
+
+// startMetricsServer serves /metrics on the configured address. An empty
+// address disables it.
+func (d *Daemon) startMetricsServer() error {
+	addr := d.config.MetricsAddr
+	if addr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.metrics.write(w, d.watcher, d.executor)
+	})
+
+	d.metricsSrv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := d.metricsSrv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			d.logger.Error("Metrics server error", "error", err)
+		}
+	}()
+
+	d.logger.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+	return nil
+}
+
+// stopMetricsServer shuts the metrics listener down
+func (d *Daemon) stopMetricsServer() {
+	if d.metricsSrv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d.metricsSrv.Shutdown(ctx)
+}
@@ -0,0 +1,71 @@
+// Package main implements running the tables once over existing files
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// RunOnce handles the files already in dir as if each had just caused an
+// event with the flags of maskSpec, e.g. IN_CREATE, and returns once the
+// commands of the matching entries have finished. The tables are read like
+// the daemon does, but nothing is watched, so it can catch up on files that
+// arrived while the daemon was down. It returns an error if a command
+// failed.
+func (d *Daemon) RunOnce(dir, maskSpec string) error {
+	if err := d.setupTables(); err != nil {
+		return err
+	}
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("--path must be absolute: %s", dir)
+	}
+	dir = filepath.Clean(dir)
+	mask, err := eventcron.ParseEventMask(maskSpec)
+	if err != nil {
+		return fmt.Errorf("invalid --mask: %v", err)
+	}
+	if err := d.setupCommands(); err != nil {
+		return err
+	}
+	defer func() {
+		if d.commandLog != nil {
+			d.commandLog.close()
+		}
+	}()
+
+	events, err := eventcron.ExistingFileEvents(dir, mask)
+	if err != nil {
+		return err
+	}
+
+	// Every file gets a run of its own: with nothing watched a command can't
+	// trigger its entry again, and restart=true would kill the runs of the
+	// files before it
+	d.mu.Lock()
+	entries := d.readTables()
+	for _, entry := range entries {
+		entry.Options.NoLoop = false
+		entry.Options.Restart = false
+	}
+	d.mu.Unlock()
+	d.logger.Info("Running tables once", "path", dir, "event", maskSpec, "files", len(events),
+		"entries", len(entries))
+
+	// The executor's queue may be shorter than the directory, so commands
+	// only start while a slot is free
+	d.batch = make(chan struct{}, max(d.config.MaxConcurrentCommands, 1))
+	for _, event := range events {
+		d.metrics.eventsReceived.Add(1)
+		d.handleEvent(event)
+	}
+	d.commands.Wait()
+
+	finished, failed := d.metrics.finishedCommands(), d.metrics.failedCommands()
+	d.logger.Info("Finished running tables once", "path", dir, "commands", finished, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, finished)
+	}
+	return nil
+}
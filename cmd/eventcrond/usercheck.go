@@ -0,0 +1,91 @@
+// Package main implements unloading the tables of users that went away
+package main
+
+import (
+	"errors"
+	"os/user"
+	"sort"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// checkUsersEvery runs checkUsers every interval until the daemon shuts down
+func (d *Daemon) checkUsersEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.checkUsers()
+		case <-d.shutdown:
+			return
+		}
+	}
+}
+
+// checkUsers unloads the tables of users that were deleted or are no longer
+// allowed to use eventcron since the tables were loaded, removing their
+// watches. Users that can't be checked keep their table.
+func (d *Daemon) checkUsers() {
+	d.mu.RLock()
+	usernames := make([]string, 0, len(d.userTables))
+	for username := range d.userTables {
+		usernames = append(usernames, username)
+	}
+	d.mu.RUnlock()
+	sort.Strings(usernames)
+
+	// Look the users up without the lock, as that may ask a directory server
+	gone := make(map[string]string)
+	for _, username := range usernames {
+		if reason := d.userGone(username); reason != "" {
+			gone[username] = reason
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, username := range usernames {
+		reason, isGone := gone[username]
+		table, loaded := d.userTables[username]
+		if !isGone || !loaded {
+			continue
+		}
+
+		// Entries sharing a watch with the table are watched again
+		for entry, err := range d.watcher.RemoveTableEntries(table) {
+			d.logger.Warn("Failed to watch again after unloading a table", "unloaded", username,
+				"table", entry.Owner, "line", entry.LineNumber, "path", entry.Path, "command", entry.Command, "error", err)
+		}
+		delete(d.userTables, username)
+		d.logger.Info("Unloaded table", "user", username, "reason", reason, "entries", len(table.Entries))
+	}
+}
+
+// userGone returns why the table of username must be unloaded, or "" if the
+// user still exists and may use eventcron
+func (d *Daemon) userGone(username string) string {
+	if _, err := user.Lookup(username); err != nil {
+		var unknown user.UnknownUserError
+		if !errors.As(err, &unknown) {
+			d.logger.Warn("Failed to look up user", "user", username, "error", err)
+			return ""
+		}
+		return "user no longer exists"
+	}
+
+	allowed, err := eventcron.CheckUserPermission(username)
+	if err != nil {
+		d.logger.Error("Error checking permissions", "user", username, "error", err)
+		return ""
+	}
+	if !allowed {
+		return "user is no longer allowed to use eventcron"
+	}
+	return ""
+}
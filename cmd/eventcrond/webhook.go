@@ -0,0 +1,113 @@
+// Package main implements the eventcrond command completion webhook
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookInFlight = 16 // Deliveries running at once; more are dropped
+)
+
+// webhook posts a JSON payload to a URL for every finished command
+type webhook struct {
+	url      string
+	client   *http.Client
+	logger   *logger
+	inFlight chan struct{} // Holds a token per delivery in progress
+}
+
+// webhookPayload is the JSON body posted for a finished command
+type webhookPayload struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Entry    string    `json:"entry"` // Watched path of the table entry
+	Path     string    `json:"path"`  // Path of the event
+	Event    string    `json:"event"`
+	Success  bool      `json:"success"`
+	ExitCode int       `json:"exit_code"`
+	Duration float64   `json:"duration_seconds"`
+	Attempts int       `json:"attempts"`
+}
+
+// parseWebhookURL checks that rawURL is an absolute http or https URL
+func parseWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("expected an http or https URL")
+	}
+	return nil
+}
+
+// newWebhook creates a webhook posting to rawURL
+func newWebhook(rawURL string, logger *logger) *webhook {
+	return &webhook{
+		url:      rawURL,
+		client:   &http.Client{Timeout: webhookTimeout},
+		logger:   logger,
+		inFlight: make(chan struct{}, webhookInFlight),
+	}
+}
+
+// notify posts the result of a command in the background. Failed deliveries
+// are logged and not retried, and notifications are dropped while too many
+// deliveries are still waiting for a slow endpoint.
+func (w *webhook) notify(entry *eventcron.IncronEntry, event *eventcron.InotifyEvent,
+	username string, result *eventcron.ExecutionResult) {
+	body, err := json.Marshal(webhookPayload{
+		Time:     time.Now().UTC(),
+		User:     username,
+		Entry:    entry.Path,
+		Path:     event.Path,
+		Event:    event.MaskString(),
+		Success:  result.Success,
+		ExitCode: result.ExitCode,
+		Duration: result.Duration.Seconds(),
+		Attempts: result.Attempts,
+	})
+	if err != nil {
+		w.logger.Error("Failed to encode webhook payload", "error", err)
+		return
+	}
+
+	select {
+	case w.inFlight <- struct{}{}:
+	default:
+		w.logger.Warn("Webhook busy: dropping notification", "path", event.Path, "in_flight", webhookInFlight)
+		return
+	}
+
+	go func() {
+		defer func() { <-w.inFlight }()
+		if err := w.post(body); err != nil {
+			w.logger.Warn("Webhook delivery failed", "path", event.Path, "error", err)
+		}
+	}()
+}
+
+// post sends one payload, failing on any status other than 2xx
+func (w *webhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -3,31 +3,55 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
-
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dpvpro/eventcron/pkg/eventcron"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	defaultEditor = "vim"
 	tempFilePrefix = "eventcrontab"
+	pingTimeout    = 5 * time.Second // How long --ping waits for the control socket
 )
 
+// dedupeFlag makes every saved table drop entries repeating an earlier entry
+var dedupeFlag = flag.Bool("dedupe", false, "Remove duplicate entries when saving the table")
+
+// tableConfig holds the settings of the configuration file for reading tables
+var tableConfig = eventcron.DefaultTableConfig()
+
+// placeholderPattern finds the {{NAME}} placeholders left in a template
+var placeholderPattern = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+
 // Operation represents the type of operation to perform
 type Operation int
 
 const (
 	OpList Operation = iota
+	OpCount
 	OpEdit
 	OpRemove
 	OpReplace
+	OpReload
+	OpTest
+	OpExplain
+	OpDedupe
 	OpHelp
 	OpVersion
 )
@@ -35,10 +59,22 @@ const (
 func main() {
 	var (
 		listFlag    = flag.Bool("l", false, "List current eventcron table")
+		countFlag   = flag.Bool("count", false, "Print the number of entries in the table")
 		editFlag    = flag.Bool("e", false, "Edit current eventcron table")
 		removeFlag  = flag.Bool("r", false, "Remove current eventcron table")
 		replaceFlag = flag.Bool("", false, "Replace eventcron table with file from stdin")
+		reloadFlag  = flag.Bool("reload", false, "Ask eventcrond to reload all tables")
+		pingFlag    = flag.Bool("ping", false, "Check that eventcrond is running and responding")
+		pidFlag     = flag.Bool("pid", false, "Print the PID of the running eventcrond")
+		testFlag    = flag.Bool("T", false, "Check a table file (or the current table) without installing it")
+		explainFlag = flag.Bool("explain", false, "Show which entries an event on a path would trigger")
+		fromFlag    = flag.String("from", "", "Install the table from a template, filling in {{USER}}, {{HOME}}, {{UID}} and {{GID}}")
+		migrateFlag = flag.String("migrate", "", "Install a classic incrontab file, translated to the eventcron format")
 		userFlag    = flag.String("u", "", "Specify user (root only)")
+		systemFlag  = flag.Bool("system", false, "List all system tables (root only)")
+		exportFlag  = flag.String("export", "", "Write all user and system tables to a tar archive (root only)")
+		importFlag  = flag.String("import", "", "Install the tables of a tar archive written by --export (root only)")
+		sinceFlag   = flag.String("since", "", "Print the command log lines of the last duration, e.g. 1h")
 		versionFlag = flag.Bool("V", false, "Show version and exit")
 		helpFlag    = flag.Bool("h", false, "Show help and exit")
 	)
@@ -54,9 +90,32 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Refuse tables the daemon would refuse to load
+	tableConfig.MaxEntries = eventcron.MaxEntriesSetting(eventcron.DefaultConfigFile)
+	tableConfig.MaxLineLength = eventcron.MaxLineLengthSetting(eventcron.DefaultConfigFile)
+	if err := eventcron.RegisterEventMasks(eventcron.EventMasksSetting(eventcron.DefaultConfigFile)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring event_masks: %v\n", err)
+	}
+
+	// Read and write the tables where the daemon looks for them
+	tableConfig.UserTableDir, tableConfig.SystemTableDir = eventcron.TableDirSettings(eventcron.DefaultConfigFile)
+
+	// --count only prints a number, so it doesn't silently win over
+	// another operation or output
+	if *countFlag {
+		var given []string
+		flag.Visit(func(f *flag.Flag) { given = append(given, f.Name) })
+		if err := checkCountFlags(given, flag.NArg()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Determine operation
 	op := OpList // default
-	if *listFlag {
+	if *countFlag {
+		op = OpCount
+	} else if *listFlag {
 		op = OpList
 	} else if *editFlag {
 		op = OpEdit
@@ -64,11 +123,84 @@ func main() {
 		op = OpRemove
 	} else if *replaceFlag {
 		op = OpReplace
+	} else if *reloadFlag {
+		op = OpReload
+	} else if *testFlag {
+		op = OpTest
+	} else if *explainFlag {
+		op = OpExplain
+	} else if *dedupeFlag && flag.NArg() == 0 && *fromFlag == "" && *migrateFlag == "" {
+		// On its own, --dedupe cleans up the installed table
+		op = OpDedupe
 	} else if flag.NArg() > 0 {
 		// File specified as argument means replace
 		op = OpReplace
 	}
 
+	// Health checks for monitoring exit 0 if the daemon is alive, 1 if not
+	if *pingFlag {
+		if err := pingDaemon(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *pidFlag {
+		pid, err := daemonPid()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(pid)
+		return
+	}
+
+	// Reloading isn't tied to a user's table
+	if op == OpReload {
+		if err := reloadTables(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Backups cover every table at once
+	if *exportFlag != "" || *importFlag != "" {
+		var err error
+		if *exportFlag != "" {
+			err = exportTables(*exportFlag)
+		} else {
+			err = importTables(*importFlag)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The command log covers every table, -u only narrows it down
+	if *sinceFlag != "" {
+		if err := showCommandLog(*sinceFlag, *userFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// System tables are listed as a whole rather than per user
+	if *systemFlag {
+		if op != OpList {
+			fmt.Fprintf(os.Stderr, "Error: --system can only be used with -l\n")
+			os.Exit(1)
+		}
+		if err := listSystemTables(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Get target user
 	targetUser, err := getTargetUser(*userFlag)
 	if err != nil {
@@ -82,6 +214,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Templates and classic tables replace the table like a file argument does
+	if *fromFlag != "" || *migrateFlag != "" {
+		if *fromFlag != "" {
+			err = installTemplate(targetUser, *fromFlag)
+		} else {
+			err = migrateTable(targetUser, *migrateFlag)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Execute operation
 	if err := executeOperation(op, targetUser); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -94,9 +240,27 @@ func showHelp() {
 	fmt.Printf("Usage: %s [options] [file]\n", os.Args[0])
 	fmt.Println("\nOptions:")
 	fmt.Println("  -l        List current eventcron table")
+	fmt.Println("  --count   Print only the number of entries in the table (0 if none); combines only with -l and -u")
 	fmt.Println("  -e        Edit current eventcron table")
 	fmt.Println("  -r        Remove current eventcron table")
+	fmt.Println("  --reload  Ask eventcrond to reload all tables")
+	fmt.Println("  --ping    Check that eventcrond is running and responding (exit status 0 or 1)")
+	fmt.Println("  --pid     Print the PID of the running eventcrond (exit status 1 if not running)")
+	fmt.Println("  -T [file] Check a table file, or the current table, and that its commands exist")
+	fmt.Println("  --explain path mask  Show which entries an event such as IN_CREATE on path would")
+	fmt.Println("            trigger and the commands they would run, without a running daemon")
+	fmt.Println("  --dedupe  Remove duplicate entries when saving with -e, a file, --from or --migrate;")
+	fmt.Println("            on its own, remove them from the installed table")
 	fmt.Println("  -u user   Specify user (root only)")
+	fmt.Println("  --from template  Install the table from a template, replacing {{USER}}, {{HOME}},")
+	fmt.Println("            {{UID}} and {{GID}} with the user's details")
+	fmt.Println("  --migrate file  Install a classic incrontab, translated so its entries behave as")
+	fmt.Println("            they did under incron; lines that can't be translated are reported")
+	fmt.Println("  --system  With -l, list all system tables (root only)")
+	fmt.Println("  --export file  Write all user and system tables to a tar archive (root only)")
+	fmt.Println("  --import file  Install all tables from an archive written by --export (root only)")
+	fmt.Println("  --since duration  Print the lines of the command_log from the last duration, such")
+	fmt.Println("            as 30m or 1h; with -u only those of the user (non-root: your own)")
 	fmt.Println("  -V        Show version and exit")
 	fmt.Println("  -h        Show help and exit")
 	fmt.Println()
@@ -147,7 +311,7 @@ func checkPermissions(username string) error {
 	}
 
 	if !allowed {
-		return fmt.Errorf("user %s is not allowed to use eventcron", username)
+		return fmt.Errorf("%w: %s", eventcron.ErrUserNotAllowed, username)
 	}
 
 	return nil
@@ -158,12 +322,20 @@ func executeOperation(op Operation, username string) error {
 	switch op {
 	case OpList:
 		return listTable(username)
+	case OpCount:
+		return countTable(username)
 	case OpEdit:
 		return editTable(username)
 	case OpRemove:
 		return removeTable(username)
 	case OpReplace:
 		return replaceTable(username)
+	case OpTest:
+		return testTable(username)
+	case OpExplain:
+		return explainEvent(username)
+	case OpDedupe:
+		return dedupeTable(username)
 	default:
 		return fmt.Errorf("unknown operation")
 	}
@@ -171,12 +343,12 @@ func executeOperation(op Operation, username string) error {
 
 // listTable lists the current eventcron table for the user
 func listTable(username string) error {
-	if !eventcron.UserTableExists(username) {
+	if !tableConfig.UserTableExists(username) {
 		// No table exists, just exit silently
 		return nil
 	}
 
-	table, err := eventcron.LoadUserTable(username)
+	table, err := tableConfig.LoadUserTable(username)
 	if err != nil {
 		return fmt.Errorf("failed to load table: %v", err)
 	}
@@ -189,6 +361,313 @@ func listTable(username string) error {
 	return nil
 }
 
+// listSystemTables lists the entries of every system table, grouped by table
+func listSystemTables() error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("only root can list system tables")
+	}
+
+	tables, err := tableConfig.LoadAllSystemTables()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# %s\n", tableConfig.GetSystemTablePath(name))
+		fmt.Println(tables[name].String())
+	}
+	return nil
+}
+
+// exportTables writes every table to a tar archive at archivePath
+func exportTables(archivePath string) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("only root can export tables")
+	}
+
+	file, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %v", err)
+	}
+
+	count, err := tableConfig.ExportTables(file)
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to write archive: %v", cerr)
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+
+	fmt.Printf("Exported %d tables to %s\n", count, archivePath)
+	return nil
+}
+
+// importTables installs every table of the tar archive at archivePath
+func importTables(archivePath string) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("only root can import tables")
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	written, err := tableConfig.ImportTables(file)
+	for _, path := range written {
+		fmt.Printf("Installed %s\n", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := reloadDaemon(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to reload daemon: %v\n", err)
+	}
+
+	fmt.Printf("Imported %d tables from %s\n", len(written), archivePath)
+	return nil
+}
+
+// showCommandLog prints the lines of the daemon's command log written in the
+// last since, only those of userFlag if it is set. Users other than root only
+// see their own commands.
+func showCommandLog(since, userFlag string) error {
+	window, err := time.ParseDuration(since)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("invalid --since duration: %s", since)
+	}
+
+	username := ""
+	if userFlag != "" || os.Getuid() != 0 {
+		if username, err = getTargetUser(userFlag); err != nil {
+			return err
+		}
+	}
+
+	path := eventcron.CommandLogPath(eventcron.DefaultConfigFile)
+	if path == "" {
+		return fmt.Errorf("command_log is not set in %s", eventcron.DefaultConfigFile)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open command log: %v", err)
+	}
+	defer file.Close()
+
+	cutoff := time.Now().Add(-window)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields, err := parseCommandLogLine(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: line %d: %v\n", path, lineNumber, err)
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, fields["time"])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: line %d: invalid time %q\n", path, lineNumber, fields["time"])
+			continue
+		}
+		if when.Before(cutoff) || (username != "" && fields["user"] != username) {
+			continue
+		}
+		fmt.Println(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read command log: %v", err)
+	}
+	return nil
+}
+
+// parseCommandLogLine splits a command log line into its key=value fields,
+// unquoting the quoted values such as user and path
+func parseCommandLogLine(line string) (map[string]string, error) {
+	fields := make(map[string]string)
+	rest := strings.TrimLeft(line, " ")
+	for rest != "" {
+		key, value, found := strings.Cut(rest, "=")
+		if !found || key == "" || strings.Contains(key, " ") {
+			return nil, fmt.Errorf("invalid field: %s", rest)
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value of %s", key)
+			}
+			fields[key], _ = strconv.Unquote(quoted)
+			value = value[len(quoted):]
+		} else {
+			end := strings.IndexByte(value, ' ')
+			if end < 0 {
+				end = len(value)
+			}
+			fields[key] = value[:end]
+			value = value[end:]
+		}
+		rest = strings.TrimLeft(value, " ")
+	}
+	return fields, nil
+}
+
+// countFlags are the flags --count may be given with
+var countFlags = []string{"count", "l", "u"}
+
+// checkCountFlags returns an error if --count was given with a flag other
+// than -l and -u, given being the names of the flags set, or with a file
+// argument, which would otherwise be ignored
+func checkCountFlags(given []string, args int) error {
+	for _, name := range given {
+		if !slices.Contains(countFlags, name) {
+			prefix := "-"
+			if len(name) > 1 {
+				prefix = "--"
+			}
+			return fmt.Errorf("--count can't be combined with %s%s", prefix, name)
+		}
+	}
+	if args > 0 {
+		return fmt.Errorf("--count doesn't take a file")
+	}
+	return nil
+}
+
+// countTable prints the number of entries in the user's table
+func countTable(username string) error {
+	if !tableConfig.UserTableExists(username) {
+		fmt.Println(0)
+		return nil
+	}
+
+	table, err := tableConfig.LoadUserTable(username)
+	if err != nil {
+		return fmt.Errorf("failed to load table: %v", err)
+	}
+
+	fmt.Println(table.Count())
+	return nil
+}
+
+// explainEvent prints the entries of the user's table watching the path given
+// as the first argument, whether an event with the mask given as the second
+// argument would trigger them, and the command each would run. The table's
+// paths are expanded like the daemon does.
+func explainEvent(username string) error {
+	if flag.NArg() != 2 {
+		return fmt.Errorf("--explain needs a path and an event mask, e.g. --explain /tmp/file IN_CREATE")
+	}
+	path := filepath.Clean(flag.Arg(0))
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("path must be absolute: %s", flag.Arg(0))
+	}
+	mask, err := eventcron.ParseEventMask(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if !tableConfig.UserTableExists(username) {
+		return fmt.Errorf("%w for user %s", eventcron.ErrTableNotFound, username)
+	}
+	table, err := tableConfig.LoadUserTable(username)
+	if err != nil {
+		return fmt.Errorf("failed to load table: %v", err)
+	}
+	owner, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to look up user %s: %v", username, err)
+	}
+	if errs := table.ExpandPaths(owner); len(errs) > 0 {
+		return errs[0]
+	}
+	table.ExpandBraces()
+
+	// The daemon may ignore hidden files before looking at any entry
+	skipDotfiles := false
+	if value, found, err := eventcron.ReadConfigValue(eventcron.DefaultConfigFile, "skip_dotfiles"); err == nil && found {
+		skipDotfiles, _ = strconv.ParseBool(value)
+	}
+
+	matched := 0
+	attrs := eventcron.StatFileAttrs(path)
+	for i := range table.Entries {
+		entry := &table.Entries[i]
+		event := entry.EventFor(path, mask)
+		event.Received = time.Now()
+		if !entry.MatchesPath(event.WatchDir) && !entry.MatchesPath(event.Path) {
+			continue
+		}
+
+		fmt.Printf("line %d: %s\n", entry.LineNumber, entry.String())
+		switch {
+		case skipDotfiles && !entry.Options.DotDirs && event.IsHidden():
+			fmt.Printf("  not triggered: %s is hidden and skip_dotfiles is set (add dotdirs=true)\n", event.Name)
+		case entry.MatchesEvent(event) && entry.WaitsForClose(event):
+			fmt.Printf("  not triggered: on_close_only is set, the command runs on IN_CLOSE_WRITE\n")
+		case entry.MatchesEvent(event):
+			matched++
+			fmt.Printf("  runs: %s\n", entry.ExpandEventCommand(event, attrs))
+		case entry.Mask&mask == 0:
+			fmt.Printf("  not triggered: the mask doesn't include %s\n", event.MaskString())
+		default:
+			fmt.Printf("  not triggered: %s is filtered out by include= or exclude=\n", filepath.Base(path))
+		}
+	}
+
+	if matched == 0 {
+		return fmt.Errorf("no entry of %s's table is triggered by %s on %s", username, flag.Arg(1), path)
+	}
+	return nil
+}
+
+// testTable checks a table file, or the user's installed table, with strict
+// validation without installing anything
+func testTable(username string) error {
+	path := tableConfig.GetUserTablePath(username)
+	if flag.NArg() > 0 {
+		path = flag.Arg(0)
+		if err := checkCallerCanRead(path); err != nil {
+			return err
+		}
+	} else if !tableConfig.UserTableExists(username) {
+		return fmt.Errorf("%w for user %s", eventcron.ErrTableNotFound, username)
+	}
+
+	table, err := tableConfig.LoadTable(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	if errors := tableConfig.ValidateTableStrict(table); len(errors) > 0 {
+		fmt.Fprintf(os.Stderr, "Validation errors found:\n")
+		for _, err := range errors {
+			fmt.Fprintf(os.Stderr, "  %v\n", err)
+		}
+		return fmt.Errorf("%s has %d invalid entries", path, len(errors))
+	}
+
+	for _, warning := range eventcron.DuplicateWarnings(table) {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	fmt.Printf("%s: %d entries OK\n", path, table.Count())
+	return nil
+}
+
 // editTable opens the user's eventcron table in an editor
 func editTable(username string) error {
 	// Get editor
@@ -210,8 +689,8 @@ func editTable(username string) error {
 
 	// Load existing table if it exists
 	var table *eventcron.IncronTable
-	if eventcron.UserTableExists(username) {
-		table, err = eventcron.LoadUserTable(username)
+	if tableConfig.UserTableExists(username) {
+		table, err = tableConfig.LoadUserTable(username)
 		if err != nil {
 			return fmt.Errorf("failed to load existing table: %v", err)
 		}
@@ -219,18 +698,20 @@ func editTable(username string) error {
 		table = &eventcron.IncronTable{Username: username}
 	}
 
-	// Write current table to temp file
-	if !table.IsEmpty() {
-		if _, err := tempFile.WriteString(table.String() + "\n"); err != nil {
+	// Write current table to temp file, keeping the user's comments
+	if !table.IsEmpty() || len(table.Raw) > 0 {
+		if _, err := tempFile.WriteString(table.Format() + "\n"); err != nil {
 			tempFile.Close()
 			return fmt.Errorf("failed to write to temporary file: %v", err)
 		}
 	}
 
 	// Add helpful comments for new users
-	if table.IsEmpty() {
+	if table.IsEmpty() && len(table.Raw) == 0 {
 		helpText := `# Edit this file to configure eventcron table for user ` + username + `
 # Format: <path> <mask> <command>
+# The path may start with ~ or use $HOME, $USER, $UID and $GID,
+# and /srv/{a,b,c} watches /srv/a, /srv/b and /srv/c
 # 
 # Example:
 # /tmp IN_CREATE,IN_MODIFY echo "File $# was $% in $@"
@@ -239,18 +720,48 @@ func editTable(username string) error {
 # IN_ACCESS, IN_MODIFY, IN_ATTRIB, IN_CLOSE_WRITE, IN_CLOSE_NOWRITE,
 # IN_OPEN, IN_MOVED_FROM, IN_MOVED_TO, IN_CREATE, IN_DELETE,
 # IN_DELETE_SELF, IN_MOVE_SELF, IN_ALL_EVENTS
+# A leading - removes a flag, e.g. IN_ALL_EVENTS,-IN_ACCESS,-IN_OPEN
 #
 # Additional options:
 # recursive=true/false   - watch subdirectories
 # loopable=true/false    - allow events during command execution  
 # dotdirs=true/false     - include hidden directories
+# followsymlinks=true/false - descend into symlinked directories
+# onlydir=true/false     - refuse to watch the path if it is not a directory
+# nocase=true/false      - match a * path pattern ignoring case
+# force=true/false       - allow recursive watches on /, /proc, /sys, /dev and watches on sockets
+# shell=true/false       - run the command through /bin/sh -c
+# quote=true/false       - shell-quote wildcard values (with shell=true, default true)
+# nice=N                 - run the command with CPU priority N (-20..19)
+# ionice=idle            - run the command in an I/O class (idle, best-effort[:N], realtime[:N])
+# restart=true/false     - kill the running command on a new event and start it again
+# log=errors             - log failed runs (none: no runs, all: every run with its output)
+# on_close_only=true     - skip IN_MODIFY, run once on IN_CLOSE_WRITE
+# systemd_scope=true     - run the command in a systemd scope in eventcron.slice
+# cooldown=<duration>    - don't run again for a file until this long after the last run
+# output_dir=/path       - keep each run's output in a file in this directory
+# onsuccess="<command>"  - run this command after the command succeeded
+# onfailure="<command>"  - run this command after the command failed
+# env=KEY=VALUE          - set an environment variable for the command
+# recursive_depth=N      - watch at most N levels of subdirectories
+# prune=/path            - leave a subtree out of a recursive watch
+# include=<glob>         - only run for file names matching the pattern
+# exclude=<glob>         - never run for file names matching the pattern
+# cwd=/path              - run the command in this directory
+# retries=N              - run a failed command again up to N times
+# retry_delay=<duration> - wait before the first retry, doubled each time
 #
 # Wildcards in commands:
 # $$  - literal $ character
 # $@  - watched directory path
 # $#  - filename that triggered the event
+# $/  - full path of the file that triggered the event
 # $%  - event name (textual)
 # $&  - event flags (numeric)
+# $:u - owner uid of the file
+# $:g - group gid of the file
+# $:p - permissions of the file in octal
+# $:t - time the event was received, as Unix seconds.nanoseconds
 #
 
 `
@@ -289,17 +800,9 @@ func editTable(username string) error {
 		return nil
 	}
 
-	// Parse the edited file
-	newTable, err := eventcron.LoadTable(tempPath)
-	if err != nil {
-		return fmt.Errorf("failed to parse edited table: %v", err)
-	}
-
-	// Set username
-	newTable.Username = username
-
-	// Validate the new table
-	if errors := eventcron.ValidateTable(newTable); len(errors) > 0 {
+	// Parse and validate the edited file, reporting every problem at once
+	newTable, errors := loadEditedTable(tempPath, username)
+	if len(errors) > 0 {
 		fmt.Fprintf(os.Stderr, "Validation errors found:\n")
 		for _, err := range errors {
 			fmt.Fprintf(os.Stderr, "  %v\n", err)
@@ -335,24 +838,7 @@ func editTable(username string) error {
 		return fmt.Errorf("table not saved due to validation errors")
 	}
 
-	// Save the new table
-	tablePath := eventcron.GetUserTablePath(username)
-	if err := eventcron.SaveTable(newTable, tablePath); err != nil {
-		return fmt.Errorf("failed to save table: %v", err)
-	}
-
-	// Set proper permissions
-	if err := os.Chmod(tablePath, 0600); err != nil {
-		return fmt.Errorf("failed to set table permissions: %v", err)
-	}
-
-	// Send SIGHUP to eventcrond to reload tables
-	if err := reloadDaemon(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to reload daemon: %v\n", err)
-	}
-
-	fmt.Printf("Table for user %s installed\n", username)
-	return nil
+	return saveUserTable(newTable, username)
 }
 
 // editTableWithContent is a helper for re-editing with preserved content
@@ -375,16 +861,9 @@ func editTableWithContent(username, tempPath string) error {
 		return fmt.Errorf("editor failed: %v", err)
 	}
 
-	// Parse the edited file again
-	newTable, err := eventcron.LoadTable(tempPath)
-	if err != nil {
-		return fmt.Errorf("failed to parse edited table: %v", err)
-	}
-
-	newTable.Username = username
-
-	// Validate again
-	if errors := eventcron.ValidateTable(newTable); len(errors) > 0 {
+	// Parse and validate the edited file again
+	newTable, errors := loadEditedTable(tempPath, username)
+	if len(errors) > 0 {
 		fmt.Fprintf(os.Stderr, "Validation errors still present:\n")
 		for _, err := range errors {
 			fmt.Fprintf(os.Stderr, "  %v\n", err)
@@ -392,32 +871,31 @@ func editTableWithContent(username, tempPath string) error {
 		return fmt.Errorf("table not saved due to validation errors")
 	}
 
-	// Save the table
-	tablePath := eventcron.GetUserTablePath(username)
-	if err := eventcron.SaveTable(newTable, tablePath); err != nil {
-		return fmt.Errorf("failed to save table: %v", err)
-	}
-
-	if err := os.Chmod(tablePath, 0600); err != nil {
-		return fmt.Errorf("failed to set table permissions: %v", err)
-	}
+	return saveUserTable(newTable, username)
+}
 
-	if err := reloadDaemon(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to reload daemon: %v\n", err)
+// loadEditedTable parses an edited table file for username. It returns the
+// errors of every invalid line and entry rather than stopping at the first.
+func loadEditedTable(path, username string) (*eventcron.IncronTable, []error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to open edited table: %v", err)}
 	}
+	defer file.Close()
 
-	fmt.Printf("Table for user %s installed\n", username)
-	return nil
+	table, errors := tableConfig.ParseTableAll(file, path)
+	table.Username = username
+	return table, append(errors, tableConfig.ValidateTable(table)...)
 }
 
 // removeTable removes the user's eventcron table
 func removeTable(username string) error {
-	if !eventcron.UserTableExists(username) {
+	if !tableConfig.UserTableExists(username) {
 		fmt.Printf("No table for user %s\n", username)
 		return nil
 	}
 
-	if err := eventcron.RemoveUserTable(username); err != nil {
+	if err := tableConfig.RemoveUserTable(username); err != nil {
 		return fmt.Errorf("failed to remove table: %v", err)
 	}
 
@@ -432,55 +910,118 @@ func removeTable(username string) error {
 
 // replaceTable replaces the user's eventcron table with content from stdin or file
 func replaceTable(username string) error {
-	var input *os.File
-	var err error
+	input := os.Stdin
+	name := "<stdin>"
 
 	// Determine input source
 	if flag.NArg() > 0 {
 		// Read from file
-		filename := flag.Arg(0)
-		input, err = os.Open(filename)
+		name = flag.Arg(0)
+		if err := checkCallerCanRead(name); err != nil {
+			return err
+		}
+		file, err := os.Open(name)
 		if err != nil {
-			return fmt.Errorf("failed to open file %s: %v", filename, err)
+			return fmt.Errorf("failed to open file %s: %v", name, err)
 		}
-		defer input.Close()
-	} else {
-		// Read from stdin
-		input = os.Stdin
+		defer file.Close()
+		input = file
 	}
 
-	// Create temporary file to store input
-	tempFile, err := os.CreateTemp("", tempFilePrefix+"_"+username+"_*")
+	// Parse the input
+	table, err := tableConfig.LoadTableReader(input, name)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
+		return fmt.Errorf("failed to parse input: %v", err)
 	}
-	tempPath := tempFile.Name()
-	defer os.Remove(tempPath)
 
-	// Copy input to temp file
-	scanner := bufio.NewScanner(input)
-	for scanner.Scan() {
-		if _, err := tempFile.WriteString(scanner.Text() + "\n"); err != nil {
-			tempFile.Close()
-			return fmt.Errorf("failed to write to temporary file: %v", err)
-		}
+	return installTable(table, username)
+}
+
+// checkCallerCanRead returns an error unless the user running eventcrontab
+// may read path. eventcrontab is installed setuid root, so files named on the
+// command line are checked with the real uid before they are opened, keeping
+// files only root can read out of tables and error messages.
+func checkCallerCanRead(path string) error {
+	if err := unix.Access(path, unix.R_OK); err != nil {
+		return fmt.Errorf("cannot read %s: %v", path, err)
 	}
-	tempFile.Close()
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("failed to read input: %v", err)
+// migrateTable installs the classic incrontab at path as the user's table.
+// Lines that can't be translated are reported and kept as comments, so they
+// can be fixed with -e.
+func migrateTable(username, path string) error {
+	if err := checkCallerCanRead(path); err != nil {
+		return err
 	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read classic table: %v", err)
+	}
+	defer file.Close()
 
-	// Parse the input
-	table, err := eventcron.LoadTable(tempPath)
+	text, errs := tableConfig.MigrateClassicTable(file, path)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+
+	table, err := tableConfig.LoadTableReader(strings.NewReader(text), path)
 	if err != nil {
-		return fmt.Errorf("failed to parse input: %v", err)
+		return fmt.Errorf("failed to parse migrated table: %v", err)
+	}
+	if err := installTable(table, username); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %d entries from %s\n", len(table.Entries), path)
+	if len(errs) > 0 {
+		fmt.Printf("%d lines could not be migrated and were kept as comments; fix them with eventcrontab -e\n", len(errs))
+	}
+	return nil
+}
+
+// installTemplate installs the table in the template file at path for the
+// user, with its placeholders filled in. Placeholders that aren't known are
+// an error rather than being installed as they are.
+func installTemplate(username, path string) error {
+	if err := checkCallerCanRead(path); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read template: %v", err)
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to look up user %s: %v", username, err)
+	}
+	text := strings.NewReplacer(
+		"{{USER}}", u.Username,
+		"{{HOME}}", u.HomeDir,
+		"{{UID}}", u.Uid,
+		"{{GID}}", u.Gid,
+	).Replace(string(content))
+
+	if left := placeholderPattern.FindAllString(text, -1); len(left) > 0 {
+		return fmt.Errorf("unknown placeholder %s in template %s (expected {{USER}}, {{HOME}}, {{UID}} or {{GID}})", left[0], path)
 	}
 
+	table, err := tableConfig.LoadTableReader(strings.NewReader(text), path)
+	if err != nil {
+		return fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	return installTable(table, username)
+}
+
+// installTable validates a table and installs it as the user's table
+func installTable(table *eventcron.IncronTable, username string) error {
 	table.Username = username
 
 	// Validate the table
-	if errors := eventcron.ValidateTable(table); len(errors) > 0 {
+	if errors := tableConfig.ValidateTable(table); len(errors) > 0 {
 		fmt.Fprintf(os.Stderr, "Validation errors found:\n")
 		for _, err := range errors {
 			fmt.Fprintf(os.Stderr, "  %v\n", err)
@@ -488,14 +1029,27 @@ func replaceTable(username string) error {
 		return fmt.Errorf("table not saved due to validation errors")
 	}
 
-	// Save the table
-	tablePath := eventcron.GetUserTablePath(username)
-	if err := eventcron.SaveTable(table, tablePath); err != nil {
-		return fmt.Errorf("failed to save table: %v", err)
+	return saveUserTable(table, username)
+}
+
+// saveUserTable installs a validated table as the user's table and asks the
+// daemon to reload it. Duplicate entries are removed with --dedupe and
+// reported otherwise.
+func saveUserTable(table *eventcron.IncronTable, username string) error {
+	if *dedupeFlag {
+		if removed := table.RemoveDuplicates(); removed > 0 {
+			fmt.Printf("Removed %d duplicate entries\n", removed)
+		}
+	} else {
+		for _, warning := range eventcron.DuplicateWarnings(table) {
+			fmt.Fprintf(os.Stderr, "Warning: %s (use --dedupe to remove it)\n", warning)
+		}
 	}
 
-	if err := os.Chmod(tablePath, 0600); err != nil {
-		return fmt.Errorf("failed to set table permissions: %v", err)
+	// Save the table
+	tablePath := tableConfig.GetUserTablePath(username)
+	if err := eventcron.SaveTable(table, tablePath, eventcron.UserTableMode); err != nil {
+		return fmt.Errorf("failed to save table: %v", err)
 	}
 
 	// Send SIGHUP to eventcrond to reload tables
@@ -507,32 +1061,170 @@ func replaceTable(username string) error {
 	return nil
 }
 
+// dedupeTable removes the duplicate entries of the user's installed table
+func dedupeTable(username string) error {
+	if !tableConfig.UserTableExists(username) {
+		return fmt.Errorf("%w for user %s", eventcron.ErrTableNotFound, username)
+	}
+	table, err := tableConfig.LoadUserTable(username)
+	if err != nil {
+		return fmt.Errorf("failed to load table: %v", err)
+	}
+
+	if len(table.Duplicates()) == 0 {
+		fmt.Printf("No duplicate entries in the table for user %s\n", username)
+		return nil
+	}
+	return saveUserTable(table, username)
+}
+
 // reloadDaemon sends SIGHUP to eventcrond to reload tables
 func reloadDaemon() error {
-	// Read PID from file
-	pidFile := "/tmp/eventcrond.pid"
-	pidBytes, err := os.ReadFile(pidFile)
+	_, err := signalDaemon(syscall.SIGHUP)
+	return err
+}
+
+// reloadTables asks the daemon to reload all tables without editing any
+func reloadTables() error {
+	pid, err := signalDaemon(syscall.SIGHUP)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reload requested from eventcrond (PID %d)\n", pid)
+	return nil
+}
+
+// pingDaemon checks that the daemon in the PID file is alive and, if its
+// control socket can be reached, that it answers a STATUS query in time
+func pingDaemon() error {
+	pid, err := daemonPid()
+	if err != nil {
+		return err
+	}
+
+	uptime, err := queryUptime(eventcron.ControlSocketPath(eventcron.DefaultConfigFile))
+	if err != nil {
+		return fmt.Errorf("eventcrond (PID %d) is not responding: %v", pid, err)
+	}
+
+	if uptime != "" {
+		fmt.Printf("eventcrond is running (PID %d, uptime %s)\n", pid, uptime)
+	} else {
+		fmt.Printf("eventcrond is running (PID %d)\n", pid)
+	}
+	return nil
+}
+
+// queryUptime asks the daemon's control socket for its uptime. It returns an
+// empty uptime without error if the socket is disabled or can't be opened,
+// e.g. by users other than root when eventcrontab isn't setuid root, and an
+// error if the daemon doesn't answer. Only the uptime of the reply is used,
+// as every user may run --ping.
+func queryUptime(socketPath string) (string, error) {
+	if socketPath == "" {
+		return "", nil
+	}
+	conn, err := net.DialTimeout("unix", socketPath, pingTimeout)
+	if err != nil {
+		return "", nil
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pingTimeout))
+	if _, err := fmt.Fprintln(conn, "STATUS"); err != nil {
+		return "", fmt.Errorf("failed to query %s: %v", socketPath, err)
+	}
+
+	uptime := ""
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			return uptime, nil
+		}
+		if value, ok := strings.CutPrefix(line, "uptime: "); ok {
+			uptime = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read status from %s: %v", socketPath, err)
+	}
+	return "", fmt.Errorf("%s closed without a status reply", socketPath)
+}
+
+// daemonPid returns the PID of the daemon in the configured PID file after
+// checking that the process is alive
+func daemonPid() (int, error) {
+	pidFile := eventcron.PidFilePath(eventcron.DefaultConfigFile)
+	pid, err := readDaemonPid(pidFile)
+	if err != nil {
+		return 0, err
+	}
+
+	// Signal 0 only checks that the process exists. EPERM means it does but
+	// belongs to another user, as for a non-root caller.
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find process %d: %v", pid, err)
+	}
+	if err := process.Signal(syscall.Signal(0)); err != nil && !errors.Is(err, syscall.EPERM) {
+		if errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH) {
+			return 0, fmt.Errorf("eventcrond is not running (stale PID file %s)", pidFile)
+		}
+		return 0, fmt.Errorf("failed to check process %d: %v", pid, err)
+	}
+	return pid, nil
+}
+
+// readDaemonPid reads the daemon's PID from its PID file. The file must be
+// owned by root and not writable by others, as eventcrontab runs setuid root
+// and would otherwise signal whatever process a user writes into it.
+func readDaemonPid(pidFile string) (int, error) {
+	file, err := os.Open(pidFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("eventcrond does not appear to be running")
+			return 0, fmt.Errorf("eventcrond does not appear to be running (no PID file %s)", pidFile)
 		}
-		return fmt.Errorf("failed to read PID file: %v", err)
+		return 0, fmt.Errorf("failed to read PID file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read PID file: %v", err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return 0, fmt.Errorf("refusing to use PID file %s: it must be owned by root and not writable by others", pidFile)
+	}
+
+	pidBytes, err := io.ReadAll(io.LimitReader(file, 64))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read PID file: %v", err)
 	}
 
 	var pid int
 	if _, err := fmt.Sscanf(string(pidBytes), "%d", &pid); err != nil {
-		return fmt.Errorf("invalid PID in file: %v", err)
+		return 0, fmt.Errorf("invalid PID in file: %v", err)
 	}
 
-	// Send SIGHUP signal
-	process, err := os.FindProcess(pid)
+	return pid, nil
+}
+
+// signalDaemon sends sig to the running daemon and returns its PID. The PID
+// file is looked up in the daemon's config file, like eventcrond does.
+func signalDaemon(sig syscall.Signal) (int, error) {
+	pidFile := eventcron.PidFilePath(eventcron.DefaultConfigFile)
+	pid, err := readDaemonPid(pidFile)
 	if err != nil {
-		return fmt.Errorf("failed to find process %d: %v", pid, err)
+		return 0, err
 	}
 
-	if err := process.Signal(syscall.SIGHUP); err != nil {
-		return fmt.Errorf("failed to send SIGHUP to process %d: %v", pid, err)
+	if err := syscall.Kill(pid, sig); err != nil {
+		if err == syscall.ESRCH {
+			return 0, fmt.Errorf("eventcrond is not running (stale PID file %s)", pidFile)
+		}
+		return 0, fmt.Errorf("failed to send %v to process %d: %v", sig, pid, err)
 	}
 
-	return nil
+	return pid, nil
 }
\ No newline at end of file
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandLogLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "command log line",
+			line: `time=2026-10-14T08:00:00Z user="alice" path="/data/a b" event=IN_CLOSE_WRITE success=true exit=0 duration=1.5s command=9f86d081884c7d65`,
+			expected: map[string]string{
+				"time": "2026-10-14T08:00:00Z", "user": "alice", "path": "/data/a b", "event": "IN_CLOSE_WRITE",
+				"success": "true", "exit": "0", "duration": "1.5s", "command": "9f86d081884c7d65",
+			},
+		},
+		{
+			name:     "escaped quotes",
+			line:     `path="/data/\"x\" y" exit=2`,
+			expected: map[string]string{"path": `/data/"x" y`, "exit": "2"},
+		},
+		{
+			name:     "extra spaces",
+			line:     "  user=bob   exit=1 ",
+			expected: map[string]string{"user": "bob", "exit": "1"},
+		},
+		{
+			name:     "empty value",
+			line:     `path="" exit=`,
+			expected: map[string]string{"path": "", "exit": ""},
+		},
+		{name: "empty line", line: "", expected: map[string]string{}},
+		{name: "no key", line: "=value", wantErr: true},
+		{name: "no value", line: "user=bob stray", wantErr: true},
+		{name: "unterminated quote", line: `user="bob`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseCommandLogLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseCommandLogLine(%q) = %v, want an error", tt.line, fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCommandLogLine(%q) failed: %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(fields, tt.expected) {
+				t.Errorf("parseCommandLogLine(%q) = %v, want %v", tt.line, fields, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckCountFlags(t *testing.T) {
+	tests := []struct {
+		given   []string
+		args    int
+		wantErr string
+	}{
+		{[]string{"count"}, 0, ""},
+		{[]string{"l", "count"}, 0, ""},
+		{[]string{"count", "u"}, 0, ""},
+		{[]string{"count", "e"}, 0, "--count can't be combined with -e"},
+		{[]string{"count", "since"}, 0, "--count can't be combined with --since"},
+		{[]string{"count", "system"}, 0, "--count can't be combined with --system"},
+		{[]string{"count"}, 1, "--count doesn't take a file"},
+	}
+
+	for _, tt := range tests {
+		err := checkCountFlags(tt.given, tt.args)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("checkCountFlags(%v, %d) = %v", tt.given, tt.args, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("checkCountFlags(%v, %d) = %v, want %q", tt.given, tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package eventcron provides backup archives of all tables
+package eventcron
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directories of the table files inside an archive
+const (
+	archiveUserDir   = "users"
+	archiveSystemDir = "system"
+)
+
+// ExportTables writes every user and system table to w as a tar archive and
+// returns the number of tables written. The archive keeps each file's mode,
+// owner and modification time.
+func (tc *TableConfig) ExportTables(w io.Writer) (int, error) {
+	return tc.exportTables(w, tc.UserTableDir, tc.SystemTableDir)
+}
+
+// ImportTables installs the tables of an archive written by ExportTables and
+// returns the paths written. Every table is validated before any is written,
+// so an archive with an invalid table changes nothing. Tables of users that
+// don't exist on this machine are skipped with a warning. Only the
+// modification time is restored: user tables get UserTableMode and system
+// tables SystemTableMode and root as their owner, whatever the archive says.
+func (tc *TableConfig) ImportTables(r io.Reader) ([]string, error) {
+	return tc.importTables(r, tc.UserTableDir, tc.SystemTableDir)
+}
+
+// exportTables archives the tables found in userDir and systemDir. Every
+// table is loaded before any is written, so the archive isn't written at all
+// if one of them is invalid, rather than missing that table.
+func (tc *TableConfig) exportTables(w io.Writer, userDir, systemDir string) (int, error) {
+	groups := []struct {
+		dir   string
+		src   string
+		names []string
+	}{
+		{dir: archiveUserDir, src: userDir},
+		{dir: archiveSystemDir, src: systemDir},
+	}
+	for i := range groups {
+		names, err := tableFileNames(groups[i].src)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range names {
+			if _, err := tc.LoadTable(filepath.Join(groups[i].src, name)); err != nil {
+				return 0, fmt.Errorf("cannot export table %s: %v", name, err)
+			}
+		}
+		groups[i].names = names
+	}
+
+	tw := tar.NewWriter(w)
+	count := 0
+	for _, group := range groups {
+		for _, name := range group.names {
+			if err := addArchiveFile(tw, filepath.Join(group.src, name), path.Join(group.dir, name)); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return count, fmt.Errorf("failed to write archive: %v", err)
+	}
+	return count, nil
+}
+
+// tableFileNames returns the names of the table files in dir in order,
+// including tables of users that don't exist and tables without entries
+func tableFileNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table directory %s: %v", dir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), tableTmpPrefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// addArchiveFile writes the file at filePath to tw under name
+func addArchiveFile(tw *tar.Writer, filePath, name string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open table file %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat table file %s: %v", filePath, err)
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", filePath, err)
+	}
+	header.Name = name
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	if _, err := io.Copy(tw, file); err != nil {
+		return fmt.Errorf("failed to archive %s: %v", filePath, err)
+	}
+	return nil
+}
+
+// archivedTable is a table read from an archive, waiting to be installed
+type archivedTable struct {
+	table  *IncronTable
+	path   string
+	header *tar.Header
+	system bool // Installed as a system table
+}
+
+// importTables installs the tables of an archive into userDir and systemDir
+func (tc *TableConfig) importTables(r io.Reader, userDir, systemDir string) ([]string, error) {
+	var tables []archivedTable
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Only plain names directly inside the two directories are tables
+		dir, name := path.Split(header.Name)
+		if name == "" || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid table name in archive: %s", header.Name)
+		}
+		var tablePath string
+		switch path.Clean(dir) {
+		case archiveUserDir:
+			if _, err := user.Lookup(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping table %s: user %s not found: %v\n", header.Name, name, err)
+				continue
+			}
+			tablePath = filepath.Join(userDir, name)
+		case archiveSystemDir:
+			tablePath = filepath.Join(systemDir, name)
+		default:
+			return nil, fmt.Errorf("unexpected file in archive: %s", header.Name)
+		}
+
+		table, err := tc.LoadTableReader(tr, header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(dir) == archiveUserDir {
+			table.Username = name
+		}
+		if errors := tc.ValidateTable(table); len(errors) > 0 {
+			return nil, fmt.Errorf("invalid table %s: %v", header.Name, errors[0])
+		}
+		tables = append(tables, archivedTable{table: table, path: tablePath, header: header,
+			system: path.Clean(dir) == archiveSystemDir})
+	}
+
+	var written []string
+	for _, t := range tables {
+		mode := UserTableMode
+		if t.system {
+			mode = SystemTableMode
+		}
+		if err := SaveTable(t.table, t.path, mode); err != nil {
+			return written, err
+		}
+		written = append(written, t.path)
+
+		// System tables run their commands as root, so nobody else may own
+		// them, even if SaveTable kept the owner of a table it replaced
+		if t.system && os.Geteuid() == 0 {
+			if err := os.Lchown(t.path, 0, 0); err != nil {
+				return written, fmt.Errorf("failed to set owner of %s: %v", t.path, err)
+			}
+		}
+		if err := os.Chtimes(t.path, t.header.ModTime, t.header.ModTime); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to set modification time of %s: %v\n", t.path, err)
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,157 @@
+package eventcron
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExportImportTables(t *testing.T) {
+	tc := DefaultTableConfig()
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+
+	userDir, systemDir := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(userDir, current.Username): "# uploads\n/srv/in IN_CLOSE_WRITE echo $#\n",
+		filepath.Join(systemDir, "backup"):       "/etc IN_MODIFY,recursive=false sync\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	count, err := tc.exportTables(&archive, userDir, systemDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("exportTables() wrote %d tables, want 2", count)
+	}
+
+	newUserDir, newSystemDir := t.TempDir(), t.TempDir()
+	written, err := tc.importTables(bytes.NewReader(archive.Bytes()), newUserDir, newSystemDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 {
+		t.Errorf("importTables() wrote %v, want 2 tables", written)
+	}
+
+	restoredDirs := map[string]string{userDir: newUserDir, systemDir: newSystemDir}
+	for path, content := range files {
+		restored := filepath.Join(restoredDirs[filepath.Dir(path)], filepath.Base(path))
+		data, err := os.ReadFile(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", restored, data, content)
+		}
+		info, err := os.Stat(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := UserTableMode
+		if filepath.Dir(path) == systemDir {
+			want = SystemTableMode
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s has mode %v, want %v", restored, info.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestExportTablesInvalid(t *testing.T) {
+	tc := DefaultTableConfig()
+	userDir, systemDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(userDir, "eventcron-no-such-user"), []byte("# nothing yet\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if count, err := tc.exportTables(&archive, userDir, systemDir); err != nil || count != 1 {
+		t.Errorf("exportTables() = %d, %v, want the table without entries of a missing user", count, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(systemDir, "broken"), []byte("/tmp IN_NOPE true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive.Reset()
+	if _, err := tc.exportTables(&archive, userDir, systemDir); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("exportTables() error = %v, want the invalid table named", err)
+	}
+	if archive.Len() != 0 {
+		t.Errorf("exportTables() wrote %d bytes despite an invalid table", archive.Len())
+	}
+}
+
+func TestImportTablesIgnoresArchivedOwner(t *testing.T) {
+	tc := DefaultTableConfig()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to set the owner of imported tables")
+	}
+
+	content := "/etc IN_MODIFY,recursive=false sync\n"
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "system/backup", Mode: 04777, Uid: 65534, Gid: 65534,
+		Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write([]byte(content))
+	tw.Close()
+
+	systemDir := t.TempDir()
+	if _, err := tc.importTables(&archive, t.TempDir(), systemDir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(systemDir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != SystemTableMode {
+		t.Errorf("imported system table has mode %v, want %v", info.Mode(), SystemTableMode)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 0 || stat.Gid != 0 {
+		t.Errorf("imported system table is owned by %d:%d, want root", stat.Uid, stat.Gid)
+	}
+}
+
+func TestImportTablesRejects(t *testing.T) {
+	tc := DefaultTableConfig()
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"invalid table", "system/backup", "relative/path IN_CREATE echo\n"},
+		{"unexpected directory", "etc/passwd", "/tmp IN_CREATE echo\n"},
+		{"path traversal", "system/../../etc/cron", "/tmp IN_CREATE echo\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			tw := tar.NewWriter(&archive)
+			tw.WriteHeader(&tar.Header{Name: tt.file, Mode: 0600, Size: int64(len(tt.content)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(tt.content))
+			tw.Close()
+
+			userDir, systemDir := t.TempDir(), t.TempDir()
+			written, err := tc.importTables(&archive, userDir, systemDir)
+			if err == nil {
+				t.Fatalf("importTables() accepted the archive and wrote %v", written)
+			}
+			if entries, _ := os.ReadDir(systemDir); len(entries) != 0 {
+				t.Errorf("importTables() wrote %d files despite the error", len(entries))
+			}
+		})
+	}
+}
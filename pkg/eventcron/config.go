@@ -0,0 +1,123 @@
+// Package eventcron provides access to the daemon configuration file
+package eventcron
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ReadConfigValue returns the value of key in the daemon configuration file
+// at path, which holds "key = value" lines. The boolean is false if the file
+// doesn't exist or doesn't set key.
+func ReadConfigValue(path, key string) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to open config file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	value, found := "", false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+			// Like the daemon, the last setting wins
+			value, found = strings.TrimSpace(parts[1]), true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", false, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	return value, found, nil
+}
+
+// PidFilePath returns the daemon's PID file as set by pid_file in the
+// configuration file at configFile, or DefaultPidFile
+func PidFilePath(configFile string) string {
+	if value, found, err := ReadConfigValue(configFile, "pid_file"); err == nil && found && value != "" {
+		return value
+	}
+	return DefaultPidFile
+}
+
+// MaxEntriesSetting returns max_entries_per_table from the configuration
+// file at configFile, or DefaultMaxEntriesPerTable if it isn't set or valid
+func MaxEntriesSetting(configFile string) int {
+	if value, found, err := ReadConfigValue(configFile, "max_entries_per_table"); err == nil && found {
+		if max, err := strconv.Atoi(value); err == nil && max >= 0 {
+			return max
+		}
+	}
+	return DefaultMaxEntriesPerTable
+}
+
+// MaxLineLengthSetting returns max_line_length from the configuration file at
+// configFile, or DefaultMaxLineLength if it isn't set or valid
+func MaxLineLengthSetting(configFile string) int {
+	if value, found, err := ReadConfigValue(configFile, "max_line_length"); err == nil && found {
+		if max, err := strconv.Atoi(value); err == nil && max > 0 {
+			return max
+		}
+	}
+	return DefaultMaxLineLength
+}
+
+// EventMasksSetting returns the extra mask names of event_masks in the
+// configuration file at configFile, see ParseEventMasks, or nil if it isn't
+// set or valid
+func EventMasksSetting(configFile string) map[string]uint32 {
+	if value, found, err := ReadConfigValue(configFile, "event_masks"); err == nil && found {
+		if masks, err := ParseEventMasks(value); err == nil {
+			return masks
+		}
+	}
+	return nil
+}
+
+// TableDirSettings returns the user and system table directories as set by
+// user_table_dir and system_table_dir in the configuration file at
+// configFile, or DefaultUserTableDir and DefaultSystemTableDir. Relative
+// paths are ignored.
+func TableDirSettings(configFile string) (userDir, systemDir string) {
+	userDir, systemDir = DefaultUserTableDir, DefaultSystemTableDir
+	if value, found, err := ReadConfigValue(configFile, "user_table_dir"); err == nil && found && filepath.IsAbs(value) {
+		userDir = value
+	}
+	if value, found, err := ReadConfigValue(configFile, "system_table_dir"); err == nil && found && filepath.IsAbs(value) {
+		systemDir = value
+	}
+	return userDir, systemDir
+}
+
+// ControlSocketPath returns the daemon's control socket as set by
+// control_socket in the configuration file at configFile, or
+// DefaultControlSocket. It is empty if the socket is disabled.
+func ControlSocketPath(configFile string) string {
+	if value, found, err := ReadConfigValue(configFile, "control_socket"); err == nil && found {
+		return value
+	}
+	return DefaultControlSocket
+}
+
+// CommandLogPath returns the command log as set by command_log in the
+// configuration file at configFile. It is empty if the log is disabled.
+func CommandLogPath(configFile string) string {
+	if value, found, err := ReadConfigValue(configFile, "command_log"); err == nil && found {
+		return value
+	}
+	return ""
+}
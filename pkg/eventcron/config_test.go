@@ -0,0 +1,216 @@
+package eventcron
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPidFilePath(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"no config file", "", DefaultPidFile},
+		{"not set", "# pid_file = /run/other.pid\nlog_level = info\n", DefaultPidFile},
+		{"set", "log_level = info\npid_file = /run/eventcrond.pid\n", "/run/eventcrond.pid"},
+		{"last setting wins", "pid_file = /run/a.pid\npid_file=/run/b.pid\n", "/run/b.pid"},
+		{"empty value", "pid_file =\n", DefaultPidFile},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := PidFilePath(path); got != tt.expected {
+				t.Errorf("PidFilePath() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExampleConfigPidFile(t *testing.T) {
+	// The example documents the commented-out default, which must be the
+	// path eventcrond and eventcrontab actually use
+	data, err := os.ReadFile(filepath.Join("..", "..", "examples", "eventcron.conf.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#pid_file = " + DefaultPidFile + "\n"; !strings.Contains(string(data), want) {
+		t.Errorf("example config does not document %q", strings.TrimSpace(want))
+	}
+}
+
+func TestControlSocketPath(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"no config file", "", DefaultControlSocket},
+		{"not set", "log_level = info\n", DefaultControlSocket},
+		{"set", "control_socket = /run/other.sock\n", "/run/other.sock"},
+		{"disabled", "control_socket =\n", ""},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := ControlSocketPath(path); got != tt.expected {
+				t.Errorf("ControlSocketPath() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCommandLogPath(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"no config file", "", ""},
+		{"not set", "log_level = info\n", ""},
+		{"set", "command_log = /var/log/eventcron/commands.log\n", "/var/log/eventcron/commands.log"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := CommandLogPath(path); got != tt.expected {
+				t.Errorf("CommandLogPath() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMaxEntriesSetting(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected int
+	}{
+		{"not set", "log_level = info\n", DefaultMaxEntriesPerTable},
+		{"set", "max_entries_per_table = 50\n", 50},
+		{"unlimited", "max_entries_per_table = 0\n", 0},
+		{"invalid", "max_entries_per_table = lots\n", DefaultMaxEntriesPerTable},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := MaxEntriesSetting(path); got != tt.expected {
+				t.Errorf("MaxEntriesSetting() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTableDirSettings(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name      string
+		content   string
+		userDir   string
+		systemDir string
+	}{
+		{"not set", "log_level = info\n", DefaultUserTableDir, DefaultSystemTableDir},
+		{"set", "user_table_dir = /srv/spool\nsystem_table_dir = /srv/tables\n", "/srv/spool", "/srv/tables"},
+		{"relative", "user_table_dir = spool\n", DefaultUserTableDir, DefaultSystemTableDir},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			userDir, systemDir := TableDirSettings(path)
+			if userDir != tt.userDir || systemDir != tt.systemDir {
+				t.Errorf("TableDirSettings() = %q, %q, want %q, %q", userDir, systemDir, tt.userDir, tt.systemDir)
+			}
+		})
+	}
+}
+
+func TestMaxLineLengthSetting(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected int
+	}{
+		{"not set", "log_level = info\n", DefaultMaxLineLength},
+		{"set", "max_line_length = 4194304\n", 4194304},
+		{"zero", "max_line_length = 0\n", DefaultMaxLineLength},
+		{"invalid", "max_line_length = long\n", DefaultMaxLineLength},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := MaxLineLengthSetting(path); got != tt.expected {
+				t.Errorf("MaxLineLengthSetting() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEventMasksSetting(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string]uint32
+	}{
+		{"not set", "log_level = info\n", nil},
+		{"set", "event_masks = IN_MASK_CREATE=0x10000000\n", map[string]uint32{"IN_MASK_CREATE": 0x10000000}},
+		{"invalid", "event_masks = IN_MASK_CREATE\n", nil},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eventcron.conf"+string(rune('a'+i)))
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := EventMasksSetting(path); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("EventMasksSetting() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
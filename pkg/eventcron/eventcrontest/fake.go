@@ -0,0 +1,64 @@
+// Package eventcrontest provides helpers for testing code that consumes
+// eventcron events without a kernel inotify instance
+package eventcrontest
+
+import (
+	"path/filepath"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+// FakeWatcher is an eventcron.EventSource whose events are supplied by a test
+type FakeWatcher struct {
+	events chan *eventcron.InotifyEvent
+	errors chan error
+}
+
+var _ eventcron.EventSource = (*FakeWatcher)(nil)
+
+// NewFakeWatcher creates a FakeWatcher that buffers up to
+// eventcron.DefaultEventBufferSize events
+func NewFakeWatcher() *FakeWatcher {
+	return &FakeWatcher{
+		events: make(chan *eventcron.InotifyEvent, eventcron.DefaultEventBufferSize),
+		errors: make(chan error, 10),
+	}
+}
+
+// Events returns the event channel
+func (f *FakeWatcher) Events() <-chan *eventcron.InotifyEvent {
+	return f.events
+}
+
+// Errors returns the error channel
+func (f *FakeWatcher) Errors() <-chan error {
+	return f.errors
+}
+
+// Send delivers event, waiting while the buffer is full
+func (f *FakeWatcher) Send(event *eventcron.InotifyEvent) {
+	f.events <- event
+}
+
+// SendEvent delivers an event for name inside the watched directory dir, as
+// a Watcher would report it, and returns it. An empty name reports the event
+// on dir itself.
+func (f *FakeWatcher) SendEvent(dir, name string, mask uint32) *eventcron.InotifyEvent {
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	event := &eventcron.InotifyEvent{
+		Path:     path,
+		Name:     name,
+		Mask:     mask,
+		WatchDir: dir,
+	}
+	f.Send(event)
+	return event
+}
+
+// SendError delivers err on the error channel, waiting while it is full
+func (f *FakeWatcher) SendError(err error) {
+	f.errors <- err
+}
@@ -0,0 +1,48 @@
+package eventcrontest
+
+import (
+	"testing"
+
+	"github.com/dpvpro/eventcron/pkg/eventcron"
+)
+
+func TestFakeWatcher(t *testing.T) {
+	var source eventcron.EventSource = NewFakeWatcher()
+	fake := source.(*FakeWatcher)
+
+	entry, err := eventcron.ParseEntry("/data IN_CLOSE_WRITE,include=*.csv import $@/$#", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		file    string
+		mask    uint32
+		matches bool
+	}{
+		{"matching file", "/data", "report.csv", eventcron.InCloseWrite, true},
+		{"excluded name", "/data", "report.txt", eventcron.InCloseWrite, false},
+		{"other event", "/data", "report.csv", eventcron.InCreate, false},
+		{"other directory", "/srv", "report.csv", eventcron.InCloseWrite, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := fake.SendEvent(tt.dir, tt.file, tt.mask)
+			event := <-source.Events()
+			if event != sent {
+				t.Fatalf("Events() returned %v, want %v", event, sent)
+			}
+			if got := entry.MatchesEvent(event); got != tt.matches {
+				t.Errorf("MatchesEvent(%v) = %v, want %v", event, got, tt.matches)
+			}
+		})
+	}
+
+	fake.SendError(eventcron.ErrQueueOverflow)
+	if err := <-source.Errors(); err != eventcron.ErrQueueOverflow {
+		t.Errorf("Errors() returned %v, want %v", err, eventcron.ErrQueueOverflow)
+	}
+}
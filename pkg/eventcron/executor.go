@@ -2,11 +2,14 @@
 package eventcron
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,13 +17,50 @@ import (
 	"time"
 )
 
+// defaultShell runs commands of entries with shell=true
+const defaultShell = "/bin/sh"
+
+// commandWaitDelay is how long a command's output is still collected after
+// it was killed or exited, before pipes held open by processes that left its
+// process group are closed
+const commandWaitDelay = 5 * time.Second
+
+// ErrMaxConcurrent is returned by Execute when the global or per-user limit
+// of concurrently running commands is reached
+var ErrMaxConcurrent = errors.New("maximum concurrent commands reached")
+
+// ErrQueueFull is returned by Execute when no command slot is free and the
+// queue of commands waiting for one is full
+var ErrQueueFull = errors.New("command queue is full")
+
 // CommandExecutor executes commands for eventcron entries
 type CommandExecutor struct {
 	runningCommands map[string]*RunningCommand // Key: command ID
 	mu              sync.RWMutex               // Mutex for thread safety
 	maxConcurrent   int                        // Maximum concurrent commands
 	currentCount    int                        // Current running command count
+	maxPerUser      int                        // Maximum concurrent commands per user, 0 for no limit
+	userCounts      map[string]int             // Running command count per user
 	timeout         time.Duration              // Command timeout
+	limiter         rateLimiter                // Commands-per-second limit
+	pending         int                        // Commands in Execute until they finish
+	allDone         chan struct{}              // Closed and replaced whenever pending drops to zero
+	spool           *Spool                     // Journal of unfinished commands, nil if disabled
+	maxOutput       int                        // Output kept per command before it is killed, 0 for no limit
+	outputRetention int                        // Output files kept per entry with output_dir=, 0 keeps all
+	onStart         func(*RunningCommand)      // Called whenever a command was started, nil for none
+	queueSize       int                        // Commands that may wait for a free slot, 0 disables queuing
+	queueMaxAge     time.Duration              // Longest wait for a slot, 0 for no limit
+	waiters         []*slotWaiter              // Commands waiting for a slot, longest waiting first
+	droppedFull     uint64                     // Commands refused because the queue was full
+	droppedExpired  uint64                     // Commands that waited longer than queueMaxAge
+}
+
+// slotWaiter is a command waiting in the queue for a free slot
+type slotWaiter struct {
+	username string
+	ready    chan struct{} // Closed once the waiter got a slot or was cancelled
+	granted  bool          // The waiter got a slot
 }
 
 // RunningCommand represents a currently executing command
@@ -28,40 +68,126 @@ type RunningCommand struct {
 	ID        string          // Unique identifier
 	Entry     *IncronEntry    // Associated eventcron entry
 	Event     *InotifyEvent   // Event that triggered the command
-	Cmd       *exec.Cmd       // The actual command
+	Cmd       *exec.Cmd       // The actual command, leading its own process group
 	Username  string          // User to run the command as
 	StartTime time.Time       // When the command started
 	Context   context.Context // Context for cancellation
 	Cancel    context.CancelFunc
+	stopped   context.Context // Done once the command was killed, ending retries
+	stop      context.CancelFunc
+	done      chan struct{} // Closed once the command and its retries finished
+	process   *os.Process   // Process of Cmd once it started, nil before
+	restarted bool          // Killed to make way for a new event (restart=true)
+	followUp  bool          // Runs the onsuccess= or onfailure= command of Entry
 }
 
 // ExecutionResult represents the result of command execution
 type ExecutionResult struct {
-	ID       string
-	Success  bool
-	ExitCode int
-	Output   []byte
-	Error    error
-	Duration time.Duration
+	ID         string
+	Success    bool
+	ExitCode   int
+	Output     []byte
+	Error      error
+	Duration   time.Duration
+	Attempts   int    // Number of times the command was run, including retries
+	Truncated  bool   // Output hit the limit and the command was killed
+	OutputFile string // File the output was written to (output_dir=), empty if it was kept in Output
+	Restarted  bool   // Killed because a new event restarted the entry's command
+	FollowUp   *ExecutionResult // Result of the onsuccess= or onfailure= command, nil if none ran
 }
 
 // NewCommandExecutor creates a new command executor
 func NewCommandExecutor(maxConcurrent int, timeout time.Duration) *CommandExecutor {
 	return &CommandExecutor{
 		runningCommands: make(map[string]*RunningCommand),
+		userCounts:      make(map[string]int),
 		maxConcurrent:   maxConcurrent,
 		timeout:         timeout,
+		outputRetention: DefaultOutputRetention,
+		allDone:         make(chan struct{}),
 	}
 }
 
 // Execute executes a command for the given entry and event
 func (ce *CommandExecutor) Execute(entry *IncronEntry, event *InotifyEvent, username string) (*ExecutionResult, error) {
+	return ce.ExecuteSpooled(entry, event, username, "")
+}
+
+// ExecuteSpooled is Execute for a command replayed from the spool under the
+// record spoolID. The record stays until the command finished instead of
+// being journaled anew, so a crash in between replays it again. An empty
+// spoolID journals the command like Execute.
+func (ce *CommandExecutor) ExecuteSpooled(entry *IncronEntry, event *InotifyEvent, username, spoolID string) (*ExecutionResult, error) {
+	// WaitForAllCommands also waits for commands that are still settling,
+	// waiting for a rate limit token or queued
 	ce.mu.Lock()
-	defer ce.mu.Unlock()
+	ce.pending++
+	spool := ce.spool
+	ce.mu.Unlock()
+	defer ce.finishPending()
 
-	// Check if we've reached the maximum concurrent commands
-	if ce.currentCount >= ce.maxConcurrent {
-		return nil, fmt.Errorf("maximum concurrent commands (%d) reached", ce.maxConcurrent)
+	// Journal the command so it can be replayed if the daemon stops first
+	if spool != nil {
+		var err error
+		if spoolID == "" {
+			spoolID, err = spool.add(entry, event, username)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		} else {
+			defer spool.Remove(spoolID)
+		}
+	}
+
+	// Wait for files that are still being written before doing anything else
+	if entry.Options.Settle > 0 && event.Mask&(InCreate|InMovedTo) != 0 {
+		if err := waitForSettle(event.Path, entry.Options.Settle); err != nil {
+			return nil, err
+		}
+	}
+
+	return ce.execute(entry, event, username, false)
+}
+
+// execute runs the command of entry for event once the rate limit and the
+// concurrency limits allow it, retrying it as configured. The onsuccess= or
+// onfailure= command runs afterwards the same way with followUp set.
+func (ce *CommandExecutor) execute(entry *IncronEntry, event *InotifyEvent, username string, followUp bool) (*ExecutionResult, error) {
+	// Respect the command rate limit, which may wait for a token
+	if err := ce.limiter.acquire(); err != nil {
+		return nil, err
+	}
+
+	ce.mu.Lock()
+
+	for {
+		// Replace the entry's running command rather than running next to it
+		for entry.Options.Restart {
+			previous := ce.runningFor(entry, username)
+			if previous == nil {
+				break
+			}
+			previous.restarted = true
+			ce.mu.Unlock()
+			ce.KillCommand(previous.ID)
+			<-previous.done
+			ce.mu.Lock()
+		}
+
+		// Wait in the queue while the global or per-user limit is reached
+		if err := ce.waitForSlot(entry, username); err != nil {
+			ce.mu.Unlock()
+			return nil, err
+		}
+
+		// Another event of the entry may have started its command while
+		// this one waited in the queue. The command is registered below
+		// without letting go of the lock, so once none runs, only this one
+		// does.
+		if !entry.Options.Restart || ce.runningFor(entry, username) == nil {
+			break
+		}
+		ce.releaseSlot(username)
 	}
 
 	// Generate unique ID for this command
@@ -72,33 +198,30 @@ func (ce *CommandExecutor) Execute(entry *IncronEntry, event *InotifyEvent, user
 		// Check if a command is already running for this path
 		for _, runningCmd := range ce.runningCommands {
 			if runningCmd.Entry.Path == entry.Path && runningCmd.Username == username {
+				ce.releaseSlot(username)
+				ce.mu.Unlock()
 				return nil, fmt.Errorf("command already running for path %s (loop prevention)", entry.Path)
 			}
 		}
 	}
 
-	// Expand the command with wildcards
-	expandedCmd := entry.ExpandCommand(event.WatchDir, event.Name, event.Mask)
-
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), ce.timeout)
+	// Create context with timeout, preferring the entry's own timeout if set
+	timeout := ce.timeout
+	if entry.Options.Timeout > 0 {
+		timeout = entry.Options.Timeout
+	}
+	stopped, stop := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(stopped, timeout)
 
-	// Parse command and arguments
-	cmdParts := parseCommand(expandedCmd)
-	if len(cmdParts) == 0 {
+	cmd, err := ce.newCommand(ctx, entry, event, username)
+	if err != nil {
 		cancel()
-		return nil, fmt.Errorf("empty command")
+		stop()
+		ce.releaseSlot(username)
+		ce.mu.Unlock()
+		return nil, err
 	}
 
-	// Create the command
-	cmd := exec.CommandContext(ctx, cmdParts[0], cmdParts[1:]...)
-
-	// Set environment variables
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_PATH=%s", event.Path))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_NAME=%s", event.Name))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_EVENT=%s", maskToString(event.Mask)))
-
 	// Create running command info
 	runningCmd := &RunningCommand{
 		ID:        id,
@@ -109,51 +232,425 @@ func (ce *CommandExecutor) Execute(entry *IncronEntry, event *InotifyEvent, user
 		StartTime: time.Now(),
 		Context:   ctx,
 		Cancel:    cancel,
+		stopped:   stopped,
+		stop:      stop,
+		done:      make(chan struct{}),
+		followUp:  followUp,
 	}
 
-	// Set up credential for running as specific user
-	if username != "root" && username != "" {
-		if err := ce.setupUserCredentials(cmd, username); err != nil {
+	// Store the running command
+	ce.runningCommands[id] = runningCmd
+	ce.mu.Unlock()
+	defer stop()
+
+	result := ce.run(runningCmd)
+
+	// Retry failed commands with exponential backoff, unless killed. The
+	// slot is given up while waiting and queued for again afterwards.
+	delay := entry.Options.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	holding := true
+	for attempt := 1; !result.Success && attempt <= entry.Options.Retries; attempt++ {
+		ce.mu.Lock()
+		ce.releaseSlot(username)
+		holding = false
+		ce.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-stopped.Done():
+		}
+		if stopped.Err() != nil {
+			break
+		}
+		delay *= 2
+
+		ce.mu.Lock()
+		if err := ce.waitForSlot(entry, username); err != nil {
+			ce.mu.Unlock()
+			result.Error = fmt.Errorf("retry: %w", err)
+			break
+		}
+		holding = true
+		ce.mu.Unlock()
+		if stopped.Err() != nil {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(stopped, timeout)
+		cmd, err := ce.newCommand(ctx, entry, event, username)
+		if err != nil {
 			cancel()
-			return nil, fmt.Errorf("failed to setup user credentials: %v", err)
+			result.Error = err
+			break
 		}
-	}
 
-	// Store the running command
-	ce.runningCommands[id] = runningCmd
-	ce.currentCount++
+		ce.mu.Lock()
+		runningCmd.Cmd = cmd
+		runningCmd.process = nil
+		runningCmd.Context = ctx
+		runningCmd.Cancel = cancel
+		ce.mu.Unlock()
 
-	// Start the command in a goroutine
-	resultChan := make(chan *ExecutionResult, 1)
-	go ce.runCommand(runningCmd, resultChan)
+		attempts := result.Attempts
+		result = ce.run(runningCmd)
+		result.Attempts = attempts + 1
+	}
 
-	// Wait for result or return immediately based on configuration
-	// For now, we'll wait for the result
-	result := <-resultChan
+	killed := stopped.Err() != nil
 
 	// Clean up
 	ce.mu.Lock()
 	delete(ce.runningCommands, id)
-	ce.currentCount--
+	if holding {
+		ce.releaseSlot(username)
+	}
+	result.Restarted = runningCmd.restarted
+	close(runningCmd.done)
 	ce.mu.Unlock()
 
+	// Run the onsuccess= or onfailure= command, unless the command was
+	// killed
+	if command := entry.FollowUp(result.Success); command != "" && !followUp && !killed {
+		result.FollowUp = ce.runFollowUp(entry, event, username, command)
+	}
+
 	return result, nil
 }
 
+// runFollowUp runs command for event after the command of entry finished.
+// It runs like the entry's own command, as the same user and with the same
+// timeout and options, and waits for the rate limit and a free slot of its
+// own. It is neither retried nor replaced by restart=true.
+func (ce *CommandExecutor) runFollowUp(entry *IncronEntry, event *InotifyEvent, username, command string) *ExecutionResult {
+	followUp := *entry
+	followUp.Command = command
+	followUp.Options.Retries = 0
+	followUp.Options.Restart = false
+	followUp.Options.NoLoop = false
+
+	result, err := ce.execute(&followUp, event, username, true)
+	if err != nil {
+		return &ExecutionResult{Error: err}
+	}
+	return result
+}
+
+// runningFor returns a running command of entry for username, or nil, not
+// counting follow-up commands. The daemon hands every run its own copy of
+// the entry, so entries are told apart by their table and line rather than
+// by pointer (internal, assumes lock held).
+func (ce *CommandExecutor) runningFor(entry *IncronEntry, username string) *RunningCommand {
+	for _, runningCmd := range ce.runningCommands {
+		if !runningCmd.followUp && sameEntry(runningCmd.Entry, entry) && runningCmd.Username == username {
+			return runningCmd
+		}
+	}
+	return nil
+}
+
+// sameEntry reports whether a and b are the same table entry, possibly
+// copied
+func sameEntry(a, b *IncronEntry) bool {
+	return a.Owner == b.Owner && a.LineNumber == b.LineNumber && a.Path == b.Path
+}
+
+// slotError returns the error for a command of username that can't start
+// because of the concurrency limits, or nil if it can (internal, assumes lock
+// held)
+func (ce *CommandExecutor) slotError(username string) error {
+	// Check if we've reached the maximum concurrent commands
+	if ce.currentCount >= ce.maxConcurrent {
+		return fmt.Errorf("%w (%d)", ErrMaxConcurrent, ce.maxConcurrent)
+	}
+
+	// Keep one user from taking all the slots
+	if ce.maxPerUser > 0 && ce.userCounts[username] >= ce.maxPerUser {
+		return fmt.Errorf("%w for user %s (%d)", ErrMaxConcurrent, username, ce.maxPerUser)
+	}
+
+	return nil
+}
+
+// waitForSlot takes a slot for a command of username. Without a free slot
+// the command waits in the queue, if it has room, until it is the longest
+// waiting command that may start or the queue's maximum age has passed;
+// KillAllCommands cancels it (internal, called and returns with the lock
+// held)
+func (ce *CommandExecutor) waitForSlot(entry *IncronEntry, username string) error {
+	err := ce.slotError(username)
+	if err == nil {
+		ce.takeSlot(username)
+		return nil
+	}
+	if ce.queueSize == 0 {
+		return err
+	}
+	if len(ce.waiters) >= ce.queueSize {
+		ce.droppedFull++
+		return fmt.Errorf("%w (%d commands waiting): %v", ErrQueueFull, len(ce.waiters), err)
+	}
+
+	waiter := &slotWaiter{username: username, ready: make(chan struct{})}
+	ce.waiters = append(ce.waiters, waiter)
+
+	var expired <-chan time.Time
+	if ce.queueMaxAge > 0 {
+		timer := time.NewTimer(ce.queueMaxAge)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	ce.mu.Unlock()
+	select {
+	case <-waiter.ready:
+	case <-expired:
+	}
+	ce.mu.Lock()
+
+	// The slot may have been handed over just as the maximum age passed
+	select {
+	case <-waiter.ready:
+		if !waiter.granted {
+			return fmt.Errorf("command for %s cancelled while queued", entry.Path)
+		}
+		return nil
+	default:
+	}
+	ce.waiters = slices.DeleteFunc(ce.waiters, func(w *slotWaiter) bool { return w == waiter })
+	ce.droppedExpired++
+	return fmt.Errorf("%w after waiting %v in the queue", ce.slotError(username), ce.queueMaxAge)
+}
+
+// takeSlot counts a command of username as running (internal, assumes lock
+// held)
+func (ce *CommandExecutor) takeSlot(username string) {
+	ce.currentCount++
+	ce.userCounts[username]++
+}
+
+// releaseSlot frees the slot of a command of username and hands it to the
+// queue (internal, assumes lock held)
+func (ce *CommandExecutor) releaseSlot(username string) {
+	ce.currentCount--
+	if ce.userCounts[username]--; ce.userCounts[username] == 0 {
+		delete(ce.userCounts, username)
+	}
+	ce.grantSlots()
+}
+
+// grantSlots hands free slots to queued commands in the order they were
+// queued. A command of a user at the per-user limit keeps its place while
+// later commands of other users go ahead (internal, assumes lock held).
+func (ce *CommandExecutor) grantSlots() {
+	waiters := ce.waiters[:0]
+	for _, waiter := range ce.waiters {
+		if ce.slotError(waiter.username) != nil {
+			waiters = append(waiters, waiter)
+			continue
+		}
+		ce.takeSlot(waiter.username)
+		waiter.granted = true
+		close(waiter.ready)
+	}
+	clear(ce.waiters[len(waiters):])
+	ce.waiters = waiters
+}
+
+// newCommand creates the command for an entry and event, either run directly
+// or through the shell (internal, assumes lock held)
+func (ce *CommandExecutor) newCommand(ctx context.Context, entry *IncronEntry, event *InotifyEvent, username string) (*exec.Cmd, error) {
+	cmd, err := buildCommand(ctx, entry, event)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set environment variables
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_PATH=%s", event.Path))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_NAME=%s", event.Name))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_EVENT=%s", maskToString(event.Mask)))
+	if event.OldPath != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_OLD_PATH=%s", event.OldPath))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("EVENTCRON_NEW_PATH=%s", event.NewPath))
+	}
+	for key, value := range entry.Options.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	// Set up credential for running as specific user
+	if username != "root" && username != "" {
+		if err := ce.setupUserCredentials(cmd, username); err != nil {
+			return nil, fmt.Errorf("failed to setup user credentials: %v", err)
+		}
+	}
+
+	// The entry's working directory overrides the user's home
+	if entry.Options.Dir != "" {
+		cmd.Dir = entry.Options.Dir
+	}
+
+	// Run the command in a process group of its own, so a timeout or kill
+	// also ends the processes it started
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd.Process)
+	}
+	cmd.WaitDelay = commandWaitDelay
+
+	return cmd, nil
+}
+
+// killProcessGroup kills the process group led by process
+func killProcessGroup(process *os.Process) error {
+	err := syscall.Kill(-process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// run runs a single attempt of the command and waits for its result
+func (ce *CommandExecutor) run(runningCmd *RunningCommand) *ExecutionResult {
+	ce.mu.RLock()
+	attempt := *runningCmd
+	ce.mu.RUnlock()
+
+	resultChan := make(chan *ExecutionResult, 1)
+	go ce.runCommand(&attempt, resultChan)
+	result := <-resultChan
+	result.Attempts = 1
+	return result
+}
+
+// waitForSettle blocks until the file at path has stopped changing in size
+// and modification time for the given quiet period
+func waitForSettle(path string, quiet time.Duration) error {
+	last, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s while waiting for it to settle: %v", path, err)
+	}
+
+	for {
+		time.Sleep(quiet)
+
+		current, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("cannot stat %s while waiting for it to settle: %v", path, err)
+		}
+
+		if current.Size() == last.Size() && current.ModTime().Equal(last.ModTime()) {
+			return nil
+		}
+		last = current
+	}
+}
+
 // runCommand runs the command and sends the result to the channel
 func (ce *CommandExecutor) runCommand(runningCmd *RunningCommand, resultChan chan<- *ExecutionResult) {
 	defer runningCmd.Cancel()
 
+	// Output over the limit kills the command's whole process group, so
+	// that children writing to the same pipe stop as well
+	cmd := runningCmd.Cmd
+	onLimit := func() {
+		if cmd.Process != nil {
+			killProcessGroup(cmd.Process)
+		}
+		runningCmd.Cancel()
+	}
+
+	ce.mu.RLock()
+	output := &outputBuffer{limit: ce.maxOutput, onLimit: onLimit}
+	retention := ce.outputRetention
+	onStart := ce.onStart
+	ce.mu.RUnlock()
+
 	startTime := time.Now()
-	
-	// Start the command
-	output, err := runningCmd.Cmd.CombinedOutput()
+
+	var cred *syscall.Credential
+	if runningCmd.Cmd.SysProcAttr != nil {
+		cred = runningCmd.Cmd.SysProcAttr.Credential
+	}
+
+	// With output_dir= the output goes to a file of its own; if that can't
+	// be created it is collected in memory as usual
+	var outputDir *os.File
+	if runningCmd.Entry.Options.OutputDir != "" {
+		dir, err := openOutputDir(runningCmd.Entry, cred)
+		var file *os.File
+		if err == nil {
+			defer dir.Close()
+			file, err = openOutputFile(dir, runningCmd.Entry, cred, startTime)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		} else {
+			output.file = file
+			outputDir = dir
+		}
+	}
+
+	// With systemd_scope= the command runs in a scope of its own, or
+	// directly where systemd isn't available. A command that can't be
+	// found is left to fail as usual.
+	// A command whose user can't be passed on to the scope fails rather
+	// than running with other credentials.
+	var err error
+	if runningCmd.Entry.Options.SystemdScope && runningCmd.Cmd.Err == nil {
+		if path, lookErr := systemdRun(); lookErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot use systemd_scope, running %s directly: %v\n", runningCmd.Cmd.Path, lookErr)
+		} else {
+			err = wrapInScope(runningCmd.Cmd, path)
+		}
+	}
+
+	// Start the command, collecting stdout and stderr together
+	runningCmd.Cmd.Stdout = output
+	runningCmd.Cmd.Stderr = output
+	if err == nil {
+		err = runningCmd.Cmd.Start()
+	}
+	if err == nil {
+		ce.mu.Lock()
+		runningCmd.process = runningCmd.Cmd.Process
+		ce.mu.Unlock()
+
+		// There is no hook between fork and exec, so the priority is set
+		// right after the command started
+		if err := setPriority(runningCmd.Cmd.Process.Pid, runningCmd.Entry.Options); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if onStart != nil {
+			onStart(runningCmd)
+		}
+		err = runningCmd.Cmd.Wait()
+	}
 	duration := time.Since(startTime)
 
 	result := &ExecutionResult{
-		ID:       runningCmd.ID,
-		Duration: duration,
-		Output:   output,
+		ID:        runningCmd.ID,
+		Duration:  duration,
+		Output:    output.buf.Bytes(),
+		Truncated: output.truncated,
+	}
+
+	if output.file != nil {
+		result.OutputFile = output.file.Name()
+		if err := output.file.Close(); err != nil && output.fileErr == nil {
+			output.fileErr = err
+		}
+		if output.fileErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to write %s: %v\n", result.OutputFile, output.fileErr)
+		}
+		if err := pruneOutputFiles(outputDir, runningCmd.Entry, retention); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
 	}
 
 	if err != nil {
@@ -185,6 +682,45 @@ func (ce *CommandExecutor) runCommand(runningCmd *RunningCommand, resultChan cha
 	}
 }
 
+// outputBuffer collects command output up to limit bytes (0 for no limit)
+// and calls onLimit once when more is written
+type outputBuffer struct {
+	buf       bytes.Buffer
+	file      *os.File // Receives the output instead of buf if set
+	fileErr   error    // First error writing to file
+	written   int
+	limit     int
+	truncated bool
+	onLimit   func()
+}
+
+// Write implements io.Writer
+func (o *outputBuffer) Write(p []byte) (int, error) {
+	if o.limit > 0 && o.written+len(p) > o.limit {
+		o.write(p[:o.limit-o.written])
+		if !o.truncated {
+			o.truncated = true
+			o.onLimit()
+		}
+		return len(p), nil
+	}
+	o.write(p)
+	return len(p), nil
+}
+
+// write stores p in the file or buffer. A failing file write drops the
+// output rather than failing the command.
+func (o *outputBuffer) write(p []byte) {
+	o.written += len(p)
+	if o.file != nil {
+		if _, err := o.file.Write(p); err != nil && o.fileErr == nil {
+			o.fileErr = err
+		}
+		return
+	}
+	o.buf.Write(p)
+}
+
 // setupUserCredentials sets up the command to run as the specified user
 func (ce *CommandExecutor) setupUserCredentials(cmd *exec.Cmd, username string) error {
 	userInfo, err := user.Lookup(username)
@@ -220,6 +756,28 @@ func (ce *CommandExecutor) setupUserCredentials(cmd *exec.Cmd, username string)
 	return nil
 }
 
+// buildCommand creates the process for entry's command, expanding its
+// wildcards for event, including the file's current owner and mode. With
+// shell=true the expanded line is handed to /bin/sh -c so pipes and
+// redirects work; otherwise the command is split into words first, so
+// substituted names are never split.
+func buildCommand(ctx context.Context, entry *IncronEntry, event *InotifyEvent) (*exec.Cmd, error) {
+	attrs := StatFileAttrs(event.Path)
+	if entry.Options.Shell {
+		cmdStr := entry.ExpandEventCommand(event, attrs)
+		if strings.TrimSpace(cmdStr) == "" {
+			return nil, fmt.Errorf("empty command")
+		}
+		return exec.CommandContext(ctx, defaultShell, "-c", cmdStr), nil
+	}
+
+	cmdParts := entry.ExpandEventArgs(event, attrs)
+	if len(cmdParts) == 0 || cmdParts[0] == "" {
+		return nil, fmt.Errorf("empty command")
+	}
+	return exec.CommandContext(ctx, cmdParts[0], cmdParts[1:]...), nil
+}
+
 // parseCommand parses a command string into command and arguments
 func parseCommand(cmdStr string) []string {
 	cmdStr = strings.TrimSpace(cmdStr)
@@ -235,7 +793,7 @@ func parseCommand(cmdStr string) []string {
 
 // generateCommandID generates a unique ID for a command
 func generateCommandID(entry *IncronEntry, event *InotifyEvent) string {
-	return fmt.Sprintf("%s_%s_%d_%d", 
+	return fmt.Sprintf("%s_%s_%d_%d",
 		strings.ReplaceAll(entry.Path, "/", "_"),
 		event.Name,
 		event.Mask,
@@ -261,35 +819,59 @@ func (ce *CommandExecutor) GetRunningCount() int {
 	return ce.currentCount
 }
 
+// GetCommandRate returns the number of commands started during the last second
+func (ce *CommandExecutor) GetCommandRate() int {
+	return ce.limiter.currentRate()
+}
+
+// SetCommandRate limits how many commands may start per second; a rate of 0
+// removes the limit. The policy decides whether commands over the limit
+// wait for their turn or fail with ErrRateLimited.
+func (ce *CommandExecutor) SetCommandRate(rate float64, policy RateLimitPolicy) {
+	ce.limiter.setRate(rate, policy)
+}
+
 // KillCommand kills a running command by ID
 func (ce *CommandExecutor) KillCommand(id string) error {
 	ce.mu.RLock()
 	runningCmd, exists := ce.runningCommands[id]
+	var cancel context.CancelFunc
+	var process *os.Process
+	if exists {
+		cancel, process = runningCmd.Cancel, runningCmd.process
+	}
 	ce.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("command with ID %s not found", id)
 	}
 
-	// Cancel the context
-	runningCmd.Cancel()
-
-	// Try to kill the process
-	if runningCmd.Cmd.Process != nil {
-		return runningCmd.Cmd.Process.Kill()
+	// Cancel the context, including any retries. A command that is still
+	// starting is killed by its Cancel once it runs; one that runs is killed
+	// here too, so a failure can be reported.
+	runningCmd.stop()
+	cancel()
+	if process != nil {
+		if err := killProcessGroup(process); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("failed to kill command %s: %v", id, err)
+		}
 	}
 
 	return nil
 }
 
-// KillAllCommands kills all running commands
+// KillAllCommands kills all running commands and cancels the queued ones
 func (ce *CommandExecutor) KillAllCommands() error {
-	ce.mu.RLock()
+	ce.mu.Lock()
 	ids := make([]string, 0, len(ce.runningCommands))
 	for id := range ce.runningCommands {
 		ids = append(ids, id)
 	}
-	ce.mu.RUnlock()
+	for _, waiter := range ce.waiters {
+		close(waiter.ready)
+	}
+	ce.waiters = nil
+	ce.mu.Unlock()
 
 	var lastErr error
 	for _, id := range ids {
@@ -301,23 +883,70 @@ func (ce *CommandExecutor) KillAllCommands() error {
 	return lastErr
 }
 
-// WaitForAllCommands waits for all running commands to complete or timeout
-func (ce *CommandExecutor) WaitForAllCommands(timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
+// finishPending counts off a command that left Execute and wakes
+// WaitForAllCommands once none are left
+func (ce *CommandExecutor) finishPending() {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
 
-	for time.Now().Before(deadline) {
-		ce.mu.RLock()
-		count := ce.currentCount
-		ce.mu.RUnlock()
+	if ce.pending--; ce.pending == 0 {
+		close(ce.allDone)
+		ce.allDone = make(chan struct{})
+	}
+}
 
-		if count == 0 {
-			return nil
-		}
+// WaitForAllCommands waits for all running commands to complete or timeout.
+// Commands still running after a timeout can be stopped with KillAllCommands.
+func (ce *CommandExecutor) WaitForAllCommands(timeout time.Duration) error {
+	ce.mu.RLock()
+	pending, allDone := ce.pending, ce.allDone
+	ce.mu.RUnlock()
+	if pending == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-		time.Sleep(100 * time.Millisecond)
+	select {
+	case <-allDone:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("timeout waiting for commands to complete")
 	}
+}
+
+// SetSpool journals every command in spool until it has finished; nil
+// disables journaling
+func (ce *CommandExecutor) SetSpool(spool *Spool) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.spool = spool
+}
 
-	return fmt.Errorf("timeout waiting for commands to complete")
+// SetMaxOutput limits how much output is kept per command; a command writing
+// more is killed and its result marked as truncated. 0 removes the limit.
+func (ce *CommandExecutor) SetMaxOutput(limit int) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.maxOutput = limit
+}
+
+// SetOutputRetention sets how many output files each entry with output_dir=
+// keeps; older ones are removed after every run. 0 keeps all of them.
+func (ce *CommandExecutor) SetOutputRetention(keep int) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.outputRetention = keep
+}
+
+// SetStartHook calls hook each time a command was started, including every
+// retry; nil removes the hook. The hook runs in the command's goroutine and
+// must not block.
+func (ce *CommandExecutor) SetStartHook(hook func(*RunningCommand)) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.onStart = hook
 }
 
 // SetMaxConcurrent sets the maximum number of concurrent commands
@@ -325,6 +954,48 @@ func (ce *CommandExecutor) SetMaxConcurrent(max int) {
 	ce.mu.Lock()
 	defer ce.mu.Unlock()
 	ce.maxConcurrent = max
+	ce.grantSlots()
+}
+
+// SetMaxPerUser sets the maximum number of concurrent commands of a single
+// user; 0 removes the limit
+func (ce *CommandExecutor) SetMaxPerUser(max int) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.maxPerUser = max
+	ce.grantSlots()
+}
+
+// SetQueue lets up to size commands wait for a free slot, for at most maxAge
+// (0 for no limit), when the concurrency limits are reached. A size of 0, the
+// default, makes Execute fail with ErrMaxConcurrent right away.
+func (ce *CommandExecutor) SetQueue(size int, maxAge time.Duration) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.queueSize = size
+	ce.queueMaxAge = maxAge
+}
+
+// GetQueuedCount returns the number of commands waiting for a free slot
+func (ce *CommandExecutor) GetQueuedCount() int {
+	ce.mu.RLock()
+	defer ce.mu.RUnlock()
+	return len(ce.waiters)
+}
+
+// QueueDrops returns how many commands were refused because the queue was
+// full and how many gave up after waiting longer than the maximum age
+func (ce *CommandExecutor) QueueDrops() (full, expired uint64) {
+	ce.mu.RLock()
+	defer ce.mu.RUnlock()
+	return ce.droppedFull, ce.droppedExpired
+}
+
+// GetUserRunningCount returns the number of commands running as username
+func (ce *CommandExecutor) GetUserRunningCount(username string) int {
+	ce.mu.RLock()
+	defer ce.mu.RUnlock()
+	return ce.userCounts[username]
 }
 
 // SetTimeout sets the command execution timeout
@@ -332,4 +1003,4 @@ func (ce *CommandExecutor) SetTimeout(timeout time.Duration) {
 	ce.mu.Lock()
 	defer ce.mu.Unlock()
 	ce.timeout = timeout
-}
\ No newline at end of file
+}
@@ -0,0 +1,933 @@
+package eventcron
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecuteShell(t *testing.T) {
+	tests := []struct {
+		name     string
+		shell    bool
+		expected string
+	}{
+		{"direct", false, "a | tr a b"},
+		{"shell", true, "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := NewCommandExecutor(1, 5*time.Second)
+			entry := &IncronEntry{
+				Path:    "/tmp",
+				Mask:    InCreate,
+				Command: "echo a | tr a b",
+				Options: EntryOptions{Shell: tt.shell},
+			}
+			event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+			result, err := ce.Execute(entry, event, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Success {
+				t.Fatalf("command failed: %v", result.Error)
+			}
+			if got := strings.TrimSpace(string(result.Output)); got != tt.expected {
+				t.Errorf("output = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteEnv(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	entry := &IncronEntry{
+		Path:    "/tmp",
+		Mask:    InCreate,
+		Command: "echo $PROFILE-$EVENTCRON_NAME",
+		Options: EntryOptions{Shell: true, Env: map[string]string{"PROFILE": "backup"}},
+	}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(result.Output)); got != "backup-file" {
+		t.Errorf("output = %q, want %q", got, "backup-file")
+	}
+}
+
+func TestWaitForAllCommands(t *testing.T) {
+	ce := NewCommandExecutor(2, 10*time.Second)
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	// Nothing running returns immediately
+	if err := ce.WaitForAllCommands(time.Second); err != nil {
+		t.Fatalf("WaitForAllCommands() with no commands: %v", err)
+	}
+
+	run := func(command string) {
+		go ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: command}, event, "")
+	}
+	waitRunning := func(want int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for ce.GetRunningCount() != want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := ce.GetRunningCount(); got != want {
+			t.Fatalf("GetRunningCount() = %d, want %d", got, want)
+		}
+	}
+
+	// Returns as soon as the last command finishes
+	run("sleep 0.2")
+	waitRunning(1)
+	start := time.Now()
+	if err := ce.WaitForAllCommands(5 * time.Second); err != nil {
+		t.Fatalf("WaitForAllCommands(): %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("WaitForAllCommands() took %v", elapsed)
+	}
+
+	// Times out without leaving anything behind, after which the commands
+	// can still be killed
+	run("sleep 10")
+	waitRunning(1)
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if err := ce.WaitForAllCommands(time.Millisecond); err == nil {
+			t.Fatal("WaitForAllCommands() did not time out")
+		}
+	}
+	if got := runtime.NumGoroutine(); got >= goroutines+20 {
+		t.Errorf("%d goroutines after timing out 20 times, %d before", got, goroutines)
+	}
+	if err := ce.KillAllCommands(); err != nil {
+		t.Fatalf("KillAllCommands(): %v", err)
+	}
+	if err := ce.WaitForAllCommands(2 * time.Second); err != nil {
+		t.Fatalf("WaitForAllCommands() after kill: %v", err)
+	}
+
+	// Waits for commands that haven't started yet, e.g. while their file
+	// settles
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	settling := &IncronEntry{Path: filepath.Dir(file), Mask: InCreate, Command: "true",
+		Options: EntryOptions{Settle: 300 * time.Millisecond}}
+	ce = NewCommandExecutor(2, 10*time.Second)
+	go ce.Execute(settling, &InotifyEvent{Path: file, Name: "file", Mask: InCreate, WatchDir: filepath.Dir(file)}, "")
+	time.Sleep(50 * time.Millisecond)
+	if got := ce.GetRunningCount(); got != 0 {
+		t.Fatalf("GetRunningCount() while settling = %d, want 0", got)
+	}
+	start = time.Now()
+	if err := ce.WaitForAllCommands(5 * time.Second); err != nil {
+		t.Fatalf("WaitForAllCommands() with a settling command: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("WaitForAllCommands() returned after %v while a command was settling", elapsed)
+	}
+}
+
+func TestExecuteRetries(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "attempts")
+
+	tests := []struct {
+		name     string
+		command  string
+		retries  int
+		success  bool
+		attempts int
+	}{
+		{"success needs no retry", "echo x >> " + counter, 3, true, 1},
+		{"succeeds on third attempt", "echo x >> " + counter + "; test $(wc -l < " + counter + ") -ge 3", 3, true, 3},
+		{"gives up", "echo x >> " + counter + "; false", 2, false, 3},
+		{"no retries", "false", 0, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(counter)
+			ce := NewCommandExecutor(1, 5*time.Second)
+			entry := &IncronEntry{
+				Path:    "/tmp",
+				Mask:    InCreate,
+				Command: tt.command,
+				Options: EntryOptions{Shell: true, Retries: tt.retries, RetryDelay: 10 * time.Millisecond},
+			}
+			event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+			result, err := ce.Execute(entry, event, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Success != tt.success || result.Attempts != tt.attempts {
+				t.Errorf("Success = %v, Attempts = %d, want %v, %d", result.Success, result.Attempts, tt.success, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestExecuteRetryBackoffFreesSlot(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	entry := &IncronEntry{
+		Path:    "/tmp",
+		Mask:    InCreate,
+		Command: "false",
+		Options: EntryOptions{Retries: 1, RetryDelay: 300 * time.Millisecond},
+	}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	failed := make(chan *ExecutionResult, 1)
+	go func() {
+		result, _ := ce.Execute(entry, event, "")
+		failed <- result
+	}()
+
+	// While the failed command waits to be retried, another one may run
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ce.GetRunningCommands()) != 1 || ce.GetRunningCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the retry backoff")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	result, err := ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "")
+	if err != nil || !result.Success {
+		t.Fatalf("Execute() during the retry backoff = %+v, %v", result, err)
+	}
+
+	if result := <-failed; result.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2", result.Attempts)
+	}
+}
+
+func TestExecuteFollowUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		retries  int
+		followUp string // Output of the follow-up, empty if none runs
+	}{
+		{"success", "true", 0, "done file"},
+		{"failure", "false", 0, "failed file"},
+		{"failure after retries", "false", 1, "failed file"},
+		{"no follow-up", "true", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := NewCommandExecutor(1, 5*time.Second)
+			entry := &IncronEntry{
+				Path:    "/tmp",
+				Mask:    InCreate,
+				Command: tt.command,
+				Options: EntryOptions{Retries: tt.retries, RetryDelay: 10 * time.Millisecond},
+			}
+			if tt.followUp != "" {
+				entry.Options.OnSuccess = "echo done $#"
+				entry.Options.OnFailure = "echo failed $#"
+			}
+			event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+			result, err := ce.Execute(entry, event, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.followUp == "" {
+				if result.FollowUp != nil {
+					t.Errorf("FollowUp = %+v, want none", result.FollowUp)
+				}
+				return
+			}
+			if result.FollowUp == nil || !result.FollowUp.Success {
+				t.Fatalf("FollowUp = %+v, want a successful follow-up", result.FollowUp)
+			}
+			if got := strings.TrimSpace(string(result.FollowUp.Output)); got != tt.followUp {
+				t.Errorf("follow-up output = %q, want %q", got, tt.followUp)
+			}
+			if result.Success != (tt.command == "true") || result.Attempts != tt.retries+1 {
+				t.Errorf("Success = %v, Attempts = %d, want the command's own result", result.Success, result.Attempts)
+			}
+		})
+	}
+}
+
+func TestExecuteFollowUpRateLimited(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	ce.SetCommandRate(1, RateLimitReject)
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true", Options: EntryOptions{OnSuccess: "true"}}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	// The command takes the only token, so the follow-up is over the limit
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FollowUp == nil || !errors.Is(result.FollowUp.Error, ErrRateLimited) {
+		t.Errorf("FollowUp = %+v, want %v", result.FollowUp, ErrRateLimited)
+	}
+}
+
+func TestExecuteFollowUpNotRestarted(t *testing.T) {
+	ce := NewCommandExecutor(2, 10*time.Second)
+	entry := &IncronEntry{
+		Path:    "/tmp",
+		Mask:    InCreate,
+		Command: "true",
+		Options: EntryOptions{Restart: true, OnSuccess: "sleep 0.5"},
+	}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	first := make(chan *ExecutionResult, 1)
+	go func() {
+		result, _ := ce.Execute(entry, event, "")
+		first <- result
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for ce.GetRunningCount() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ce.GetRunningCount(); got != 1 {
+		t.Fatalf("GetRunningCount() = %d, want the follow-up running", got)
+	}
+
+	// A new event restarts the entry's command, not the follow-up of the
+	// previous one
+	e2 := *entry
+	e2.Options.OnSuccess = ""
+	if _, err := ce.Execute(&e2, event, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case result := <-first:
+		if result.FollowUp == nil || !result.FollowUp.Success || result.FollowUp.Restarted {
+			t.Errorf("FollowUp = %+v, want it to finish", result.FollowUp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("follow-up did not finish")
+	}
+}
+
+func TestExecuteDir(t *testing.T) {
+	dir := t.TempDir()
+	ce := NewCommandExecutor(1, 5*time.Second)
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "pwd", Options: EntryOptions{Dir: dir}}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(result.Output)); got != dir {
+		t.Errorf("command ran in %q, want %q", got, dir)
+	}
+}
+
+func TestExecuteQuote(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	entry := &IncronEntry{
+		Path:    "/tmp",
+		Mask:    InCreate,
+		Command: "echo $#",
+		Options: EntryOptions{Shell: true},
+	}
+	event := &InotifyEvent{Path: "/tmp/a; echo injected", Name: "a; echo injected", Mask: InCreate, WatchDir: "/tmp"}
+
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(result.Output)); got != "a; echo injected" {
+		t.Errorf("output = %q, want the file name as a single argument", got)
+	}
+
+	// Without a shell the name is a single argument as well
+	entry = &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "printf %s| $#"}
+	event = &InotifyEvent{Path: "/tmp/a  b", Name: "a  b", Mask: InCreate, WatchDir: "/tmp"}
+	result, err = ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(result.Output); got != "a  b|" {
+		t.Errorf("output = %q, want the file name as a single argument", got)
+	}
+}
+
+func TestExecuteMaxOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		command   string
+		limit     int
+		output    string
+		truncated bool
+	}{
+		{"under the limit", "printf abc", 10, "abc", false},
+		{"no limit", "printf abc", 0, "abc", false},
+		{"runaway output", "yes", 8, "y\ny\ny\ny\n", true},
+		{"runaway child", "yes & wait", 8, "y\ny\ny\ny\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := NewCommandExecutor(1, 5*time.Second)
+			ce.SetMaxOutput(tt.limit)
+			entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: tt.command, Options: EntryOptions{Shell: true}}
+			event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+			result, err := ce.Execute(entry, event, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(result.Output) != tt.output || result.Truncated != tt.truncated {
+				t.Errorf("Output = %q, Truncated = %v, want %q, %v", result.Output, result.Truncated, tt.output, tt.truncated)
+			}
+			if tt.truncated && result.Success {
+				t.Error("command writing too much output was not killed")
+			}
+		})
+	}
+}
+
+func TestExecuteMaxPerUser(t *testing.T) {
+	ce := NewCommandExecutor(4, 10*time.Second)
+	ce.SetMaxPerUser(1)
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 10"}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	go ce.Execute(entry, event, "")
+	deadline := time.Now().Add(2 * time.Second)
+	for ce.GetUserRunningCount("") != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ce.GetUserRunningCount(""); got != 1 {
+		t.Fatalf("GetUserRunningCount() = %d, want 1", got)
+	}
+
+	// The same user is over its limit while the global limit has room
+	_, err := ce.Execute(entry, event, "")
+	if !errors.Is(err, ErrMaxConcurrent) || !strings.Contains(err.Error(), "for user") {
+		t.Fatalf("Execute() over the per-user limit returned %v", err)
+	}
+
+	// Other users are not affected
+	if os.Geteuid() != 0 {
+		return
+	}
+	result, err := ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "root")
+	if err != nil {
+		t.Fatalf("Execute() for another user: %v", err)
+	}
+	if !result.Success {
+		t.Errorf("command for another user failed: %v", result.Error)
+	}
+	if got := ce.GetUserRunningCount("root"); got != 0 {
+		t.Errorf("GetUserRunningCount(root) = %d after the command finished", got)
+	}
+}
+
+func TestExecuteNice(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	entry := &IncronEntry{
+		Path: "/tmp",
+		Mask: InCreate,
+		// Field 19 of stat is the nice value; wait for it to be applied
+		Command: "sleep 0.2; cut -d' ' -f19 /proc/self/stat",
+		Options: EntryOptions{Shell: true, Nice: 10, IONice: "idle"},
+	}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(result.Output)); got != "10" {
+		t.Errorf("command ran with nice %q, want 10", got)
+	}
+}
+
+func TestExecuteQueue(t *testing.T) {
+	ce := NewCommandExecutor(1, 10*time.Second)
+	ce.SetQueue(1, 5*time.Second)
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+
+	go ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 0.3"}, event, "")
+	waitFor("the first command", func() bool { return ce.GetRunningCount() == 1 })
+
+	// The second command waits for the slot instead of failing
+	queued := make(chan error, 1)
+	go func() {
+		result, err := ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "")
+		if err == nil && !result.Success {
+			err = result.Error
+		}
+		queued <- err
+	}()
+	waitFor("the queued command", func() bool { return ce.GetQueuedCount() == 1 })
+
+	// The third finds the queue full
+	_, err := ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "")
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Execute() with a full queue returned %v", err)
+	}
+
+	if err := <-queued; err != nil {
+		t.Fatalf("queued command: %v", err)
+	}
+	if full, expired := ce.QueueDrops(); full != 1 || expired != 0 {
+		t.Errorf("QueueDrops() = %d, %d, want 1, 0", full, expired)
+	}
+
+	// Commands waiting longer than the maximum age give up
+	ce.SetQueue(1, 50*time.Millisecond)
+	go ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 10"}, event, "")
+	waitFor("the long command", func() bool { return ce.GetRunningCount() == 1 })
+	_, err = ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "")
+	if !errors.Is(err, ErrMaxConcurrent) {
+		t.Fatalf("Execute() after the maximum age returned %v", err)
+	}
+	if _, expired := ce.QueueDrops(); expired != 1 {
+		t.Errorf("expired drops = %d, want 1", expired)
+	}
+
+	// Killing all commands cancels queued ones rather than starting them
+	ce.SetQueue(1, 0)
+	go func() {
+		_, err := ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "")
+		queued <- err
+	}()
+	waitFor("the queued command", func() bool { return ce.GetQueuedCount() == 1 })
+	ce.KillAllCommands()
+	if err := <-queued; err == nil || !strings.Contains(err.Error(), "cancelled while queued") {
+		t.Errorf("queued command after KillAllCommands() returned %v", err)
+	}
+}
+
+func TestExecuteQueueOrder(t *testing.T) {
+	ce := NewCommandExecutor(1, 10*time.Second)
+	ce.SetQueue(3, 0)
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	var mu sync.Mutex
+	var started []string
+	ce.SetStartHook(func(command *RunningCommand) {
+		mu.Lock()
+		defer mu.Unlock()
+		started = append(started, command.Entry.Command)
+	})
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+
+	go ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 0.2"}, event, "")
+	waitFor("the first command", func() bool { return ce.GetRunningCount() == 1 })
+
+	// Queued commands start in the order they were queued
+	var wg sync.WaitGroup
+	want := []string{"sleep 0.2"}
+	for i := 1; i <= 3; i++ {
+		command := fmt.Sprintf("sleep 0.0%d", i)
+		want = append(want, command)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: command}, event, "")
+		}()
+		waitFor("the queued command", func() bool { return ce.GetQueuedCount() == i })
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(started, want) {
+		t.Errorf("commands started in order %q, want %q", started, want)
+	}
+}
+
+func TestExecuteRestart(t *testing.T) {
+	ce := NewCommandExecutor(1, 10*time.Second)
+	entry := &IncronEntry{
+		Path:    "/tmp",
+		Mask:    InCreate,
+		Command: "sleep 10",
+		Options: EntryOptions{NoLoop: true, Restart: true},
+	}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	first := make(chan *ExecutionResult, 1)
+	go func() {
+		result, _ := ce.Execute(entry, event, "")
+		first <- result
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for ce.GetRunningCount() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ce.GetRunningCount(); got != 1 {
+		t.Fatalf("GetRunningCount() = %d, want 1", got)
+	}
+
+	// A new event replaces the running command instead of being skipped
+	// by loop prevention or the concurrency limit. The daemon passes each
+	// run a copy of the entry.
+	second := make(chan error, 1)
+	go func() {
+		e2 := *entry
+		_, err := ce.Execute(&e2, event, "")
+		second <- err
+	}()
+
+	select {
+	case result := <-first:
+		if result == nil || !result.Restarted || result.Success {
+			t.Errorf("first command result = %+v, want it killed for the restart", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first command was not killed")
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for ce.GetRunningCount() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ce.GetRunningCount(); got != 1 {
+		t.Fatalf("GetRunningCount() after the restart = %d, want 1", got)
+	}
+	select {
+	case err := <-second:
+		t.Fatalf("restarted command returned early: %v", err)
+	default:
+	}
+}
+
+func TestExecuteRestartQueued(t *testing.T) {
+	ce := NewCommandExecutor(2, 10*time.Second)
+	ce.SetQueue(10, 0)
+	restart := IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 10", Options: EntryOptions{Restart: true},
+		Owner: "alice", LineNumber: 1}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	// Count the entry's commands running whenever one of them starts
+	var mu sync.Mutex
+	most := 0
+	ce.SetStartHook(func(started *RunningCommand) {
+		if started.Entry.Command != restart.Command {
+			return
+		}
+		copies := 0
+		for _, command := range ce.GetRunningCommands() {
+			if command.Entry.Command == restart.Command {
+				copies++
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		most = max(most, copies)
+	})
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+
+	// Two events of the entry queue behind other commands and get slots
+	// at the same time
+	for i := 0; i < 2; i++ {
+		go ce.Execute(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 0.2"}, event, "")
+	}
+	waitFor("the other commands", func() bool { return ce.GetRunningCount() == 2 })
+	for i := 0; i < 2; i++ {
+		go func() {
+			e := restart
+			ce.Execute(&e, event, "")
+		}()
+	}
+	waitFor("the queued restart commands", func() bool { return ce.GetQueuedCount() == 2 })
+	waitFor("a restart command", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return most > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most != 1 {
+		t.Errorf("%d copies of the restart=true command ran at once, want 1", most)
+	}
+}
+
+func TestExecuteRestartEntryCopies(t *testing.T) {
+	ce := NewCommandExecutor(2, 10*time.Second)
+	entry := IncronEntry{
+		Path:       "/tmp",
+		Mask:       InCreate,
+		Command:    "sleep 10",
+		Options:    EntryOptions{Restart: true},
+		Owner:      "alice",
+		LineNumber: 1,
+	}
+	other := entry
+	other.LineNumber = 2
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	defer func() {
+		ce.KillAllCommands()
+		ce.WaitForAllCommands(2 * time.Second)
+	}()
+
+	waitForRunning := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for ce.GetRunningCount() != want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := ce.GetRunningCount(); got != want {
+			t.Fatalf("GetRunningCount() = %d, want %d", got, want)
+		}
+	}
+
+	// Like the daemon, every run gets a copy of its entry
+	run := func(entry IncronEntry) <-chan *ExecutionResult {
+		done := make(chan *ExecutionResult, 1)
+		go func() {
+			result, _ := ce.Execute(&entry, event, "")
+			done <- result
+		}()
+		return done
+	}
+
+	first := run(entry)
+	waitForRunning(1)
+
+	// Another line of the same table is a different entry and runs alongside
+	beside := run(other)
+	waitForRunning(2)
+
+	// A copy of the first entry replaces its running command
+	run(entry)
+	select {
+	case result := <-first:
+		if result == nil || !result.Restarted {
+			t.Errorf("first command result = %+v, want it killed for the restart", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first command was not restarted by a copy of its entry")
+	}
+	waitForRunning(2)
+	select {
+	case result := <-beside:
+		t.Errorf("command of another entry finished early: %+v", result)
+	default:
+	}
+}
+
+func TestExecuteOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	ce := NewCommandExecutor(1, 5*time.Second)
+	ce.SetOutputRetention(2)
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "echo $#",
+		Options: EntryOptions{OutputDir: dir}}
+	other := &IncronEntry{Path: "/srv", Mask: InCreate, Command: "echo other",
+		Options: EntryOptions{OutputDir: dir}}
+
+	if _, err := ce.Execute(other, &InotifyEvent{Path: "/srv/x", Name: "x", Mask: InCreate, WatchDir: "/srv"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	var last *ExecutionResult
+	for _, name := range []string{"one", "two", "three"} {
+		event := &InotifyEvent{Path: "/tmp/" + name, Name: name, Mask: InCreate, WatchDir: "/tmp"}
+		result, err := ce.Execute(entry, event, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Output) != 0 || result.OutputFile == "" {
+			t.Fatalf("Output = %q, OutputFile = %q, want output in a file", result.Output, result.OutputFile)
+		}
+		last = result
+	}
+
+	data, err := os.ReadFile(last.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "three\n" {
+		t.Errorf("output file contains %q, want %q", data, "three\n")
+	}
+
+	// The oldest run of entry is pruned, the other entry's file stays
+	files, err := filepath.Glob(filepath.Join(dir, "*.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("output_dir holds %v, want 2 files of the entry and 1 of the other", files)
+	}
+
+	// Without a usable directory the output is kept in memory
+	entry.Options.OutputDir = filepath.Join(dir, "missing")
+	result, err := ce.Execute(entry, &InotifyEvent{Path: "/tmp/four", Name: "four", Mask: InCreate, WatchDir: "/tmp"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Output) != "four\n" || result.OutputFile != "" {
+		t.Errorf("Output = %q, OutputFile = %q, want output in memory", result.Output, result.OutputFile)
+	}
+
+	// A symlink in place of the directory isn't followed
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	entry.Options.OutputDir = link
+	result, err = ce.Execute(entry, &InotifyEvent{Path: "/tmp/five", Name: "five", Mask: InCreate, WatchDir: "/tmp"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Output) != "five\n" || result.OutputFile != "" {
+		t.Errorf("Output = %q, OutputFile = %q, want output in memory for a symlinked output_dir", result.Output, result.OutputFile)
+	}
+}
+
+func TestExecuteStartHook(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	var started [][]string
+	ce.SetStartHook(func(cmd *RunningCommand) {
+		started = append(started, cmd.Cmd.Args)
+	})
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "test $# = x",
+		Options: EntryOptions{Retries: 1}}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	if _, err := ce.Execute(entry, event, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 2 {
+		t.Fatalf("hook called %d times, want 2 (one retry)", len(started))
+	}
+	if got := strings.Join(started[1], " "); got != "test file = x" {
+		t.Errorf("started %q, want the expanded command line", got)
+	}
+}
+
+func TestExecuteTimeoutKillsChildren(t *testing.T) {
+	ce := NewCommandExecutor(1, 5*time.Second)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "sleep 30 & echo $! > " + pidFile + "; wait",
+		Options: EntryOptions{Shell: true, Timeout: 200 * time.Millisecond}}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	start := time.Now()
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Success {
+		t.Fatal("command outliving its timeout succeeded")
+	}
+	// A child left running would keep the output pipe open until the wait
+	// delay closes it
+	if elapsed := time.Since(start); elapsed >= commandWaitDelay {
+		t.Errorf("Execute() took %v, the child kept running", elapsed)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		// An orphan killed with the group may briefly remain a zombie
+		if stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil && strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("child %d was not killed with the command", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestExecuteSystemdScopeFallback(t *testing.T) {
+	if _, err := systemdRun(); err == nil {
+		t.Skip("systemd is running, commands would get a scope")
+	}
+
+	ce := NewCommandExecutor(1, 5*time.Second)
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "echo $#",
+		Options: EntryOptions{SystemdScope: true}}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+
+	result, err := ce.Execute(entry, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success || string(result.Output) != "file\n" {
+		t.Errorf("Execute() = %v, %q, want the command run directly", result.Success, result.Output)
+	}
+}
@@ -0,0 +1,143 @@
+// Package eventcron provides conversion of classic incron tables
+package eventcron
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// classicOptions are the options classic incron understands in the mask field
+var classicOptions = map[string]bool{
+	"recursive": true,
+	"loopable":  true,
+	"dotdirs":   true,
+}
+
+// classicWildcards are the characters classic incron expands after a $
+const classicWildcards = "$@#%&"
+
+// extraWildcards are the characters only eventcron expands after a $. The
+// colon starts $:u, $:g, $:p and $:t.
+const extraWildcards = "/:"
+
+// MigrateClassicTable translates a classic incrontab into the eventcron table
+// format, keeping how each entry behaved under incron: commands run through
+// /bin/sh with unquoted wildcards, events are handled while a command runs
+// unless the entry has IN_NO_LOOP, and eventcron's extra wildcards stay
+// literal text. Comments are
+// kept. Lines that can't be translated are returned as errors and kept in
+// the result as comments.
+func (tc *TableConfig) MigrateClassicTable(r io.Reader, name string) (string, []error) {
+	var out strings.Builder
+	var errs []error
+
+	scanner := tc.newTableScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			fmt.Fprintln(&out, line)
+			continue
+		}
+
+		migrated, err := migrateClassicLine(trimmed, lineNumber)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error in file %s: line %d: %v", name, lineNumber, err))
+			fmt.Fprintf(&out, "# Not migrated (%v): %s\n", err, line)
+			continue
+		}
+		fmt.Fprintln(&out, migrated)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, tc.scanError(err, name, lineNumber))
+	}
+
+	return out.String(), errs
+}
+
+// migrateClassicLine translates a single classic incrontab entry
+func migrateClassicLine(line string, lineNumber int) (string, error) {
+	// Classic incron separates the fields by any run of spaces and tabs
+	path, rest := cutField(line)
+	mask, rest := cutField(rest)
+	command := strings.TrimLeft(rest, " \t")
+	if command == "" {
+		return "", fmt.Errorf("invalid format, expected: <path> <mask> <command>")
+	}
+	if strings.HasSuffix(path, `\`) {
+		return "", fmt.Errorf("paths with escaped spaces are not supported")
+	}
+
+	var flags []string
+	loopSet := false
+	for _, part := range strings.Split(mask, ",") {
+		key, _, isOption := strings.Cut(part, "=")
+		switch {
+		case part == noLoopFlag:
+			loopSet = true
+			flags = append(flags, "loopable=false")
+		case isOption && classicOptions[key]:
+			loopSet = loopSet || key == "loopable"
+			flags = append(flags, part)
+		case isOption:
+			return "", fmt.Errorf("unknown option: %s", part)
+		default:
+			if _, ok := EventMaskMap[part]; !ok {
+				if _, err := parseNumericMask(part); err != nil {
+					return "", unknownMaskError(part)
+				}
+			}
+			flags = append(flags, part)
+		}
+	}
+
+	// Classic incron passes events on while the command is still running
+	if !loopSet {
+		flags = append(flags, "loopable=true")
+	}
+	flags = append(flags, "shell=true", "quote=false")
+
+	entry, err := ParseEntry(path+" "+strings.Join(flags, ",")+" "+escapeWildcards(command), lineNumber)
+	if err != nil {
+		return "", err
+	}
+	if err := ValidateEntry(entry); err != nil {
+		return "", err
+	}
+	return entry.String(), nil
+}
+
+// cutField splits off the first whitespace-separated field of s
+func cutField(s string) (field, rest string) {
+	s = strings.TrimLeft(s, " \t")
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+// escapeWildcards doubles the $ of every wildcard classic incron doesn't
+// know, such as $/ or $:u, so the command keeps passing them on literally
+func escapeWildcards(command string) string {
+	var b strings.Builder
+	for i := 0; i < len(command); i++ {
+		b.WriteByte(command[i])
+		if command[i] != '$' || i+1 == len(command) {
+			continue
+		}
+		if strings.IndexByte(classicWildcards, command[i+1]) >= 0 {
+			i++
+			b.WriteByte(command[i])
+			continue
+		}
+		if strings.IndexByte(extraWildcards, command[i+1]) >= 0 {
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package eventcron
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrateClassicTable(t *testing.T) {
+	tc := DefaultTableConfig()
+	tests := []struct {
+		name    string
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"loops by default", "/tmp IN_CREATE echo $#", "/tmp IN_CREATE,loopable=true,shell=true,quote=false echo $#", false},
+		{"IN_NO_LOOP", "/tmp IN_CLOSE_WRITE,IN_NO_LOOP gzip $@/$#", "/tmp IN_CLOSE_WRITE,shell=true,quote=false gzip $@/$#", false},
+		{"classic options", "/srv IN_CREATE,recursive=false,dotdirs=true,loopable=false ls", "/srv IN_CREATE,recursive=false,dotdirs=true,shell=true,quote=false ls", false},
+		{"tabs and spaces", "/tmp\t IN_DELETE \tlogger  deleted $#", "/tmp IN_DELETE,loopable=true,shell=true,quote=false logger  deleted $#", false},
+		{"numeric mask", "/tmp 0x100 true", "/tmp IN_CREATE,loopable=true,shell=true,quote=false true", false},
+		{"eventcron wildcards stay literal", "/tmp IN_CREATE echo $/ $:u $:p $$:g", "/tmp IN_CREATE,loopable=true,shell=true,quote=false echo $$/ $$:u $$:p $$:g", false},
+		{"$:t stays literal", "/tmp IN_CREATE echo $:t", "/tmp IN_CREATE,loopable=true,shell=true,quote=false echo $$:t", false},
+		{"shell variables are untouched", "/tmp IN_CREATE echo $user $tmp $path", "/tmp IN_CREATE,loopable=true,shell=true,quote=false echo $user $tmp $path", false},
+		{"pipes", "/in IN_MOVED_TO cat $@/$# | mail -s new root", "/in IN_MOVED_TO,loopable=true,shell=true,quote=false cat $@/$# | mail -s new root", false},
+		{"unknown flag", "/tmp IN_FOO echo", "", true},
+		{"eventcron option", "/tmp IN_CREATE,timeout=5s echo", "", true},
+		{"escaped space", `/srv/my\ dir IN_CREATE echo`, "", true},
+		{"missing command", "/tmp IN_CREATE", "", true},
+		{"relative path", "tmp IN_CREATE echo", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, errs := tc.MigrateClassicTable(strings.NewReader(tt.line+"\n"), "incrontab")
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("MigrateClassicTable() errors = %v, wantErr %v", errs, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.HasPrefix(text, "# Not migrated") || !strings.Contains(text, tt.line) {
+					t.Errorf("untranslated line not kept as a comment: %q", text)
+				}
+				return
+			}
+			if got := strings.TrimSuffix(text, "\n"); got != tt.want {
+				t.Errorf("MigrateClassicTable() = %q, want %q", got, tt.want)
+			}
+
+			// The result is a valid table with the classic behaviour
+			table, err := tc.LoadTableReader(strings.NewReader(text), "migrated")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(table.Entries) != 1 || !table.Entries[0].Options.Shell {
+				t.Errorf("migrated table = %+v, want one shell entry", table.Entries)
+			}
+		})
+	}
+}
+
+func TestMigrateClassicTableComments(t *testing.T) {
+	tc := DefaultTableConfig()
+	input := "# backups\n\n/data IN_CLOSE_WRITE backup $@/$#\n"
+	text, errs := tc.MigrateClassicTable(strings.NewReader(input), "incrontab")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := "# backups\n\n/data IN_CLOSE_WRITE,loopable=true,shell=true,quote=false backup $@/$#\n"
+	if text != want {
+		t.Errorf("MigrateClassicTable() = %q, want %q", text, want)
+	}
+}
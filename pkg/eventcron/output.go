@@ -0,0 +1,128 @@
+// Package eventcron provides per-invocation command output files
+package eventcron
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultOutputRetention is the number of output files kept per entry
+const DefaultOutputRetention = 20
+
+// outputFileSuffix ends the name of every output file
+const outputFileSuffix = ".out"
+
+// outputFileTag identifies the output files of an entry, so entries sharing
+// an output_dir prune only their own files
+func outputFileTag(entry *IncronEntry) string {
+	sum := sha256.Sum256([]byte(entry.String()))
+	return hex.EncodeToString(sum[:4])
+}
+
+// outputFileName names the output file of a run started at start. Names sort
+// by start time, oldest first.
+func outputFileName(entry *IncronEntry, start time.Time) string {
+	base := strings.Map(func(r rune) rune {
+		if r == '/' || r == '_' || r < ' ' {
+			return '-'
+		}
+		return r
+	}, filepath.Base(entry.Path))
+	return start.UTC().Format("20060102T150405.000000000") + "_" + base + "_" + outputFileTag(entry) + outputFileSuffix
+}
+
+// openOutputDir opens entry's output_dir, which later calls work in through
+// the returned handle so that the directory can't be swapped for a symlink
+// after it was checked. A command running as a user other than root needs an
+// output_dir owned by that user, so a table can't make the daemon write where
+// its owner couldn't.
+func openOutputDir(entry *IncronEntry, cred *syscall.Credential) (*os.File, error) {
+	dir := entry.Options.OutputDir
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == unix.ENOTDIR || err == unix.ELOOP {
+			return nil, fmt.Errorf("output_dir %s is not a directory", dir)
+		}
+		return nil, fmt.Errorf("cannot use output_dir %s: %v", dir, err)
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("cannot stat output_dir %s: %v", dir, err)
+	}
+	if cred != nil && cred.Uid != 0 && stat.Uid != cred.Uid {
+		unix.Close(fd)
+		return nil, fmt.Errorf("output_dir %s is not owned by uid %d", dir, cred.Uid)
+	}
+	return os.NewFile(uintptr(fd), dir), nil
+}
+
+// openOutputFile creates the file in dir receiving the output of one run of
+// entry's command. A command running as another user gets a file it owns.
+func openOutputFile(dir *os.File, entry *IncronEntry, cred *syscall.Credential, start time.Time) (*os.File, error) {
+	name := outputFileName(entry, start)
+	path := filepath.Join(dir.Name(), name)
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create output file %s: %v", path, err)
+	}
+	file := os.NewFile(uintptr(fd), path)
+	if cred != nil {
+		if err := file.Chown(int(cred.Uid), int(cred.Gid)); err != nil {
+			file.Close()
+			unix.Unlinkat(int(dir.Fd()), name, 0)
+			return nil, fmt.Errorf("cannot change owner of %s: %v", path, err)
+		}
+	}
+	return file, nil
+}
+
+// pruneOutputFiles removes the oldest output files of entry from dir so that
+// at most keep remain; 0 keeps all of them
+func pruneOutputFiles(dir *os.File, entry *IncronEntry, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	// Read the names through a handle of its own, as reading moves the
+	// offset of dir
+	fd, err := unix.Openat(int(dir.Fd()), ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("cannot read output_dir: %v", err)
+	}
+	list := os.NewFile(uintptr(fd), dir.Name())
+	entries, err := list.ReadDir(-1)
+	list.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read output_dir: %v", err)
+	}
+
+	suffix := "_" + outputFileTag(entry) + outputFileSuffix
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), suffix) {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := unix.Unlinkat(int(dir.Fd()), name, 0); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("cannot remove old output file: %v", err)
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package eventcron
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"os/user"
@@ -10,6 +11,10 @@ import (
 	"syscall"
 )
 
+// ErrUserNotAllowed reports a user that the allow or deny file keeps from
+// using eventcron
+var ErrUserNotAllowed = errors.New("user is not allowed to use eventcron")
+
 // CheckUserPermission checks if a user has permission to use eventcron
 // This implements the same logic as the original C++ version:
 // 1. If allow file exists, user must be listed there
@@ -42,7 +47,8 @@ func CheckUserPermission(username string) (bool, error) {
 	return true, nil
 }
 
-// userInFile checks if a username is listed in the given file
+// userInFile checks if a username is listed in the given file, either by
+// name or through an @group line naming one of the user's groups
 func userInFile(username, filePath string) (bool, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -52,25 +58,66 @@ func userInFile(username, filePath string) (bool, error) {
 		return false, err
 	}
 	defer file.Close()
-	
+
+	// The user's groups are only looked up once an @group line shows up
+	var groupIds []string
+	groupsLoaded := false
+
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
-		
+
 		// Skip empty lines and comments
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		
+
+		// Check if this line names one of the user's groups
+		if groupName, ok := strings.CutPrefix(line, "@"); ok {
+			if !groupsLoaded {
+				groupIds = userGroupIds(username)
+				groupsLoaded = true
+			}
+			if inGroup(groupName, groupIds) {
+				return true, nil
+			}
+			continue
+		}
+
 		// Check if this line matches the username
 		if line == username {
 			return true, nil
 		}
 	}
-	
+
 	return false, scanner.Err()
 }
 
+// userGroupIds returns the IDs of the user's primary and supplementary
+// groups, or nil if the user can't be looked up
+func userGroupIds(username string) []string {
+	userInfo, err := user.Lookup(username)
+	if err != nil {
+		return nil
+	}
+
+	groupIds, err := userInfo.GroupIds()
+	if err != nil {
+		// Fall back to the primary group
+		return []string{userInfo.Gid}
+	}
+	return append(groupIds, userInfo.Gid)
+}
+
+// inGroup reports whether the named group is one of groupIds
+func inGroup(groupName string, groupIds []string) bool {
+	group, err := user.LookupGroup(groupName)
+	if err != nil {
+		return false
+	}
+	return inGroupId(group.Gid, groupIds)
+}
+
 // fileExists checks if a file exists
 func fileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
@@ -101,15 +148,24 @@ func GetUserByUID(uid string) (*user.User, error) {
 	return user.LookupId(uid)
 }
 
-// CanAccessPath checks if a user can access the given path
-// This is a simplified version - in practice, you might want to
-// implement more sophisticated permission checking
-func CanAccessPath(username, path string) (bool, error) {
+// Access bits for CanAccessPath, as in access(2)
+const (
+	AccessRead    uint32 = 4
+	AccessWrite   uint32 = 2
+	AccessExecute uint32 = 1
+)
+
+// CanAccessPath checks if a user has the requested access (a combination of
+// AccessRead, AccessWrite and AccessExecute) to the given path. Like the
+// kernel it uses the owner bits for the owner, the group bits for members of
+// the file's group (primary or supplementary) and the other bits otherwise.
+// ACLs and capabilities other than root's are not considered.
+func CanAccessPath(username, path string, access uint32) (bool, error) {
 	userInfo, err := GetUserByName(username)
 	if err != nil {
 		return false, fmt.Errorf("user not found: %s", username)
 	}
-	
+
 	// Get file info
 	info, err := os.Stat(path)
 	if err != nil {
@@ -118,52 +174,59 @@ func CanAccessPath(username, path string) (bool, error) {
 		}
 		return false, err
 	}
-	
+
 	// Get file ownership and permissions
 	stat := info.Sys().(*syscall.Stat_t)
-	
-	// Convert user info
-	uid := fmt.Sprintf("%d", stat.Uid)
-	gid := fmt.Sprintf("%d", stat.Gid)
-	
+	perm := uint32(info.Mode().Perm())
+
+	// Root may read and write anything, and execute if anyone may
+	if userInfo.Uid == "0" {
+		return access&AccessExecute == 0 || perm&0111 != 0, nil
+	}
+
 	// Check if user owns the file
-	if userInfo.Uid == uid {
-		return true, nil
+	if userInfo.Uid == fmt.Sprintf("%d", stat.Uid) {
+		return (perm>>6)&access == access, nil
 	}
-	
+
 	// Check if user is in the file's group
-	if userInfo.Gid == gid {
-		return true, nil
+	if inGroupId(fmt.Sprintf("%d", stat.Gid), userGroupIds(username)) {
+		return (perm>>3)&access == access, nil
 	}
-	
-	// Check world permissions (simplified - just check if others can read)
-	mode := info.Mode()
-	if mode&0004 != 0 { // Others can read
-		return true, nil
+
+	// Fall back to world permissions
+	return perm&access == access, nil
+}
+
+// inGroupId reports whether gid is one of groupIds
+func inGroupId(gid string, groupIds []string) bool {
+	for _, id := range groupIds {
+		if id == gid {
+			return true
+		}
 	}
-	
-	return false, nil
+	return false
 }
 
 // SetupPermissions creates necessary directories and sets proper permissions
-func SetupPermissions() error {
+func (tc *TableConfig) SetupPermissions() error {
 	// Create user table directory
-	if err := os.MkdirAll(DefaultUserTableDir, 0755); err != nil {
+	if err := os.MkdirAll(tc.UserTableDir, 0755); err != nil {
 		return fmt.Errorf("failed to create user table directory: %v", err)
 	}
 	
 	// Create system table directory
-	if err := os.MkdirAll(DefaultSystemTableDir, 0755); err != nil {
+	if err := os.MkdirAll(tc.SystemTableDir, 0755); err != nil {
 		return fmt.Errorf("failed to create system table directory: %v", err)
 	}
 	
 	// Set proper ownership for user table directory (root:root)
-	if err := os.Chown(DefaultUserTableDir, 0, 0); err != nil {
+	if err := os.Chown(tc.UserTableDir, 0, 0); err != nil {
 		return fmt.Errorf("failed to set ownership for user table directory: %v", err)
 	}
 	
 	// Set proper ownership for system table directory (root:root)
-	if err := os.Chown(DefaultSystemTableDir, 0, 0); err != nil {
+	if err := os.Chown(tc.SystemTableDir, 0, 0); err != nil {
 		return fmt.Errorf("failed to set ownership for system table directory: %v", err)
 	}
 	
@@ -0,0 +1,101 @@
+package eventcron
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserInFile(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+	primary, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skipf("cannot look up primary group: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected bool
+	}{
+		{"username", "# allowed\n" + current.Username + "\n", true},
+		{"primary group", "@" + primary.Name + "\n", true},
+		{"other user", "eventcron-no-such-user\n", false},
+		{"unknown group", "@eventcron-no-such-group\n", false},
+		{"group name without @", primary.Name + "\n", primary.Name == current.Username},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "eventcron.allow")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := userInFile(current.Username, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("userInFile() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCanAccessPath(t *testing.T) {
+	if !IsRoot() {
+		t.Skip("changing file ownership requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+	uid, _ := parseUID(nobody.Uid)
+	gid, _ := parseGID(nobody.Gid)
+
+	tests := []struct {
+		name     string
+		uid, gid int
+		mode     os.FileMode
+		access   uint32
+		expected bool
+	}{
+		{"owner read", uid, 0, 0400, AccessRead, true},
+		{"owner write denied", uid, 0, 0444, AccessWrite, false},
+		{"owner bits win over others", uid, 0, 0006, AccessRead, false},
+		{"group read", 0, gid, 0040, AccessRead, true},
+		{"group write denied", 0, gid, 0047, AccessWrite, false},
+		{"others read", 0, 0, 0004, AccessRead, true},
+		{"others write denied", 0, 0, 0004, AccessWrite, false},
+		{"others read and execute", 0, 0, 0005, AccessRead | AccessExecute, true},
+		{"no access", 0, 0, 0770, AccessRead, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chown(path, tt.uid, tt.gid); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := CanAccessPath("nobody", path, tt.access)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("CanAccessPath() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
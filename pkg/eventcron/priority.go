@@ -0,0 +1,80 @@
+// Package eventcron provides CPU and I/O priority settings for commands
+package eventcron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Nice range accepted by nice=
+const (
+	MinNice = -20
+	MaxNice = 19
+)
+
+// I/O scheduling classes and the ioprio_set encoding, see ioprio_set(2)
+const (
+	ioprioClassRealtime   = 1
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+	ioprioClassShift      = 13
+	ioprioWhoProcess      = 1
+	ioprioMaxLevel        = 7
+)
+
+// ioClasses maps the ionice= class names to scheduling classes
+var ioClasses = map[string]int{
+	"realtime":    ioprioClassRealtime,
+	"best-effort": ioprioClassBestEffort,
+	"idle":        ioprioClassIdle,
+}
+
+// parseIONice parses an ionice= value like "idle" or "best-effort:7" into an
+// ioprio_set priority. The level defaults to 4 and is ignored for idle.
+func parseIONice(value string) (int, error) {
+	name, levelStr, hasLevel := strings.Cut(value, ":")
+	class, ok := ioClasses[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown I/O class %s (expected idle, best-effort or realtime)", name)
+	}
+
+	level := 4
+	if class == ioprioClassIdle {
+		if hasLevel {
+			return 0, fmt.Errorf("the idle I/O class has no level")
+		}
+		level = 0
+	} else if hasLevel {
+		var err error
+		level, err = strconv.Atoi(levelStr)
+		if err != nil || level < 0 || level > ioprioMaxLevel {
+			return 0, fmt.Errorf("invalid I/O level %s (expected 0-%d)", levelStr, ioprioMaxLevel)
+		}
+	}
+
+	return class<<ioprioClassShift | level, nil
+}
+
+// setPriority applies the nice= and ionice= options to the process pid
+func setPriority(pid int, opts EntryOptions) error {
+	if opts.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, opts.Nice); err != nil {
+			return fmt.Errorf("failed to set nice %d for process %d: %v", opts.Nice, pid, err)
+		}
+	}
+
+	if opts.IONice != "" {
+		prio, err := parseIONice(opts.IONice)
+		if err != nil {
+			return err
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("failed to set ionice %s for process %d: %v", opts.IONice, pid, errno)
+		}
+	}
+
+	return nil
+}
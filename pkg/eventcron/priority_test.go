@@ -0,0 +1,32 @@
+package eventcron
+
+import "testing"
+
+func TestParseIONice(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    int
+		expectError bool
+	}{
+		{"idle", 3 << 13, false},
+		{"best-effort", 2<<13 | 4, false},
+		{"best-effort:7", 2<<13 | 7, false},
+		{"realtime:0", 1 << 13, false},
+		{"idle:3", 0, true},
+		{"best-effort:8", 0, true},
+		{"best-effort:x", 0, true},
+		{"low", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseIONice(tt.value)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("parseIONice(%q) error = %v, expectError %v", tt.value, err, tt.expectError)
+			}
+			if got != tt.expected {
+				t.Errorf("parseIONice(%q) = %#x, want %#x", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
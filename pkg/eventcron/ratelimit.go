@@ -0,0 +1,135 @@
+// Package eventcron provides command rate limiting functionality
+package eventcron
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by Execute when the command rate limit is hit
+// and the reject policy is in effect
+var ErrRateLimited = errors.New("command rate limit reached")
+
+// RateLimitPolicy controls what Execute does when no token is available
+type RateLimitPolicy int
+
+const (
+	// RateLimitQueue waits until a token becomes available (default)
+	RateLimitQueue RateLimitPolicy = iota
+	// RateLimitReject fails the command with ErrRateLimited
+	RateLimitReject
+)
+
+// String returns the configuration name of the policy
+func (p RateLimitPolicy) String() string {
+	switch p {
+	case RateLimitQueue:
+		return "queue"
+	case RateLimitReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("RateLimitPolicy(%d)", int(p))
+	}
+}
+
+// ParseRateLimitPolicy parses a policy name as used in the configuration file
+func ParseRateLimitPolicy(s string) (RateLimitPolicy, error) {
+	switch s {
+	case "queue":
+		return RateLimitQueue, nil
+	case "reject":
+		return RateLimitReject, nil
+	default:
+		return 0, fmt.Errorf("unknown rate limit policy: %s (expected queue or reject)", s)
+	}
+}
+
+// rateLimiter is a token bucket limiting how many commands start per second
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     float64     // Tokens added per second, 0 means unlimited
+	burst    float64     // Bucket capacity
+	tokens   float64     // Tokens currently available
+	last     time.Time   // Last time tokens were refilled
+	policy   RateLimitPolicy
+	launches []time.Time // Launch times within the last second
+}
+
+// setRate reconfigures the limiter; a rate of 0 disables limiting
+func (rl *rateLimiter) setRate(rate float64, policy RateLimitPolicy) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.rate = rate
+	rl.burst = rate
+	if rl.burst < 1 {
+		rl.burst = 1
+	}
+	rl.tokens = rl.burst
+	rl.last = time.Now()
+	rl.policy = policy
+}
+
+// acquire takes a token, waiting or failing according to the policy
+func (rl *rateLimiter) acquire() error {
+	for {
+		rl.mu.Lock()
+		now := time.Now()
+
+		if rl.rate <= 0 {
+			rl.recordLaunch(now)
+			rl.mu.Unlock()
+			return nil
+		}
+
+		// Refill the bucket for the time that passed
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.burst {
+			rl.tokens = rl.burst
+		}
+		rl.last = now
+
+		if rl.tokens >= 1 {
+			rl.tokens--
+			rl.recordLaunch(now)
+			rl.mu.Unlock()
+			return nil
+		}
+
+		if rl.policy == RateLimitReject {
+			rate := rl.rate
+			rl.mu.Unlock()
+			return fmt.Errorf("%w (%g commands/s)", ErrRateLimited, rate)
+		}
+
+		wait := time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+		rl.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// recordLaunch remembers a launch for currentRate (assumes lock held)
+func (rl *rateLimiter) recordLaunch(now time.Time) {
+	rl.launches = append(rl.launches, now)
+	rl.pruneLaunches(now)
+}
+
+// pruneLaunches drops launches older than one second (assumes lock held)
+func (rl *rateLimiter) pruneLaunches(now time.Time) {
+	cutoff := now.Add(-time.Second)
+	i := 0
+	for i < len(rl.launches) && !rl.launches[i].After(cutoff) {
+		i++
+	}
+	rl.launches = rl.launches[i:]
+}
+
+// currentRate returns the number of commands started in the last second
+func (rl *rateLimiter) currentRate() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.pruneLaunches(time.Now())
+	return len(rl.launches)
+}
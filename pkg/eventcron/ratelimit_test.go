@@ -0,0 +1,60 @@
+package eventcron
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReject(t *testing.T) {
+	var rl rateLimiter
+	rl.setRate(2, RateLimitReject)
+
+	for i := 0; i < 2; i++ {
+		if err := rl.acquire(); err != nil {
+			t.Fatalf("acquire %d: unexpected error %v", i, err)
+		}
+	}
+	if err := rl.acquire(); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("acquire over limit = %v, want ErrRateLimited", err)
+	}
+	if got := rl.currentRate(); got != 2 {
+		t.Errorf("currentRate() = %d, want 2", got)
+	}
+}
+
+func TestRateLimiterQueue(t *testing.T) {
+	var rl rateLimiter
+	rl.setRate(20, RateLimitQueue)
+
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		if err := rl.acquire(); err != nil {
+			t.Fatalf("acquire %d: unexpected error %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("21 acquires at 20/s took %v, expected the last one to wait", elapsed)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var rl rateLimiter
+	for i := 0; i < 100; i++ {
+		if err := rl.acquire(); err != nil {
+			t.Fatalf("acquire %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestParseRateLimitPolicy(t *testing.T) {
+	for _, p := range []RateLimitPolicy{RateLimitQueue, RateLimitReject} {
+		got, err := ParseRateLimitPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParseRateLimitPolicy(%q) = %v, %v; want %v", p.String(), got, err, p)
+		}
+	}
+	if _, err := ParseRateLimitPolicy("drop"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,81 @@
+// Package eventcron provides running commands in transient systemd scopes
+package eventcron
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemdSlice is the slice holding the scopes of systemd_scope=true
+// commands, so their resources can be limited and accounted for together
+const systemdSlice = "eventcron.slice"
+
+// systemdRuntimeDir exists only while systemd is the init system, see
+// sd_booted(3)
+const systemdRuntimeDir = "/run/systemd/system"
+
+// systemdRun returns the path of systemd-run if commands can be started in
+// a scope on this host
+func systemdRun() (string, error) {
+	if _, err := os.Stat(systemdRuntimeDir); err != nil {
+		return "", fmt.Errorf("systemd is not running")
+	}
+	path, err := exec.LookPath("systemd-run")
+	if err != nil {
+		return "", fmt.Errorf("systemd-run not found: %v", err)
+	}
+	return path, nil
+}
+
+// wrapInScope changes cmd to be started through systemdRunPath in a
+// transient scope in systemdSlice. systemd-run execs the command itself, so
+// its PID, environment, directory and output stay those of cmd. It must
+// create the scope as root, so cmd's user, group and supplementary groups
+// are set by setpriv inside the scope instead. cmd is left unchanged if
+// setpriv is needed but can't be found.
+func wrapInScope(cmd *exec.Cmd, systemdRunPath string) error {
+	args := []string{systemdRunPath, "--scope", "--quiet", "--slice=" + systemdSlice, "--"}
+	if attr := cmd.SysProcAttr; attr != nil && attr.Credential != nil {
+		setprivPath, err := exec.LookPath("setpriv")
+		if err != nil {
+			return fmt.Errorf("cannot run %s in a systemd scope as uid %d: setpriv not found: %v", cmd.Path, attr.Credential.Uid, err)
+		}
+		args = append(args, setprivPath)
+		args = append(args, credentialArgs(attr.Credential)...)
+		args = append(args, "--")
+	}
+	args = append(args, cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+
+	cmd.Path = systemdRunPath
+	cmd.Args = args
+	if cmd.SysProcAttr != nil {
+		cmd.SysProcAttr.Credential = nil
+	}
+	return nil
+}
+
+// credentialArgs returns the setpriv arguments switching to cred
+func credentialArgs(cred *syscall.Credential) []string {
+	args := []string{
+		"--reuid=" + strconv.FormatUint(uint64(cred.Uid), 10),
+		"--regid=" + strconv.FormatUint(uint64(cred.Gid), 10),
+	}
+	switch {
+	case cred.NoSetGroups:
+		args = append(args, "--keep-groups")
+	case len(cred.Groups) == 0:
+		args = append(args, "--clear-groups")
+	default:
+		groups := make([]string, len(cred.Groups))
+		for i, gid := range cred.Groups {
+			groups[i] = strconv.FormatUint(uint64(gid), 10)
+		}
+		args = append(args, "--groups="+strings.Join(groups, ","))
+	}
+	return args
+}
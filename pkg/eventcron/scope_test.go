@@ -0,0 +1,63 @@
+package eventcron
+
+import (
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestWrapInScope(t *testing.T) {
+	setpriv, err := exec.LookPath("setpriv")
+	if err != nil {
+		t.Skip("setpriv not found")
+	}
+	scope := []string{"/usr/bin/systemd-run", "--scope", "--quiet", "--slice=eventcron.slice", "--"}
+
+	tests := []struct {
+		name     string
+		cred     *syscall.Credential
+		expected []string
+	}{
+		{"as root", nil, append(scope, "/bin/echo", "a", "b")},
+		{"as a user", &syscall.Credential{Uid: 1000, Gid: 100, Groups: []uint32{100, 27}},
+			append(scope, setpriv, "--reuid=1000", "--regid=100", "--groups=100,27", "--", "/bin/echo", "a", "b")},
+		{"without supplementary groups", &syscall.Credential{Uid: 1000, Gid: 100},
+			append(scope, setpriv, "--reuid=1000", "--regid=100", "--clear-groups", "--", "/bin/echo", "a", "b")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("/bin/echo", "a", "b")
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: tt.cred}
+
+			if err := wrapInScope(cmd, "/usr/bin/systemd-run"); err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Path != "/usr/bin/systemd-run" {
+				t.Errorf("Path = %q, want systemd-run", cmd.Path)
+			}
+			if !reflect.DeepEqual(cmd.Args, tt.expected) {
+				t.Errorf("Args = %q, want %q", cmd.Args, tt.expected)
+			}
+			// systemd-run creates the scope as root and setpriv switches
+			// to the user
+			if cmd.SysProcAttr.Credential != nil || !cmd.SysProcAttr.Setpgid {
+				t.Errorf("SysProcAttr = %+v, want the credential removed", cmd.SysProcAttr)
+			}
+		})
+	}
+}
+
+func TestWrapInScopeWithoutSetpriv(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	cmd := exec.Command("/bin/echo", "a")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 1000, Gid: 100}}
+
+	if err := wrapInScope(cmd, "/usr/bin/systemd-run"); err == nil {
+		t.Fatal("wrapInScope() succeeded without setpriv")
+	}
+	if cmd.Path != "/bin/echo" || cmd.SysProcAttr.Credential == nil {
+		t.Errorf("cmd = %q with %+v, want it unchanged", cmd.Args, cmd.SysProcAttr)
+	}
+}
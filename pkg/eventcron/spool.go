@@ -0,0 +1,200 @@
+// Package eventcron provides the on-disk command journal
+package eventcron
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Spool journals command invocations on disk so they survive a daemon restart
+type Spool struct {
+	dir string
+	seq atomic.Uint64
+}
+
+// SpooledCommand is a command invocation that was journaled but never completed
+type SpooledCommand struct {
+	ID       string        // Journal file name
+	Entry    *IncronEntry  // Entry the command belongs to
+	Event    *InotifyEvent // Event that triggered the command
+	Username string        // User the command runs as
+	Queued   time.Time     // When the command was journaled
+}
+
+// spoolRecord is the JSON form of a journaled command
+type spoolRecord struct {
+	User     string    `json:"user"`
+	Entry    string    `json:"entry"` // Table line, parsed with ParseEntry
+	Line     int       `json:"line"`
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Mask     uint32    `json:"mask"`
+	Cookie   uint32    `json:"cookie"`
+	WatchDir string    `json:"watch_dir"`
+	Received time.Time `json:"received"` // Zero in records of older versions
+	Queued   time.Time `json:"queued"`
+}
+
+const (
+	spoolSuffix    = ".json"
+	spoolTmpPrefix = ".tmp-"
+	corruptSuffix  = ".corrupt"
+)
+
+// OpenSpool opens the journal directory, creating it if needed. Journaled
+// commands are replayed as root, so the directory must not be writable by
+// group or others.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %v", dir, err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat spool directory %s: %v", dir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("spool path %s is not a directory", dir)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("spool directory %s is writable by group or others", dir)
+	}
+
+	return &Spool{dir: dir}, nil
+}
+
+// add journals a command before it runs and returns its ID
+func (s *Spool) add(entry *IncronEntry, event *InotifyEvent, username string) (string, error) {
+	record := spoolRecord{
+		User:     username,
+		Entry:    entry.String(),
+		Line:     entry.LineNumber,
+		Path:     event.Path,
+		Name:     event.Name,
+		Mask:     event.Mask,
+		Cookie:   event.Cookie,
+		WatchDir: event.WatchDir,
+		Received: event.Received,
+		Queued:   time.Now(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode spool record: %v", err)
+	}
+
+	id := fmt.Sprintf("%d-%d%s", record.Queued.UnixNano(), s.seq.Add(1), spoolSuffix)
+
+	// Write to a temporary file first, so a crash never leaves a partial record
+	tmp, err := os.CreateTemp(s.dir, spoolTmpPrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create spool record: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write spool record: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write spool record: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write spool record: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, id)); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write spool record: %v", err)
+	}
+
+	return id, nil
+}
+
+// Remove marks a journaled command as complete
+func (s *Spool) Remove(id string) error {
+	if err := os.Remove(filepath.Join(s.dir, id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spool record %s: %v", id, err)
+	}
+	return nil
+}
+
+// Pending returns the journaled commands that never completed, oldest first.
+// Leftover temporary files are removed and records that can't be read are
+// renamed with a .corrupt suffix so they are only reported once.
+func (s *Spool) Pending() ([]*SpooledCommand, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %v", s.dir, err)
+	}
+
+	var commands []*SpooledCommand
+	for _, file := range files {
+		name := file.Name()
+		path := filepath.Join(s.dir, name)
+
+		if strings.HasPrefix(name, spoolTmpPrefix) {
+			os.Remove(path)
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+
+		command, err := readSpoolRecord(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping corrupt spool record %s: %v\n", path, err)
+			os.Rename(path, path+corruptSuffix)
+			continue
+		}
+		command.ID = name
+		commands = append(commands, command)
+	}
+
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Queued.Before(commands[j].Queued)
+	})
+
+	return commands, nil
+}
+
+// readSpoolRecord reads a single journaled command
+func readSpoolRecord(path string) (*SpooledCommand, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var record spoolRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	entry, err := ParseEntry(record.Entry, record.Line)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("record has no entry")
+	}
+
+	return &SpooledCommand{
+		Entry: entry,
+		Event: &InotifyEvent{
+			Path:     record.Path,
+			Name:     record.Name,
+			Mask:     record.Mask,
+			Cookie:   record.Cookie,
+			WatchDir: record.WatchDir,
+			Received: record.Received,
+		},
+		Username: record.User,
+		Queued:   record.Queued,
+	}, nil
+}
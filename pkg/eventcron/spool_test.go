@@ -0,0 +1,133 @@
+package eventcron
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolPending(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := ParseEntry("/data IN_CLOSE_WRITE,timeout=30s process $/", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &InotifyEvent{Path: "/data/file", Name: "file", Mask: InCloseWrite, WatchDir: "/data",
+		Received: time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)}
+
+	first, err := spool.add(entry, event, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spool.add(entry, event, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial writes and corrupt records are cleaned up
+	if err := os.WriteFile(filepath.Join(dir, spoolTmpPrefix+"123"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1-1.json"), []byte("{\"entry\": "), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.Remove(first); err != nil {
+		t.Fatal(err)
+	}
+
+	commands, err := spool.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 {
+		t.Fatalf("Pending() returned %d commands, want 1", len(commands))
+	}
+	got := commands[0]
+	if got.Username != "bob" || got.Entry.String() != entry.String() || got.Entry.LineNumber != 3 {
+		t.Errorf("Pending() = %+v, entry %q", got, got.Entry.String())
+	}
+	if *got.Event != *event {
+		t.Errorf("Pending() event = %v, want %v", got.Event, event)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, spoolTmpPrefix+"123")); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1-1.json"+corruptSuffix)); err != nil {
+		t.Errorf("corrupt record was not set aside: %v", err)
+	}
+}
+
+func TestOpenSpoolRejectsWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSpool(dir); err == nil {
+		t.Error("OpenSpool() accepted a world-writable directory")
+	}
+}
+
+func TestExecuteRemovesSpoolRecord(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := NewCommandExecutor(1, 5*time.Second)
+	ce.SetSpool(spool)
+
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	if _, err := ce.Execute(entry, event, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	commands, err := spool.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("Pending() after the command finished = %d commands, want 0", len(commands))
+	}
+}
+
+func TestExecuteSpooledKeepsRecord(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := NewCommandExecutor(1, 5*time.Second)
+	ce.SetSpool(spool)
+
+	event := &InotifyEvent{Path: "/tmp/file", Name: "file", Mask: InCreate, WatchDir: "/tmp"}
+	id, err := spool.add(&IncronEntry{Path: "/tmp", Mask: InCreate, Command: "true"}, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While it runs, the replayed command is journaled under its old record only
+	entry := &IncronEntry{Path: "/tmp", Mask: InCreate, Command: "ls " + dir}
+	result, err := ce.ExecuteSpooled(entry, event, "", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(result.Output)); len(got) != 1 || got[0] != id {
+		t.Errorf("spool records while replaying = %q, want only %q", got, id)
+	}
+
+	commands, err := spool.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("Pending() after the replayed command finished = %d commands, want 0", len(commands))
+	}
+}
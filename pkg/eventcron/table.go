@@ -3,32 +3,134 @@ package eventcron
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
-// LoadTable loads an eventcron table from a file
-func LoadTable(filePath string) (*IncronTable, error) {
-	table := &IncronTable{
-		FilePath: filePath,
+// ErrTableNotFound is returned when loading a table file that doesn't exist
+var ErrTableNotFound = errors.New("table not found")
+
+// ErrTooManyEntries is returned when a table has more than
+// TableConfig.MaxEntries entries, counting every path of a brace list
+var ErrTooManyEntries = errors.New("too many entries in table")
+
+// DefaultMaxEntriesPerTable is the default of TableConfig.MaxEntries
+const DefaultMaxEntriesPerTable = 1000
+
+// MaxBracePaths limits the paths the brace lists of one entry may stand for,
+// so a short line can't expand to millions of watches
+const MaxBracePaths = 256
+
+// TableConfig holds the settings tables are read with. eventcrond and
+// eventcrontab fill it from the configuration file.
+type TableConfig struct {
+	UserTableDir   string // Directory holding a table per user, user_table_dir
+	SystemTableDir string // Directory of the system tables, system_table_dir
+
+	// MaxEntries limits the entries of a single table, so a huge table
+	// can't make the daemon add an unbounded number of watches. Loading and
+	// validating a larger table fails; 0 removes the limit.
+	MaxEntries int
+
+	// MaxLineLength is the longest table line, in bytes, that can be read,
+	// e.g. for an entry with a long inline script; 0 for
+	// DefaultMaxLineLength.
+	MaxLineLength int
+}
+
+// DefaultTableConfig returns the settings used without a configuration file
+func DefaultTableConfig() *TableConfig {
+	return &TableConfig{
+		UserTableDir:   DefaultUserTableDir,
+		SystemTableDir: DefaultSystemTableDir,
+		MaxEntries:     DefaultMaxEntriesPerTable,
+		MaxLineLength:  DefaultMaxLineLength,
 	}
+}
 
-	// Extract username from file path if it's a user table
-	if strings.Contains(filePath, DefaultUserTableDir) {
-		base := filepath.Base(filePath)
-		table.Username = base
+// maxLineLength returns the longest line tc allows
+func (tc *TableConfig) maxLineLength() int {
+	if tc.MaxLineLength <= 0 {
+		return DefaultMaxLineLength
 	}
+	return tc.MaxLineLength
+}
+
+// ErrLineTooLong is returned when a table line is longer than
+// TableConfig.MaxLineLength
+var ErrLineTooLong = errors.New("line too long")
+
+// DefaultMaxLineLength is the default of TableConfig.MaxLineLength
+const DefaultMaxLineLength = 1 << 20
 
+// File modes for saved tables. User tables can contain commands their owner
+// wants kept private.
+const (
+	UserTableMode   os.FileMode = 0600
+	SystemTableMode os.FileMode = 0644
+)
+
+// LoadTable loads an eventcron table from a file
+func (tc *TableConfig) LoadTable(filePath string) (*IncronTable, error) {
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, filePath)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open table file %s: %v", filePath, err)
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	table, err := tc.LoadTableReader(file, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract username from file path if it's a user table
+	if filepath.Dir(filepath.Clean(filePath)) == filepath.Clean(tc.UserTableDir) {
+		table.Username = filepath.Base(filePath)
+	}
+
+	return table, nil
+}
+
+// LoadTableReader parses an eventcron table from r. The name is used as the
+// table's FilePath and in error messages. It fails on the first invalid line.
+func (tc *TableConfig) LoadTableReader(r io.Reader, name string) (*IncronTable, error) {
+	table, errs := tc.parseTable(r, name, true)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return table, nil
+}
+
+// ParseTableAll parses an eventcron table from r like LoadTableReader, but
+// doesn't stop at an invalid line. It returns the table of all valid entries,
+// with an error for every invalid line. Invalid lines are kept in the table's
+// layout like comments.
+func (tc *TableConfig) ParseTableAll(r io.Reader, name string) (*IncronTable, []error) {
+	return tc.parseTable(r, name, false)
+}
+
+// parseTable parses a table, stopping at the first invalid line if failFast
+// is set
+func (tc *TableConfig) parseTable(r io.Reader, name string, failFast bool) (*IncronTable, []error) {
+	table := &IncronTable{
+		FilePath: name,
+	}
+	var errs []error
+
+	scanner := tc.newTableScanner(r)
 	lineNumber := 0
+	watches := 0
 
 	for scanner.Scan() {
 		lineNumber++
@@ -36,76 +138,198 @@ func LoadTable(filePath string) (*IncronTable, error) {
 
 		entry, err := ParseEntry(line, lineNumber)
 		if err != nil {
-			return nil, fmt.Errorf("error in file %s: %v", filePath, err)
+			errs = append(errs, fmt.Errorf("error in file %s: %v", name, err))
+			if failFast {
+				return nil, errs
+			}
+			table.Raw = append(table.Raw, Line{Text: line})
+			continue
 		}
 
-		// Skip nil entries (empty lines, comments)
-		if entry != nil {
-			table.Add(*entry)
+		// Remember the layout so SaveTable can write comments back
+		if entry == nil {
+			table.Raw = append(table.Raw, Line{Text: line})
+			continue
+		}
+		// Don't read the rest of a table that is too large anyway
+		watches += braceCount(entry.Path)
+		if tc.MaxEntries > 0 && watches > tc.MaxEntries {
+			return table, append(errs, tc.tooManyEntries(name))
 		}
+		table.Raw = append(table.Raw, Line{Text: line, LineNumber: lineNumber, rendered: entry.String()})
+		table.Add(*entry)
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file %s: %v", filePath, err)
+		errs = append(errs, tc.scanError(err, name, lineNumber))
 	}
 
-	return table, nil
+	return table, errs
 }
 
-// SaveTable saves an eventcron table to a file
-func SaveTable(table *IncronTable, filePath string) error {
+// newTableScanner reads the lines of a table, allowing lines of up to
+// tc.MaxLineLength bytes
+func (tc *TableConfig) newTableScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// The buffer holds the line's newline as well
+	max := tc.maxLineLength()
+	scanner.Buffer(make([]byte, 0, min(bufio.MaxScanTokenSize, max+1)), max+1)
+	return scanner
+}
+
+// scanError returns the error for a table scanner that stopped after
+// lineNumber lines, naming the line that is too long
+func (tc *TableConfig) scanError(err error, name string, lineNumber int) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%w in file %s: line %d is longer than %d bytes (max_line_length)",
+			ErrLineTooLong, name, lineNumber+1, tc.maxLineLength())
+	}
+	return fmt.Errorf("error reading file %s: %v", name, err)
+}
+
+// tooManyEntries returns the error for a table over tc.MaxEntries
+func (tc *TableConfig) tooManyEntries(name string) error {
+	return fmt.Errorf("%w %s: more than %d (max_entries_per_table)", ErrTooManyEntries, name, tc.MaxEntries)
+}
+
+// tableTmpPrefix starts the names of the temporary files SaveTable writes
+// next to a table. They are never loaded as tables.
+const tableTmpPrefix = ".tmp-"
+
+// staleTmpAge is the age after which SaveTable removes temporary files left
+// behind by a save that was interrupted
+const staleTmpAge = time.Hour
+
+// SaveTable saves an eventcron table to a file with the given mode. The table
+// is written to a temporary file in the same directory and renamed over the
+// old one, so the daemon reads either the old or the new table, and a failed
+// save leaves the old one in place. The temporary file is never readable by
+// others, and it takes over the owner of the table it replaces.
+func SaveTable(table *IncronTable, filePath string, mode os.FileMode) error {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(filePath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", dir, err)
 	}
+	removeStaleTemps(dir)
 
-	file, err := os.Create(filePath)
+	tmp, err := os.CreateTemp(dir, tableTmpPrefix+filepath.Base(filePath)+"-")
 	if err != nil {
 		return fmt.Errorf("failed to create file %s: %v", filePath, err)
 	}
-	defer file.Close()
+	if err := writeTable(tmp, table, filePath, mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write file %s: %v", filePath, err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace %s: %v", filePath, err)
+	}
+	return nil
+}
 
-	// Write header comment
-	fmt.Fprintf(file, "# Eventcron table for user %s\n", table.Username)
-	fmt.Fprintf(file, "# Format: <path> <mask> <command>\n")
-	fmt.Fprintf(file, "# Generated by eventcron %s\n\n", Version)
+// removeStaleTemps removes the temporary files of saves in dir that were
+// interrupted more than staleTmpAge ago. Newer ones may belong to a save
+// still in progress.
+func removeStaleTemps(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), tableTmpPrefix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleTmpAge {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
 
-	// Write entries
-	for _, entry := range table.Entries {
-		fmt.Fprintln(file, entry.String())
+// writeTable writes table to file, the temporary file of the table at
+// filePath, and gives it mode and the owner and group of the existing
+// table. A symlink in place of the table is refused rather than replaced.
+func writeTable(file *os.File, table *IncronTable, filePath string, mode os.FileMode) error {
+	// The umask may have cleared bits
+	if err := file.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", filePath, err)
+	}
+	if info, err := os.Lstat(filePath); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to replace %s: it is a symlink", filePath)
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := file.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+				return fmt.Errorf("failed to keep owner of %s: %v", filePath, err)
+			}
+		}
 	}
 
+	var content strings.Builder
+	if len(table.Raw) > 0 {
+		// Tables read from a file are written back with their own comments
+		fmt.Fprintln(&content, table.Format())
+	} else {
+		// Write header comment
+		fmt.Fprintf(&content, "# Eventcron table for user %s\n", table.Username)
+		fmt.Fprintf(&content, "# Format: <path> <mask> <command>\n")
+		fmt.Fprintf(&content, "# Generated by eventcron %s\n\n", Version)
+
+		// Write entries
+		for _, entry := range table.Entries {
+			fmt.Fprintln(&content, entry.String())
+		}
+	}
+
+	if _, err := file.WriteString(content.String()); err != nil {
+		return fmt.Errorf("failed to write file %s: %v", filePath, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to write file %s: %v", filePath, err)
+	}
 	return nil
 }
 
 // LoadUserTable loads a user's eventcron table
-func LoadUserTable(username string) (*IncronTable, error) {
-	tablePath := GetUserTablePath(username)
-	return LoadTable(tablePath)
+func (tc *TableConfig) LoadUserTable(username string) (*IncronTable, error) {
+	tablePath := tc.GetUserTablePath(username)
+	return tc.LoadTable(tablePath)
 }
 
 // LoadSystemTable loads a system eventcron table
-func LoadSystemTable(tableName string) (*IncronTable, error) {
-	tablePath := GetSystemTablePath(tableName)
-	return LoadTable(tablePath)
+func (tc *TableConfig) LoadSystemTable(tableName string) (*IncronTable, error) {
+	tablePath := tc.GetSystemTablePath(tableName)
+	return tc.LoadTable(tablePath)
 }
 
 // GetUserTablePath returns the path to a user's eventcron table
-func GetUserTablePath(username string) string {
-	return filepath.Join(DefaultUserTableDir, username)
+func (tc *TableConfig) GetUserTablePath(username string) string {
+	return filepath.Join(tc.UserTableDir, username)
 }
 
 // GetSystemTablePath returns the path to a system eventcron table
-func GetSystemTablePath(tableName string) string {
-	return filepath.Join(DefaultSystemTableDir, tableName)
+func (tc *TableConfig) GetSystemTablePath(tableName string) string {
+	return filepath.Join(tc.SystemTableDir, tableName)
+}
+
+// LoadAllUserTables loads all user tables from the user table directory.
+// Tables whose filename is not an existing user are skipped with a warning,
+// and removed as well if prune is set. Entry paths are expanded for the
+// table's user with ExpandPaths.
+func (tc *TableConfig) LoadAllUserTables(prune bool) (map[string]*IncronTable, error) {
+	return tc.loadUserTablesFrom(tc.UserTableDir, prune)
 }
 
-// LoadAllUserTables loads all user tables from the user table directory
-func LoadAllUserTables() (map[string]*IncronTable, error) {
+// loadUserTablesFrom loads all user tables found in dir
+func (tc *TableConfig) loadUserTablesFrom(dir string, prune bool) (map[string]*IncronTable, error) {
 	tables := make(map[string]*IncronTable)
 
-	entries, err := os.ReadDir(DefaultUserTableDir)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return tables, nil // Return empty map if directory doesn't exist
@@ -114,17 +338,49 @@ func LoadAllUserTables() (map[string]*IncronTable, error) {
 	}
 
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tableTmpPrefix) {
 			continue
 		}
 
 		username := entry.Name()
-		table, err := LoadUserTable(username)
+		tablePath := filepath.Join(dir, username)
+
+		// Never watch on behalf of an account that no longer exists
+		owner, err := user.Lookup(username)
+		if err != nil {
+			var unknown user.UnknownUserError
+			if !errors.As(err, &unknown) {
+				fmt.Fprintf(os.Stderr, "Warning: failed to look up user %s, skipping table: %v\n", username, err)
+				continue
+			}
+			if !prune {
+				fmt.Fprintf(os.Stderr, "Warning: skipping table %s: user %s does not exist\n", tablePath, username)
+				continue
+			}
+			if err := os.Remove(tablePath); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to remove orphaned table %s: %v\n", tablePath, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: removed orphaned table %s: user %s does not exist\n", tablePath, username)
+			}
+			continue
+		}
+
+		table, err := tc.LoadTable(tablePath)
 		if err != nil {
 			// Log error but continue with other tables
 			fmt.Fprintf(os.Stderr, "Warning: failed to load user table for %s: %v\n", username, err)
 			continue
 		}
+		table.Username = username
+
+		if errs := table.ExpandPaths(owner); len(errs) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: failed to load user table for %s: %v\n", username, errs[0])
+			continue
+		}
+		if err := checkTablePrivileged(table); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to load user table for %s: %v\n", username, err)
+			continue
+		}
 
 		if !table.IsEmpty() {
 			tables[username] = table
@@ -134,11 +390,126 @@ func LoadAllUserTables() (map[string]*IncronTable, error) {
 	return tables, nil
 }
 
+// combinedSectionPrefix starts the section headers of a combined table
+const combinedSectionPrefix = "[user:"
+
+// LoadCombinedTable loads the user tables of a combined table file, in which
+// a line like [user:alice] starts the entries of user alice. A user may have
+// several sections. Entries keep the line numbers of the combined file, and
+// it fails on the first invalid line like LoadTable. Its entries run as the
+// users named in it, so the file must be owned by root and not writable by
+// group or others. Sections of users that don't exist or that fail to expand
+// are skipped, and the reasons are returned in skipped.
+func (tc *TableConfig) LoadCombinedTable(path string) (tables map[string]*IncronTable, skipped []error, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTableNotFound, path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open table file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot stat table file %s: %v", path, err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 {
+		return nil, nil, fmt.Errorf("table file %s is not owned by root", path)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return nil, nil, fmt.Errorf("table file %s is writable by group or others", path)
+	}
+
+	sections, err := tc.parseCombinedTable(file, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tables = make(map[string]*IncronTable)
+	for username, table := range sections {
+		owner, err := user.Lookup(username)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("skipping section [user:%s] of %s: %v", username, path, err))
+			continue
+		}
+		if errs := table.ExpandPaths(owner); len(errs) > 0 {
+			skipped = append(skipped, fmt.Errorf("skipping section [user:%s] of %s: %v", username, path, errs[0]))
+			continue
+		}
+		if err := checkTablePrivileged(table); err != nil {
+			skipped = append(skipped, fmt.Errorf("skipping section [user:%s] of %s: %v", username, path, err))
+			continue
+		}
+
+		if !table.IsEmpty() {
+			tables[username] = table
+		}
+	}
+
+	return tables, skipped, nil
+}
+
+// parseCombinedTable parses a combined table into a table per user
+func (tc *TableConfig) parseCombinedTable(r io.Reader, name string) (map[string]*IncronTable, error) {
+	tables := make(map[string]*IncronTable)
+	watches := make(map[string]int)
+	var table *IncronTable
+
+	scanner := tc.newTableScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "[") {
+			username, ok := strings.CutPrefix(line, combinedSectionPrefix)
+			username, closed := strings.CutSuffix(username, "]")
+			if !ok || !closed || username == "" || strings.ContainsAny(username, "/ \t") {
+				return nil, fmt.Errorf("error in file %s: line %d: invalid section header %s, expected [user:<name>]", name, lineNumber, line)
+			}
+			if table = tables[username]; table == nil {
+				table = &IncronTable{FilePath: name, Username: username}
+				tables[username] = table
+			}
+			continue
+		}
+
+		entry, err := ParseEntry(line, lineNumber)
+		if err != nil {
+			return nil, fmt.Errorf("error in file %s: %v", name, err)
+		}
+		if entry == nil {
+			continue
+		}
+		if table == nil {
+			return nil, fmt.Errorf("error in file %s: line %d: entry before the first [user:<name>] section", name, lineNumber)
+		}
+		watches[table.Username] += braceCount(entry.Path)
+		if tc.MaxEntries > 0 && watches[table.Username] > tc.MaxEntries {
+			return nil, tc.tooManyEntries(name + " [user:" + table.Username + "]")
+		}
+		table.Add(*entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, tc.scanError(err, name, lineNumber)
+	}
+
+	return tables, nil
+}
+
 // LoadAllSystemTables loads all system tables from the system table directory
-func LoadAllSystemTables() (map[string]*IncronTable, error) {
+func (tc *TableConfig) LoadAllSystemTables() (map[string]*IncronTable, error) {
+	return tc.loadSystemTablesFrom(tc.SystemTableDir)
+}
+
+// loadSystemTablesFrom loads all system tables found in dir
+func (tc *TableConfig) loadSystemTablesFrom(dir string) (map[string]*IncronTable, error) {
 	tables := make(map[string]*IncronTable)
 
-	entries, err := os.ReadDir(DefaultSystemTableDir)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return tables, nil // Return empty map if directory doesn't exist
@@ -147,17 +518,21 @@ func LoadAllSystemTables() (map[string]*IncronTable, error) {
 	}
 
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tableTmpPrefix) {
 			continue
 		}
 
 		tableName := entry.Name()
-		table, err := LoadSystemTable(tableName)
+		table, err := tc.LoadTable(filepath.Join(dir, tableName))
 		if err != nil {
 			// Log error but continue with other tables
 			fmt.Fprintf(os.Stderr, "Warning: failed to load system table %s: %v\n", tableName, err)
 			continue
 		}
+		if err := checkTablePrivileged(table); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to load system table %s: %v\n", tableName, err)
+			continue
+		}
 
 		if !table.IsEmpty() {
 			tables[tableName] = table
@@ -174,18 +549,18 @@ func TableExists(filePath string) bool {
 }
 
 // UserTableExists checks if a user table exists
-func UserTableExists(username string) bool {
-	return TableExists(GetUserTablePath(username))
+func (tc *TableConfig) UserTableExists(username string) bool {
+	return TableExists(tc.GetUserTablePath(username))
 }
 
 // SystemTableExists checks if a system table exists
-func SystemTableExists(tableName string) bool {
-	return TableExists(GetSystemTablePath(tableName))
+func (tc *TableConfig) SystemTableExists(tableName string) bool {
+	return TableExists(tc.GetSystemTablePath(tableName))
 }
 
 // RemoveUserTable removes a user's eventcron table
-func RemoveUserTable(username string) error {
-	tablePath := GetUserTablePath(username)
+func (tc *TableConfig) RemoveUserTable(username string) error {
+	tablePath := tc.GetUserTablePath(username)
 	err := os.Remove(tablePath)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove user table for %s: %v", username, err)
@@ -194,8 +569,8 @@ func RemoveUserTable(username string) error {
 }
 
 // RemoveSystemTable removes a system eventcron table
-func RemoveSystemTable(tableName string) error {
-	tablePath := GetSystemTablePath(tableName)
+func (tc *TableConfig) RemoveSystemTable(tableName string) error {
+	tablePath := tc.GetSystemTablePath(tableName)
 	err := os.Remove(tablePath)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove system table %s: %v", tableName, err)
@@ -203,12 +578,49 @@ func RemoveSystemTable(tableName string) error {
 	return nil
 }
 
-// ValidateTable validates all entries in a table
-func ValidateTable(table *IncronTable) []error {
+// ValidateTable validates all entries in a table. The paths of a user table
+// are checked as they will be after ExpandPaths.
+func (tc *TableConfig) ValidateTable(table *IncronTable) []error {
+	return tc.validateTable(table, ValidateEntry)
+}
+
+// ValidateTableStrict validates all entries in a table with ValidateEntryStrict
+func (tc *TableConfig) ValidateTableStrict(table *IncronTable) []error {
+	return tc.validateTable(table, ValidateEntryStrict)
+}
+
+// validateTable checks a copy of every entry, with its path expanded for the
+// table's user, using validate
+func (tc *TableConfig) validateTable(table *IncronTable, validate func(*IncronEntry) error) []error {
 	var errors []error
 
+	watches := 0
+	for i := range table.Entries {
+		watches += braceCount(table.Entries[i].Path)
+	}
+	if tc.MaxEntries > 0 && watches > tc.MaxEntries {
+		errors = append(errors, tc.tooManyEntries(table.FilePath))
+	}
+
+	var owner *user.User
+	if table.Username != "" {
+		owner, _ = user.Lookup(table.Username)
+	}
+
 	for i, entry := range table.Entries {
-		if err := ValidateEntry(&entry); err != nil {
+		if owner != nil {
+			path, err := ExpandPath(entry.Path, owner)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("entry %d: %v", i+1, err))
+				continue
+			}
+			entry.Path = path
+		}
+		if err := validate(&entry); err != nil {
+			errors = append(errors, fmt.Errorf("entry %d: %v", i+1, err))
+			continue
+		}
+		if err := checkPrivileged(&entry, table.Username); err != nil {
 			errors = append(errors, fmt.Errorf("entry %d: %v", i+1, err))
 		}
 	}
@@ -216,11 +628,193 @@ func ValidateTable(table *IncronTable) []error {
 	return errors
 }
 
+// DuplicateWarnings describes the entries of a table that repeat an earlier
+// entry, see IncronTable.Duplicates. They are warnings rather than validation
+// errors, as the table still works; the command just runs twice.
+func DuplicateWarnings(table *IncronTable) []string {
+	var warnings []string
+	for _, duplicate := range table.Duplicates() {
+		entry := table.Entries[duplicate.Index]
+		warnings = append(warnings, fmt.Sprintf("line %d repeats line %d, so its command runs twice per event: %s",
+			entry.LineNumber, table.Entries[duplicate.Original].LineNumber, entry.String()))
+	}
+	return warnings
+}
+
+// checkPrivileged checks the options of an entry in the table of username,
+// which is empty for system tables, that only root may use. Only system
+// tables may run commands as another user, and the user must exist so the
+// command never falls back to root. Raising the CPU or I/O priority, with a
+// negative nice= or ionice=realtime, is reserved for system tables too, as
+// the daemon sets it as root.
+func checkPrivileged(entry *IncronEntry, username string) error {
+	if username != "" {
+		if entry.Options.Nice < 0 {
+			return fmt.Errorf("nice=%d is only allowed in system tables", entry.Options.Nice)
+		}
+		if class, _, _ := strings.Cut(entry.Options.IONice, ":"); ioClasses[class] == ioprioClassRealtime {
+			return fmt.Errorf("ionice=%s is only allowed in system tables", entry.Options.IONice)
+		}
+	}
+	if entry.Options.RunAs == "" {
+		return nil
+	}
+	if username != "" {
+		return fmt.Errorf("user=%s is only allowed in system tables", entry.Options.RunAs)
+	}
+	if _, err := user.Lookup(entry.Options.RunAs); err != nil {
+		return fmt.Errorf("invalid value for user: %s (%v)", entry.Options.RunAs, err)
+	}
+	return nil
+}
+
+// checkTablePrivileged returns the first problem checkPrivileged finds in a
+// table
+func checkTablePrivileged(table *IncronTable) error {
+	for i := range table.Entries {
+		if err := checkPrivileged(&table.Entries[i], table.Username); err != nil {
+			return fmt.Errorf("line %d: %v", table.Entries[i].LineNumber, err)
+		}
+	}
+	return nil
+}
+
+// ExpandBraces returns the paths a path with brace lists stands for, like the
+// shell: /srv/{a,b}/in is /srv/a/in and /srv/b/in, and several lists in one
+// path give every combination. Braces without a comma inside, such as
+// ${HOME}, are kept as they are. Lists can't be nested. A path standing for
+// more than MaxBracePaths paths is returned unexpanded; ValidateEntry rejects
+// it.
+func ExpandBraces(path string) []string {
+	if braceCount(path) > MaxBracePaths {
+		return []string{path}
+	}
+	return expandBraces(path)
+}
+
+// expandBraces does the work of ExpandBraces without the limit
+func expandBraces(path string) []string {
+	for start := strings.IndexByte(path, '{'); start >= 0; {
+		end := strings.IndexByte(path[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		inner := path[start+1 : end]
+		if strings.Contains(inner, ",") && !strings.Contains(inner, "{") {
+			var paths []string
+			seen := make(map[string]bool)
+			for _, alternative := range strings.Split(inner, ",") {
+				for _, rest := range expandBraces(path[end+1:]) {
+					expanded := path[:start] + alternative + rest
+					if !seen[expanded] {
+						seen[expanded] = true
+						paths = append(paths, expanded)
+					}
+				}
+			}
+			return paths
+		}
+
+		next := strings.IndexByte(path[start+1:], '{')
+		if next < 0 {
+			break
+		}
+		start += 1 + next
+	}
+	return []string{path}
+}
+
+// braceCount returns how many paths ExpandBraces makes of path before
+// removing duplicates, without expanding it. Counts above MaxBracePaths are
+// returned as MaxBracePaths+1.
+func braceCount(path string) int {
+	for start := strings.IndexByte(path, '{'); start >= 0; {
+		end := strings.IndexByte(path[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		inner := path[start+1 : end]
+		if strings.Contains(inner, ",") && !strings.Contains(inner, "{") {
+			count := (strings.Count(inner, ",") + 1) * braceCount(path[end+1:])
+			return min(count, MaxBracePaths+1)
+		}
+
+		next := strings.IndexByte(path[start+1:], '{')
+		if next < 0 {
+			break
+		}
+		start += 1 + next
+	}
+	return 1
+}
+
+// ExpandPath expands a leading ~ and the variables $HOME, $USER, $LOGNAME,
+// $UID and $GID (also written ${HOME} etc.) in path from the passwd entry of
+// u, not from the environment. The result must be absolute.
+func ExpandPath(path string, u *user.User) (string, error) {
+	if !strings.HasPrefix(path, "~") && !strings.Contains(path, "$") {
+		return path, nil
+	}
+
+	expanded := path
+	if expanded == "~" || strings.HasPrefix(expanded, "~/") {
+		expanded = u.HomeDir + expanded[1:]
+	} else if strings.HasPrefix(expanded, "~") {
+		return "", fmt.Errorf("cannot expand %s: only ~ for the table's own user is supported", path)
+	}
+
+	vars := map[string]string{
+		"HOME":    u.HomeDir,
+		"USER":    u.Username,
+		"LOGNAME": u.Username,
+		"UID":     u.Uid,
+		"GID":     u.Gid,
+	}
+	var unknown string
+	expanded = os.Expand(expanded, func(name string) string {
+		value, ok := vars[name]
+		if !ok && unknown == "" {
+			unknown = name
+		}
+		return value
+	})
+	if unknown != "" {
+		return "", fmt.Errorf("cannot expand %s: unknown variable $%s", path, unknown)
+	}
+
+	if !filepath.IsAbs(expanded) {
+		return "", fmt.Errorf("path must be absolute after expansion: %s (from %s)", expanded, path)
+	}
+	return filepath.Clean(expanded), nil
+}
+
 // ValidateEntry validates a single eventcron entry
 func ValidateEntry(entry *IncronEntry) error {
-	// Check if path is absolute
-	if !filepath.IsAbs(entry.Path) {
-		return fmt.Errorf("path must be absolute: %s", entry.Path)
+	if braceCount(entry.Path) > MaxBracePaths {
+		return fmt.Errorf("path %s stands for more than %d paths", entry.Path, MaxBracePaths)
+	}
+
+	// Check if path is absolute, for every path a brace list stands for
+	for _, path := range ExpandBraces(entry.Path) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("path must be absolute: %s", path)
+		}
+	}
+
+	// Pruned subtrees must lie below the watched path
+	for _, prune := range entry.Options.Prune {
+		if !prunesBelow(entry, prune) {
+			return fmt.Errorf("prune path %s is not below the watched path %s", prune, entry.Path)
+		}
+	}
+
+	// Literal paths are watched as written and matched exactly
+	if entry.Options.NoCase && !strings.Contains(entry.Path, "*") {
+		return fmt.Errorf("nocase=true only applies to paths with a * pattern")
 	}
 
 	// Check if command is not empty
@@ -233,5 +827,64 @@ func ValidateEntry(entry *IncronEntry) error {
 		return fmt.Errorf("event mask cannot be zero")
 	}
 
+	// on_close_only waits for an event the entry must watch
+	if entry.Options.OnCloseOnly && entry.Mask&InCloseWrite == 0 {
+		return fmt.Errorf("on_close_only=true needs IN_CLOSE_WRITE in the mask")
+	}
+
+	// Check if the per-entry timeout is usable
+	if entry.Options.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative: %v", entry.Options.Timeout)
+	}
+
+	// A cooldown holds back the events restart=true would restart on
+	if entry.Options.Restart && entry.Options.Cooldown > 0 {
+		return fmt.Errorf("restart=true cannot be combined with cooldown=")
+	}
+
+	return nil
+}
+
+// prunesBelow reports whether prune lies below one of the paths the entry
+// watches
+func prunesBelow(entry *IncronEntry, prune string) bool {
+	for _, path := range ExpandBraces(entry.Path) {
+		root := strings.TrimSuffix(filepath.Clean(path), string(filepath.Separator))
+		if strings.HasPrefix(prune, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateEntryStrict validates an entry like ValidateEntry and also checks
+// that the programs of a non-shell command and its onsuccess= and onfailure=
+// commands can be found, either as an executable path or in PATH. Programs
+// named through wildcards are not checked.
+func ValidateEntryStrict(entry *IncronEntry) error {
+	if err := ValidateEntry(entry); err != nil {
+		return err
+	}
+	if entry.Options.Shell {
+		return nil
+	}
+
+	for _, command := range []string{entry.Command, entry.Options.OnSuccess, entry.Options.OnFailure} {
+		if command == "" {
+			continue
+		}
+		args := parseCommand(command)
+		if len(args) == 0 {
+			return fmt.Errorf("command cannot be empty")
+		}
+		program := args[0]
+		if strings.Contains(program, "$") {
+			continue
+		}
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("command not found: %s", program)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,812 @@
+package eventcron
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadUserTablesSkipsUnknownUsers(t *testing.T) {
+	tc := DefaultTableConfig()
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+
+	const orphan = "eventcron-no-such-user"
+	const line = "/tmp IN_CREATE echo $@/$#\n"
+
+	for _, prune := range []bool{false, true} {
+		dir := t.TempDir()
+		for _, name := range []string{current.Username, orphan} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(line), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tables, err := tc.loadUserTablesFrom(dir, prune)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := tables[current.Username]; !ok {
+			t.Errorf("prune=%v: table for %s was not loaded", prune, current.Username)
+		}
+		if tables[current.Username] != nil && tables[current.Username].Username != current.Username {
+			t.Errorf("prune=%v: Username = %q, want %q", prune, tables[current.Username].Username, current.Username)
+		}
+		if _, ok := tables[orphan]; ok {
+			t.Errorf("prune=%v: table for non-existent user was loaded", prune)
+		}
+
+		_, statErr := os.Stat(filepath.Join(dir, orphan))
+		if exists := statErr == nil; exists == prune {
+			t.Errorf("prune=%v: orphaned table exists = %v", prune, exists)
+		}
+	}
+}
+
+func TestSaveTablePreservesComments(t *testing.T) {
+	tc := DefaultTableConfig()
+	const content = `# Build hooks
+
+/srv/src IN_CLOSE_WRITE  make -C $@   # two spaces on purpose
+# Uploads
+/srv/in IN_MOVED_TO,IN_CREATE /usr/local/bin/ingest $/
+`
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := tc.LoadTable(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged tables round-trip byte for byte
+	dst := filepath.Join(dir, "dst")
+	if err := SaveTable(table, dst, UserTableMode); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("round trip changed the table:\n got: %q\nwant: %q", got, content)
+	}
+
+	// Edited and added entries are rendered, comments stay in place
+	table.Entries[1].Command = "/usr/local/bin/ingest -q $/"
+	table.Add(IncronEntry{Path: "/srv/out", Mask: InDelete, Command: "logger $#"})
+	want := `# Build hooks
+
+/srv/src IN_CLOSE_WRITE  make -C $@   # two spaces on purpose
+# Uploads
+` + table.Entries[1].String() + `
+` + table.Entries[2].String()
+	if got := table.Format(); got != want {
+		t.Errorf("Format() =\n%s\nwant:\n%s", got, want)
+	}
+
+	// Removing an entry doesn't move the others onto its line
+	table.Entries = table.Entries[1:]
+	want = `# Build hooks
+
+# Uploads
+` + table.Entries[0].String() + `
+` + table.Entries[1].String()
+	if got := table.Format(); got != want {
+		t.Errorf("Format() after removing the first entry =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestValidateEntryStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{"program in PATH", "/tmp IN_CREATE sh -c true", false},
+		{"absolute path", "/tmp IN_CREATE /bin/sh -c true", false},
+		{"typo in path", "/tmp IN_CREATE /usr/bni/rsync $/ remote:", true},
+		{"unknown program", "/tmp IN_CREATE eventcron-no-such-command $/", true},
+		{"shell command", "/tmp IN_CREATE,shell=true eventcron-no-such-command $/", false},
+		{"wildcard program", "/tmp IN_CREATE $/ --run", false},
+		{"basic validation still applies", "tmp IN_CREATE /bin/sh", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := ParseEntry(tt.line, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ValidateEntryStrict(entry)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateEntryStrict() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && ValidateEntry(entry) != nil {
+				t.Errorf("ValidateEntry() rejected an entry ValidateEntryStrict accepts")
+			}
+		})
+	}
+}
+
+func TestValidateEntryStrictBlankCommand(t *testing.T) {
+	for _, entry := range []*IncronEntry{
+		{Path: "/tmp", Mask: InCreate, Command: " \t "},
+		{Path: "/tmp", Mask: InCreate, Command: "true", Options: EntryOptions{OnSuccess: "  "}},
+	} {
+		if err := ValidateEntryStrict(entry); err == nil {
+			t.Errorf("ValidateEntryStrict(%q, onsuccess=%q) accepted a blank command", entry.Command, entry.Options.OnSuccess)
+		}
+	}
+}
+
+func TestValidateEntryPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{"below the root", "/data IN_CREATE,prune=/data/tmp echo $#", false},
+		{"below one brace path", "/srv/{a,b} IN_CREATE,prune=/srv/b/cache echo $#", false},
+		{"below /", "/ IN_CREATE,force=true,prune=/proc echo $#", false},
+		{"the root itself", "/data IN_CREATE,prune=/data echo $#", true},
+		{"outside the root", "/data IN_CREATE,prune=/var/tmp echo $#", true},
+		{"sharing a prefix", "/data IN_CREATE,prune=/database echo $#", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := ParseEntry(tt.line, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ValidateEntry(entry); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadTableNotFound(t *testing.T) {
+	tc := DefaultTableConfig()
+	_, err := tc.LoadTable(filepath.Join(t.TempDir(), "missing"))
+	if !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("LoadTable() of a missing file returned %v, want ErrTableNotFound", err)
+	}
+}
+
+func TestLoadTableReader(t *testing.T) {
+	tc := DefaultTableConfig()
+	input := "# comment\n/tmp IN_CREATE echo $#\n\n/data IN_CLOSE_WRITE,recursive=false sync $/\n"
+
+	table, err := tc.LoadTableReader(strings.NewReader(input), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Count() != 2 || table.FilePath != "<stdin>" {
+		t.Fatalf("got %d entries from %q, want 2 from <stdin>", table.Count(), table.FilePath)
+	}
+	if table.Entries[1].LineNumber != 4 || table.Entries[1].Options.Recursive {
+		t.Errorf("second entry = %+v", table.Entries[1])
+	}
+	if got := table.Format(); got != strings.TrimSuffix(input, "\n") {
+		t.Errorf("Format() = %q, want %q", got, input)
+	}
+
+	_, err = tc.LoadTableReader(strings.NewReader("/tmp IN_BOGUS echo\n"), "<stdin>")
+	if err == nil || !strings.Contains(err.Error(), "<stdin>") {
+		t.Errorf("LoadTableReader() error = %v, want one naming <stdin>", err)
+	}
+}
+
+func TestParseTableAll(t *testing.T) {
+	tc := DefaultTableConfig()
+	input := "/tmp IN_BOGUS echo\n# comment\n/tmp IN_CREATE echo $#\n/data\n/srv IN_MODIFY,retries=x sync\n"
+
+	table, errs := tc.ParseTableAll(strings.NewReader(input), "<stdin>")
+	if table.Count() != 1 || table.Entries[0].LineNumber != 3 {
+		t.Errorf("got entries %+v, want only the one on line 3", table.Entries)
+	}
+
+	lines := []string{"line 1:", "line 4:", "line 5:"}
+	if len(errs) != len(lines) {
+		t.Fatalf("ParseTableAll() errors = %v, want %d", errs, len(lines))
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), lines[i]) || !strings.Contains(err.Error(), "<stdin>") {
+			t.Errorf("error %d = %v, want one for <stdin> %s", i, err, lines[i])
+		}
+	}
+
+	// The daemon's loading still fails on the first invalid line
+	if _, err := tc.LoadTableReader(strings.NewReader(input), "<stdin>"); err == nil || !strings.Contains(err.Error(), "line 1:") {
+		t.Errorf("LoadTableReader() error = %v, want the one for line 1", err)
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	alice := &user.User{Username: "alice", Uid: "1000", Gid: "100", HomeDir: "/home/alice"}
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"/srv/in", "/srv/in", false},
+		{"~", "/home/alice", false},
+		{"~/Downloads", "/home/alice/Downloads", false},
+		{"$HOME/Downloads", "/home/alice/Downloads", false},
+		{"${HOME}/in/", "/home/alice/in", false},
+		{"/srv/$USER/$UID", "/srv/alice/1000", false},
+		{"~bob/Downloads", "", true},
+		{"$SHELL/x", "", true},
+		{"$USER/in", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ExpandPath(tt.path, alice)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ExpandPath(%q) = %q, %v, want %q, error %v", tt.path, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadUserTablesExpandsPaths(t *testing.T) {
+	tc := DefaultTableConfig()
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, current.Username), []byte("$HOME/Downloads IN_CREATE echo $#\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := tc.loadUserTablesFrom(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := tables[current.Username]
+	if table == nil {
+		t.Fatal("table was not loaded")
+	}
+	if want := filepath.Join(current.HomeDir, "Downloads"); table.Entries[0].Path != want {
+		t.Errorf("Path = %q, want %q", table.Entries[0].Path, want)
+	}
+
+	// Validation checks the expanded path, but only user tables are expanded
+	unexpanded := &IncronTable{Username: current.Username, Entries: []IncronEntry{{Path: "$HOME/Downloads", Mask: InCreate, Command: "true"}}}
+	if errs := tc.ValidateTable(unexpanded); len(errs) != 0 {
+		t.Errorf("ValidateTable() of a user table = %v", errs)
+	}
+	unexpanded.Username = ""
+	if errs := tc.ValidateTable(unexpanded); len(errs) != 1 {
+		t.Errorf("ValidateTable() of a system table = %v, want a relative path error", errs)
+	}
+}
+
+func TestSaveTableMode(t *testing.T) {
+	dir := t.TempDir()
+	table := &IncronTable{Entries: []IncronEntry{{Path: "/tmp", Mask: InCreate, Command: "true"}}}
+
+	existing := filepath.Join(dir, "existing")
+	if err := os.WriteFile(existing, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		mode os.FileMode
+	}{
+		{"new user table", filepath.Join(dir, "user"), UserTableMode},
+		{"new system table", filepath.Join(dir, "system"), SystemTableMode},
+		{"existing file", existing, UserTableMode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SaveTable(table, tt.path, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.mode {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), tt.mode)
+			}
+		})
+	}
+}
+
+func TestSaveTableReplacesAtomically(t *testing.T) {
+	tc := DefaultTableConfig()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup")
+	if err := os.WriteFile(path, []byte("/old IN_CREATE true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := &IncronTable{Entries: []IncronEntry{{Path: "/new", Mask: InCreate, Command: "true"}}}
+	if err := SaveTable(table, path, SystemTableMode); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("table was rewritten in place instead of replaced")
+	}
+	saved, err := tc.LoadTable(path)
+	if err != nil || len(saved.Entries) != 1 || saved.Entries[0].Path != "/new" {
+		t.Errorf("saved table = %+v, %v, want the /new entry", saved, err)
+	}
+
+	// A failed save keeps the old table and leaves nothing behind
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTable(table, blocked, SystemTableMode); err == nil {
+		t.Error("SaveTable() over a directory succeeded")
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tableTmpPrefix) {
+			t.Errorf("temporary file %s was left behind", file.Name())
+		}
+	}
+
+	// A save in progress is never loaded as a table
+	if err := os.WriteFile(filepath.Join(dir, tableTmpPrefix+"backup-123"), []byte("/half IN_CREATE"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := tc.loadSystemTablesFrom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables["backup"] == nil {
+		t.Errorf("loaded tables %v, want only backup", tables)
+	}
+
+	// The next save removes temporary files of interrupted saves, but not
+	// the one of a save that may still be running
+	stale := filepath.Join(dir, tableTmpPrefix+"backup-456")
+	if err := os.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleTmpAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTable(table, path, SystemTableMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale temporary file was kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tableTmpPrefix+"backup-123")); err != nil {
+		t.Errorf("recent temporary file was removed: %v", err)
+	}
+
+	// A symlinked table is not replaced
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTable(table, link, SystemTableMode); err == nil {
+		t.Error("SaveTable() replaced a symlink")
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink was replaced: %v", err)
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/srv/in", []string{"/srv/in"}},
+		{"/srv/{a,b,c}/in", []string{"/srv/a/in", "/srv/b/in", "/srv/c/in"}},
+		{"/{srv,data}/{x,y}", []string{"/srv/x", "/srv/y", "/data/x", "/data/y"}},
+		{"/data{,.bak}", []string{"/data", "/data.bak"}},
+		{"/srv/{a,a,b}", []string{"/srv/a", "/srv/b"}},
+		{"${HOME}/{in,out}", []string{"${HOME}/in", "${HOME}/out"}},
+		{"/srv/{single}", []string{"/srv/{single}"}},
+		{"/srv/{a,b", []string{"/srv/{a,b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := ExpandBraces(tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExpandBraces(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	// 10^8 combinations are neither expanded nor accepted
+	huge := strings.Repeat("/{0,1,2,3,4,5,6,7,8,9}", 8)
+	if got := ExpandBraces(huge); !reflect.DeepEqual(got, []string{huge}) {
+		t.Errorf("ExpandBraces() over the limit = %d paths, want the path unexpanded", len(got))
+	}
+	if err := ValidateEntry(&IncronEntry{Path: huge, Mask: InCreate, Command: "true"}); err == nil {
+		t.Error("ValidateEntry() accepted a path over MaxBracePaths")
+	}
+	if got := len(ExpandBraces(strings.Repeat("/{0,1,2,3,4,5,6,7,8,9}", 2))); got != 100 {
+		t.Errorf("ExpandBraces() under the limit = %d paths, want 100", got)
+	}
+}
+
+func TestTableExpandBraces(t *testing.T) {
+	tc := DefaultTableConfig()
+	table, err := tc.LoadTableReader(strings.NewReader("/srv/{a,b} IN_CREATE echo $#\n/data IN_DELETE true\n"), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := tc.ValidateTable(table); len(errs) != 0 {
+		t.Fatalf("ValidateTable() = %v", errs)
+	}
+
+	table.ExpandBraces()
+	var paths []string
+	for _, entry := range table.Entries {
+		paths = append(paths, entry.Path)
+	}
+	if want := []string{"/srv/a", "/srv/b", "/data"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %q, want %q", paths, want)
+	}
+
+	// Every path of the list must be absolute
+	if err := ValidateEntry(&IncronEntry{Path: "/srv/{a,../b}", Mask: InCreate, Command: "true"}); err != nil {
+		t.Errorf("ValidateEntry() = %v", err)
+	}
+	if err := ValidateEntry(&IncronEntry{Path: "{/srv,data}", Mask: InCreate, Command: "true"}); err == nil {
+		t.Error("ValidateEntry() accepted a relative path in a brace list")
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	tc := DefaultTableConfig()
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+
+	entry := "/srv IN_CREATE,user=" + current.Username + " echo $#\n"
+	unknown := "/srv IN_CREATE,user=no-such-user-eventcron echo $#\n"
+
+	// System tables may name any existing user
+	systemDir := t.TempDir()
+	os.WriteFile(filepath.Join(systemDir, "known"), []byte(entry), 0644)
+	os.WriteFile(filepath.Join(systemDir, "unknown"), []byte(unknown), 0644)
+	system, err := tc.loadSystemTablesFrom(systemDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table := system["known"]; table == nil || table.Entries[0].Options.RunAs != current.Username {
+		t.Errorf("system table with user=%s was not loaded", current.Username)
+	}
+	if _, ok := system["unknown"]; ok {
+		t.Error("system table naming an unknown user was loaded")
+	}
+
+	// User tables can't run commands as anyone
+	userDir := t.TempDir()
+	os.WriteFile(filepath.Join(userDir, current.Username), []byte(entry), 0600)
+	users, err := tc.loadUserTablesFrom(userDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := users[current.Username]; ok {
+		t.Error("user table with user= was loaded")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		content  string
+		valid    bool
+	}{
+		{"system table", "", entry, true},
+		{"unknown user", "", unknown, false},
+		{"user table", current.Username, entry, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := tc.LoadTableReader(strings.NewReader(tt.content), "<stdin>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.Username = tt.username
+			if errs := tc.ValidateTable(table); (len(errs) == 0) != tt.valid {
+				t.Errorf("ValidateTable() = %v, want valid %v", errs, tt.valid)
+			}
+		})
+	}
+}
+
+func TestPriorityOnlyInSystemTables(t *testing.T) {
+	tc := DefaultTableConfig()
+
+	tests := []struct {
+		name     string
+		username string
+		content  string
+		valid    bool
+	}{
+		{"lower nice in a user table", "nobody", "/tmp IN_CREATE,nice=10 true\n", true},
+		{"negative nice in a user table", "nobody", "/tmp IN_CREATE,nice=-5 true\n", false},
+		{"negative nice in a system table", "", "/tmp IN_CREATE,nice=-5 true\n", true},
+		{"idle ionice in a user table", "nobody", "/tmp IN_CREATE,ionice=idle true\n", true},
+		{"realtime ionice in a user table", "nobody", "/tmp IN_CREATE,ionice=realtime:2 true\n", false},
+		{"realtime ionice in a system table", "", "/tmp IN_CREATE,ionice=realtime true\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := tc.LoadTableReader(strings.NewReader(tt.content), "<stdin>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.Username = tt.username
+			if errs := tc.ValidateTable(table); (len(errs) == 0) != tt.valid {
+				t.Errorf("ValidateTable() = %v, want valid %v", errs, tt.valid)
+			}
+			if err := checkTablePrivileged(table); (err == nil) != tt.valid {
+				t.Errorf("checkTablePrivileged() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMaxEntriesPerTable(t *testing.T) {
+	tc := &TableConfig{MaxEntries: 2}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"under the limit", "/a IN_CREATE true\n", false},
+		{"at the limit", "# comment\n/a IN_CREATE true\n/b IN_CREATE true\n", false},
+		{"over the limit", "/a IN_CREATE true\n/b IN_CREATE true\n/c IN_CREATE true\n", true},
+		{"brace list at the limit", "/{a,b} IN_CREATE true\n", false},
+		{"brace list over the limit", "/a IN_CREATE true\n/{b,c} IN_CREATE true\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tc.LoadTableReader(strings.NewReader(tt.content), "<stdin>")
+			if tt.wantErr {
+				if !errors.Is(err, ErrTooManyEntries) || !strings.Contains(err.Error(), "max_entries_per_table") {
+					t.Errorf("LoadTableReader() = %v, want %v naming the limit", err, ErrTooManyEntries)
+				}
+			} else if err != nil {
+				t.Errorf("LoadTableReader() = %v", err)
+			}
+		})
+	}
+
+	// Tables built in memory are checked by validation
+	table := &IncronTable{}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		table.Add(IncronEntry{Path: path, Mask: InCreate, Command: "true"})
+	}
+	if errs := tc.ValidateTable(table); len(errs) != 1 || !errors.Is(errs[0], ErrTooManyEntries) {
+		t.Errorf("ValidateTable() = %v, want %v", errs, ErrTooManyEntries)
+	}
+	braces := &IncronTable{}
+	braces.Add(IncronEntry{Path: "/{a,b,c}", Mask: InCreate, Command: "true"})
+	if errs := tc.ValidateTable(braces); len(errs) != 1 || !errors.Is(errs[0], ErrTooManyEntries) {
+		t.Errorf("ValidateTable() of a brace list = %v, want %v", errs, ErrTooManyEntries)
+	}
+
+	tc.MaxEntries = 0
+	if errs := tc.ValidateTable(table); len(errs) != 0 {
+		t.Errorf("ValidateTable() without a limit = %v", errs)
+	}
+}
+
+func TestTableDirs(t *testing.T) {
+	tc := &TableConfig{UserTableDir: t.TempDir(), SystemTableDir: t.TempDir()}
+
+	if got, want := tc.GetUserTablePath("alice"), filepath.Join(tc.UserTableDir, "alice"); got != want {
+		t.Errorf("GetUserTablePath() = %q, want %q", got, want)
+	}
+	if got, want := tc.GetSystemTablePath("backup"), filepath.Join(tc.SystemTableDir, "backup"); got != want {
+		t.Errorf("GetSystemTablePath() = %q, want %q", got, want)
+	}
+
+	const line = "/tmp IN_CREATE true\n"
+	if err := os.WriteFile(tc.GetUserTablePath("alice"), []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.GetSystemTablePath("backup"), []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := tc.LoadUserTable("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Username != "alice" {
+		t.Errorf("Username = %q, want %q", table.Username, "alice")
+	}
+
+	tables, err := tc.LoadAllSystemTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tables["backup"]; !ok || len(tables) != 1 {
+		t.Errorf("LoadAllSystemTables() = %v, want the backup table", tables)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	tc := DefaultTableConfig()
+
+	script := strings.Repeat("echo $#; ", 10000)
+	content := "# long inline script\n/data IN_CREATE,shell=true " + script + "\n"
+
+	table, err := tc.LoadTableReader(strings.NewReader(content), "<stdin>")
+	if err != nil {
+		t.Fatalf("LoadTableReader() with a %d byte line = %v", len(script), err)
+	}
+	if len(table.Entries) != 1 || table.Entries[0].Command != strings.TrimSpace(script) {
+		t.Error("long command was not loaded")
+	}
+
+	tc.MaxLineLength = 1000
+	_, err = tc.LoadTableReader(strings.NewReader(content), "<stdin>")
+	if !errors.Is(err, ErrLineTooLong) || !strings.Contains(err.Error(), "line 2 ") {
+		t.Errorf("LoadTableReader() = %v, want %v naming line 2", err, ErrLineTooLong)
+	}
+
+	// A line of exactly the limit still fits
+	line := "/data IN_CREATE true"
+	tc.MaxLineLength = len(line)
+	if _, err := tc.LoadTableReader(strings.NewReader(line+"\n"), "<stdin>"); err != nil {
+		t.Errorf("LoadTableReader() with a line at the limit = %v", err)
+	}
+}
+
+func TestLoadCombinedTable(t *testing.T) {
+	tc := DefaultTableConfig()
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+
+	content := `# Managed by configuration management
+[user:` + current.Username + `]
+$HOME/in IN_CREATE echo $#
+
+[user:eventcron-no-such-user]
+/tmp IN_CREATE echo $#
+
+[user:` + current.Username + `]
+/tmp IN_DELETE echo $#
+`
+	path := filepath.Join(t.TempDir(), "all.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, skipped, err := tc.LoadCombinedTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("LoadCombinedTable() = %d tables, want only the existing user's", len(tables))
+	}
+	if len(skipped) != 1 || !strings.Contains(skipped[0].Error(), "[user:eventcron-no-such-user]") {
+		t.Errorf("skipped = %v, want the section of the missing user", skipped)
+	}
+	table := tables[current.Username]
+	if table == nil || table.Username != current.Username || len(table.Entries) != 2 {
+		t.Fatalf("table = %+v, want both sections of %s", table, current.Username)
+	}
+	if want := filepath.Join(current.HomeDir, "in"); table.Entries[0].Path != want {
+		t.Errorf("Path = %q, want %q", table.Entries[0].Path, want)
+	}
+	if table.Entries[1].LineNumber != 9 {
+		t.Errorf("LineNumber = %d, want the line in the combined file", table.Entries[1].LineNumber)
+	}
+
+	if _, _, err := tc.LoadCombinedTable(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("missing file error = %v, want ErrTableNotFound", err)
+	}
+}
+
+func TestLoadCombinedTableOwnership(t *testing.T) {
+	tc := DefaultTableConfig()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to own the table file")
+	}
+	path := filepath.Join(t.TempDir(), "all.conf")
+	if err := os.WriteFile(path, []byte("[user:root]\n/tmp IN_CREATE true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tc.LoadCombinedTable(path); err != nil {
+		t.Fatalf("LoadCombinedTable() = %v for a file owned by root", err)
+	}
+
+	if err := os.Chmod(path, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tc.LoadCombinedTable(path); err == nil || !strings.Contains(err.Error(), "writable by group or others") {
+		t.Errorf("group-writable file error = %v", err)
+	}
+
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(path, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tc.LoadCombinedTable(path); err == nil || !strings.Contains(err.Error(), "not owned by root") {
+		t.Errorf("file owned by another user error = %v", err)
+	}
+}
+
+func TestParseCombinedTable(t *testing.T) {
+	tc := DefaultTableConfig()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"sections", "[user:alice]\n/tmp IN_CREATE true\n  [user:bob]  \n/srv IN_DELETE true\n", ""},
+		{"empty section", "[user:alice]\n# nothing yet\n", ""},
+		{"entry before section", "/tmp IN_CREATE true\n[user:alice]\n", "line 1: entry before the first [user:<name>] section"},
+		{"bad header", "[alice]\n/tmp IN_CREATE true\n", "line 1: invalid section header [alice]"},
+		{"no name", "[user:]\n", "line 1: invalid section header"},
+		{"invalid entry", "[user:alice]\n/tmp IN_NOPE true\n", "line 2: unknown event mask 'IN_NOPE'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables, err := tc.parseCombinedTable(strings.NewReader(tt.content), "all.conf")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if table := tables["alice"]; table == nil || table.Username != "alice" {
+				t.Errorf("tables = %+v, want a table for alice", tables)
+			}
+		})
+	}
+}
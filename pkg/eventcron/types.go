@@ -3,10 +3,15 @@ package eventcron
 
 import (
 	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Version information
@@ -22,8 +27,17 @@ const (
 	DefaultSystemTableDir = "/etc/eventcron.d"
 	DefaultAllowFile     = "/etc/eventcron.allow"
 	DefaultDenyFile      = "/etc/eventcron.deny"
+	DefaultPidFile       = "/run/eventcrond.pid"
+	DefaultControlSocket = "/run/eventcrond.sock"
 )
 
+// DefaultSettleTime is the quiet period used by settle=true
+const DefaultSettleTime = 2 * time.Second
+
+// DefaultRetryDelay is the wait before the first retry when retries= is set
+// without retry_delay=
+const DefaultRetryDelay = time.Second
+
 // Inotify event masks - mapping from original C++ constants
 const (
 	InAccess        = syscall.IN_ACCESS
@@ -106,11 +120,171 @@ var ReverseEventMaskMap = map[uint32]string{
 	InAllEvents:     "IN_ALL_EVENTS",
 }
 
+// orderedEventFlags lists the single-bit flags in the order they are printed,
+// so mask strings are stable between runs
+var orderedEventFlags = []uint32{
+	InAccess, InModify, InAttrib, InCloseWrite, InCloseNowrite,
+	InOpen, InMovedFrom, InMovedTo, InCreate, InDelete,
+	InDeleteSelf, InMoveSelf, InUnmount, InQOverflow, InIgnored,
+	InOnlydir, InDontFollow, InExclUnlink, InMaskAdd, InIsdir, InOneshot,
+}
+
+// eventFlagNames returns the names of the flags set in mask, in stable order
+func eventFlagNames(mask uint32) []string {
+	var names []string
+	for _, flag := range orderedEventFlags {
+		if mask&flag != 0 {
+			names = append(names, ReverseEventMaskMap[flag])
+		}
+	}
+	return names
+}
+
+// eventMaskNames returns the names parseMask accepts, sorted
+func eventMaskNames() []string {
+	names := make([]string, 0, len(EventMaskMap))
+	for name := range EventMaskMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownMaskError reports a mask name that is neither known nor numeric
+func unknownMaskError(name string) error {
+	return fmt.Errorf("unknown event mask '%s'; valid masks are: %s", name, strings.Join(eventMaskNames(), ", "))
+}
+
+// ParseEventMasks parses extra mask names given as NAME=VALUE items separated
+// by whitespace, e.g. "IN_FOO=0x10000000", for flags of newer kernels that
+// EventMaskMap doesn't know yet. Names start with IN_ and values are decimal
+// or hex.
+func ParseEventMasks(spec string) (map[string]uint32, error) {
+	masks := make(map[string]uint32)
+	for _, item := range strings.Fields(spec) {
+		name, value, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid event mask %s, expected NAME=VALUE", item)
+		}
+		if !strings.HasPrefix(name, "IN_") || strings.TrimLeft(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+			return nil, fmt.Errorf("invalid event mask name %s, expected IN_ followed by capitals, digits or _", name)
+		}
+		mask, err := parseNumericMask(value)
+		if err != nil || mask == 0 {
+			return nil, fmt.Errorf("invalid value for event mask %s: %s", name, value)
+		}
+		masks[name] = mask
+	}
+	return masks, nil
+}
+
+// RegisterEventMasks adds extra mask names, as returned by ParseEventMasks,
+// to EventMaskMap. Names of single flags without a name yet are also used
+// when masks are printed. It must be called before tables are parsed, and
+// fails for a name already known with a different value.
+func RegisterEventMasks(masks map[string]uint32) error {
+	names := make([]string, 0, len(masks))
+	for name := range masks {
+		if known, ok := EventMaskMap[name]; ok && known != masks[name] {
+			return fmt.Errorf("event mask %s is already defined as 0x%x", name, known)
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		mask := masks[name]
+		EventMaskMap[name] = mask
+		if _, named := ReverseEventMaskMap[mask]; !named && mask&(mask-1) == 0 {
+			ReverseEventMaskMap[mask] = name
+			orderedEventFlags = append(orderedEventFlags, mask)
+		}
+	}
+	return nil
+}
+
+// EntryLog selects which runs of an entry's command the daemon logs (log=)
+type EntryLog int
+
+const (
+	// EntryLogErrors logs failed runs, and successful ones only at debug
+	// level (default)
+	EntryLogErrors EntryLog = iota
+	// EntryLogNone logs no runs, not even failed ones
+	EntryLogNone
+	// EntryLogAll logs every run along with the command's output
+	EntryLogAll
+)
+
+// String returns the option value of the setting
+func (l EntryLog) String() string {
+	switch l {
+	case EntryLogErrors:
+		return "errors"
+	case EntryLogNone:
+		return "none"
+	case EntryLogAll:
+		return "all"
+	default:
+		return fmt.Sprintf("EntryLog(%d)", int(l))
+	}
+}
+
+// ParseEntryLog parses the value of the log= option
+func ParseEntryLog(s string) (EntryLog, error) {
+	switch s {
+	case "errors":
+		return EntryLogErrors, nil
+	case "none":
+		return EntryLogNone, nil
+	case "all":
+		return EntryLogAll, nil
+	default:
+		return 0, fmt.Errorf("expected none, errors or all")
+	}
+}
+
 // EntryOptions holds additional options for eventcron entries
 type EntryOptions struct {
 	NoLoop     bool // loopable=false - disable events during command execution
 	Recursive  bool // recursive=true/false - watch subdirectories
 	DotDirs    bool // dotdirs=true - include hidden directories and files
+	FollowSymlinks bool // followsymlinks=true - descend into symlinked directories when recursive
+	Force      bool // force=true - allow recursive watches on protected roots such as /
+	OnlyDir    bool // onlydir=true - only watch the path if it is a directory (IN_ONLYDIR)
+	NoCase     bool // nocase=true - match a * path pattern against event paths ignoring case
+	Settle     time.Duration // settle=true/<duration> - wait for file size to stop changing
+	Timeout    time.Duration // timeout=<duration> - override the executor's command timeout
+	Shell      bool // shell=true - run the command through /bin/sh -c
+	Env        map[string]string // env=KEY=VALUE - extra environment for the command
+	LimitDepth bool // Whether RecursiveDepth applies
+	RecursiveDepth int // recursive_depth=N - subdirectory levels to watch, 0 for the root only
+	Include    []string // include=<glob> - only file names matching one of these
+	Exclude    []string // exclude=<glob> - skip file names matching any of these
+	Retries    int // retries=N - run a failed command again up to N times
+	RetryDelay time.Duration // retry_delay=<duration> - wait before the first retry, doubled each time
+	Dir        string // cwd=/path - working directory for the command
+	NoQuote    bool // quote=false - substitute wildcards unquoted with shell=true
+	Nice       int // nice=N - CPU priority of the command, 0 keeps the daemon's
+	IONice     string // ionice=<class>[:level] - I/O scheduling class of the command
+	RunAs      string // user=<name> - run the command as this user (system tables only)
+	Restart    bool // restart=true - kill the entry's running command on a new event and start over
+	OnCloseOnly bool // on_close_only=true - ignore IN_MODIFY, run once the file is closed after writing
+	SystemdScope bool // systemd_scope=true - run the command in a transient scope in eventcron.slice
+	Cooldown   time.Duration // cooldown=<duration> - don't fire again for a file this long after the command finished
+	OnSuccess  string // onsuccess=<command> - run after the command succeeded
+	OnFailure  string // onfailure=<command> - run after the command failed for good
+	OutputDir  string // output_dir=/path - write each run's output to a file in this directory
+	Log        EntryLog // log=none|errors|all - which runs of the command the daemon logs
+	Prune      []string // prune=/path - subtrees of a recursive watch that get no watches
+}
+
+// maxDepth returns the recursion limit, or -1 if there is none
+func (o EntryOptions) maxDepth() int {
+	if o.LimitDepth {
+		return o.RecursiveDepth
+	}
+	return -1
 }
 
 // eventcronEntry represents a single entry in an eventcron table
@@ -120,6 +294,7 @@ type IncronEntry struct {
 	Command   string       // Command to execute
 	Options   EntryOptions // Additional options
 	LineNumber int         // Line number in the source file (for error reporting)
+	Owner     string       // Table the entry belongs to, e.g. "user alice", set by the daemon
 }
 
 // String returns the string representation of an eventcronEntry suitable for writing to a file
@@ -137,6 +312,94 @@ func (e *IncronEntry) String() string {
 	if e.Options.DotDirs {
 		opts = append(opts, "dotdirs=true")
 	}
+	if e.Options.FollowSymlinks {
+		opts = append(opts, "followsymlinks=true")
+	}
+	if e.Options.Force {
+		opts = append(opts, "force=true")
+	}
+	if e.Options.OnlyDir {
+		opts = append(opts, "onlydir=true")
+	}
+	if e.Options.NoCase {
+		opts = append(opts, "nocase=true")
+	}
+	if e.Options.Settle == DefaultSettleTime {
+		opts = append(opts, "settle=true")
+	} else if e.Options.Settle > 0 {
+		opts = append(opts, "settle="+e.Options.Settle.String())
+	}
+	if e.Options.Timeout > 0 {
+		opts = append(opts, "timeout="+e.Options.Timeout.String())
+	}
+	if e.Options.Shell {
+		opts = append(opts, "shell=true")
+	}
+	if e.Options.LimitDepth {
+		opts = append(opts, "recursive_depth="+strconv.Itoa(e.Options.RecursiveDepth))
+	}
+	if e.Options.Retries > 0 {
+		opts = append(opts, "retries="+strconv.Itoa(e.Options.Retries))
+	}
+	if e.Options.RetryDelay > 0 {
+		opts = append(opts, "retry_delay="+e.Options.RetryDelay.String())
+	}
+	if e.Options.Dir != "" {
+		opts = append(opts, "cwd="+optionValue(e.Options.Dir))
+	}
+	if e.Options.NoQuote {
+		opts = append(opts, "quote=false")
+	}
+	if e.Options.Nice != 0 {
+		opts = append(opts, "nice="+strconv.Itoa(e.Options.Nice))
+	}
+	if e.Options.IONice != "" {
+		opts = append(opts, "ionice="+e.Options.IONice)
+	}
+	if e.Options.RunAs != "" {
+		opts = append(opts, "user="+e.Options.RunAs)
+	}
+	if e.Options.Restart {
+		opts = append(opts, "restart=true")
+	}
+	if e.Options.OnCloseOnly {
+		opts = append(opts, "on_close_only=true")
+	}
+	if e.Options.SystemdScope {
+		opts = append(opts, "systemd_scope=true")
+	}
+	if e.Options.Cooldown > 0 {
+		opts = append(opts, "cooldown="+e.Options.Cooldown.String())
+	}
+	if e.Options.OnSuccess != "" {
+		opts = append(opts, "onsuccess="+optionValue(e.Options.OnSuccess))
+	}
+	if e.Options.OnFailure != "" {
+		opts = append(opts, "onfailure="+optionValue(e.Options.OnFailure))
+	}
+	if e.Options.OutputDir != "" {
+		opts = append(opts, "output_dir="+optionValue(e.Options.OutputDir))
+	}
+	if e.Options.Log != EntryLogErrors {
+		opts = append(opts, "log="+e.Options.Log.String())
+	}
+	for _, path := range e.Options.Prune {
+		opts = append(opts, "prune="+optionValue(path))
+	}
+	for _, pattern := range e.Options.Include {
+		opts = append(opts, "include="+optionValue(pattern))
+	}
+	for _, pattern := range e.Options.Exclude {
+		opts = append(opts, "exclude="+optionValue(pattern))
+	}
+	keys := make([]string, 0, len(e.Options.Env))
+	for key := range e.Options.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opts = append(opts, "env="+optionValue(key+"="+e.Options.Env[key]))
+	}
 
 	if len(opts) > 0 {
 		maskStr = maskStr + "," + strings.Join(opts, ",")
@@ -145,24 +408,41 @@ func (e *IncronEntry) String() string {
 	return fmt.Sprintf("%s %s %s", e.Path, maskStr, e.Command)
 }
 
-// MaskToString converts the numeric mask to string representation
+// MaskToString converts the numeric mask to string representation. A mask
+// with most of IN_ALL_EVENTS is written as IN_ALL_EVENTS minus the missing
+// flags when that is shorter, e.g. IN_ALL_EVENTS,-IN_ACCESS.
 func (e *IncronEntry) MaskToString() string {
 	if e.Mask == InAllEvents {
 		return "IN_ALL_EVENTS"
 	}
 
-	var parts []string
-	mask := e.Mask
+	parts := maskParts(e.Mask)
+	if e.Mask&InAllEvents != 0 {
+		subtractive := []string{"IN_ALL_EVENTS"}
+		for _, flag := range orderedEventFlags {
+			if InAllEvents&flag != 0 && e.Mask&flag == 0 {
+				subtractive = append(subtractive, "-"+ReverseEventMaskMap[flag])
+			}
+		}
+		subtractive = append(subtractive, maskParts(e.Mask&^InAllEvents)...)
+		if len(subtractive) < len(parts) {
+			parts = subtractive
+		}
+	}
 
-	// Check each flag in order of preference
-	flags := []uint32{
-		InAccess, InModify, InAttrib, InCloseWrite, InCloseNowrite,
-		InOpen, InMovedFrom, InMovedTo, InCreate, InDelete,
-		InDeleteSelf, InMoveSelf, InUnmount, InQOverflow, InIgnored,
-		InOnlydir, InDontFollow, InExclUnlink, InMaskAdd, InIsdir, InOneshot,
+	if len(parts) == 0 {
+		return "0"
 	}
 
-	for _, flag := range flags {
+	return strings.Join(parts, ",")
+}
+
+// maskParts lists the flag names of mask, with any bits without a name as a
+// hex number at the end
+func maskParts(mask uint32) []string {
+	var parts []string
+
+	for _, flag := range orderedEventFlags {
 		if mask&flag != 0 {
 			if name, ok := ReverseEventMaskMap[flag]; ok {
 				parts = append(parts, name)
@@ -176,11 +456,7 @@ func (e *IncronEntry) MaskToString() string {
 		parts = append(parts, fmt.Sprintf("0x%x", mask))
 	}
 
-	if len(parts) == 0 {
-		return "0"
-	}
-
-	return strings.Join(parts, ",")
+	return parts
 }
 
 // ParseEntry parses a string line into an IncronEntry
@@ -192,14 +468,16 @@ func ParseEntry(line string, lineNumber int) (*IncronEntry, error) {
 		return nil, nil
 	}
 
-	// Split into at most 3 parts: path, mask, command
-	parts := strings.SplitN(line, " ", 3)
-	if len(parts) < 3 {
-		return nil, fmt.Errorf("line %d: invalid format, expected: <path> <mask> <command>", lineNumber)
+	// Split into 3 parts: path, mask, command. Quoted option values in the
+	// mask may contain spaces.
+	path, rest, _ := strings.Cut(line, " ")
+	maskField, command, err := cutMaskField(rest)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", lineNumber, err)
 	}
 
 	entry := &IncronEntry{
-		Path:       parts[0],
+		Path:       path,
 		LineNumber: lineNumber,
 		Options: EntryOptions{
 			NoLoop:    true,  // Default: loopable=false
@@ -209,24 +487,27 @@ func ParseEntry(line string, lineNumber int) (*IncronEntry, error) {
 	}
 
 	// Parse mask and options
-	mask, err := parseMask(parts[1], &entry.Options)
+	mask, err := parseMask(maskField, &entry.Options)
 	if err != nil {
 		return nil, fmt.Errorf("line %d: %v", lineNumber, err)
 	}
 	entry.Mask = mask
 
-	// Command is everything after the second space
-	entry.Command = parts[2]
+	// Command is everything after the mask field
+	entry.Command = command
 
 	return entry, nil
 }
 
+// noLoopFlag is accepted in the mask field for compatibility with incron
+const noLoopFlag = "IN_NO_LOOP"
+
 // parseMask parses the mask string and extracts options
 func parseMask(maskStr string, opts *EntryOptions) (uint32, error) {
 	var mask uint32
 
 	// Split by comma to handle options
-	parts := strings.Split(maskStr, ",")
+	parts := splitMaskField(maskStr)
 
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
@@ -239,13 +520,27 @@ func parseMask(maskStr string, opts *EntryOptions) (uint32, error) {
 			continue
 		}
 
-		// Parse as event mask
-		if eventMask, ok := EventMaskMap[part]; ok {
-			mask |= eventMask
-		} else if num, err := parseNumericMask(part); err == nil {
-			mask |= num
+		// Classic incron spelling of loopable=false, not an inotify flag
+		if part == noLoopFlag {
+			opts.NoLoop = true
+			continue
+		}
+
+		// Parse as event mask; a leading - removes the flags from those
+		// given so far, as in IN_ALL_EVENTS,-IN_ACCESS
+		name, remove := strings.CutPrefix(part, "-")
+		var flags uint32
+		if eventMask, ok := EventMaskMap[name]; ok {
+			flags = eventMask
+		} else if num, err := parseNumericMask(name); err == nil {
+			flags = num
+		} else {
+			return 0, unknownMaskError(name)
+		}
+		if remove {
+			mask &^= flags
 		} else {
-			return 0, fmt.Errorf("unknown event mask: %s", part)
+			mask |= flags
 		}
 	}
 
@@ -256,7 +551,92 @@ func parseMask(maskStr string, opts *EntryOptions) (uint32, error) {
 	return mask, nil
 }
 
-// parseOption parses a single option like "loopable=false"
+// cutMaskField splits the mask field off the rest of an entry after its
+// path, at the first space outside double quotes
+func cutMaskField(s string) (mask, command string, err error) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++ // Skip the escaped character
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ' ' && !quoted:
+			return s[:i], s[i+1:], nil
+		}
+	}
+	if quoted {
+		return "", "", fmt.Errorf("unterminated quote in mask field: %s", s)
+	}
+	return "", "", fmt.Errorf("invalid format, expected: <path> <mask> <command>")
+}
+
+// splitMaskField splits a mask field at the commas outside double quotes
+func splitMaskField(s string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++ // Skip the escaped character
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// optionValue returns value as written in a mask field, in double quotes if
+// it contains a space, comma or quote
+func optionValue(value string) string {
+	if !strings.ContainsAny(value, " ,\"") {
+		return value
+	}
+	// Escape quotes, and the backslashes unquoteOption would take for
+	// escapes
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' && (i+1 == len(value) || value[i+1] == '"' || value[i+1] == '\\') {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// unquoteOption returns the option value s, removing its double quotes and
+// the backslashes before escaped quotes and backslashes. Other backslashes
+// are kept, as in onsuccess="sed -i 's/\./_/' $#". Quotes that neither
+// enclose the whole value nor are escaped are an error.
+func unquoteOption(s string) (string, error) {
+	errQuotes := fmt.Errorf("%s (quotes can only enclose the whole value)", s)
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		if strings.Contains(s, `"`) {
+			return "", errQuotes
+		}
+		return s, nil
+	}
+	inner := s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) && (inner[i+1] == '"' || inner[i+1] == '\\') {
+			i++
+		} else if inner[i] == '"' {
+			return "", errQuotes
+		}
+		b.WriteByte(inner[i])
+	}
+	return b.String(), nil
+}
+
+// parseOption parses a single option like "loopable=false". A value in
+// double quotes, such as onfailure="mv $@/$# /srv/failed", may contain spaces
+// and commas, and quotes written as \".
 func parseOption(optStr string, opts *EntryOptions) error {
 	parts := strings.SplitN(optStr, "=", 2)
 	if len(parts) != 2 {
@@ -264,7 +644,10 @@ func parseOption(optStr string, opts *EntryOptions) error {
 	}
 
 	key := strings.TrimSpace(parts[0])
-	value := strings.TrimSpace(parts[1])
+	value, err := unquoteOption(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %v", key, err)
+	}
 
 	switch key {
 	case "loopable":
@@ -291,6 +674,183 @@ func parseOption(optStr string, opts *EntryOptions) error {
 		} else {
 			return fmt.Errorf("invalid value for dotdirs: %s (expected true/false)", value)
 		}
+	case "followsymlinks":
+		if value == "true" {
+			opts.FollowSymlinks = true
+		} else if value == "false" {
+			opts.FollowSymlinks = false
+		} else {
+			return fmt.Errorf("invalid value for followsymlinks: %s (expected true/false)", value)
+		}
+	case "force":
+		if value == "true" {
+			opts.Force = true
+		} else if value == "false" {
+			opts.Force = false
+		} else {
+			return fmt.Errorf("invalid value for force: %s (expected true/false)", value)
+		}
+	case "onlydir":
+		if value == "true" {
+			opts.OnlyDir = true
+		} else if value == "false" {
+			opts.OnlyDir = false
+		} else {
+			return fmt.Errorf("invalid value for onlydir: %s (expected true/false)", value)
+		}
+	case "nocase":
+		if value == "true" {
+			opts.NoCase = true
+		} else if value == "false" {
+			opts.NoCase = false
+		} else {
+			return fmt.Errorf("invalid value for nocase: %s (expected true/false)", value)
+		}
+	case "settle":
+		if value == "true" {
+			opts.Settle = DefaultSettleTime
+		} else if value == "false" {
+			opts.Settle = 0
+		} else if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			opts.Settle = d
+		} else {
+			return fmt.Errorf("invalid value for settle: %s (expected true/false or a duration)", value)
+		}
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid value for timeout: %s (expected a positive duration like 30s)", value)
+		}
+		opts.Timeout = d
+	case "shell":
+		if value == "true" {
+			opts.Shell = true
+		} else if value == "false" {
+			opts.Shell = false
+		} else {
+			return fmt.Errorf("invalid value for shell: %s (expected true/false)", value)
+		}
+	case "recursive_depth":
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			return fmt.Errorf("invalid value for recursive_depth: %s (expected a non-negative number)", value)
+		}
+		opts.LimitDepth = true
+		opts.RecursiveDepth = depth
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid value for retries: %s (expected a non-negative number)", value)
+		}
+		opts.Retries = retries
+	case "cooldown":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid value for cooldown: %s (expected a positive duration like 5s)", value)
+		}
+		opts.Cooldown = d
+	case "retry_delay":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid value for retry_delay: %s (expected a positive duration like 10s)", value)
+		}
+		opts.RetryDelay = d
+	case "quote":
+		if value == "true" {
+			opts.NoQuote = false
+		} else if value == "false" {
+			opts.NoQuote = true
+		} else {
+			return fmt.Errorf("invalid value for quote: %s (expected true/false)", value)
+		}
+	case "nice":
+		nice, err := strconv.Atoi(value)
+		if err != nil || nice < MinNice || nice > MaxNice {
+			return fmt.Errorf("invalid value for nice: %s (expected a number from %d to %d)", value, MinNice, MaxNice)
+		}
+		opts.Nice = nice
+	case "ionice":
+		if _, err := parseIONice(value); err != nil {
+			return fmt.Errorf("invalid value for ionice: %s (%v)", value, err)
+		}
+		opts.IONice = value
+	case "cwd":
+		if !filepath.IsAbs(value) {
+			return fmt.Errorf("invalid value for cwd: %s (expected an absolute path)", value)
+		}
+		opts.Dir = filepath.Clean(value)
+	case "prune":
+		if !filepath.IsAbs(value) {
+			return fmt.Errorf("invalid value for prune: %s (expected an absolute path)", value)
+		}
+		opts.Prune = append(opts.Prune, filepath.Clean(value))
+	case "output_dir":
+		if !filepath.IsAbs(value) {
+			return fmt.Errorf("invalid value for output_dir: %s (expected an absolute path)", value)
+		}
+		opts.OutputDir = filepath.Clean(value)
+	case "log":
+		log, err := ParseEntryLog(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for log: %s (%v)", value, err)
+		}
+		opts.Log = log
+	case "include", "exclude":
+		if _, err := filepath.Match(value, ""); err != nil || value == "" {
+			return fmt.Errorf("invalid value for %s: %s (expected a glob pattern like *.jpg)", key, value)
+		}
+		if key == "include" {
+			opts.Include = append(opts.Include, value)
+		} else {
+			opts.Exclude = append(opts.Exclude, value)
+		}
+	case "restart":
+		if value == "true" {
+			opts.Restart = true
+		} else if value == "false" {
+			opts.Restart = false
+		} else {
+			return fmt.Errorf("invalid value for restart: %s (expected true/false)", value)
+		}
+	case "on_close_only":
+		if value == "true" {
+			opts.OnCloseOnly = true
+		} else if value == "false" {
+			opts.OnCloseOnly = false
+		} else {
+			return fmt.Errorf("invalid value for on_close_only: %s (expected true/false)", value)
+		}
+	case "systemd_scope":
+		if value == "true" {
+			opts.SystemdScope = true
+		} else if value == "false" {
+			opts.SystemdScope = false
+		} else {
+			return fmt.Errorf("invalid value for systemd_scope: %s (expected true/false)", value)
+		}
+	case "onsuccess", "onfailure":
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("invalid value for %s: %s (expected a command)", key, value)
+		}
+		if key == "onsuccess" {
+			opts.OnSuccess = value
+		} else {
+			opts.OnFailure = value
+		}
+	case "user":
+		if value == "" || strings.ContainsAny(value, " \t") {
+			return fmt.Errorf("invalid value for user: %s (expected a user name)", value)
+		}
+		opts.RunAs = value
+	case "env":
+		name, val, ok := strings.Cut(value, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("invalid value for env: %s (expected KEY=VALUE)", value)
+		}
+		if opts.Env == nil {
+			opts.Env = make(map[string]string)
+		}
+		opts.Env[name] = val
 	default:
 		return fmt.Errorf("unknown option: %s", key)
 	}
@@ -298,6 +858,16 @@ func parseOption(optStr string, opts *EntryOptions) error {
 	return nil
 }
 
+// ParseEventMask parses a list of event flags such as IN_CREATE,IN_MOVED_TO
+// like the mask field of an entry, but without options
+func ParseEventMask(s string) (uint32, error) {
+	if strings.Contains(s, "=") {
+		return 0, fmt.Errorf("options are not allowed in an event mask: %s", s)
+	}
+	var opts EntryOptions
+	return parseMask(s, &opts)
+}
+
 // parseNumericMask parses numeric mask (hex or decimal)
 func parseNumericMask(s string) (uint32, error) {
 	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
@@ -308,29 +878,127 @@ func parseNumericMask(s string) (uint32, error) {
 	return uint32(val), err
 }
 
-// ExpandCommand expands wildcards in the command string
+// FileAttrs are the owner and permission bits of an event's file, as
+// substituted for $:u, $:g and $:p
+type FileAttrs struct {
+	Uid  uint32
+	Gid  uint32
+	Mode uint32 // Permission bits including setuid, setgid and sticky
+}
+
+// StatFileAttrs returns the attributes of the file at path, or nil if it
+// can't be read, e.g. because it was deleted
+func StatFileAttrs(path string) *FileAttrs {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &FileAttrs{Uid: stat.Uid, Gid: stat.Gid, Mode: stat.Mode & 07777}
+}
+
+// ExpandCommand expands wildcards in the command string.
+//
+// Wildcards are replaced in a single left-to-right pass, so "$$" always
+// becomes a literal "$" and is never combined with the following character:
+// "$$/" expands to "$/", not to the event path.
 func (e *IncronEntry) ExpandCommand(watchPath, filename string, eventMask uint32) string {
-	cmd := e.Command
+	return e.ExpandCommandWith(watchPath, filename, eventMask, nil)
+}
 
-	// Replace wildcards
-	cmd = strings.ReplaceAll(cmd, "$$", "$")
-	cmd = strings.ReplaceAll(cmd, "$@", watchPath)
-	cmd = strings.ReplaceAll(cmd, "$#", filename)
-	cmd = strings.ReplaceAll(cmd, "$%", e.eventMaskToText(eventMask))
-	cmd = strings.ReplaceAll(cmd, "$&", fmt.Sprintf("%d", eventMask))
+// ExpandCommandWith expands wildcards like ExpandCommand, and also $:u, $:g
+// and $:p from attrs. Without attrs these expand to nothing.
+func (e *IncronEntry) ExpandCommandWith(watchPath, filename string, eventMask uint32, attrs *FileAttrs) string {
+	return e.expandCommand(watchPath, filename, eventMask, attrs, time.Time{})
+}
 
-	return cmd
+// ExpandEventCommand expands wildcards like ExpandCommandWith for event, and
+// also $:t, the time the event was received
+func (e *IncronEntry) ExpandEventCommand(event *InotifyEvent, attrs *FileAttrs) string {
+	return e.expandCommand(event.WatchDir, event.Name, event.Mask, attrs, event.Received)
 }
 
-// eventMaskToText converts event mask to human-readable text
-func (e *IncronEntry) eventMaskToText(mask uint32) string {
-	var parts []string
+// ExpandEventArgs splits the command of an entry without shell=true into its
+// words and expands the wildcards of each word like ExpandEventCommand, so a
+// substituted name with spaces stays a single argument
+func (e *IncronEntry) ExpandEventArgs(event *InotifyEvent, attrs *FileAttrs) []string {
+	replacer := e.replacer(event.WatchDir, event.Name, event.Mask, attrs, event.Received, false)
+	args := parseCommand(e.Command)
+	for i, arg := range args {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
 
-	for flag, name := range ReverseEventMaskMap {
-		if mask&flag != 0 {
-			parts = append(parts, name)
-		}
+// EventTimestamp formats t as $:t does: Unix time in seconds with nanoseconds,
+// e.g. 1700000000.123456789, or "" for the zero time
+func EventTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// expandCommand expands the wildcards of e's command, $:t from received.
+// Shell commands get the substituted names quoted unless quote=false, so file
+// names with spaces or metacharacters stay a single word.
+func (e *IncronEntry) expandCommand(watchPath, filename string, eventMask uint32, attrs *FileAttrs, received time.Time) string {
+	quote := e.Options.Shell && !e.Options.NoQuote
+	return e.replacer(watchPath, filename, eventMask, attrs, received, quote).Replace(e.Command)
+}
+
+// replacer returns the replacer expanding the wildcards of e's command,
+// shell-quoting the substituted names if quote is set
+func (e *IncronEntry) replacer(watchPath, filename string, eventMask uint32, attrs *FileAttrs, received time.Time, quote bool) *strings.Replacer {
+	// Full path of the event: the watched file itself, or the file inside
+	// the watched directory
+	fullPath := watchPath
+	if filename != "" {
+		fullPath = filepath.Join(watchPath, filename)
+	}
+
+	eventText := e.eventMaskToText(eventMask)
+	if quote {
+		watchPath = ShellQuote(watchPath)
+		filename = ShellQuote(filename)
+		fullPath = ShellQuote(fullPath)
+		eventText = ShellQuote(eventText)
+	}
+
+	var uid, gid, mode string
+	if attrs != nil {
+		uid = strconv.FormatUint(uint64(attrs.Uid), 10)
+		gid = strconv.FormatUint(uint64(attrs.Gid), 10)
+		mode = fmt.Sprintf("%04o", attrs.Mode)
+	}
+
+	// strings.Replacer scans the command once, so wildcard-looking text in
+	// the substituted names is never expanded again
+	return strings.NewReplacer(
+		"$$", "$",
+		"$@", watchPath,
+		"$#", filename,
+		"$/", fullPath,
+		"$%", eventText,
+		"$&", fmt.Sprintf("%d", eventMask),
+		"$:u", uid,
+		"$:g", gid,
+		"$:p", mode,
+		"$:t", EventTimestamp(received),
+	)
+}
+
+// ShellQuote quotes s as a single word for /bin/sh
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// eventMaskToText converts event mask to human-readable text
+func (e *IncronEntry) eventMaskToText(mask uint32) string {
+	parts := eventFlagNames(mask)
 
 	if len(parts) == 0 {
 		return fmt.Sprintf("0x%x", mask)
@@ -339,12 +1007,17 @@ func (e *IncronEntry) eventMaskToText(mask uint32) string {
 	return strings.Join(parts, ",")
 }
 
-// MatchesPath checks if the given path matches this entry's path pattern
+// MatchesPath checks if the given path matches this entry's path pattern.
+// With nocase=true a * pattern ignores case; a literal path is watched as
+// written, so the paths of its events never differ from it in case.
 func (e *IncronEntry) MatchesPath(path string) bool {
 	// For now, implement simple glob-style matching
 	// TODO: Implement full glob pattern matching
 	if strings.Contains(e.Path, "*") {
 		pattern := strings.ReplaceAll(e.Path, "*", ".*")
+		if e.Options.NoCase {
+			pattern = "(?i)" + pattern
+		}
 		matched, _ := regexp.MatchString("^"+pattern+"$", path)
 		return matched
 	}
@@ -352,11 +1025,117 @@ func (e *IncronEntry) MatchesPath(path string) bool {
 	return e.Path == path
 }
 
+// EventFor returns the event the daemon would see for mask on path while
+// watching this entry: an event on the watched path itself if the entry's
+// path matches it, or else on a file in the watched directory path is in
+func (e *IncronEntry) EventFor(path string, mask uint32) *InotifyEvent {
+	event := &InotifyEvent{Path: path, Mask: mask, WatchDir: path}
+	if !e.MatchesPath(path) {
+		event.WatchDir = filepath.Dir(path)
+		event.Name = filepath.Base(path)
+	}
+	return event
+}
+
+// MatchesEvent checks if an event belongs to this entry: the entry's path
+// must match the watched directory or the event's path, or for a recursive
+// entry a directory above the watched one, at least one of the event's flags
+// must be in the entry's mask, and the file name must pass the include and
+// exclude filters
+func (e *IncronEntry) MatchesEvent(event *InotifyEvent) bool {
+	if !e.MatchesPath(event.WatchDir) && !e.MatchesPath(event.Path) && !e.watchesBelow(event.WatchDir, event.Symlinked) {
+		return false
+	}
+
+	if e.Mask&event.Mask == 0 {
+		return false
+	}
+
+	// Events on a watched file have no name
+	name := event.Name
+	if name == "" {
+		name = filepath.Base(event.Path)
+	}
+	return e.MatchesName(name)
+}
+
+// watchesBelow reports whether dir is a subdirectory of the entry's path that
+// a recursive watch of the entry covers. A watch shared with other entries can
+// reach further than this entry's own dotdirs=, recursive_depth=, prune= and
+// followsymlinks=, so those are checked here.
+func (e *IncronEntry) watchesBelow(dir string, symlinked bool) bool {
+	if !e.Options.Recursive || symlinked && !e.Options.FollowSymlinks || isPruned(dir, e.Options.Prune) {
+		return false
+	}
+	maxDepth := e.Options.maxDepth()
+	for depth, sub := 1, dir; ; depth, sub = depth+1, filepath.Dir(sub) {
+		if maxDepth >= 0 && depth > maxDepth {
+			return false
+		}
+		if !e.Options.DotDirs && strings.HasPrefix(filepath.Base(sub), ".") {
+			return false
+		}
+		parent := filepath.Dir(sub)
+		if e.MatchesPath(parent) {
+			return true
+		}
+		if parent == sub || parent == filepath.Dir(parent) {
+			return false
+		}
+	}
+}
+
+// FollowUp returns the onsuccess= or onfailure= command to run after the
+// entry's command succeeded or failed, or "" if there is none
+func (e *IncronEntry) FollowUp(success bool) string {
+	if success {
+		return e.Options.OnSuccess
+	}
+	return e.Options.OnFailure
+}
+
+// WaitsForClose reports whether the entry ignores an event it matches because
+// of on_close_only=true: an IN_MODIFY is left to the IN_CLOSE_WRITE that
+// follows the write
+func (e *IncronEntry) WaitsForClose(event *InotifyEvent) bool {
+	return e.Options.OnCloseOnly && e.Mask&InCloseWrite != 0 &&
+		event.Mask&InModify != 0 && event.Mask&InCloseWrite == 0
+}
+
+// MatchesName checks a file name against the entry's include and exclude
+// patterns. With include patterns the name must match at least one of them,
+// and it must not match any exclude pattern.
+func (e *IncronEntry) MatchesName(name string) bool {
+	for _, pattern := range e.Options.Exclude {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+
+	if len(e.Options.Include) == 0 {
+		return true
+	}
+	for _, pattern := range e.Options.Include {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // IncronTable represents a collection of incron entries
 type IncronTable struct {
 	Entries  []IncronEntry
 	Username string // Empty for system tables
 	FilePath string // Path to the source file
+	Raw      []Line // Layout of the source file, including comments
+}
+
+// Line is a single line of a table file as it was loaded
+type Line struct {
+	Text       string // Original text of the line
+	LineNumber int    // LineNumber of the entry on this line, 0 for comments and blank lines
+	rendered   string // Entry.String() at load time, to detect edits
 }
 
 // Add adds an entry to the table
@@ -364,9 +1143,110 @@ func (t *IncronTable) Add(entry IncronEntry) {
 	t.Entries = append(t.Entries, entry)
 }
 
-// Clear removes all entries from the table
+// Clear removes all entries from the table, keeping its comments
 func (t *IncronTable) Clear() {
 	t.Entries = t.Entries[:0]
+
+	raw := t.Raw[:0]
+	for _, line := range t.Raw {
+		if line.LineNumber == 0 {
+			raw = append(raw, line)
+		}
+	}
+	t.Raw = raw
+}
+
+// Match returns the entries of the table that event triggers, see
+// MatchesEvent, in table order. The entries point into the table's Entries.
+// Paths are compared as they are, so a loaded table needs ExpandPaths and
+// ExpandBraces first, as the daemon does.
+func (t *IncronTable) Match(event *InotifyEvent) []*IncronEntry {
+	var matches []*IncronEntry
+	for i := range t.Entries {
+		if t.Entries[i].MatchesEvent(event) {
+			matches = append(matches, &t.Entries[i])
+		}
+	}
+	return matches
+}
+
+// ExpandPaths expands ~ and variables in the path of every entry for the
+// table's user u, see ExpandPath. It returns an error for each entry that
+// can't be expanded. Expanded entries are written out with the expanded path.
+func (t *IncronTable) ExpandPaths(u *user.User) []error {
+	var errs []error
+	for i := range t.Entries {
+		path, err := ExpandPath(t.Entries[i].Path, u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", t.Entries[i].LineNumber, err))
+			continue
+		}
+		t.Entries[i].Path = path
+	}
+	return errs
+}
+
+// ExpandBraces replaces every entry whose path has brace lists with an entry
+// per path, see ExpandBraces. The table's layout is dropped, as it no longer
+// matches the entries.
+func (t *IncronTable) ExpandBraces() {
+	var entries []IncronEntry
+	for _, entry := range t.Entries {
+		for _, path := range ExpandBraces(entry.Path) {
+			expanded := entry
+			expanded.Path = path
+			entries = append(entries, expanded)
+		}
+	}
+	t.Entries = entries
+	t.Raw = nil
+}
+
+// Duplicate is an entry that repeats an earlier entry of its table, so its
+// command runs a second time for every event
+type Duplicate struct {
+	Index    int // Index of the repeated entry in Entries
+	Original int // Index of the first equal entry
+}
+
+// Duplicates returns the entries equal to an earlier entry. Entries are equal
+// if they are written the same way, i.e. have the same path, mask, options and
+// command.
+func (t *IncronTable) Duplicates() []Duplicate {
+	var duplicates []Duplicate
+	first := make(map[string]int)
+	for i := range t.Entries {
+		key := t.Entries[i].String()
+		if original, ok := first[key]; ok {
+			duplicates = append(duplicates, Duplicate{Index: i, Original: original})
+		} else {
+			first[key] = i
+		}
+	}
+	return duplicates
+}
+
+// RemoveDuplicates removes the entries returned by Duplicates, whose lines
+// Format then leaves out, and returns how many were removed
+func (t *IncronTable) RemoveDuplicates() int {
+	duplicates := t.Duplicates()
+	if len(duplicates) == 0 {
+		return 0
+	}
+
+	removed := make(map[int]bool, len(duplicates))
+	for _, duplicate := range duplicates {
+		removed[duplicate.Index] = true
+	}
+	entries := t.Entries[:0]
+	for i, entry := range t.Entries {
+		if !removed[i] {
+			entries = append(entries, entry)
+		}
+	}
+	t.Entries = entries
+
+	return len(duplicates)
 }
 
 // IsEmpty returns true if the table has no entries
@@ -387,3 +1267,49 @@ func (t *IncronTable) String() string {
 	}
 	return strings.Join(lines, "\n")
 }
+
+// Format returns the table as file content. Comments and blank lines from
+// the source file stay in place and unchanged entries keep their original
+// text; entries added since loading are appended at the end. Entries are
+// found in the layout by their LineNumber, so removing or reordering entries
+// leaves the others on their lines.
+func (t *IncronTable) Format() string {
+	if len(t.Raw) == 0 {
+		return t.String()
+	}
+
+	// The first entry with a line number takes its line
+	index := make(map[int]int, len(t.Entries))
+	for i := len(t.Entries) - 1; i >= 0; i-- {
+		if t.Entries[i].LineNumber > 0 {
+			index[t.Entries[i].LineNumber] = i
+		}
+	}
+
+	var lines []string
+	written := make([]bool, len(t.Entries))
+	for _, line := range t.Raw {
+		if line.LineNumber == 0 {
+			lines = append(lines, line.Text)
+			continue
+		}
+		i, ok := index[line.LineNumber]
+		if !ok {
+			continue // Entry was removed
+		}
+
+		text := t.Entries[i].String()
+		if text == line.rendered {
+			text = line.Text
+		}
+		lines = append(lines, text)
+		written[i] = true
+	}
+
+	for i, entry := range t.Entries {
+		if !written[i] {
+			lines = append(lines, entry.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,8 +1,12 @@
 package eventcron
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseEntry(t *testing.T) {
@@ -61,6 +65,528 @@ func TestParseEntry(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:       "with settle",
+			line:       "/tmp IN_CREATE,settle=5s echo test",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/tmp",
+				Mask:       InCreate,
+				Command:    "echo test",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Settle:    5 * time.Second,
+				},
+			},
+		},
+		{
+			name:       "with timeout",
+			line:       "/tmp IN_CREATE,timeout=30s echo test",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/tmp",
+				Mask:       InCreate,
+				Command:    "echo test",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Timeout:   30 * time.Second,
+				},
+			},
+		},
+		{
+			name:        "invalid timeout",
+			line:        "/tmp IN_CREATE,timeout=30 echo test",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with shell",
+			line:       "/tmp IN_CREATE,shell=true cat $/ | gzip > $/.gz",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/tmp",
+				Mask:       InCreate,
+				Command:    "cat $/ | gzip > $/.gz",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Shell:     true,
+				},
+			},
+		},
+		{
+			name:       "with shell, unquoted",
+			line:       "/tmp IN_CREATE,shell=true,quote=false cat \"$/\"",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/tmp",
+				Mask:       InCreate,
+				Command:    "cat \"$/\"",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Shell:     true,
+					NoQuote:   true,
+				},
+			},
+		},
+		{
+			name:       "with IN_NO_LOOP",
+			line:       "/tmp IN_CLOSE_WRITE,IN_NO_LOOP touch $@/done",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/tmp",
+				Mask:       InCloseWrite,
+				Command:    "touch $@/done",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+				},
+			},
+		},
+		{
+			name:        "IN_NO_LOOP alone",
+			line:        "/tmp IN_NO_LOOP touch $@/done",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with recursive depth",
+			line:       "/srv IN_CREATE,recursive_depth=2 echo $/",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/srv",
+				Mask:       InCreate,
+				Command:    "echo $/",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:         true,
+					Recursive:      true,
+					LimitDepth:     true,
+					RecursiveDepth: 2,
+				},
+			},
+		},
+		{
+			name:       "with retries",
+			line:       "/data IN_CLOSE_WRITE,retries=3,retry_delay=10s rsync $/ remote:",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCloseWrite,
+				Command:    "rsync $/ remote:",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:     true,
+					Recursive:  true,
+					Retries:    3,
+					RetryDelay: 10 * time.Second,
+				},
+			},
+		},
+		{
+			name:       "with cwd",
+			line:       "/data IN_CLOSE_WRITE,cwd=/srv/jobs/ ./process $#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCloseWrite,
+				Command:    "./process $#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Dir:       "/srv/jobs",
+				},
+			},
+		},
+		{
+			name:       "with followsymlinks",
+			line:       "/data IN_CREATE,followsymlinks=true echo $#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCreate,
+				Command:    "echo $#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:         true,
+					Recursive:      true,
+					FollowSymlinks: true,
+				},
+			},
+		},
+		{
+			name:       "with nice and ionice",
+			line:       "/data IN_CLOSE_WRITE,nice=10,ionice=best-effort:7 sync $#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCloseWrite,
+				Command:    "sync $#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Nice:      10,
+					IONice:    "best-effort:7",
+				},
+			},
+		},
+		{
+			name:        "nice out of range",
+			line:        "/data IN_CLOSE_WRITE,nice=20 sync $#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "unknown ionice class",
+			line:        "/data IN_CLOSE_WRITE,ionice=low sync $#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with force",
+			line:       "/ IN_CREATE,force=true echo $#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/",
+				Mask:       InCreate,
+				Command:    "echo $#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Force:     true,
+				},
+			},
+		},
+		{
+			name:       "with onlydir",
+			line:       "/data IN_CREATE,onlydir=true echo $#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCreate,
+				Command:    "echo $#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					OnlyDir:   true,
+				},
+			},
+		},
+		{
+			name:       "with user",
+			line:       "/srv/www IN_CLOSE_WRITE,user=www-data thumbnail $@/$#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/srv/www",
+				Mask:       InCloseWrite,
+				Command:    "thumbnail $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					RunAs:     "www-data",
+				},
+			},
+		},
+		{
+			name:       "with output_dir",
+			line:       "/srv/app IN_CLOSE_WRITE,output_dir=/var/log/builds/ make",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/srv/app",
+				Mask:       InCloseWrite,
+				Command:    "make",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					OutputDir: "/var/log/builds",
+				},
+			},
+		},
+		{
+			name:       "with prune",
+			line:       "/data IN_CREATE,prune=/data/tmp/,prune=/data/cache sync $@",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCreate,
+				Command:    "sync $@",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Prune:     []string{"/data/tmp", "/data/cache"},
+				},
+			},
+		},
+		{
+			name:       "with on_close_only",
+			line:       "/data IN_MODIFY,IN_CLOSE_WRITE,on_close_only=true process $@/$#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InModify | InCloseWrite,
+				Command:    "process $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:      true,
+					Recursive:   true,
+					OnCloseOnly: true,
+				},
+			},
+		},
+		{
+			name:       "with subtracted flags",
+			line:       "/data IN_ALL_EVENTS,-IN_ACCESS,-IN_OPEN,IN_ONLYDIR sync",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InAllEvents&^(InAccess|InOpen) | InOnlydir,
+				Command:    "sync",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+				},
+			},
+		},
+		{
+			name:       "with systemd_scope",
+			line:       "/data IN_CLOSE_WRITE,systemd_scope=true convert $@/$#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCloseWrite,
+				Command:    "convert $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:       true,
+					Recursive:    true,
+					SystemdScope: true,
+				},
+			},
+		},
+		{
+			name:       "with cooldown",
+			line:       "/data IN_CLOSE_WRITE,cooldown=5s gzip $@/$#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCloseWrite,
+				Command:    "gzip $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Cooldown:  5 * time.Second,
+				},
+			},
+		},
+		{
+			name:        "invalid cooldown",
+			line:        "/data IN_CLOSE_WRITE,cooldown=-5s gzip $@/$#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with follow-ups",
+			line:       `/data/in IN_CLOSE_WRITE,onsuccess="rm $@/$#",onfailure="mv $@/$# /data/failed" import $@/$#`,
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data/in",
+				Mask:       InCloseWrite,
+				Command:    "import $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					OnSuccess: "rm $@/$#",
+					OnFailure: "mv $@/$# /data/failed",
+				},
+			},
+		},
+		{
+			name:       "escaped quotes in a follow-up",
+			line:       `/data/in IN_CLOSE_WRITE,onsuccess="logger \"imported, $#\"" import $@/$#`,
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data/in",
+				Mask:       InCloseWrite,
+				Command:    "import $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					OnSuccess: `logger "imported, $#"`,
+				},
+			},
+		},
+		{
+			name:        "empty follow-up",
+			line:        `/data/in IN_CLOSE_WRITE,onsuccess="" import $@/$#`,
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "unterminated quote",
+			line:        `/data/in IN_CLOSE_WRITE,onsuccess="rm $@/$# import $@/$#`,
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with nocase",
+			line:       "/mnt/share/Inbox IN_CLOSE_WRITE,nocase=true import $@/$#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/mnt/share/Inbox",
+				Mask:       InCloseWrite,
+				Command:    "import $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					NoCase:    true,
+				},
+			},
+		},
+		{
+			name:        "invalid nocase",
+			line:        "/mnt/share/Inbox IN_CLOSE_WRITE,nocase=yes import $@/$#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with log",
+			line:       "/var/spool/in IN_CLOSE_WRITE,log=all import $@/$#",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/var/spool/in",
+				Mask:       InCloseWrite,
+				Command:    "import $@/$#",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Log:       EntryLogAll,
+				},
+			},
+		},
+		{
+			name:        "invalid log",
+			line:        "/var/spool/in IN_CLOSE_WRITE,log=verbose import $@/$#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with restart",
+			line:       "/srv/app IN_CLOSE_WRITE,restart=true make run",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/srv/app",
+				Mask:       InCloseWrite,
+				Command:    "make run",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Restart:   true,
+				},
+			},
+		},
+		{
+			name:        "empty user",
+			line:        "/srv/www IN_CLOSE_WRITE,user= thumbnail $#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "invalid force",
+			line:        "/ IN_CREATE,force=yes echo $#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "relative cwd",
+			line:        "/data IN_CLOSE_WRITE,cwd=jobs ./process $#",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "invalid retries",
+			line:        "/data IN_CLOSE_WRITE,retries=many rsync $/ remote:",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "invalid recursive depth",
+			line:        "/srv IN_CREATE,recursive_depth=-1 echo $/",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:       "with env",
+			line:       "/data IN_CLOSE_WRITE,env=AWS_PROFILE=backup,env=MODE=a=b /usr/local/bin/sync $/",
+			lineNumber: 1,
+			expected: &IncronEntry{
+				Path:       "/data",
+				Mask:       InCloseWrite,
+				Command:    "/usr/local/bin/sync $/",
+				LineNumber: 1,
+				Options: EntryOptions{
+					NoLoop:    true,
+					Recursive: true,
+					Env:       map[string]string{"AWS_PROFILE": "backup", "MODE": "a=b"},
+				},
+			},
+		},
+		{
+			name:        "invalid env",
+			line:        "/data IN_CLOSE_WRITE,env=AWS_PROFILE /usr/local/bin/sync $/",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "invalid shell",
+			line:        "/tmp IN_CREATE,shell=bash echo test",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "invalid settle",
+			line:        "/tmp IN_CREATE,settle=soon echo test",
+			lineNumber:  1,
+			expected:    nil,
+			expectError: true,
+		},
 		{
 			name:        "empty line",
 			line:        "",
@@ -126,41 +652,283 @@ func TestParseEntry(t *testing.T) {
 			if entry.Mask != tt.expected.Mask {
 				t.Errorf("mask mismatch: got %d, want %d", entry.Mask, tt.expected.Mask)
 			}
-			
-			if entry.Command != tt.expected.Command {
-				t.Errorf("command mismatch: got %q, want %q", entry.Command, tt.expected.Command)
+			
+			if entry.Command != tt.expected.Command {
+				t.Errorf("command mismatch: got %q, want %q", entry.Command, tt.expected.Command)
+			}
+			
+			if entry.LineNumber != tt.expected.LineNumber {
+				t.Errorf("line number mismatch: got %d, want %d", entry.LineNumber, tt.expected.LineNumber)
+			}
+			
+			if !reflect.DeepEqual(entry.Options, tt.expected.Options) {
+				t.Errorf("options mismatch: got %+v, want %+v", entry.Options, tt.expected.Options)
+			}
+		})
+	}
+}
+
+func TestIncronEntry_String(t *testing.T) {
+	entry := &IncronEntry{
+		Path:    "/tmp",
+		Mask:    InCreate | InModify,
+		Command: "echo test",
+		Options: EntryOptions{
+			NoLoop:    true,
+			Recursive: true,
+			DotDirs:   false,
+		},
+	}
+	
+	result := entry.String()
+	// The order of flags in the output may vary, so just check that both flags are present
+	if !strings.Contains(result, "IN_CREATE") || !strings.Contains(result, "IN_MODIFY") {
+		t.Errorf("String() missing expected flags: got %q", result)
+	}
+	if !strings.Contains(result, "/tmp") || !strings.Contains(result, "echo test") {
+		t.Errorf("String() missing expected path or command: got %q", result)
+	}
+}
+
+func TestIncronEntry_StringNoLoopRoundTrip(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		// IN_NO_LOOP is the default, so it isn't written back
+		{"/tmp IN_CLOSE_WRITE,IN_NO_LOOP touch x", "/tmp IN_CLOSE_WRITE touch x"},
+		{"/tmp IN_NO_LOOP,IN_CLOSE_WRITE,loopable=true touch x", "/tmp IN_CLOSE_WRITE,loopable=true touch x"},
+	}
+
+	for _, tt := range tests {
+		entry, err := ParseEntry(tt.line, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := entry.String()
+		if got != tt.expected {
+			t.Errorf("String() = %q, want %q", got, tt.expected)
+		}
+		reparsed, err := ParseEntry(got, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reparsed, entry) {
+			t.Errorf("%q does not round-trip: got %+v, want %+v", tt.line, reparsed, entry)
+		}
+	}
+}
+
+func TestIncronEntry_StringEnvRoundTrip(t *testing.T) {
+	line := "/data IN_CLOSE_WRITE,env=A=1,env=B=x=y sync $/"
+	entry, err := ParseEntry(line, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entry.String(); got != line {
+		t.Errorf("String() = %q, want %q", got, line)
+	}
+}
+
+func TestIncronEntry_StringLogRoundTrip(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"/data IN_CLOSE_WRITE,log=none sync $/", "/data IN_CLOSE_WRITE,log=none sync $/"},
+		{"/data IN_CLOSE_WRITE,log=all sync $/", "/data IN_CLOSE_WRITE,log=all sync $/"},
+		{"/data IN_CLOSE_WRITE,log=errors sync $/", "/data IN_CLOSE_WRITE sync $/"},
+	}
+
+	for _, tt := range tests {
+		entry, err := ParseEntry(tt.line, 1)
+		if err != nil {
+			t.Fatalf("ParseEntry(%q): %v", tt.line, err)
+		}
+		if got := entry.String(); got != tt.expected {
+			t.Errorf("String() = %q, want %q", got, tt.expected)
+		}
+	}
+}
+
+func TestIncronEntry_StringQuotedRoundTrip(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{`/data IN_CLOSE_WRITE,onsuccess=true import $#`, `/data IN_CLOSE_WRITE,onsuccess=true import $#`},
+		{`/data IN_CLOSE_WRITE,onfailure="logger failed, $#" import $#`, `/data IN_CLOSE_WRITE,onfailure="logger failed, $#" import $#`},
+		{`/data IN_CLOSE_WRITE,cwd="/srv/my files",env="NAME=a b" import $#`, `/data IN_CLOSE_WRITE,cwd="/srv/my files",env="NAME=a b" import $#`},
+		{`/data IN_CLOSE_WRITE,cwd="/srv" import $#`, `/data IN_CLOSE_WRITE,cwd=/srv import $#`},
+		{`/data IN_CLOSE_WRITE,onsuccess="logger \"done, $#\"" import $#`, `/data IN_CLOSE_WRITE,onsuccess="logger \"done, $#\"" import $#`},
+		{`/data IN_CLOSE_WRITE,onsuccess="sed -i 's/\./_/' $#" import $#`, `/data IN_CLOSE_WRITE,onsuccess="sed -i 's/\./_/' $#" import $#`},
+		{`/data IN_CLOSE_WRITE,onsuccess="echo \\\"" import $#`, `/data IN_CLOSE_WRITE,onsuccess="echo \\\"" import $#`},
+	}
+
+	for _, tt := range tests {
+		entry, err := ParseEntry(tt.line, 1)
+		if err != nil {
+			t.Fatalf("ParseEntry(%q): %v", tt.line, err)
+		}
+		got := entry.String()
+		if got != tt.expected {
+			t.Errorf("String() = %q, want %q", got, tt.expected)
+		}
+		reparsed, err := ParseEntry(got, 1)
+		if err != nil || !reflect.DeepEqual(reparsed, entry) {
+			t.Errorf("%q does not round-trip: got %+v, %v", tt.line, reparsed, err)
+		}
+	}
+}
+
+func TestIncronEntry_MatchesName(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		file     string
+		expected bool
+	}{
+		{"no filters", "/data IN_CREATE echo", "a.tmp", true},
+		{"include match", "/data IN_CREATE,include=*.jpg,include=*.png echo", "a.png", true},
+		{"include miss", "/data IN_CREATE,include=*.jpg echo", "a.png", false},
+		{"exclude match", "/data IN_CREATE,exclude=*.tmp echo", "a.tmp", false},
+		{"exclude miss", "/data IN_CREATE,exclude=*.tmp echo", "a.jpg", true},
+		{"exclude wins", "/data IN_CREATE,include=*.jpg,exclude=.* echo", ".a.jpg", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := ParseEntry(tt.line, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entry.MatchesName(tt.file); got != tt.expected {
+				t.Errorf("MatchesName(%q) = %v, want %v", tt.file, got, tt.expected)
 			}
-			
-			if entry.LineNumber != tt.expected.LineNumber {
-				t.Errorf("line number mismatch: got %d, want %d", entry.LineNumber, tt.expected.LineNumber)
+			if got := entry.String(); got != tt.line {
+				t.Errorf("String() = %q, want %q", got, tt.line)
 			}
-			
-			if entry.Options != tt.expected.Options {
-				t.Errorf("options mismatch: got %+v, want %+v", entry.Options, tt.expected.Options)
+		})
+	}
+
+	if _, err := ParseEntry("/data IN_CREATE,include=[ echo", 1); err == nil {
+		t.Error("ParseEntry() accepted an invalid include pattern")
+	}
+}
+
+func TestIncronEntry_MatchesEvent(t *testing.T) {
+	dirEntry := &IncronEntry{Path: "/data", Mask: InCreate | InCloseWrite}
+	fileEntry := &IncronEntry{Path: "/etc/app.conf", Mask: InModify}
+	filtered := &IncronEntry{Path: "/data", Mask: InCreate, Options: EntryOptions{Include: []string{"*.jpg"}}}
+	recursive := &IncronEntry{Path: "/data", Mask: InCreate, Options: EntryOptions{Recursive: true}}
+	shallow := &IncronEntry{Path: "/data", Mask: InCreate, Options: EntryOptions{Recursive: true, LimitDepth: true, RecursiveDepth: 1}}
+	pruned := &IncronEntry{Path: "/data", Mask: InCreate, Options: EntryOptions{Recursive: true, Prune: []string{"/data/tmp"}}}
+	dotDirs := &IncronEntry{Path: "/data", Mask: InCreate, Options: EntryOptions{Recursive: true, DotDirs: true}}
+	symlinks := &IncronEntry{Path: "/data", Mask: InCreate, Options: EntryOptions{Recursive: true, FollowSymlinks: true}}
+
+	tests := []struct {
+		name     string
+		entry    *IncronEntry
+		event    InotifyEvent
+		expected bool
+	}{
+		{"file in watched directory", dirEntry,
+			InotifyEvent{Path: "/data/a.txt", Name: "a.txt", Mask: InCreate, WatchDir: "/data"}, true},
+		{"partial mask overlap", dirEntry,
+			InotifyEvent{Path: "/data/sub", Name: "sub", Mask: InCreate | InIsdir, WatchDir: "/data"}, true},
+		{"mask not in entry", dirEntry,
+			InotifyEvent{Path: "/data/a.txt", Name: "a.txt", Mask: InDelete, WatchDir: "/data"}, false},
+		{"other directory", dirEntry,
+			InotifyEvent{Path: "/other/a.txt", Name: "a.txt", Mask: InCreate, WatchDir: "/other"}, false},
+		{"watched file", fileEntry,
+			InotifyEvent{Path: "/etc/app.conf", Mask: InModify, WatchDir: "/etc/app.conf"}, true},
+		{"watched file wrong mask", fileEntry,
+			InotifyEvent{Path: "/etc/app.conf", Mask: InAttrib, WatchDir: "/etc/app.conf"}, false},
+		{"name filter match", filtered,
+			InotifyEvent{Path: "/data/a.jpg", Name: "a.jpg", Mask: InCreate, WatchDir: "/data"}, true},
+		{"name filter miss", filtered,
+			InotifyEvent{Path: "/data/a.txt", Name: "a.txt", Mask: InCreate, WatchDir: "/data"}, false},
+		{"subdirectory of recursive entry", recursive,
+			InotifyEvent{Path: "/data/a/b/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/a/b"}, true},
+		{"subdirectory of non-recursive entry", dirEntry,
+			InotifyEvent{Path: "/data/a/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/a"}, false},
+		{"sibling of recursive entry", recursive,
+			InotifyEvent{Path: "/database/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/database"}, false},
+		{"within recursive_depth", shallow,
+			InotifyEvent{Path: "/data/a/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/a"}, true},
+		{"below recursive_depth", shallow,
+			InotifyEvent{Path: "/data/a/b/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/a/b"}, false},
+		{"pruned subtree", pruned,
+			InotifyEvent{Path: "/data/tmp/a/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/tmp/a"}, false},
+		{"outside pruned subtree", pruned,
+			InotifyEvent{Path: "/data/tmpfiles/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/tmpfiles"}, true},
+		{"dot directory", recursive,
+			InotifyEvent{Path: "/data/.git/a/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/.git/a"}, false},
+		{"dot directory with dotdirs", dotDirs,
+			InotifyEvent{Path: "/data/.git/a/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/.git/a"}, true},
+		{"through symlink", recursive,
+			InotifyEvent{Path: "/data/link/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/link", Symlinked: true}, false},
+		{"through symlink with followsymlinks", symlinks,
+			InotifyEvent{Path: "/data/link/c.txt", Name: "c.txt", Mask: InCreate, WatchDir: "/data/link", Symlinked: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.MatchesEvent(&tt.event); got != tt.expected {
+				t.Errorf("MatchesEvent(%v) = %v, want %v", &tt.event, got, tt.expected)
 			}
 		})
 	}
 }
 
-func TestIncronEntry_String(t *testing.T) {
-	entry := &IncronEntry{
-		Path:    "/tmp",
-		Mask:    InCreate | InModify,
-		Command: "echo test",
-		Options: EntryOptions{
-			NoLoop:    true,
-			Recursive: true,
-			DotDirs:   false,
-		},
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"file.txt", "'file.txt'"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"a; rm -rf b", "'a; rm -rf b'"},
+		{"it's", `'it'\''s'`},
+		{"$(id)`id`", "'$(id)`id`'"},
 	}
-	
-	result := entry.String()
-	// The order of flags in the output may vary, so just check that both flags are present
-	if !strings.Contains(result, "IN_CREATE") || !strings.Contains(result, "IN_MODIFY") {
-		t.Errorf("String() missing expected flags: got %q", result)
+
+	for _, tt := range tests {
+		if got := ShellQuote(tt.input); got != tt.expected {
+			t.Errorf("ShellQuote(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
 	}
-	if !strings.Contains(result, "/tmp") || !strings.Contains(result, "echo test") {
-		t.Errorf("String() missing expected path or command: got %q", result)
+}
+
+func TestIncronEntry_ExpandCommandQuote(t *testing.T) {
+	entry := &IncronEntry{Command: "gzip $/ && echo $# $&", Options: EntryOptions{Shell: true}}
+	got := entry.ExpandCommand("/in box", "a'b; rm x", InCreate)
+	want := `gzip '/in box/a'\''b; rm x' && echo 'a'\''b; rm x' 256`
+	if got != want {
+		t.Errorf("ExpandCommand() = %q, want %q", got, want)
+	}
+
+	// quote=false substitutes the names as they are
+	entry.Options.NoQuote = true
+	if got := entry.ExpandCommand("/in", "a b", InCreate); got != "gzip /in/a b && echo a b 256" {
+		t.Errorf("ExpandCommand() with quote=false = %q", got)
+	}
+
+	// Quoting only applies to shell commands
+	entry.Options = EntryOptions{}
+	if got := entry.ExpandCommand("/in", "a", InCreate); got != "gzip /in/a && echo a 256" {
+		t.Errorf("ExpandCommand() without shell = %q", got)
+	}
+}
+
+func TestIncronEntry_ExpandEventArgs(t *testing.T) {
+	entry := &IncronEntry{Command: "  cp  $/ /backup/$#.bak $:u"}
+	event := &InotifyEvent{Path: "/in/a b", Name: "a b", Mask: InCreate, WatchDir: "/in"}
+	got := entry.ExpandEventArgs(event, &FileAttrs{Uid: 1000})
+	want := []string{"cp", "/in/a b", "/backup/a b.bak", "1000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExpandEventArgs() = %q, want %q", got, want)
 	}
 }
 
@@ -186,10 +954,80 @@ func TestIncronEntry_ExpandCommand(t *testing.T) {
 	}
 }
 
+func TestIncronEntry_ExpandFullPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		command   string
+		watchPath string
+		filename  string
+		want      string
+	}{
+		{
+			name:      "directory watch",
+			command:   "cat $/",
+			watchPath: "/watch/dir",
+			filename:  "file.txt",
+			want:      "cat /watch/dir/file.txt",
+		},
+		{
+			name:      "file watch",
+			command:   "cat $/",
+			watchPath: "/etc/app.conf",
+			filename:  "",
+			want:      "cat /etc/app.conf",
+		},
+		{
+			name:      "literal dollar wins",
+			command:   "echo $$/ $$@",
+			watchPath: "/watch/dir",
+			filename:  "file.txt",
+			want:      "echo $/ $@",
+		},
+		{
+			name:      "wildcards in file name are not expanded",
+			command:   "mv $/ /done/$#",
+			watchPath: "/watch/dir",
+			filename:  "$@-$#-$$.txt",
+			want:      "mv /watch/dir/$@-$#-$$.txt /done/$@-$#-$$.txt",
+		},
+		{
+			name:      "wildcards in watch path are not expanded",
+			command:   "ls $@ $#",
+			watchPath: "/watch/$#",
+			filename:  "file.txt",
+			want:      "ls /watch/$# file.txt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &IncronEntry{Command: tt.command}
+			if got := entry.ExpandCommand(tt.watchPath, tt.filename, InCreate); got != tt.want {
+				t.Errorf("ExpandCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventMaskOrdering(t *testing.T) {
+	entry := &IncronEntry{Command: "echo $%"}
+
+	// Map iteration order is randomized, so repeat to catch unstable output
+	for i := 0; i < 20; i++ {
+		if got := entry.ExpandCommand("/tmp", "dir", InCreate|InIsdir); got != "echo IN_CREATE,IN_ISDIR" {
+			t.Fatalf("ExpandCommand() = %q, want %q", got, "echo IN_CREATE,IN_ISDIR")
+		}
+		if got := maskToString(InCreate | InIsdir); got != "IN_CREATE|IN_ISDIR" {
+			t.Fatalf("maskToString() = %q, want %q", got, "IN_CREATE|IN_ISDIR")
+		}
+	}
+}
+
 func TestIncronEntry_MatchesPath(t *testing.T) {
 	tests := []struct {
 		name     string
 		entryPath string
+		noCase    bool
 		testPath  string
 		expected  bool
 	}{
@@ -217,11 +1055,38 @@ func TestIncronEntry_MatchesPath(t *testing.T) {
 			testPath:  "/tmp/test.log",
 			expected:  false,
 		},
+		{
+			name:     "case differs",
+			entryPath: "/mnt/Share",
+			testPath:  "/mnt/share",
+			expected:  false,
+		},
+		{
+			name:     "nocase literal path",
+			entryPath: "/mnt/Share",
+			noCase:    true,
+			testPath:  "/mnt/SHARE",
+			expected:  false,
+		},
+		{
+			name:     "nocase wildcard no match",
+			entryPath: "/mnt/*.txt",
+			noCase:    true,
+			testPath:  "/mnt/Notes.log",
+			expected:  false,
+		},
+		{
+			name:     "nocase wildcard match",
+			entryPath: "/mnt/*.txt",
+			noCase:    true,
+			testPath:  "/MNT/Notes.TXT",
+			expected:  true,
+		},
 	}
 	
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			entry := &IncronEntry{Path: tt.entryPath}
+			entry := &IncronEntry{Path: tt.entryPath, Options: EntryOptions{NoCase: tt.noCase}}
 			result := entry.MatchesPath(tt.testPath)
 			
 			if result != tt.expected {
@@ -257,6 +1122,16 @@ func TestMaskToString(t *testing.T) {
 			mask: 0,
 			want: "0",
 		},
+		{
+			name: "most events",
+			mask: InAllEvents &^ (InAccess | InOpen),
+			want: "IN_ALL_EVENTS,-IN_ACCESS,-IN_OPEN",
+		},
+		{
+			name: "most events and extra flags",
+			mask: InAllEvents&^InAccess | InOnlydir,
+			want: "IN_ALL_EVENTS,-IN_ACCESS,IN_ONLYDIR",
+		},
 	}
 	
 	for _, tt := range tests {
@@ -362,6 +1237,26 @@ func TestValidateEntry(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "nocase on a literal path",
+			entry: &IncronEntry{
+				Path:    "/tmp",
+				Mask:    InCreate,
+				Command: "echo test",
+				Options: EntryOptions{NoCase: true},
+			},
+			expectError: true,
+		},
+		{
+			name: "nocase on a pattern",
+			entry: &IncronEntry{
+				Path:    "/tmp/*.txt",
+				Mask:    InCreate,
+				Command: "echo test",
+				Options: EntryOptions{NoCase: true},
+			},
+			expectError: false,
+		},
 		{
 			name: "relative path",
 			entry: &IncronEntry{
@@ -389,6 +1284,16 @@ func TestValidateEntry(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "restart with cooldown",
+			entry: &IncronEntry{
+				Path:    "/tmp",
+				Mask:    InCreate,
+				Command: "echo test",
+				Options: EntryOptions{Restart: true, Cooldown: time.Second},
+			},
+			expectError: true,
+		},
 	}
 	
 	for _, tt := range tests {
@@ -404,4 +1309,336 @@ func TestValidateEntry(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestIncronEntry_ExpandCommandWith(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs *FileAttrs
+		want  string
+	}{
+		{"with attributes", &FileAttrs{Uid: 1000, Gid: 100, Mode: 0777}, "/in/a mode 0777 owner 1000:100 $:u $user"},
+		{"setuid", &FileAttrs{Uid: 0, Gid: 0, Mode: 04755}, "/in/a mode 4755 owner 0:0 $:u $user"},
+		{"file gone", nil, "/in/a mode  owner : $:u $user"},
+	}
+
+	entry := &IncronEntry{Command: "$/ mode $:p owner $:u:$:g $$:u $user"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entry.ExpandCommandWith("/in", "a", InAttrib, tt.attrs); got != tt.want {
+				t.Errorf("ExpandCommandWith() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncronEntry_ExpandEventCommand(t *testing.T) {
+	received := time.Unix(1700000000, 1234)
+	tests := []struct {
+		name  string
+		event *InotifyEvent
+		want  string
+	}{
+		{"received", &InotifyEvent{WatchDir: "/in", Name: "a", Mask: InCreate, Received: received},
+			"/in/a at 1700000000.000001234 $:t $tmp"},
+		{"no receive time", &InotifyEvent{WatchDir: "/in", Name: "a", Mask: InCreate}, "/in/a at  $:t $tmp"},
+	}
+
+	entry := &IncronEntry{Command: "$/ at $:t $$:t $tmp"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entry.ExpandEventCommand(tt.event, nil); got != tt.want {
+				t.Errorf("ExpandEventCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatFileAttrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0754|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := StatFileAttrs(path)
+	if attrs == nil {
+		t.Fatal("StatFileAttrs() = nil")
+	}
+	if attrs.Mode != 01754 || attrs.Uid != uint32(os.Getuid()) {
+		t.Errorf("StatFileAttrs() = %+v, want mode 01754 and uid %d", attrs, os.Getuid())
+	}
+
+	if attrs := StatFileAttrs(path + ".missing"); attrs != nil {
+		t.Errorf("StatFileAttrs() of a missing file = %+v", attrs)
+	}
+}
+
+func TestParseEventMask(t *testing.T) {
+	tests := []struct {
+		mask     string
+		expected uint32
+		wantErr  bool
+	}{
+		{"IN_CREATE", InCreate, false},
+		{"IN_CREATE,IN_MOVED_TO", InCreate | InMovedTo, false},
+		{"0x100", InCreate, false},
+		{"IN_CREATE,recursive=false", 0, true},
+		{"IN_NOPE", 0, true},
+		{"IN_ALL_EVENTS,-IN_ACCESS,-IN_OPEN", InAllEvents &^ (InAccess | InOpen), false},
+		{"IN_CLOSE,-IN_CLOSE_NOWRITE,-0x1", InCloseWrite, false},
+		{"IN_ACCESS,-IN_ALL_EVENTS,IN_CREATE", InCreate, false},
+		{"IN_CREATE,-IN_CREATE", 0, true},
+		{"IN_CREATE,-IN_NOPE", 0, true},
+		{"IN_CREATE,-", 0, true},
+		{"IN_CREATE,0x10000000", InCreate | 0x10000000, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mask, func(t *testing.T) {
+			mask, err := ParseEventMask(tt.mask)
+			if (err != nil) != tt.wantErr || mask != tt.expected {
+				t.Errorf("ParseEventMask(%q) = %#x, %v, want %#x, error %v", tt.mask, mask, err, tt.expected, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaskRoundTrip(t *testing.T) {
+	masks := []uint32{
+		InCreate,
+		InAllEvents,
+		InAllEvents &^ InAccess,
+		InAllEvents&^(InAccess|InOpen) | InOnlydir | InIsdir,
+		InCreate | InDelete | InOneshot,
+	}
+
+	for _, mask := range masks {
+		entry := &IncronEntry{Mask: mask}
+		parsed, err := ParseEventMask(entry.MaskToString())
+		if err != nil || parsed != mask {
+			t.Errorf("ParseEventMask(%q) = %#x, %v, want %#x", entry.MaskToString(), parsed, err, mask)
+		}
+	}
+}
+
+func TestUnknownMaskError(t *testing.T) {
+	_, err := ParseEventMask("IN_CREATE,-IN_FOO")
+	if err == nil {
+		t.Fatal("ParseEventMask accepted IN_FOO")
+	}
+	if !strings.HasPrefix(err.Error(), "unknown event mask 'IN_FOO'; valid masks are: IN_ACCESS, IN_ALL_EVENTS, IN_ATTRIB,") {
+		t.Errorf("error = %q, want the unknown name and the valid names", err)
+	}
+}
+
+func TestParseEventMasks(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		expected map[string]uint32
+		wantErr  bool
+	}{
+		{"empty", "", map[string]uint32{}, false},
+		{"hex and decimal", "IN_MASK_CREATE=0x10000000  IN_NEWER=536870912", map[string]uint32{"IN_MASK_CREATE": 0x10000000, "IN_NEWER": 0x20000000}, false},
+		{"no value", "IN_MASK_CREATE", nil, true},
+		{"no prefix", "MASK_CREATE=0x10000000", nil, true},
+		{"lower case", "IN_mask=0x10000000", nil, true},
+		{"zero", "IN_NONE=0", nil, true},
+		{"not a number", "IN_FOO=IN_CREATE", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masks, err := ParseEventMasks(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEventMasks(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(masks, tt.expected) {
+				t.Errorf("ParseEventMasks(%q) = %v, want %v", tt.spec, masks, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRegisterEventMasks(t *testing.T) {
+	flags := len(orderedEventFlags)
+	t.Cleanup(func() {
+		delete(EventMaskMap, "IN_MASK_CREATE")
+		delete(EventMaskMap, "IN_CREATED")
+		delete(ReverseEventMaskMap, 0x10000000)
+		orderedEventFlags = orderedEventFlags[:flags]
+	})
+
+	if err := RegisterEventMasks(map[string]uint32{"IN_CREATE": InDelete}); err == nil {
+		t.Error("RegisterEventMasks redefined IN_CREATE")
+	}
+	if err := RegisterEventMasks(map[string]uint32{"IN_MASK_CREATE": 0x10000000, "IN_CREATED": InCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	mask, err := ParseEventMask("IN_CREATED,IN_MASK_CREATE")
+	if err != nil || mask != InCreate|0x10000000 {
+		t.Errorf("ParseEventMask() = %#x, %v, want %#x", mask, err, InCreate|0x10000000)
+	}
+	entry := &IncronEntry{Mask: mask}
+	if got := entry.MaskToString(); got != "IN_CREATE,IN_MASK_CREATE" {
+		t.Errorf("MaskToString() = %q, want IN_CREATE,IN_MASK_CREATE", got)
+	}
+}
+
+func TestEntryEventFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    string
+		path     string
+		watchDir string
+		file     string
+		matches  bool
+	}{
+		{"file in watched directory", "/data IN_CREATE true", "/data/a.txt", "/data", "a.txt", true},
+		{"watched file", "/data/a.txt IN_MODIFY true", "/data/a.txt", "/data/a.txt", "", true},
+		{"other directory", "/data IN_CREATE true", "/srv/a.txt", "/srv", "a.txt", false},
+		{"excluded name", "/data IN_CREATE,exclude=*.txt true", "/data/a.txt", "/data", "a.txt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := ParseEntry(tt.entry, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := entry.EventFor(tt.path, entry.Mask)
+			if event.WatchDir != tt.watchDir || event.Name != tt.file || event.Path != tt.path {
+				t.Errorf("EventFor() = %+v, want watch dir %q and name %q", event, tt.watchDir, tt.file)
+			}
+			if got := entry.MatchesEvent(event); got != tt.matches {
+				t.Errorf("MatchesEvent() = %v, want %v", got, tt.matches)
+			}
+		})
+	}
+}
+
+func TestTableDuplicates(t *testing.T) {
+	tc := DefaultTableConfig()
+	content := `# uploads
+/data IN_CREATE echo $#
+/data IN_CREATE,recursive=false echo $#
+# copied by mistake
+/data IN_CREATE echo $#
+/data IN_CREATE,loopable=false echo $#
+/srv IN_DELETE true`
+
+	table, err := tc.LoadTableReader(strings.NewReader(content), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Options are part of the entry, spelling out their defaults isn't
+	want := []Duplicate{{Index: 2, Original: 0}, {Index: 3, Original: 0}}
+	if got := table.Duplicates(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Duplicates() = %+v, want %+v", got, want)
+	}
+	if warnings := DuplicateWarnings(table); len(warnings) != 2 || !strings.Contains(warnings[0], "line 5 repeats line 2") {
+		t.Errorf("DuplicateWarnings() = %q", warnings)
+	}
+	if errs := tc.ValidateTable(table); len(errs) != 0 {
+		t.Errorf("ValidateTable() = %v, duplicates should only be warnings", errs)
+	}
+
+	if removed := table.RemoveDuplicates(); removed != 2 {
+		t.Errorf("RemoveDuplicates() = %d, want 2", removed)
+	}
+	expected := `# uploads
+/data IN_CREATE echo $#
+/data IN_CREATE,recursive=false echo $#
+# copied by mistake
+/srv IN_DELETE true`
+	if got := table.Format(); got != expected {
+		t.Errorf("Format() after RemoveDuplicates() =\n%s\nwant\n%s", got, expected)
+	}
+	if len(table.Duplicates()) != 0 {
+		t.Error("duplicates left after RemoveDuplicates()")
+	}
+}
+
+func TestTableMatch(t *testing.T) {
+	tc := DefaultTableConfig()
+	table, err := tc.LoadTableReader(strings.NewReader(`/data IN_CREATE echo created $#
+/data IN_CLOSE_WRITE,include=*.csv echo written $#
+/data IN_CREATE,IN_DELETE echo changed $#
+/srv/*/in IN_CREATE echo upload $#
+`), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		event InotifyEvent
+		lines []int
+	}{
+		{"multiple matches",
+			InotifyEvent{Path: "/data/a.csv", Name: "a.csv", Mask: InCreate, WatchDir: "/data"}, []int{1, 3}},
+		{"name filter",
+			InotifyEvent{Path: "/data/a.csv", Name: "a.csv", Mask: InCloseWrite, WatchDir: "/data"}, []int{2}},
+		{"no match",
+			InotifyEvent{Path: "/data/a.csv", Name: "a.csv", Mask: InAttrib, WatchDir: "/data"}, nil},
+		{"other directory",
+			InotifyEvent{Path: "/tmp/a.csv", Name: "a.csv", Mask: InCreate, WatchDir: "/tmp"}, nil},
+		{"wildcard path",
+			InotifyEvent{Path: "/srv/alice/in/a.csv", Name: "a.csv", Mask: InCreate, WatchDir: "/srv/alice/in"}, []int{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []int
+			for _, entry := range table.Match(&tt.event) {
+				lines = append(lines, entry.LineNumber)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("Match() returned lines %v, want %v", lines, tt.lines)
+			}
+		})
+	}
+
+	// Matches point into the table
+	event := &InotifyEvent{Path: "/data/a", Name: "a", Mask: InCreate, WatchDir: "/data"}
+	if matches := table.Match(event); len(matches) == 0 || matches[0] != &table.Entries[0] {
+		t.Error("Match() doesn't return the table's own entries")
+	}
+}
+
+func TestIncronEntry_WaitsForClose(t *testing.T) {
+	closeOnly := &IncronEntry{Path: "/data", Mask: InModify | InCloseWrite, Options: EntryOptions{OnCloseOnly: true}}
+	every := &IncronEntry{Path: "/data", Mask: InModify | InCloseWrite}
+
+	tests := []struct {
+		name     string
+		entry    *IncronEntry
+		mask     uint32
+		expected bool
+	}{
+		{"modify held back", closeOnly, InModify, true},
+		{"close delivered", closeOnly, InCloseWrite, false},
+		{"combined event delivered", closeOnly, InModify | InCloseWrite, false},
+		{"without the option", every, InModify, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &InotifyEvent{Path: "/data/a", Name: "a", Mask: tt.mask, WatchDir: "/data"}
+			if got := tt.entry.WaitsForClose(event); got != tt.expected {
+				t.Errorf("WaitsForClose(%v) = %v, want %v", event, got, tt.expected)
+			}
+		})
+	}
+
+	// The option needs the event it waits for
+	entry := &IncronEntry{Path: "/data", Mask: InModify, Command: "true", Options: EntryOptions{OnCloseOnly: true}}
+	if err := ValidateEntry(entry); err == nil {
+		t.Error("ValidateEntry() accepted on_close_only=true without IN_CLOSE_WRITE")
+	}
+}
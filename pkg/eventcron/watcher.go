@@ -2,12 +2,19 @@
 package eventcron
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -15,11 +22,17 @@ import (
 
 // InotifyEvent represents an inotify event
 type InotifyEvent struct {
-	Path     string // Full path where the event occurred
-	Name     string // Name of the file/directory that triggered the event
-	Mask     uint32 // Event mask
-	Cookie   uint32 // Unique cookie for related events
-	WatchDir string // The directory being watched
+	Path      string    // Full path where the event occurred
+	Name      string    // Name of the file/directory that triggered the event
+	Mask      uint32    // Event mask
+	Cookie    uint32    // Unique cookie for related events
+	WatchDir  string    // The directory being watched
+	Symlinked bool      // WatchDir was reached through a symlinked directory of a recursive watch
+	Spent     bool      // The watch was IN_ONESHOT and has been removed
+	OldPath   string    // For a correlated rename, the path the file was moved from
+	NewPath   string    // For a correlated rename, the path the file was moved to
+	Seq       uint64    // Order in which the watcher read the event, starting at 1; 0 if not read from inotify
+	Received  time.Time // When the watcher read the event, or ExistingFileEvents made it
 }
 
 // String returns a string representation of the event
@@ -28,41 +41,246 @@ func (e *InotifyEvent) String() string {
 		e.Path, e.Name, maskToString(e.Mask), e.Cookie, e.WatchDir)
 }
 
+// MaskString returns the event flags as text, e.g. IN_CREATE|IN_ISDIR
+func (e *InotifyEvent) MaskString() string {
+	return maskToString(e.Mask)
+}
+
+// IsHidden reports whether the event is for a dotfile or dot directory inside
+// the watched directory. Events on a watched file itself have no name and are
+// never hidden.
+func (e *InotifyEvent) IsHidden() bool {
+	return strings.HasPrefix(e.Name, ".")
+}
+
+// DefaultEventBufferSize is the event channel capacity used by NewWatcher
+const DefaultEventBufferSize = 100
+
+// ErrQueueOverflow is reported on the error channel when the kernel's inotify
+// queue overflowed and events were lost
+var ErrQueueOverflow = errors.New("inotify event queue overflowed")
+
+// ErrPathNotWatched is returned by RemoveWatch for a path without a watch
+var ErrPathNotWatched = errors.New("path is not being watched")
+
+// ErrProtectedRoot is returned for a recursive entry on one of the protected
+// roots, unless the entry sets force=true
+var ErrProtectedRoot = errors.New("refusing to watch protected path recursively")
+
+// ErrSpecialFile is returned for an entry on a socket, or on a fifo or device
+// with a mask of events it never reports, unless the entry sets force=true
+var ErrSpecialFile = errors.New("refusing to watch special file")
+
+// File types of watches, see WatchInfo.Type
+const (
+	FileTypeDirectory   = "directory"
+	FileTypeFile        = "file"
+	FileTypeFifo        = "fifo"
+	FileTypeSocket      = "socket"
+	FileTypeCharDevice  = "char device"
+	FileTypeBlockDevice = "block device"
+)
+
+// specialFileEvents are the events inotify reports for a fifo or device:
+// reads and writes through it, and changes to the file itself
+const specialFileEvents = InAccess | InModify | InAttrib | InCloseWrite | InCloseNowrite | InOpen | InDeleteSelf | InMoveSelf
+
+// DefaultProtectedRoots are the paths NewWatcher refuses to watch recursively.
+// Each of them would take a watch for every directory of the system.
+var DefaultProtectedRoots = []string{"/", "/proc", "/sys", "/dev"}
+
+// maxUserWatchesFile holds the per-user inotify watch limit
+const maxUserWatchesFile = "/proc/sys/fs/inotify/max_user_watches"
+
+// WatchLimitError is returned when a watch can't be added because the
+// fs.inotify.max_user_watches limit has been reached
+type WatchLimitError struct {
+	Path    string // Path that couldn't be watched
+	Watches int    // Watches held by this watcher
+	Limit   int    // Current max_user_watches, 0 if unknown
+}
+
+// Error returns the error message
+func (e *WatchLimitError) Error() string {
+	limit := "unknown"
+	if e.Limit > 0 {
+		limit = strconv.Itoa(e.Limit)
+	}
+	return fmt.Sprintf("cannot watch %s: inotify watch limit reached (%d watches held, fs.inotify.max_user_watches = %s)",
+		e.Path, e.Watches, limit)
+}
+
+// Unwrap lets errors.Is match the error against ENOSPC
+func (e *WatchLimitError) Unwrap() error {
+	return unix.ENOSPC
+}
+
+// MaxUserWatches returns the current fs.inotify.max_user_watches limit
+func MaxUserWatches() (int, error) {
+	data, err := os.ReadFile(maxUserWatchesFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", maxUserWatchesFile, err)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %v", maxUserWatchesFile, err)
+	}
+	return limit, nil
+}
+
+// OverflowPolicy controls what happens when the event channel is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest discards the event that doesn't fit (default)
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued event to make room
+	OverflowDropOldest
+	// OverflowBlock waits until the consumer makes room
+	OverflowBlock
+)
+
+// String returns the configuration name of the policy
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// ParseOverflowPolicy parses a policy name as used in the configuration file
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "block":
+		return OverflowBlock, nil
+	default:
+		return 0, fmt.Errorf("unknown overflow policy: %s (expected block, drop-newest or drop-oldest)", s)
+	}
+}
+
 // Watcher manages inotify watches for eventcron entries
 type Watcher struct {
-	fd          int                    // Inotify file descriptor
-	watches     map[int]*WatchInfo     // Watch descriptor to watch info mapping
-	pathWatches map[string]int         // Path to watch descriptor mapping
-	events      chan *InotifyEvent     // Event channel
-	errors      chan error             // Error channel
-	done        chan struct{}          // Done channel for shutdown
-	mu          sync.RWMutex           // Mutex for thread safety
-	running     bool                   // Whether the watcher is running
+	fd             int                      // Inotify file descriptor, nonblocking
+	wake           [2]int                   // Pipe whose read end wakes readEvents once Stop writes to it
+	watches        map[int]*WatchInfo       // Watch descriptor to watch info mapping
+	pathWatches    map[string]int           // Path to watch descriptor mapping
+	fileWatches    map[fileID]int           // Watched file or directory of each entry watch
+	events         chan *InotifyEvent       // Event channel
+	errors         chan error               // Error channel
+	done           chan struct{}            // Done channel for shutdown
+	readerDone     chan struct{}            // Closed when readEvents has returned
+	mu             sync.RWMutex             // Mutex for thread safety
+	running        bool                     // Whether the watcher is running
+	overflowPolicy OverflowPolicy           // What to do when the event channel is full
+	droppedEvents  atomic.Uint64            // Number of events dropped
+	sequence       atomic.Uint64            // Seq of the last event read
+	pending        map[string]*pendingWatch // Entries whose path doesn't exist yet
+	moves          map[uint32]*pendingMove  // IN_MOVED_FROM events waiting for their IN_MOVED_TO
+	moveTimers     sync.WaitGroup           // Timers of moves that may still deliver their event
+	protectedRoots []string                 // Paths only watched recursively with force=true
+	maskCreate     bool                     // Kernel supports IN_MASK_CREATE
+}
+
+// EventSource delivers inotify events and errors, e.g. a Watcher
+type EventSource interface {
+	Events() <-chan *InotifyEvent
+	Errors() <-chan error
 }
 
+var _ EventSource = (*Watcher)(nil)
+
 // WatchInfo contains information about a watched path
 type WatchInfo struct {
-	Path      string      // Watched path
-	Mask      uint32      // Watch mask
-	Entry     *IncronEntry // Associated eventcron entry
-	Recursive bool        // Whether to watch recursively
-	DotDirs   bool        // Whether to include dot directories
+	Path           string         // Watched path
+	Mask           uint32         // Watch mask
+	Entries        []*IncronEntry // Entries watching this path, nil for helper watches
+	Recursive      bool           // Whether to watch recursively
+	DotDirs        bool           // Whether to include dot directories
+	FollowSymlinks bool           // Whether recursion descends into symlinked directories
+	File           bool           // Watches a single file, watched again when it is replaced
+	Deferred       bool           // Only waits for a pending entry's path to appear
+	Depth          int            // Directory levels below the entry's path
+	Symlinked      bool           // Reached through a symlinked directory
+	MaxDepth       int            // Deepest level to watch recursively, -1 for unlimited
+	Prune          []string       // Subtrees left out of the recursive watch
+	Aliases        []string       // Other paths of the same file or directory, e.g. bind mounts
+	Type           string         // Type of the watched file, e.g. FileTypeDirectory or FileTypeFifo
+	id             fileID         // Device and inode of the watched file or directory
+}
+
+// pendingWatch is a path waiting to be created, with the entries watching it
+type pendingWatch struct {
+	entries []*IncronEntry
+	parent  string // Nearest existing ancestor, watched for the next component
+}
+
+// stopPollInterval is how long readEvents waits in poll before it checks
+// whether the watcher was stopped, in case Stop couldn't wake it
+const stopPollInterval = time.Second
+
+// pendingMove is an IN_MOVED_FROM event held back by correlateMove, with the
+// timer delivering it if no IN_MOVED_TO follows
+type pendingMove struct {
+	event *InotifyEvent
+	timer *time.Timer
 }
 
+// moveWindow is how long an IN_MOVED_FROM event is held back waiting for the
+// IN_MOVED_TO with the same cookie
+const moveWindow = 50 * time.Millisecond
+
+// deferredMask is used to watch the ancestor of a path that doesn't exist yet
+const deferredMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
 // NewWatcher creates a new inotify watcher
 func NewWatcher() (*Watcher, error) {
-	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	return NewWatcherWithBuffer(DefaultEventBufferSize)
+}
+
+// NewWatcherWithBuffer creates a new inotify watcher whose event channel
+// holds up to size events
+func NewWatcherWithBuffer(size int) (*Watcher, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid event buffer size: %d", size)
+	}
+
+	// readEvents polls the nonblocking fd together with the read end of
+	// wake, so Stop can wake it without closing the fd under it
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize inotify: %v", err)
 	}
+	var wake [2]int
+	if err := unix.Pipe2(wake[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to create wake pipe: %v", err)
+	}
 
 	w := &Watcher{
 		fd:          fd,
+		wake:        wake,
 		watches:     make(map[int]*WatchInfo),
 		pathWatches: make(map[string]int),
-		events:      make(chan *InotifyEvent, 100),
+		fileWatches: make(map[fileID]int),
+		pending:     make(map[string]*pendingWatch),
+		moves:       make(map[uint32]*pendingMove),
+		events:      make(chan *InotifyEvent, size),
 		errors:      make(chan error, 10),
 		done:        make(chan struct{}),
+		readerDone:  make(chan struct{}),
+
+		protectedRoots: DefaultProtectedRoots,
+		maskCreate:     probeMaskCreate(fd),
 	}
 
 	return w, nil
@@ -76,172 +294,976 @@ func (w *Watcher) Start() error {
 	if w.running {
 		return fmt.Errorf("watcher is already running")
 	}
+	select {
+	case <-w.done:
+		return fmt.Errorf("watcher has been stopped")
+	default:
+	}
 
 	w.running = true
 	go w.readEvents()
 	return nil
 }
 
-// Stop stops the watcher and closes all resources
+// Stop stops the watcher and closes all resources. It waits for the reader
+// and the timers of pending moves to finish, so the event and error channels
+// are closed only once nothing sends on them anymore; events still buffered
+// can be drained afterwards.
 func (w *Watcher) Stop() error {
 	w.mu.Lock()
-	defer w.mu.Unlock()
-
 	if !w.running {
+		w.mu.Unlock()
 		return nil
 	}
 
 	w.running = false
 	close(w.done)
+	w.mu.Unlock()
+
+	// Wake readEvents if it is waiting in poll. Should that fail, it notices
+	// the stop within stopPollInterval instead, and everything is closed all
+	// the same.
+	var wakeErr error
+	if _, err := unix.Write(w.wake[1], []byte{0}); err != nil && err != unix.EAGAIN {
+		wakeErr = fmt.Errorf("failed to wake event reader: %v", err)
+	}
+
+	// Only close what readEvents uses once it can no longer send or read.
+	// Moves still waiting for their IN_MOVED_TO are dropped, and their timers
+	// have to return before the channels they send on are closed.
+	<-w.readerDone
+	w.mu.Lock()
+	for cookie, move := range w.moves {
+		if move.timer.Stop() {
+			w.moveTimers.Done()
+		}
+		delete(w.moves, cookie)
+	}
+	w.mu.Unlock()
+	w.moveTimers.Wait()
+	close(w.events)
+	close(w.errors)
+
+	unix.Close(w.wake[0])
+	unix.Close(w.wake[1])
+	if err := unix.Close(w.fd); err != nil {
+		return fmt.Errorf("failed to close inotify fd: %v", err)
+	}
+
+	return wakeErr
+}
+
+// AddWatch adds a watch for the given eventcron entry. If the path doesn't
+// exist yet the entry becomes pending and is watched once the path appears.
+func (w *Watcher) AddWatch(entry *IncronEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addWatch(entry)
+}
+
+// addWatch adds a watch for the given entry. Entries for a path that is
+// already watched share its watch (internal, assumes lock held).
+func (w *Watcher) addWatch(entry *IncronEntry) error {
+	path := entry.Path
+
+	if err := w.checkProtected(entry); err != nil {
+		return err
+	}
+
+	if pw, exists := w.pending[path]; exists {
+		if containsEntry(pw.entries, entry) {
+			return fmt.Errorf("path %s is already being watched", path)
+		}
+		pw.entries = append(pw.entries, entry)
+		return nil
+	}
+
+	if wd, exists := w.pathWatches[path]; exists && len(w.watches[wd].Entries) > 0 {
+		if containsEntry(w.watches[wd].Entries, entry) {
+			return fmt.Errorf("path %s is already being watched", path)
+		}
+		return w.rewatchWith(wd, []*IncronEntry{entry})
+	}
+
+	return w.watchEntries(path, []*IncronEntry{entry})
+}
+
+// rewatchWith replaces the entry watch wd with one for its entries plus
+// entries, using the combined mask and options of all of them. If that fails
+// the entries that were watched before keep their watch (internal, assumes
+// lock held).
+func (w *Watcher) rewatchWith(wd int, entries []*IncronEntry) error {
+	watchInfo := w.watches[wd]
+	combined := append(append([]*IncronEntry(nil), watchInfo.Entries...), entries...)
+	if watchInfo.Recursive {
+		w.removeSubdirWatches(watchInfo.Path)
+	}
+	if err := w.removeWatch(wd); err != nil {
+		return err
+	}
+	if err := w.watchEntries(watchInfo.Path, combined); err != nil {
+		if err := w.watchEntries(watchInfo.Path, watchInfo.Entries); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to add watch for %s: %v\n", watchInfo.Path, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// watchEntries adds the watch for entries that all watch path. If the path
+// doesn't exist yet they become pending (internal, assumes lock held).
+func (w *Watcher) watchEntries(path string, entries []*IncronEntry) error {
+	// Check if we're already watching this path
+	if wd, exists := w.pathWatches[path]; exists && !w.watches[wd].Deferred {
+		return fmt.Errorf("path %s is already being watched", path)
+	}
+	if _, exists := w.pending[path]; exists {
+		return fmt.Errorf("path %s is already being watched", path)
+	}
+
+	// Check if path exists, otherwise wait for it to be created
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return w.deferWatch(path, entries)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot stat path %s: %v", path, err)
+	}
+
+	// Another path may lead to the same file or directory, e.g. through a
+	// bind mount. The kernel has a single watch for both, so its entries are
+	// merged into the watch of that path.
+	id := fileIDOf(info)
+	if wd, exists := w.fileWatches[id]; exists {
+		return w.rewatchWith(wd, entries)
+	}
+
+	if err := checkFileType(path, info.Mode(), entries); err != nil {
+		return err
+	}
+
+	watchInfo := mergeEntries(path, entries)
+	watchInfo.File = !info.IsDir()
+	watchInfo.Type = fileTypeOf(info.Mode())
+	watchInfo.id = id
+
+	// Add watch for the main path
+	wd, err := w.addSingleWatch(path, watchInfo.kernelMask())
+	if err != nil {
+		return err
+	}
+
+	w.watches[wd] = watchInfo
+	w.pathWatches[path] = wd
+	for _, alias := range watchInfo.Aliases {
+		w.pathWatches[alias] = wd
+	}
+	w.fileWatches[id] = wd
+	w.keepPendingParent(path)
+
+	// If it's a directory and recursive is enabled, add watches for subdirectories
+	if info.IsDir() && watchInfo.Recursive {
+		if err := w.addRecursiveWatches(path, watchInfo.Mask, watchInfo.DotDirs, watchInfo.FollowSymlinks, watchInfo.MaxDepth, watchInfo.Prune); err != nil {
+			// Clean up the main watch and its subdirectories if recursive
+			// setup fails
+			w.removeSubdirWatches(path)
+			w.removeWatch(wd)
+			return fmt.Errorf("failed to setup recursive watches: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// fileTypeOf returns the type of a file with mode, see WatchInfo.Type
+func fileTypeOf(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return FileTypeDirectory
+	case mode&os.ModeNamedPipe != 0:
+		return FileTypeFifo
+	case mode&os.ModeSocket != 0:
+		return FileTypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return FileTypeCharDevice
+	case mode&os.ModeDevice != 0:
+		return FileTypeBlockDevice
+	default:
+		return FileTypeFile
+	}
+}
+
+// checkFileType refuses entries on special files that would never fire
+// unless they set force=true: inotify doesn't report the traffic through a
+// socket such as /dev/log, and a fifo or device only reports the events in
+// specialFileEvents
+func checkFileType(path string, mode os.FileMode, entries []*IncronEntry) error {
+	fileType := fileTypeOf(mode)
+	for _, entry := range entries {
+		if entry.Options.Force {
+			continue
+		}
+		switch fileType {
+		case FileTypeSocket:
+			return fmt.Errorf("%w: %s is a socket, whose traffic inotify doesn't report (set force=true to watch it anyway)",
+				ErrSpecialFile, path)
+		case FileTypeFifo, FileTypeCharDevice, FileTypeBlockDevice:
+			if entry.Mask&specialFileEvents == 0 {
+				return fmt.Errorf("%w: %s is a %s, which reports none of %s (set force=true to watch it anyway)",
+					ErrSpecialFile, path, fileType, entry.MaskToString())
+			}
+		}
+	}
+	return nil
+}
+
+// checkProtected refuses recursive entries on a protected root that don't
+// set force=true (internal, assumes lock held)
+func (w *Watcher) checkProtected(entry *IncronEntry) error {
+	if !entry.Options.Recursive || entry.Options.Force {
+		return nil
+	}
+
+	path := filepath.Clean(entry.Path)
+	for _, root := range w.protectedRoots {
+		if path == filepath.Clean(root) {
+			return fmt.Errorf("%w: %s (set recursive=false, or force=true to watch it anyway)", ErrProtectedRoot, entry.Path)
+		}
+	}
+	return nil
+}
+
+// mergeEntries returns the watch for entries sharing path: it reports the
+// events of every entry, and recursion reaches as far as any entry wants it
+// to. The watch is only oneshot, or limited to directories, if all entries
+// are, and a subtree is only pruned if every recursive entry prunes it.
+// MatchesEvent leaves each entry only the events inside its own scope.
+// Entries for other paths of the same file or directory make them aliases.
+func mergeEntries(path string, entries []*IncronEntry) *WatchInfo {
+	watchInfo := &WatchInfo{
+		Path:     path,
+		Entries:  entries,
+		MaxDepth: entries[0].Options.maxDepth(),
+	}
+
+	oneshot, onlyDir := true, true
+	var prune []string
+	pruneSet := false
+	for _, entry := range entries {
+		if entry.Path != path && !slices.Contains(watchInfo.Aliases, entry.Path) {
+			watchInfo.Aliases = append(watchInfo.Aliases, entry.Path)
+		}
+		if entry.Options.Recursive {
+			if !pruneSet {
+				prune = append(prune, entry.Options.Prune...)
+				pruneSet = true
+			} else {
+				prune = slices.DeleteFunc(prune, func(p string) bool {
+					return !slices.Contains(entry.Options.Prune, p)
+				})
+			}
+		}
+
+		watchInfo.Mask |= entry.Mask &^ (unix.IN_ONESHOT | unix.IN_ONLYDIR)
+		oneshot = oneshot && entry.Mask&unix.IN_ONESHOT != 0
+		onlyDir = onlyDir && (entry.Options.OnlyDir || entry.Mask&unix.IN_ONLYDIR != 0)
+		watchInfo.Recursive = watchInfo.Recursive || entry.Options.Recursive
+		watchInfo.DotDirs = watchInfo.DotDirs || entry.Options.DotDirs
+		watchInfo.FollowSymlinks = watchInfo.FollowSymlinks || entry.Options.FollowSymlinks
+		if depth := entry.Options.maxDepth(); depth < 0 || watchInfo.MaxDepth < 0 {
+			watchInfo.MaxDepth = -1
+		} else if depth > watchInfo.MaxDepth {
+			watchInfo.MaxDepth = depth
+		}
+	}
+	if oneshot {
+		watchInfo.Mask |= unix.IN_ONESHOT
+	}
+	if onlyDir {
+		watchInfo.Mask |= unix.IN_ONLYDIR
+	}
+	if len(prune) > 0 {
+		watchInfo.Prune = prune
+	}
+
+	return watchInfo
+}
+
+// kernelMask returns the mask of the inotify watch. File watches also need to
+// hear about the file being moved away, after which the watch follows the
+// wrong file, unless that would use up a oneshot watch.
+func (wi *WatchInfo) kernelMask() uint32 {
+	mask := wi.Mask
+	if wi.File && mask&unix.IN_ONESHOT == 0 {
+		mask |= unix.IN_MOVE_SELF
+	}
+	return mask
+}
+
+// sameWatch reports whether two watches on a path use the same kernel mask
+// and recursion, so one can stand in for the other
+func (wi *WatchInfo) sameWatch(other *WatchInfo) bool {
+	return wi.Mask == other.Mask &&
+		wi.Recursive == other.Recursive &&
+		wi.DotDirs == other.DotDirs &&
+		wi.FollowSymlinks == other.FollowSymlinks &&
+		wi.MaxDepth == other.MaxDepth &&
+		slices.Equal(wi.Prune, other.Prune)
+}
+
+// containsEntry reports whether entry is one of entries
+func containsEntry(entries []*IncronEntry, entry *IncronEntry) bool {
+	for _, e := range entries {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// deferWatch makes the entries for path pending and watches the nearest
+// existing ancestor for the next missing component (internal, assumes lock
+// held)
+func (w *Watcher) deferWatch(path string, entries []*IncronEntry) error {
+	parent := filepath.Dir(path)
+	for {
+		if info, err := os.Stat(parent); err == nil && info.IsDir() {
+			break
+		}
+		next := filepath.Dir(parent)
+		if next == parent {
+			return fmt.Errorf("no existing ancestor for %s", path)
+		}
+		parent = next
+	}
+
+	if wd, exists := w.pathWatches[parent]; exists {
+		// Add the creation events to the existing watch
+		if _, err := unix.InotifyAddWatch(w.fd, parent, deferredMask|unix.IN_MASK_ADD); err != nil {
+			return fmt.Errorf("failed to watch %s for %s to appear: %v", parent, path, err)
+		}
+		if w.watches[wd].Deferred {
+			w.watches[wd].Mask |= deferredMask
+		}
+	} else {
+		wd, err := w.addSingleWatch(parent, deferredMask)
+		if err != nil {
+			return err
+		}
+		w.watches[wd] = &WatchInfo{Path: parent, Mask: deferredMask, Deferred: true, Type: FileTypeDirectory}
+		w.pathWatches[parent] = wd
+	}
+
+	w.pending[path] = &pendingWatch{entries: entries, parent: parent}
+
+	// The next component may have appeared before the watch was in place
+	w.retryPending(parent, nextComponent(parent, path))
+	return nil
+}
+
+// dropPending forgets a pending entry and the deferred watch it no longer
+// needs (internal, assumes lock held)
+func (w *Watcher) dropPending(path string) {
+	pw, exists := w.pending[path]
+	if !exists {
+		return
+	}
+	delete(w.pending, path)
+
+	for _, other := range w.pending {
+		if other.parent == pw.parent {
+			return // Still needed by another entry
+		}
+	}
+	if wd, exists := w.pathWatches[pw.parent]; exists && w.watches[wd].Deferred {
+		_ = w.removeWatch(wd)
+	}
+}
+
+// retryPending tries again to watch the pending entries waiting on parent
+// whose path is at or below child, once child exists (internal, assumes lock
+// held)
+func (w *Watcher) retryPending(parent, child string) {
+	if _, err := os.Stat(child); err != nil {
+		return
+	}
+
+	for path, pw := range w.pending {
+		if pw.parent != parent {
+			continue
+		}
+		if path != child && !strings.HasPrefix(path, child+string(filepath.Separator)) {
+			continue
+		}
+
+		entries := pw.entries
+		w.dropPending(path)
+		if err := w.watchEntries(path, entries); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to add watch for %s: %v\n", path, err)
+		}
+	}
+}
+
+// requeuePending re-defers the pending entries waiting on parent after its
+// watch went away, e.g. because parent was deleted (internal, assumes lock
+// held)
+func (w *Watcher) requeuePending(parent string) {
+	for path, pw := range w.pending {
+		if pw.parent != parent {
+			continue
+		}
+		delete(w.pending, path)
+		if err := w.watchEntries(path, pw.entries); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to add watch for %s: %v\n", path, err)
+		}
+	}
+}
+
+// keepPendingParent makes sure a watch that replaced a deferred watch on path
+// still reports the creation events pending entries wait for (internal,
+// assumes lock held)
+func (w *Watcher) keepPendingParent(path string) {
+	for _, pw := range w.pending {
+		if pw.parent == path {
+			_, _ = unix.InotifyAddWatch(w.fd, path, deferredMask|unix.IN_MASK_ADD)
+			return
+		}
+	}
+}
+
+// rewatchFile watches the path of a file watch again after the watched file
+// was deleted, moved away or replaced, e.g. by an editor saving through a
+// rename. If nothing exists at the path yet, the entries wait for it like
+// pending entries (internal, assumes lock held).
+func (w *Watcher) rewatchFile(watchInfo *WatchInfo) {
+	if err := w.watchEntries(watchInfo.Path, watchInfo.Entries); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to watch %s again: %v\n", watchInfo.Path, err)
+	}
+}
+
+// nextComponent returns the child of parent on the way to path
+func nextComponent(parent, path string) string {
+	rel, err := filepath.Rel(parent, path)
+	if err != nil {
+		return path
+	}
+	first, _, _ := strings.Cut(rel, string(filepath.Separator))
+	return filepath.Join(parent, first)
+}
+
+// GetPendingPaths returns the paths of entries that are waiting for their
+// path to be created
+func (w *Watcher) GetPendingPaths() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	paths := make([]string, 0, len(w.pending))
+	for path := range w.pending {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// GetWatchOwners returns the owners of the entries behind each watched path,
+// see IncronEntry.Owner, sorted. Subdirectories of a recursive watch belong
+// to the entries of the recursive watch, and the ancestor watched until a
+// pending path appears also to the pending entries.
+func (w *Watcher) GetWatchOwners() map[string][]string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	owners := make(map[string][]string, len(w.pathWatches))
+	for path, wd := range w.pathWatches {
+		owners[path] = entryOwners(w.watchEntriesOf(w.watches[wd]))
+	}
+	return owners
+}
+
+// watchEntriesOf returns the entries a watch is there for (internal, assumes
+// lock held)
+func (w *Watcher) watchEntriesOf(watchInfo *WatchInfo) []*IncronEntry {
+	entries := slices.Clone(watchInfo.Entries)
+	for _, pw := range w.pending {
+		if pw.parent == watchInfo.Path {
+			entries = append(entries, pw.entries...)
+		}
+	}
+	if len(entries) != 0 || watchInfo.Deferred {
+		return entries
+	}
+
+	// A subdirectory watch belongs to the recursive entries of the nearest
+	// entry watch above
+	for dir := filepath.Dir(watchInfo.Path); ; dir = filepath.Dir(dir) {
+		if wd, exists := w.pathWatches[dir]; exists {
+			if root := w.watches[wd]; root.Recursive && root.Entries != nil {
+				var entries []*IncronEntry
+				for _, entry := range root.Entries {
+					if entry.Options.Recursive {
+						entries = append(entries, entry)
+					}
+				}
+				return entries
+			}
+		}
+		if dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// entryOwners returns the distinct owners of entries, sorted
+func entryOwners(entries []*IncronEntry) []string {
+	var owners []string
+	for _, entry := range entries {
+		if entry.Owner != "" && !slices.Contains(owners, entry.Owner) {
+			owners = append(owners, entry.Owner)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// RemoveWatch removes a watch for the given path
+func (w *Watcher) RemoveWatch(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.pending[path]; exists {
+		w.dropPending(path)
+		return nil
+	}
+
+	wd, exists := w.pathWatches[path]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrPathNotWatched, path)
+	}
+
+	if len(w.watches[wd].Aliases) > 0 {
+		return w.removeAlias(wd, path)
+	}
+	return w.removeWatch(wd)
+}
+
+// removeAlias stops watching path, one of the paths sharing the watch wd,
+// and watches the entries of the other paths again (internal, assumes lock
+// held)
+func (w *Watcher) removeAlias(wd int, path string) error {
+	watchInfo := w.watches[wd]
+	var rest []*IncronEntry
+	for _, entry := range watchInfo.Entries {
+		if entry.Path != path {
+			rest = append(rest, entry)
+		}
+	}
+
+	if watchInfo.Recursive {
+		w.removeSubdirWatches(watchInfo.Path)
+	}
+	if err := w.removeWatch(wd); err != nil {
+		return err
+	}
+	return w.watchEntries(rest[0].Path, rest)
+}
+
+// Reconcile makes the set of entry watches match desired in one step:
+// watches for entries that are gone are removed, new entries are watched and
+// watches whose path, mask and options are unchanged are kept as they are,
+// so no events are missed for them during a reload. It returns the entries
+// that could not be watched together with the reason.
+func (w *Watcher) Reconcile(desired []*IncronEntry) map[*IncronEntry]error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reconcile(desired)
+}
+
+// RemoveTableEntries stops watching for the entries of table, e.g. when
+// its user no longer exists. Watches shared with other entries keep watching
+// for those. It returns the other entries that could not be watched again
+// with the reason.
+func (w *Watcher) RemoveTableEntries(table *IncronTable) map[*IncronEntry]error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	removed := make(map[*IncronEntry]bool, len(table.Entries))
+	for i := range table.Entries {
+		removed[&table.Entries[i]] = true
+	}
+
+	// Every other entry watched or waiting for its path stays as it is
+	var desired []*IncronEntry
+	keep := func(entries []*IncronEntry) {
+		for _, entry := range entries {
+			if !removed[entry] {
+				removed[entry] = true // Entries of aliased watches are listed once
+				desired = append(desired, entry)
+			}
+		}
+	}
+	for _, watchInfo := range w.watches {
+		keep(watchInfo.Entries)
+	}
+	for _, pw := range w.pending {
+		keep(pw.entries)
+	}
+
+	return w.reconcile(desired)
+}
+
+// reconcile implements Reconcile (internal, assumes lock held)
+func (w *Watcher) reconcile(desired []*IncronEntry) map[*IncronEntry]error {
+	failed := make(map[*IncronEntry]error)
+
+	// Entries for the same path share a watch
+	wanted := make(map[string][]*IncronEntry, len(desired))
+	for _, entry := range desired {
+		if err := w.checkProtected(entry); err != nil {
+			failed[entry] = err
+			continue
+		}
+		wanted[entry.Path] = append(wanted[entry.Path], entry)
+	}
+
+	// Pending entries keep waiting with their new definition
+	for path, pw := range w.pending {
+		if entries, keep := wanted[path]; keep {
+			pw.entries = entries
+			delete(wanted, path)
+			continue
+		}
+		w.dropPending(path)
+	}
+
+	// Drop watches for entries that are gone or have changed
+	for wd, watchInfo := range w.watches {
+		if len(watchInfo.Entries) == 0 {
+			continue
+		}
+		entries, keep := wanted[watchInfo.Path]
+		if len(watchInfo.Aliases) > 0 {
+			// Every path sharing the watch must still be wanted
+			entries = append([]*IncronEntry(nil), entries...)
+			for _, alias := range watchInfo.Aliases {
+				aliasEntries, wantedAlias := wanted[alias]
+				keep = keep && wantedAlias
+				entries = append(entries, aliasEntries...)
+			}
+		}
+		if keep && mergeEntries(watchInfo.Path, entries).sameWatch(watchInfo) {
+			watchInfo.Entries = entries
+			delete(wanted, watchInfo.Path)
+			for _, alias := range watchInfo.Aliases {
+				delete(wanted, alias)
+			}
+			continue
+		}
+		if watchInfo.Recursive {
+			w.removeSubdirWatches(watchInfo.Path)
+		}
+		if err := w.removeWatch(wd); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to remove watch for %s: %v\n", watchInfo.Path, err)
+		}
+	}
+
+	// Add watches for new and changed entries, in the order they were given
+	for _, entry := range desired {
+		entries, exists := wanted[entry.Path]
+		if !exists || entries[0] != entry {
+			continue
+		}
+		if err := w.watchEntries(entry.Path, entries); err != nil {
+			for _, e := range entries {
+				failed[e] = err
+			}
+		}
+	}
+
+	return failed
+}
+
+// removeWatch removes a watch by watch descriptor (internal, assumes lock held)
+func (w *Watcher) removeWatch(wd int) error {
+	if _, exists := w.watches[wd]; !exists {
+		return fmt.Errorf("watch descriptor %d not found", wd)
+	}
+
+	// Remove from inotify; EINVAL means the kernel already dropped the watch
+	if _, err := unix.InotifyRmWatch(w.fd, uint32(wd)); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("failed to remove inotify watch: %v", err)
+	}
+
+	path := w.watches[wd].Path
+	w.forgetWatch(wd)
+	w.requeuePending(path)
+	return nil
+}
+
+// forgetWatch removes a watch descriptor from our maps without touching
+// inotify (internal, assumes lock held)
+func (w *Watcher) forgetWatch(wd int) {
+	watchInfo, exists := w.watches[wd]
+	if !exists {
+		return
+	}
+
+	delete(w.watches, wd)
+	for _, path := range append([]string{watchInfo.Path}, watchInfo.Aliases...) {
+		if w.pathWatches[path] == wd {
+			delete(w.pathWatches, path)
+		}
+	}
+	if len(watchInfo.Entries) > 0 && w.fileWatches[watchInfo.id] == wd {
+		delete(w.fileWatches, watchInfo.id)
+	}
+}
+
+// removeSubdirWatches removes the recursive subdirectory watches at and below
+// root (internal, assumes lock held)
+func (w *Watcher) removeSubdirWatches(root string) {
+	for path, wd := range w.pathWatches {
+		if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			continue
+		}
+		if watchInfo := w.watches[wd]; watchInfo == nil || len(watchInfo.Entries) > 0 || watchInfo.Deferred {
+			continue
+		}
+		_ = w.removeWatch(wd)
+	}
+}
+
+// probeMaskCreate reports whether the kernel supports IN_MASK_CREATE (Linux
+// 4.18). Older kernels ignore the flag, so watching the same directory twice
+// with it succeeds instead of failing with EEXIST.
+func probeMaskCreate(fd int) bool {
+	wd, err := unix.InotifyAddWatch(fd, "/", unix.IN_DELETE_SELF|unix.IN_MASK_CREATE)
+	if err != nil {
+		return false
+	}
+	defer unix.InotifyRmWatch(fd, uint32(wd))
+
+	_, err = unix.InotifyAddWatch(fd, "/", unix.IN_DELETE_SELF|unix.IN_MASK_CREATE)
+	return err == unix.EEXIST
+}
+
+// addSingleWatch adds a single inotify watch. It fails if the file is already
+// watched through another path, e.g. a hard link or bind mount, instead of
+// changing the mask of that watch; watchEntries merges entry watches on the
+// same file before getting here. Only a deferred watch on path itself is
+// replaced (internal, assumes lock held).
+func (w *Watcher) addSingleWatch(path string, mask uint32) (int, error) {
+	replace := false
+	if wd, exists := w.pathWatches[path]; exists && w.watches[wd].Deferred {
+		replace = true
+	}
+
+	// Let the kernel refuse to merge into an existing watch where it can
+	addMask := mask
+	if w.maskCreate && !replace {
+		addMask |= unix.IN_MASK_CREATE
+	}
+
+	wd, err := unix.InotifyAddWatch(w.fd, path, addMask)
+	if err == unix.EEXIST {
+		return -1, fmt.Errorf("failed to add inotify watch for %s: already watched through another path", path)
+	}
+	if err == nil && !replace {
+		// Without IN_MASK_CREATE the kernel has already replaced the other
+		// watch's mask, so put it back
+		if other, exists := w.watches[wd]; exists && other.Path != path {
+			_, _ = unix.InotifyAddWatch(w.fd, other.Path, other.kernelMask())
+			w.keepPendingParent(other.Path)
+			return -1, fmt.Errorf("failed to add inotify watch for %s: already watched as %s", path, other.Path)
+		}
+	}
+	if err == unix.ENOSPC {
+		limit, _ := MaxUserWatches()
+		return -1, &WatchLimitError{Path: path, Watches: len(w.watches), Limit: limit}
+	}
+	if err == unix.ENOTDIR && mask&unix.IN_ONLYDIR != 0 {
+		return -1, fmt.Errorf("failed to add inotify watch for %s: not a directory (onlydir=true)", path)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to add inotify watch for %s: %v", path, err)
+	}
+	return wd, nil
+}
+
+// addRecursiveWatches adds watches for all subdirectories up to maxDepth
+// levels below rootPath (-1 for no limit), leaving out the pruned subtrees.
+// With followSymlinks, symlinks to directories are descended into as well,
+// each directory at most once.
+func (w *Watcher) addRecursiveWatches(rootPath string, mask uint32, includeDotDirs, followSymlinks bool, maxDepth int, prune []string) error {
+	// Directories already walked, so that symlink cycles end
+	visited := make(map[fileID]bool)
+	if followSymlinks {
+		info, err := os.Stat(rootPath)
+		if err != nil {
+			return err
+		}
+		visited[fileIDOf(info)] = true
+	}
+
+	var walk func(dir string, depth int, symlinked bool) error
+	walk = func(dir string, depth int, symlinked bool) error {
+		// Stop descending below the depth limit
+		if maxDepth >= 0 && depth >= maxDepth {
+			return nil
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+
+			// Skip non-directories, resolving symlinks if enabled
+			isDir := entry.IsDir()
+			var info os.FileInfo
+			if followSymlinks {
+				info, err = os.Stat(path)
+				isDir = err == nil && info.IsDir()
+			}
+			if !isDir {
+				continue
+			}
 
-	// Remove all watches
-	for wd := range w.watches {
-		_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
-	}
+			// Skip dot directories if not enabled
+			if !includeDotDirs && strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
 
-	// Close file descriptor
-	if err := unix.Close(w.fd); err != nil {
-		return fmt.Errorf("failed to close inotify fd: %v", err)
-	}
+			// Skip pruned subtrees
+			if isPruned(path, prune) {
+				continue
+			}
 
-	close(w.events)
-	close(w.errors)
+			// Skip directories reached before through another path
+			if followSymlinks {
+				id := fileIDOf(info)
+				if visited[id] {
+					continue
+				}
+				visited[id] = true
+			}
 
-	return nil
-}
+			viaSymlink := symlinked || entry.Type()&os.ModeSymlink != 0
+			if err := w.addSubdirWatch(path, mask, includeDotDirs, followSymlinks, viaSymlink, depth+1, maxDepth, prune); err != nil {
+				return err
+			}
+			if err := walk(path, depth+1, viaSymlink); err != nil {
+				return err
+			}
+		}
 
-// AddWatch adds a watch for the given eventcron entry
-func (w *Watcher) AddWatch(entry *IncronEntry) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+		return nil
+	}
 
-	path := entry.Path
+	return walk(rootPath, 0, false)
+}
 
-	// Check if we're already watching this path
-	if _, exists := w.pathWatches[path]; exists {
-		return fmt.Errorf("path %s is already being watched", path)
+// addSubdirWatch adds the watch for a directory found below a recursive
+// watch. Failures are logged and skipped so the walk continues, unless no
+// more watches can be added at all, which returns the WatchLimitError.
+func (w *Watcher) addSubdirWatch(path string, mask uint32, includeDotDirs, followSymlinks, symlinked bool, depth, maxDepth int, prune []string) error {
+	// Don't replace the mask of a directory that is already watched,
+	// unless it's only watched for a pending entry
+	if wd, exists := w.pathWatches[path]; exists && !w.watches[wd].Deferred {
+		return nil
 	}
 
-	// Check if path exists
-	info, err := os.Stat(path)
+	// Add watch for this directory
+	wd, err := w.addSingleWatch(path, mask)
+	var limitErr *WatchLimitError
+	if errors.As(err, &limitErr) {
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("cannot stat path %s: %v", path, err)
+		fmt.Fprintf(os.Stderr, "Warning: failed to add watch for %s: %v\n", path, err)
+		return nil
 	}
 
+	// Create watch info for this subdirectory
 	watchInfo := &WatchInfo{
-		Path:      path,
-		Mask:      entry.Mask,
-		Entry:     entry,
-		Recursive: entry.Options.Recursive,
-		DotDirs:   entry.Options.DotDirs,
-	}
-
-	// Add watch for the main path
-	wd, err := w.addSingleWatch(path, entry.Mask)
-	if err != nil {
-		return err
+		Path:           path,
+		Mask:           mask,
+		Entries:        nil, // Subdirectory watches don't have their own entries
+		Recursive:      true,
+		DotDirs:        includeDotDirs,
+		FollowSymlinks: followSymlinks,
+		Depth:          depth,
+		Symlinked:      symlinked,
+		MaxDepth:       maxDepth,
+		Prune:          prune,
+		Type:           FileTypeDirectory,
 	}
 
 	w.watches[wd] = watchInfo
 	w.pathWatches[path] = wd
-
-	// If it's a directory and recursive is enabled, add watches for subdirectories
-	if info.IsDir() && entry.Options.Recursive {
-		if err := w.addRecursiveWatches(path, entry.Mask, entry.Options.DotDirs); err != nil {
-			// Clean up the main watch if recursive setup fails
-			w.removeWatch(wd)
-			return fmt.Errorf("failed to setup recursive watches: %v", err)
-		}
-	}
+	w.keepPendingParent(path)
 
 	return nil
 }
 
-// RemoveWatch removes a watch for the given path
-func (w *Watcher) RemoveWatch(path string) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	wd, exists := w.pathWatches[path]
-	if !exists {
-		return fmt.Errorf("path %s is not being watched", path)
+// isPruned reports whether path is one of the pruned subtrees or lies below one
+func isPruned(path string, prune []string) bool {
+	for _, root := range prune {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
 	}
-
-	return w.removeWatch(wd)
+	return false
 }
 
-// removeWatch removes a watch by watch descriptor (internal, assumes lock held)
-func (w *Watcher) removeWatch(wd int) error {
-	watchInfo, exists := w.watches[wd]
-	if !exists {
-		return fmt.Errorf("watch descriptor %d not found", wd)
-	}
-
-	// Remove from inotify
-	if _, err := unix.InotifyRmWatch(w.fd, uint32(wd)); err != nil {
-		return fmt.Errorf("failed to remove inotify watch: %v", err)
-	}
-
-	// Remove from our maps
-	delete(w.watches, wd)
-	delete(w.pathWatches, watchInfo.Path)
-
-	return nil
+// fileID identifies a file independently of the path it was reached by
+type fileID struct {
+	dev uint64
+	ino uint64
 }
 
-// addSingleWatch adds a single inotify watch
-func (w *Watcher) addSingleWatch(path string, mask uint32) (int, error) {
-	wd, err := unix.InotifyAddWatch(w.fd, path, mask)
-	if err != nil {
-		return -1, fmt.Errorf("failed to add inotify watch for %s: %v", path, err)
+// fileIDOf returns the device and inode of info
+func fileIDOf(info os.FileInfo) fileID {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}
 	}
-	return wd, nil
+	return fileID{dev: uint64(st.Dev), ino: st.Ino}
 }
 
-// addRecursiveWatches adds watches for all subdirectories
-func (w *Watcher) addRecursiveWatches(rootPath string, mask uint32, includeDotDirs bool) error {
-	return filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip non-directories
-		if !info.IsDir() {
-			return nil
-		}
+// Rescan walks every recursive watch and adds watches for subdirectories
+// that are not watched yet, e.g. because their IN_CREATE event was lost in a
+// queue overflow. It returns the number of watches added.
+func (w *Watcher) Rescan() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-		// Skip the root path (already added)
-		if path == rootPath {
-			return nil
-		}
+	before := len(w.watches)
 
-		// Skip dot directories if not enabled
-		if !includeDotDirs && strings.HasPrefix(filepath.Base(path), ".") {
-			return filepath.SkipDir
+	var roots []*WatchInfo
+	for _, watchInfo := range w.watches {
+		if len(watchInfo.Entries) > 0 && watchInfo.Recursive {
+			roots = append(roots, watchInfo)
 		}
+	}
 
-		// Add watch for this directory
-		wd, err := w.addSingleWatch(path, mask)
-		if err != nil {
-			// Log error but continue with other directories
-			fmt.Fprintf(os.Stderr, "Warning: failed to add watch for %s: %v\n", path, err)
-			return nil
+	var lastErr error
+	for _, root := range roots {
+		info, err := os.Stat(root.Path)
+		if err != nil || !info.IsDir() {
+			continue
 		}
-
-		// Create watch info for this subdirectory
-		watchInfo := &WatchInfo{
-			Path:      path,
-			Mask:      mask,
-			Entry:     nil, // Subdirectory watches don't have their own entries
-			Recursive: true,
-			DotDirs:   includeDotDirs,
+		if err := w.addRecursiveWatches(root.Path, root.Mask, root.DotDirs, root.FollowSymlinks, root.MaxDepth, root.Prune); err != nil {
+			lastErr = fmt.Errorf("failed to rescan %s: %w", root.Path, err)
 		}
+	}
 
-		w.watches[wd] = watchInfo
-		w.pathWatches[path] = wd
+	// Pending paths may have been created while events were lost too
+	for path, pw := range w.pending {
+		w.retryPending(pw.parent, nextComponent(pw.parent, path))
+	}
 
-		return nil
-	})
+	return len(w.watches) - before, lastErr
 }
 
 // Events returns the event channel
@@ -254,45 +1276,80 @@ func (w *Watcher) Errors() <-chan error {
 	return w.errors
 }
 
-// readEvents reads events from the inotify file descriptor
+// readEvents reads events from the inotify file descriptor whenever poll
+// reports it readable, until Stop writes to the wake pipe
 func (w *Watcher) readEvents() {
+	defer close(w.readerDone)
 	buffer := make([]byte, 4096)
+	fds := []unix.PollFd{
+		{Fd: int32(w.fd), Events: unix.POLLIN},
+		{Fd: int32(w.wake[0]), Events: unix.POLLIN},
+	}
 
 	for {
 		select {
 		case <-w.done:
 			return
 		default:
-			n, err := unix.Read(w.fd, buffer)
-			if err != nil {
-				if err == syscall.EINTR {
-					continue
-				}
-				select {
-				case w.errors <- fmt.Errorf("error reading inotify events: %v", err):
-				case <-w.done:
-				}
-				return
+		}
+
+		if _, err := unix.Poll(fds, int(stopPollInterval/time.Millisecond)); err != nil {
+			if err == syscall.EINTR {
+				continue
 			}
+			w.readError(fmt.Errorf("error waiting for inotify events: %v", err))
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		if fds[0].Revents == 0 {
+			continue
+		}
 
-			if n == 0 {
+		n, err := unix.Read(w.fd, buffer)
+		if err != nil {
+			if err == syscall.EINTR || err == syscall.EAGAIN {
 				continue
 			}
+			w.readError(fmt.Errorf("error reading inotify events: %v", err))
+			return
+		}
 
-			w.parseEvents(buffer[:n])
+		if n == 0 {
+			continue
 		}
+
+		w.parseEvents(buffer[:n])
+	}
+}
+
+// readError reports an error that stopped readEvents, unless the watcher
+// is stopping anyway
+func (w *Watcher) readError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
 	}
 }
 
 // parseEvents parses raw inotify events from buffer
 func (w *Watcher) parseEvents(buffer []byte) {
 	offset := 0
+	received := time.Now() // The events of a read arrived together
 
 	for offset < len(buffer) {
 		if offset+16 > len(buffer) {
 			break
 		}
 
+		// Events read while stopping, e.g. for the removed watches, are dropped
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
 		// Parse inotify_event structure
 		wd := int(*(*int32)(unsafe.Pointer(&buffer[offset])))
 		mask := *(*uint32)(unsafe.Pointer(&buffer[offset+4]))
@@ -306,42 +1363,259 @@ func (w *Watcher) parseEvents(buffer []byte) {
 			if offset+int(nameLen) > len(buffer) {
 				break
 			}
-			// Remove null terminator
+			// Remove null terminator and the kernel's alignment padding
 			nameBytes := buffer[offset : offset+int(nameLen)]
-			if len(nameBytes) > 0 && nameBytes[len(nameBytes)-1] == 0 {
-				nameBytes = nameBytes[:len(nameBytes)-1]
+			if i := bytes.IndexByte(nameBytes, 0); i >= 0 {
+				nameBytes = nameBytes[:i]
 			}
 			name = string(nameBytes)
 			offset += int(nameLen)
 		}
 
-		// Create event
-		event := w.createEvent(wd, mask, cookie, name)
-		if event != nil {
+		// The kernel queue overflowed, so events (and new directories) were lost
+		if mask&unix.IN_Q_OVERFLOW != 0 {
 			select {
-			case w.events <- event:
+			case w.errors <- ErrQueueOverflow:
 			case <-w.done:
 				return
 			default:
-				// Channel is full, drop event
-				fmt.Fprintf(os.Stderr, "Warning: event channel full, dropping event: %v\n", event)
+				// An error report is already pending
+			}
+			continue
+		}
+
+		// Create event
+		event := w.createEvent(wd, mask, cookie, name, received)
+
+		// The kernel drops oneshot watches after their first event
+		if event != nil && event.Spent {
+			w.mu.Lock()
+			w.forgetWatch(wd)
+			w.mu.Unlock()
+		}
+
+		// Renames are delivered as a pair once both halves are known
+		if event != nil && event.Cookie != 0 && mask&(unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 {
+			if !w.correlateMove(event) {
+				return
 			}
+		} else if event != nil && !w.deliverEvent(event) {
+			return
 		}
 
 		// Handle directory creation for recursive watches
 		if mask&unix.IN_CREATE != 0 && mask&unix.IN_ISDIR != 0 {
 			w.handleDirCreate(wd, name)
 		}
+
+		// Drop watches for directories that were deleted or moved away
+		if mask&unix.IN_ISDIR != 0 && mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0 {
+			w.handleDirRemove(wd, name)
+		}
+
+		// A pending entry's path (or a directory on the way) may have appeared
+		if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && name != "" {
+			w.handlePendingCreate(wd, name)
+		}
+
+		// A watched file was moved away, so the watch no longer follows its path
+		if mask&unix.IN_MOVE_SELF != 0 {
+			w.mu.Lock()
+			if watchInfo, exists := w.watches[wd]; exists && watchInfo.File && len(watchInfo.Entries) > 0 {
+				_ = w.removeWatch(wd)
+				w.rewatchFile(watchInfo)
+			}
+			w.mu.Unlock()
+		}
+
+		// The kernel has removed this watch, so forget about it
+		if mask&unix.IN_IGNORED != 0 {
+			w.mu.Lock()
+			if watchInfo, exists := w.watches[wd]; exists {
+				w.forgetWatch(wd)
+				w.requeuePending(watchInfo.Path)
+				if watchInfo.File && len(watchInfo.Entries) > 0 {
+					w.rewatchFile(watchInfo)
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// correlateMove holds back IN_MOVED_FROM events until the matching
+// IN_MOVED_TO arrives, then delivers both with OldPath and NewPath set. An
+// IN_MOVED_FROM without a match (moved out of the watched tree) is delivered
+// on its own after moveWindow. It returns false if the watcher is shutting
+// down.
+func (w *Watcher) correlateMove(event *InotifyEvent) bool {
+	if event.Mask&unix.IN_MOVED_FROM != 0 {
+		w.mu.Lock()
+		move := &pendingMove{event: event}
+		w.moveTimers.Add(1)
+		move.timer = time.AfterFunc(moveWindow, func() {
+			defer w.moveTimers.Done()
+			w.mu.Lock()
+			unmatched := w.moves[event.Cookie] == move
+			if unmatched {
+				delete(w.moves, event.Cookie)
+			}
+			w.mu.Unlock()
+
+			select {
+			case <-w.done:
+			default:
+				if unmatched {
+					w.deliverEvent(event)
+				}
+			}
+		})
+		w.moves[event.Cookie] = move
+		w.mu.Unlock()
+		return true
+	}
+
+	w.mu.Lock()
+	move, exists := w.moves[event.Cookie]
+	delete(w.moves, event.Cookie)
+	if exists && move.timer.Stop() {
+		w.moveTimers.Done()
+	}
+	w.mu.Unlock()
+
+	if !exists {
+		return w.deliverEvent(event)
+	}
+
+	from := move.event
+
+	from.OldPath, from.NewPath = from.Path, event.Path
+	event.OldPath, event.NewPath = from.Path, event.Path
+	return w.deliverEvent(from) && w.deliverEvent(event)
+}
+
+// deliverEvent sends an event, and a copy of it for every alias of the
+// watched path, so the entries of each path see the event under their own
+// path. It returns false if the watcher is shutting down.
+func (w *Watcher) deliverEvent(event *InotifyEvent) bool {
+	w.mu.RLock()
+	var aliases []string
+	if wd, exists := w.pathWatches[event.WatchDir]; exists && w.watches[wd].Path == event.WatchDir {
+		aliases = w.watches[wd].Aliases
+	}
+	w.mu.RUnlock()
+
+	if !w.sendEvent(event) {
+		return false
+	}
+	for _, alias := range aliases {
+		if !w.sendEvent(event.seenAt(event.WatchDir, alias)) {
+			return false
+		}
+	}
+	return true
+}
+
+// seenAt returns a copy of the event with the watched path root replaced by
+// alias, another path of the same directory
+func (e *InotifyEvent) seenAt(root, alias string) *InotifyEvent {
+	rebase := func(path string) string {
+		if path == root {
+			return alias
+		}
+		if strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return alias + path[len(root):]
+		}
+		return path
+	}
+
+	event := *e
+	event.Path = rebase(e.Path)
+	event.WatchDir = alias
+	event.OldPath = rebase(e.OldPath)
+	event.NewPath = rebase(e.NewPath)
+	return &event
+}
+
+// sendEvent sends an event to the event channel according to the overflow
+// policy. It returns false if the watcher is shutting down.
+func (w *Watcher) sendEvent(event *InotifyEvent) bool {
+	w.mu.RLock()
+	policy := w.overflowPolicy
+	w.mu.RUnlock()
+
+	switch policy {
+	case OverflowBlock:
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return false
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case w.events <- event:
+				return true
+			case <-w.done:
+				return false
+			default:
+			}
+
+			// Channel is full, make room by discarding the oldest event
+			select {
+			case old := <-w.events:
+				w.droppedEvents.Add(1)
+				fmt.Fprintf(os.Stderr, "Warning: event channel full, dropping oldest event: %v\n", old)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return false
+		default:
+			// Channel is full, drop event
+			w.droppedEvents.Add(1)
+			fmt.Fprintf(os.Stderr, "Warning: event channel full, dropping event: %v\n", event)
+		}
 	}
+
+	return true
+}
+
+// SetProtectedRoots sets the paths that entries may only watch recursively
+// with force=true. It applies to watches added afterwards.
+func (w *Watcher) SetProtectedRoots(roots []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.protectedRoots = roots
+}
+
+// SetOverflowPolicy sets what happens when the event channel is full
+func (w *Watcher) SetOverflowPolicy(policy OverflowPolicy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.overflowPolicy = policy
+}
+
+// DroppedEvents returns the number of events dropped because the event
+// channel was full
+func (w *Watcher) DroppedEvents() uint64 {
+	return w.droppedEvents.Load()
 }
 
-// createEvent creates an InotifyEvent from raw data
-func (w *Watcher) createEvent(wd int, mask, cookie uint32, name string) *InotifyEvent {
+// createEvent creates an InotifyEvent from raw data read at received, giving
+// it the next sequence number
+func (w *Watcher) createEvent(wd int, mask, cookie uint32, name string, received time.Time) *InotifyEvent {
 	w.mu.RLock()
 	watchInfo, exists := w.watches[wd]
 	w.mu.RUnlock()
 
-	if !exists {
+	// Deferred watches only exist to notice pending paths being created
+	if !exists || watchInfo.Deferred {
 		return nil
 	}
 
@@ -351,12 +1625,44 @@ func (w *Watcher) createEvent(wd int, mask, cookie uint32, name string) *Inotify
 	}
 
 	return &InotifyEvent{
-		Path:     path,
-		Name:     name,
-		Mask:     mask,
-		Cookie:   cookie,
-		WatchDir: watchInfo.Path,
+		Path:      path,
+		Name:      name,
+		Mask:      mask,
+		Cookie:    cookie,
+		WatchDir:  watchInfo.Path,
+		Symlinked: watchInfo.Symlinked,
+		Spent:     watchInfo.Mask&unix.IN_ONESHOT != 0 && mask&unix.IN_IGNORED == 0,
+		Seq:       w.sequence.Add(1),
+		Received:  received,
+	}
+}
+
+// ExistingFileEvents returns the events a watch with mask on dir would have
+// reported had each file directly in dir just appeared, sorted by name:
+// directories get IN_ISDIR like real events do. The events have no Seq and
+// are all received now.
+func ExistingFileEvents(dir string, mask uint32) ([]*InotifyEvent, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", dir, err)
+	}
+	received := time.Now()
+
+	events := make([]*InotifyEvent, 0, len(files))
+	for _, file := range files {
+		event := &InotifyEvent{
+			Path:     filepath.Join(dir, file.Name()),
+			Name:     file.Name(),
+			Mask:     mask,
+			WatchDir: dir,
+			Received: received,
+		}
+		if file.IsDir() {
+			event.Mask |= InIsdir
+		}
+		events = append(events, event)
 	}
+	return events, nil
 }
 
 // handleDirCreate handles directory creation for recursive watches
@@ -374,8 +1680,18 @@ func (w *Watcher) handleDirCreate(wd int, name string) {
 		return
 	}
 
+	// Skip directories below the depth limit
+	if watchInfo.MaxDepth >= 0 && watchInfo.Depth+1 > watchInfo.MaxDepth {
+		return
+	}
+
 	newPath := filepath.Join(watchInfo.Path, name)
 
+	// Skip pruned subtrees
+	if isPruned(newPath, watchInfo.Prune) {
+		return
+	}
+
 	// Check if the new path is a directory
 	info, err := os.Stat(newPath)
 	if err != nil || !info.IsDir() {
@@ -383,7 +1699,18 @@ func (w *Watcher) handleDirCreate(wd int, name string) {
 	}
 
 	// Add watch for the new directory
+	// Running out of watches is reported on Errors, as the tree is no
+	// longer watched completely
 	newWd, err := w.addSingleWatch(newPath, watchInfo.Mask)
+	var limitErr *WatchLimitError
+	if errors.As(err, &limitErr) {
+		select {
+		case w.errors <- err:
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		return
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Warning: failed to add watch for new directory %s: %v\n", newPath, err)
 		return
@@ -391,17 +1718,51 @@ func (w *Watcher) handleDirCreate(wd int, name string) {
 
 	// Create watch info for the new directory
 	newWatchInfo := &WatchInfo{
-		Path:      newPath,
-		Mask:      watchInfo.Mask,
-		Entry:     nil, // Subdirectory watches don't have their own entries
-		Recursive: true,
-		DotDirs:   watchInfo.DotDirs,
+		Path:           newPath,
+		Mask:           watchInfo.Mask,
+		Entries:        nil, // Subdirectory watches don't have their own entries
+		Recursive:      true,
+		DotDirs:        watchInfo.DotDirs,
+		FollowSymlinks: watchInfo.FollowSymlinks,
+		Depth:          watchInfo.Depth + 1,
+		Symlinked:      watchInfo.Symlinked,
+		MaxDepth:       watchInfo.MaxDepth,
+		Prune:          watchInfo.Prune,
+		Type:           FileTypeDirectory,
 	}
 
 	w.watches[newWd] = newWatchInfo
 	w.pathWatches[newPath] = newWd
 }
 
+// handleDirRemove handles deletion or move-away of a directory under a
+// recursive watch
+func (w *Watcher) handleDirRemove(wd int, name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watchInfo, exists := w.watches[wd]
+	if !exists || !watchInfo.Recursive {
+		return
+	}
+
+	w.removeSubdirWatches(filepath.Join(watchInfo.Path, name))
+}
+
+// handlePendingCreate promotes pending entries when something they wait for
+// appears in a watched directory
+func (w *Watcher) handlePendingCreate(wd int, name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watchInfo, exists := w.watches[wd]
+	if !exists || len(w.pending) == 0 {
+		return
+	}
+
+	w.retryPending(watchInfo.Path, filepath.Join(watchInfo.Path, name))
+}
+
 // GetWatchedPaths returns a list of all watched paths
 func (w *Watcher) GetWatchedPaths() []string {
 	w.mu.RLock()
@@ -414,6 +1775,19 @@ func (w *Watcher) GetWatchedPaths() []string {
 	return paths
 }
 
+// GetWatchTypes returns the file type of each watched path, see
+// WatchInfo.Type
+func (w *Watcher) GetWatchTypes() map[string]string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	types := make(map[string]string, len(w.pathWatches))
+	for path, wd := range w.pathWatches {
+		types[path] = w.watches[wd].Type
+	}
+	return types
+}
+
 // GetWatchCount returns the number of active watches
 func (w *Watcher) GetWatchCount() int {
 	w.mu.RLock()
@@ -423,13 +1797,7 @@ func (w *Watcher) GetWatchCount() int {
 
 // maskToString converts an event mask to string representation
 func maskToString(mask uint32) string {
-	var parts []string
-
-	for flag, name := range ReverseEventMaskMap {
-		if mask&flag != 0 {
-			parts = append(parts, name)
-		}
-	}
+	parts := eventFlagNames(mask)
 
 	if len(parts) == 0 {
 		return fmt.Sprintf("0x%x", mask)
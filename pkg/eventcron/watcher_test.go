@@ -0,0 +1,1441 @@
+package eventcron
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForWatchCount polls until the watcher reaches the expected watch count
+func waitForWatchCount(t *testing.T, w *Watcher, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if w.GetWatchCount() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("watch count = %d, want %d (paths: %v)", w.GetWatchCount(), want, w.GetWatchedPaths())
+}
+
+func TestWatcherOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		policy   OverflowPolicy
+		wantName string
+	}{
+		{OverflowDropNewest, "first"},
+		{OverflowDropOldest, "second"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			w, err := NewWatcherWithBuffer(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			w.SetOverflowPolicy(tt.policy)
+
+			w.deliverEvent(&InotifyEvent{Name: "first"})
+			w.deliverEvent(&InotifyEvent{Name: "second"})
+
+			if got := w.DroppedEvents(); got != 1 {
+				t.Errorf("DroppedEvents() = %d, want 1", got)
+			}
+			if got := (<-w.Events()).Name; got != tt.wantName {
+				t.Errorf("queued event = %q, want %q", got, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OverflowDropNewest, OverflowDropOldest, OverflowBlock} {
+		got, err := ParseOverflowPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v; want %v", p.String(), got, err, p)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop-all"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestWatcherQueueOverflow(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// struct inotify_event{wd: -1, mask: IN_Q_OVERFLOW, cookie: 0, len: 0}
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint32(buf[0:], 0xffffffff)
+	binary.LittleEndian.PutUint32(buf[4:], InQOverflow)
+	w.parseEvents(buf)
+
+	select {
+	case err := <-w.Errors():
+		if !errors.Is(err, ErrQueueOverflow) {
+			t.Errorf("got error %v, want ErrQueueOverflow", err)
+		}
+	default:
+		t.Fatal("expected ErrQueueOverflow on the error channel")
+	}
+}
+
+func TestWatcherRescan(t *testing.T) {
+	root := t.TempDir()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entry := &IncronEntry{Path: root, Mask: InCreate, Options: EntryOptions{Recursive: true}}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watcher isn't reading events, so this directory is missed
+	if err := os.MkdirAll(filepath.Join(root, "missed", "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := w.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Errorf("Rescan() added %d watches, want 2", added)
+	}
+	if added, _ := w.Rescan(); added != 0 {
+		t.Errorf("second Rescan() added %d watches, want 0", added)
+	}
+}
+
+func TestWatcherRecursiveSubdirLifecycle(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entry := &IncronEntry{
+		Path:    root,
+		Mask:    InCreate | InDelete | InMovedFrom,
+		Options: EntryOptions{Recursive: true},
+	}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.Events() {
+		}
+	}()
+
+	// root, a, a/b, c
+	waitForWatchCount(t, w, 4)
+
+	// New directories are picked up
+	if err := os.Mkdir(filepath.Join(root, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 5)
+
+	// Deleting a tree drops its watches
+	if err := os.RemoveAll(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 3)
+
+	// Moving a directory out of the tree drops its watch
+	if err := os.Rename(filepath.Join(root, "c"), filepath.Join(t.TempDir(), "c")); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 2)
+}
+
+func TestWatcherReconcile(t *testing.T) {
+	keep, drop, add := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(keep, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	recursive := EntryOptions{Recursive: true}
+	old := []*IncronEntry{
+		{Path: keep, Mask: InCreate, Options: recursive},
+		{Path: drop, Mask: InCreate},
+	}
+	if failed := w.Reconcile(old); len(failed) != 0 {
+		t.Fatalf("initial Reconcile failed: %v", failed)
+	}
+	keepWd := w.pathWatches[keep]
+	subWd := w.pathWatches[filepath.Join(keep, "sub")]
+
+	updated := []*IncronEntry{
+		{Path: keep, Mask: InCreate, Options: recursive, Command: "new command"},
+		{Path: add, Mask: InDelete},
+		{Path: add, Mask: InCreate},
+	}
+	if failed := w.Reconcile(updated); len(failed) != 0 {
+		t.Errorf("Reconcile failures = %v", failed)
+	}
+
+	if _, ok := w.pathWatches[drop]; ok {
+		t.Error("watch for removed entry is still present")
+	}
+	if _, ok := w.pathWatches[add]; !ok {
+		t.Error("watch for new entry was not added")
+	}
+	if w.pathWatches[keep] != keepWd || w.pathWatches[filepath.Join(keep, "sub")] != subWd {
+		t.Error("unchanged recursive watch was re-created")
+	}
+	if entries := w.watches[keepWd].Entries; len(entries) != 1 || entries[0] != updated[0] {
+		t.Error("unchanged watch does not point at the new entry")
+	}
+	if entries := w.watches[w.pathWatches[add]].Entries; len(entries) != 2 {
+		t.Errorf("watch for a path with two entries has %d entries", len(entries))
+	}
+	waitForWatchCount(t, w, 3)
+}
+
+func TestWatcherRemoveTableEntries(t *testing.T) {
+	shared, own := t.TempDir(), t.TempDir()
+	missing := filepath.Join(t.TempDir(), "later")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	table := &IncronTable{Username: "alice"}
+	table.Add(IncronEntry{Path: shared, Mask: InModify})
+	table.Add(IncronEntry{Path: own, Mask: InCreate})
+	table.Add(IncronEntry{Path: missing, Mask: InCreate})
+	other := &IncronEntry{Path: shared, Mask: InCreate}
+
+	desired := []*IncronEntry{other}
+	for i := range table.Entries {
+		desired = append(desired, &table.Entries[i])
+	}
+	if failed := w.Reconcile(desired); len(failed) != 0 {
+		t.Fatalf("Reconcile failed: %v", failed)
+	}
+
+	if failed := w.RemoveTableEntries(table); len(failed) != 0 {
+		t.Errorf("RemoveTableEntries failures = %v", failed)
+	}
+	if _, ok := w.pathWatches[own]; ok {
+		t.Error("watch only used by the removed table is still present")
+	}
+	if len(w.GetPendingPaths()) != 0 {
+		t.Error("pending entry of the removed table is still waiting")
+	}
+	watchInfo := w.watches[w.pathWatches[shared]]
+	if watchInfo == nil || len(watchInfo.Entries) != 1 || watchInfo.Entries[0] != other || watchInfo.Mask&InModify != 0 {
+		t.Errorf("shared watch = %+v, want only the other entry", watchInfo)
+	}
+}
+
+func TestWatcherOneshotSpent(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entry := &IncronEntry{Path: dir, Mask: InCreate | InOneshot}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatal(err)
+	}
+	wd := w.pathWatches[dir]
+
+	// IN_CREATE followed by the IN_IGNORED the kernel sends for oneshot watches
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(wd))
+	binary.LittleEndian.PutUint32(buf[4:], InCreate)
+	binary.LittleEndian.PutUint32(buf[16:], uint32(wd))
+	binary.LittleEndian.PutUint32(buf[20:], InIgnored)
+	w.parseEvents(buf)
+
+	event := <-w.Events()
+	if !event.Spent {
+		t.Error("event from oneshot watch is not marked spent")
+	}
+	if got := w.GetWatchCount(); got != 0 {
+		t.Errorf("watch count after oneshot event = %d, want 0", got)
+	}
+	select {
+	case extra := <-w.Events():
+		t.Errorf("unexpected event after oneshot watch was spent: %v", extra)
+	default:
+	}
+}
+
+func TestWatcherEventSequence(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := w.AddWatch(&IncronEntry{Path: dir, Mask: InCreate | InDelete}); err != nil {
+		t.Fatal(err)
+	}
+	wd := w.pathWatches[dir]
+
+	// Two reads: IN_CREATE and IN_DELETE, then another IN_CREATE
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(wd))
+	binary.LittleEndian.PutUint32(buf[4:], InCreate)
+	binary.LittleEndian.PutUint32(buf[16:], uint32(wd))
+	binary.LittleEndian.PutUint32(buf[20:], InDelete)
+	before := time.Now()
+	w.parseEvents(buf)
+	w.parseEvents(buf[:16])
+
+	var events []*InotifyEvent
+	for i := 0; i < 3; i++ {
+		events = append(events, <-w.Events())
+	}
+	for i, event := range events {
+		if event.Seq != uint64(i+1) {
+			t.Errorf("event %d has Seq %d, want %d", i, event.Seq, i+1)
+		}
+		if event.Received.Before(before) {
+			t.Errorf("event %d has Received %v, before it was read", i, event.Received)
+		}
+	}
+	if !events[0].Received.Equal(events[1].Received) {
+		t.Error("events of the same read have different receive times")
+	}
+}
+
+func TestWatcherDeferredWatch(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "a", "b")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entry := &IncronEntry{Path: path, Mask: InCreate}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatalf("AddWatch() on a missing path: %v", err)
+	}
+	if pending := w.GetPendingPaths(); len(pending) != 1 || pending[0] != path {
+		t.Fatalf("GetPendingPaths() = %v, want [%s]", pending, path)
+	}
+	if err := w.AddWatch(entry); err == nil {
+		t.Error("AddWatch() accepted a duplicate pending path")
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.Events() {
+		}
+	}()
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(w.GetPendingPaths()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending := w.GetPendingPaths(); len(pending) != 0 {
+		t.Fatalf("path still pending after creation: %v", pending)
+	}
+	// Only the real watch is left once the helper watches are gone
+	waitForWatchCount(t, w, 1)
+	if paths := w.GetWatchedPaths(); len(paths) != 1 || paths[0] != path {
+		t.Errorf("GetWatchedPaths() = %v, want [%s]", paths, path)
+	}
+}
+
+func TestWatcherFileReplaced(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "config.yml")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := w.AddWatch(&IncronEntry{Path: path, Mask: InCloseWrite}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// drain discards the events left over from the previous step
+	drain := func() {
+		time.Sleep(50 * time.Millisecond)
+		for {
+			select {
+			case <-w.Events():
+			default:
+				return
+			}
+		}
+	}
+
+	// expectWrite writes the file in place and waits for its event
+	expectWrite := func(step string) {
+		t.Helper()
+		deadline := time.After(2 * time.Second)
+		for {
+			// The watch is re-added asynchronously, so keep writing until it is
+			if err := os.WriteFile(path, []byte("b"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case event := <-w.Events():
+				if event.Mask&InCloseWrite != 0 && event.Path == path {
+					return
+				}
+			case <-time.After(50 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("%s: no IN_CLOSE_WRITE for %s", step, path)
+			}
+		}
+	}
+
+	// Saved through a rename, as many editors do
+	tmp := filepath.Join(root, ".config.yml.swp")
+	if err := os.WriteFile(tmp, []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expectWrite("after atomic replace")
+
+	// Moved away and created again
+	drain()
+	if err := os.Rename(path, path+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	expectWrite("after move and recreate")
+
+	// Deleted and created again
+	drain()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expectWrite("after delete and recreate")
+
+	// The helper watch on the directory goes away once the file is watched
+	waitForWatchCount(t, w, 1)
+	if paths := w.GetWatchedPaths(); len(paths) != 1 || paths[0] != path {
+		t.Errorf("GetWatchedPaths() = %v, want [%s]", paths, path)
+	}
+}
+
+func TestWatcherMoveCorrelation(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, name := range []string{"a", "c"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := w.AddWatch(&IncronEntry{Path: root, Mask: InMovedFrom | InMovedTo}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() *InotifyEvent {
+		t.Helper()
+		select {
+		case event := <-w.Events():
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return nil
+		}
+	}
+
+	// A rename within the tree is delivered as a pair
+	if err := os.Rename(filepath.Join(root, "a"), filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	from, to := next(), next()
+	if from.Mask&InMovedFrom == 0 || to.Mask&InMovedTo == 0 {
+		t.Fatalf("got %v then %v, want IN_MOVED_FROM then IN_MOVED_TO", from, to)
+	}
+	for _, event := range []*InotifyEvent{from, to} {
+		if event.OldPath != filepath.Join(root, "a") || event.NewPath != filepath.Join(root, "b") {
+			t.Errorf("%s: OldPath = %q, NewPath = %q", event.MaskString(), event.OldPath, event.NewPath)
+		}
+	}
+
+	// A move out of the tree still arrives once the window has passed
+	if err := os.Rename(filepath.Join(root, "c"), filepath.Join(outside, "c")); err != nil {
+		t.Fatal(err)
+	}
+	event := next()
+	if event.Mask&InMovedFrom == 0 || event.OldPath != "" || event.NewPath != "" {
+		t.Errorf("unmatched move: got %v (OldPath %q, NewPath %q)", event, event.OldPath, event.NewPath)
+	}
+}
+
+func TestWatcherRecursiveDepth(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		options  EntryOptions
+		expected int
+	}{
+		{"unlimited", EntryOptions{Recursive: true}, 4},
+		{"root only", EntryOptions{Recursive: true, LimitDepth: true}, 1},
+		{"two levels", EntryOptions{Recursive: true, LimitDepth: true, RecursiveDepth: 2}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			if err := w.AddWatch(&IncronEntry{Path: root, Mask: InCreate, Options: tt.options}); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.GetWatchCount(); got != tt.expected {
+				t.Errorf("GetWatchCount() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+
+	// New directories below the limit aren't watched either
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entry := &IncronEntry{Path: root, Mask: InCreate, Options: EntryOptions{Recursive: true, LimitDepth: true, RecursiveDepth: 1}}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.Events() {
+		}
+	}()
+	if err := os.Mkdir(filepath.Join(root, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 3)
+	if err := os.Mkdir(filepath.Join(root, "d", "e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := w.GetWatchCount(); got != 3 {
+		t.Errorf("GetWatchCount() after creating d/e = %d, want 3", got)
+	}
+}
+
+func TestWatcherFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outside, "sub", "deeper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A linked subtree, plus links back up that would loop forever
+	for link, target := range map[string]string{
+		filepath.Join(root, "ext"):     outside,
+		filepath.Join(root, "loop"):    root,
+		filepath.Join(outside, "back"): root,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		options  EntryOptions
+		expected []string
+	}{
+		{"not followed", EntryOptions{Recursive: true}, []string{root}},
+		{"followed", EntryOptions{Recursive: true, FollowSymlinks: true}, []string{
+			root,
+			filepath.Join(root, "ext"),
+			filepath.Join(root, "ext", "sub"),
+			filepath.Join(root, "ext", "sub", "deeper"),
+		}},
+		{"followed with depth limit", EntryOptions{Recursive: true, FollowSymlinks: true, LimitDepth: true, RecursiveDepth: 2}, []string{
+			root,
+			filepath.Join(root, "ext"),
+			filepath.Join(root, "ext", "sub"),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			if err := w.AddWatch(&IncronEntry{Path: root, Mask: InCreate, Options: tt.options}); err != nil {
+				t.Fatal(err)
+			}
+			got := w.GetWatchedPaths()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("GetWatchedPaths() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRemoveWatchNotWatched(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := w.RemoveWatch(t.TempDir()); !errors.Is(err, ErrPathNotWatched) {
+		t.Errorf("RemoveWatch() of an unwatched path returned %v, want ErrPathNotWatched", err)
+	}
+}
+
+func TestWatchLimitError(t *testing.T) {
+	var err error = &WatchLimitError{Path: "/data", Watches: 8190, Limit: 8192}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Error("WatchLimitError does not match ENOSPC")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "8190 watches") || !strings.Contains(msg, "max_user_watches = 8192") {
+		t.Errorf("Error() = %q", msg)
+	}
+
+	if _, statErr := os.Stat(maxUserWatchesFile); statErr != nil {
+		t.Skipf("no %s", maxUserWatchesFile)
+	}
+	limit, err := MaxUserWatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit <= 0 {
+		t.Errorf("MaxUserWatches() = %d", limit)
+	}
+}
+
+func TestWatcherMultipleEntries(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	create := &IncronEntry{Path: dir, Mask: InCreate}
+	remove := &IncronEntry{Path: dir, Mask: InDelete}
+	for _, entry := range []*IncronEntry{create, remove} {
+		if err := w.AddWatch(entry); err != nil {
+			t.Fatalf("AddWatch(%s): %v", entry.MaskToString(), err)
+		}
+	}
+	if err := w.AddWatch(create); err == nil {
+		t.Error("AddWatch() accepted the same entry twice")
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both entries share one watch that reports the events of either
+	waitForWatchCount(t, w, 1)
+	watchInfo := w.watches[w.pathWatches[dir]]
+	if watchInfo.Mask != InCreate|InDelete || len(watchInfo.Entries) != 2 {
+		t.Fatalf("watch mask = %#x with %d entries, want %#x with 2", watchInfo.Mask, len(watchInfo.Entries), InCreate|InDelete)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []*IncronEntry{create, remove} {
+		select {
+		case event := <-w.Events():
+			if !entry.MatchesEvent(event) {
+				t.Errorf("event %s does not match the %s entry", event.MaskString(), entry.MaskToString())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no event for the %s entry", entry.MaskToString())
+		}
+	}
+}
+
+func TestWatcherNoCase(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Inbox")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := w.AddWatch(&IncronEntry{Path: dir, Mask: InCreate}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 1)
+	if err := os.WriteFile(filepath.Join(dir, "Report.CSV"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var event *InotifyEvent
+	select {
+	case event = <-w.Events():
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+
+	// The watched path itself matches as written. A pattern in another
+	// case only matches the event's path with nocase=true.
+	pattern := filepath.Join(filepath.Dir(dir), "inbox", "*.csv")
+	tests := []struct {
+		entry *IncronEntry
+		want  bool
+	}{
+		{&IncronEntry{Path: dir, Mask: InCreate}, true},
+		{&IncronEntry{Path: pattern, Mask: InCreate}, false},
+		{&IncronEntry{Path: pattern, Mask: InCreate, Options: EntryOptions{NoCase: true}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.MatchesEvent(event); got != tt.want {
+			t.Errorf("%s (nocase=%v) MatchesEvent(%s) = %v, want %v", tt.entry.Path, tt.entry.Options.NoCase, event.Path, got, tt.want)
+		}
+	}
+}
+
+func TestWatcherRecursiveEventMatches(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	entry := &IncronEntry{Path: root, Mask: InCloseWrite, Options: EntryOptions{Recursive: true}}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 3)
+	if err := os.WriteFile(filepath.Join(sub, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var event *InotifyEvent
+	select {
+	case event = <-w.Events():
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+
+	// The event comes from the watch on a/b, not the entry's own path
+	if event.WatchDir != sub {
+		t.Fatalf("WatchDir = %s, want %s", event.WatchDir, sub)
+	}
+	if !entry.MatchesEvent(event) {
+		t.Errorf("recursive entry doesn't match %v", event)
+	}
+}
+
+func TestWatcherProtectedRoots(t *testing.T) {
+	root := t.TempDir()
+
+	tests := []struct {
+		name    string
+		options EntryOptions
+		refused bool
+	}{
+		{"recursive", EntryOptions{Recursive: true}, true},
+		{"not recursive", EntryOptions{}, false},
+		{"forced", EntryOptions{Recursive: true, Force: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			w.SetProtectedRoots([]string{root})
+			entry := &IncronEntry{Path: root + "/", Mask: InCreate, Options: tt.options}
+
+			err = w.AddWatch(entry)
+			if refused := errors.Is(err, ErrProtectedRoot); refused != tt.refused {
+				t.Errorf("AddWatch() = %v, want refused %v", err, tt.refused)
+			}
+			if !tt.refused && err != nil {
+				t.Fatal(err)
+			}
+
+			failed := w.Reconcile([]*IncronEntry{entry})
+			if refused := errors.Is(failed[entry], ErrProtectedRoot); refused != tt.refused {
+				t.Errorf("Reconcile() failures = %v, want refused %v", failed, tt.refused)
+			}
+		})
+	}
+}
+
+func TestInotifyEventIsHidden(t *testing.T) {
+	tests := []struct {
+		name  string
+		event InotifyEvent
+		want  bool
+	}{
+		{"dotfile", InotifyEvent{Path: "/data/.report.swp", Name: ".report.swp"}, true},
+		{"dot directory", InotifyEvent{Path: "/data/.git", Name: ".git"}, true},
+		{"regular file", InotifyEvent{Path: "/data/report.txt", Name: "report.txt"}, false},
+		{"watched dotfile", InotifyEvent{Path: "/home/alice/.bashrc"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.event.IsHidden(); got != tt.want {
+				t.Errorf("IsHidden() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcherOnlyDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		onlyDir bool
+		wantErr bool
+	}{
+		{"directory", dir, true, false},
+		{"file", file, true, true},
+		{"file without onlydir", file, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			entry := &IncronEntry{Path: tt.path, Mask: InModify, Options: EntryOptions{OnlyDir: tt.onlyDir}}
+			err = w.AddWatch(entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddWatch() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "not a directory") {
+				t.Errorf("AddWatch() = %v, want a not a directory error", err)
+			}
+		})
+	}
+}
+
+func TestWatcherStopUnderLoad(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		dir := t.TempDir()
+		w, err := NewWatcherWithBuffer(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddWatch(&IncronEntry{Path: dir, Mask: InCreate | InDelete}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Keep events coming while the watcher stops
+		stop := make(chan struct{})
+		generated := make(chan struct{})
+		go func() {
+			defer close(generated)
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				file := filepath.Join(dir, fmt.Sprintf("f%d", j))
+				os.WriteFile(file, nil, 0644)
+				os.Remove(file)
+			}
+		}()
+		time.Sleep(5 * time.Millisecond)
+
+		if err := w.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		close(stop)
+		<-generated
+
+		// Both channels are closed once the buffered events are drained
+		for range w.Events() {
+		}
+		if _, ok := <-w.Errors(); ok {
+			t.Error("error channel still open after Stop")
+		}
+	}
+}
+
+func TestWatcherStopPendingMove(t *testing.T) {
+	// Stop around the time an unmatched IN_MOVED_FROM is delivered on its own
+	for i := 0; i < 20; i++ {
+		root := t.TempDir()
+		outside := t.TempDir()
+		file := filepath.Join(root, "f")
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddWatch(&IncronEntry{Path: root, Mask: InMovedFrom}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Rename(file, filepath.Join(outside, "f")); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			w.mu.RLock()
+			held := len(w.moves)
+			w.mu.RUnlock()
+			if held == 1 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(moveWindow * time.Duration(i) / 10)
+
+		if err := w.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		for range w.Events() {
+		}
+		w.mu.RLock()
+		held := len(w.moves)
+		w.mu.RUnlock()
+		if held != 0 {
+			t.Fatalf("%d moves still pending after Stop()", held)
+		}
+	}
+}
+
+func TestWatcherStopIdle(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader is blocked without any watch to wake it
+	stopped := make(chan error)
+	go func() { stopped <- w.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop() did not return")
+	}
+	if err := w.Start(); err == nil {
+		t.Error("Start() after Stop() succeeded")
+	}
+}
+
+func TestWatcherStopClosesDescriptors(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWatch(&IncronEntry{Path: t.TempDir(), Mask: InCreate}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the queued events, e.g. the IN_IGNORED of probing IN_MASK_CREATE,
+	// are read, a read returns at once instead of blocking
+	buf := make([]byte, 4096)
+	for err == nil {
+		_, err = syscall.Read(w.fd, buf)
+	}
+	if err != syscall.EAGAIN {
+		t.Fatalf("Read() on an idle inotify fd = %v, want EAGAIN", err)
+	}
+
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range []int{w.fd, w.wake[0], w.wake[1]} {
+		if _, err := os.Stat(fmt.Sprintf("/proc/self/fd/%d", fd)); !os.IsNotExist(err) {
+			t.Errorf("fd %d is still open after Stop()", fd)
+		}
+	}
+}
+
+func TestWatcherStopWakeFailure(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the read end of the wake pipe, Stop's write fails with EPIPE;
+	// the reader polls a pipe that never becomes readable instead
+	var idle [2]int
+	if err := syscall.Pipe2(idle[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(idle[1])
+	syscall.Close(w.wake[0])
+	w.wake[0] = idle[0]
+
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := w.Stop(); err == nil {
+		t.Error("Stop() with a broken wake pipe returned no error")
+	}
+	if elapsed := time.Since(start); elapsed > stopPollInterval+time.Second {
+		t.Errorf("Stop() took %v", elapsed)
+	}
+	for _, fd := range []int{w.fd, w.wake[0], w.wake[1]} {
+		if _, err := os.Stat(fmt.Sprintf("/proc/self/fd/%d", fd)); !os.IsNotExist(err) {
+			t.Errorf("fd %d is still open after Stop()", fd)
+		}
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Error("event channel is still open after Stop()")
+	}
+}
+
+// inotifyMasks returns the kernel's mask of every watch on the watcher's fd
+func inotifyMasks(t *testing.T, w *Watcher) map[int]uint32 {
+	t.Helper()
+	data, err := os.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", w.fd))
+	if err != nil {
+		t.Skipf("cannot read inotify fdinfo: %v", err)
+	}
+	masks := make(map[int]uint32)
+	for _, line := range strings.Split(string(data), "\n") {
+		var wd int
+		var mask uint32
+		if !strings.HasPrefix(line, "inotify wd:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		fmt.Sscanf(fields[1], "wd:%x", &wd)
+		for _, field := range fields {
+			if strings.HasPrefix(field, "mask:") {
+				fmt.Sscanf(field, "mask:%x", &mask)
+			}
+		}
+		masks[wd] = mask
+	}
+	return masks
+}
+
+func TestWatcherHardLinkMerge(t *testing.T) {
+	dir := t.TempDir()
+	file, link := filepath.Join(dir, "file"), filepath.Join(dir, "link")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(file, link); err != nil {
+		t.Skipf("cannot create hard link: %v", err)
+	}
+
+	for _, maskCreate := range []bool{true, false} {
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		if maskCreate && !w.maskCreate {
+			continue // Kernel without IN_MASK_CREATE
+		}
+		w.maskCreate = maskCreate
+
+		if err := w.AddWatch(&IncronEntry{Path: file, Mask: InModify}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The same inode through the link shares the watch
+		if err := w.AddWatch(&IncronEntry{Path: link, Mask: InAttrib}); err != nil {
+			t.Fatalf("IN_MASK_CREATE %v: AddWatch() of a hard link = %v", maskCreate, err)
+		}
+		wd := w.pathWatches[file]
+		if w.GetWatchCount() != 1 || w.pathWatches[link] != wd {
+			t.Fatalf("IN_MASK_CREATE %v: file and link have watches %d and %d", maskCreate, wd, w.pathWatches[link])
+		}
+		if masks := inotifyMasks(t, w); masks[wd]&^InMoveSelf != InModify|InAttrib {
+			t.Errorf("IN_MASK_CREATE %v: kernel mask = %#x, want IN_MODIFY|IN_ATTRIB", maskCreate, masks[wd])
+		}
+
+		// Removing the link leaves the file's watch as it was
+		if err := w.RemoveWatch(link); err != nil {
+			t.Fatal(err)
+		}
+		wd, exists := w.pathWatches[file]
+		if _, linked := w.pathWatches[link]; !exists || linked {
+			t.Fatalf("IN_MASK_CREATE %v: watched paths after removing the link = %v", maskCreate, w.GetWatchedPaths())
+		}
+		if masks := inotifyMasks(t, w); masks[wd]&^InMoveSelf != InModify {
+			t.Errorf("IN_MASK_CREATE %v: kernel mask = %#x, want IN_MODIFY", maskCreate, masks[wd])
+		}
+	}
+}
+
+func TestWatcherBindMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	root := t.TempDir()
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	for _, dir := range []string{src, dst} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
+		t.Skipf("cannot bind mount: %v", err)
+	}
+	defer syscall.Unmount(dst, 0)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entries := []*IncronEntry{
+		{Path: src, Mask: InCreate},
+		{Path: dst, Mask: InCreate},
+	}
+	if failed := w.Reconcile(entries); len(failed) > 0 {
+		t.Fatalf("Reconcile() failed for %v", failed)
+	}
+	wd := w.pathWatches[src]
+	if w.GetWatchCount() != 1 || w.pathWatches[dst] != wd {
+		t.Fatalf("bind mount and source have watches %d and %d", wd, w.pathWatches[dst])
+	}
+
+	// A reload keeps the shared watch
+	if failed := w.Reconcile(entries); len(failed) > 0 || w.pathWatches[src] != wd {
+		t.Fatalf("Reconcile() again failed for %v or replaced the watch", failed)
+	}
+
+	// Each path's entries see the event under their own path
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for len(paths) < 2 {
+		select {
+		case event := <-w.Events():
+			paths = append(paths, event.Path)
+			if !entries[len(paths)-1].MatchesEvent(event) {
+				t.Errorf("event %v doesn't match the entry for %s", event, entries[len(paths)-1].Path)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got events for %v, want one per path", paths)
+		}
+	}
+	if want := []string{filepath.Join(src, "file"), filepath.Join(dst, "file")}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("event paths = %v, want %v", paths, want)
+	}
+}
+
+func TestWatcherPrune(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"src/lib", "tmp/a/b", "cache"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(root, "tmp")
+	cache := filepath.Join(root, "cache")
+
+	tests := []struct {
+		name     string
+		prunes   [][]string // Prune option of each entry on root
+		expected int
+	}{
+		{"no prune", [][]string{nil}, 7},
+		{"one subtree", [][]string{{tmp}}, 4},
+		{"two subtrees", [][]string{{tmp, cache}}, 3},
+		{"pruned by every entry", [][]string{{tmp, cache}, {tmp}}, 4},
+		{"not pruned by every entry", [][]string{{tmp}, nil}, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			for _, prune := range tt.prunes {
+				entry := &IncronEntry{Path: root, Mask: InCreate, Options: EntryOptions{Recursive: true, Prune: prune}}
+				if err := w.AddWatch(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := w.GetWatchCount(); got != tt.expected {
+				t.Errorf("GetWatchCount() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+
+	// New directories in a pruned subtree aren't watched either
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	entry := &IncronEntry{Path: root, Mask: InCreate, Options: EntryOptions{Recursive: true, Prune: []string{tmp}}}
+	if err := w.AddWatch(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	go func() {
+		for range w.Events() {
+		}
+	}()
+	if err := os.Mkdir(filepath.Join(root, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatchCount(t, w, 5)
+	if err := os.RemoveAll(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "again"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := w.GetWatchCount(); got != 5 {
+		t.Errorf("GetWatchCount() after recreating the pruned subtree = %d, want 5", got)
+	}
+}
+
+func TestWatcherOwners(t *testing.T) {
+	root, shared := t.TempDir(), t.TempDir()
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(shared, "later", "file")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	desired := []*IncronEntry{
+		{Path: root, Mask: InCreate, Options: EntryOptions{Recursive: true}, Owner: "user alice"},
+		{Path: root, Mask: InDelete, Owner: "user dave"},
+		{Path: shared, Mask: InModify, Owner: "user bob"},
+		{Path: shared, Mask: InCreate, Owner: "system table backup"},
+		{Path: shared, Mask: InDelete, Owner: "user bob"},
+		{Path: missing, Mask: InCreate, Owner: "user carol"},
+	}
+	if failed := w.Reconcile(desired); len(failed) != 0 {
+		t.Fatalf("Reconcile failed: %v", failed)
+	}
+
+	want := map[string][]string{
+		root:   {"user alice", "user dave"},
+		sub:    {"user alice"},
+		shared: {"system table backup", "user bob", "user carol"},
+	}
+	if got := w.GetWatchOwners(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetWatchOwners() = %v, want %v", got, want)
+	}
+}
+
+func TestWatcherSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "jobs.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tests := []struct {
+		name     string
+		entry    IncronEntry
+		wantErr  bool
+		wantType string
+	}{
+		{"directory", IncronEntry{Path: dir, Mask: InCreate}, false, FileTypeDirectory},
+		{"fifo", IncronEntry{Path: fifo, Mask: InCloseWrite}, false, FileTypeFifo},
+		{"fifo without its events", IncronEntry{Path: fifo, Mask: InCreate}, true, ""},
+		{"fifo forced", IncronEntry{Path: fifo, Mask: InCreate, Options: EntryOptions{Force: true}}, false, FileTypeFifo},
+		{"socket", IncronEntry{Path: socket, Mask: InModify}, true, ""},
+		{"socket forced", IncronEntry{Path: socket, Mask: InAttrib, Options: EntryOptions{Force: true}}, false, FileTypeSocket},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+
+			err = w.AddWatch(&tt.entry)
+			if tt.wantErr {
+				if !errors.Is(err, ErrSpecialFile) {
+					t.Errorf("AddWatch() error = %v, want ErrSpecialFile", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.GetWatchTypes()[tt.entry.Path]; got != tt.wantType {
+				t.Errorf("type = %q, want %q", got, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestExistingFileEvents(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.txt", "a.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := ExistingFileEvents(dir, InCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event.Received.IsZero() {
+			t.Errorf("event for %s has no receive time", event.Name)
+		}
+		event.Received = time.Time{}
+	}
+	want := []*InotifyEvent{
+		{Path: filepath.Join(dir, "a.txt"), Name: "a.txt", Mask: InCreate, WatchDir: dir},
+		{Path: filepath.Join(dir, "b.txt"), Name: "b.txt", Mask: InCreate, WatchDir: dir},
+		{Path: filepath.Join(dir, "sub"), Name: "sub", Mask: InCreate | InIsdir, WatchDir: dir},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("ExistingFileEvents() = %v, want %v", events, want)
+	}
+
+	entry := IncronEntry{Path: dir, Mask: InCreate, Options: EntryOptions{Include: []string{"*.txt"}}}
+	matched := 0
+	for _, event := range events {
+		if entry.MatchesEvent(event) {
+			matched++
+		}
+	}
+	if matched != 2 {
+		t.Errorf("entry matched %d events, want 2", matched)
+	}
+
+	if _, err := ExistingFileEvents(filepath.Join(dir, "missing"), InCreate); err == nil {
+		t.Error("ExistingFileEvents() on a missing directory succeeded")
+	}
+}